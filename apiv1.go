@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const apiV1Prefix = "/api/v1"
+
+// v1Envelope /api/v1 下所有 JSON 响应的外层结构
+type v1Envelope struct {
+	Data  interface{} `json:"data"`
+	Error *v1Error    `json:"error"`
+	Meta  v1Meta      `json:"meta"`
+}
+
+type v1Error struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type v1Meta struct {
+	APIVersion string `json:"apiVersion"`
+	RequestID  string `json:"requestId"`
+}
+
+// setupAPIv1Routes 注册资源风格的 /api/v1 路由，与旧路由共用同一组 handler。
+// createLimiter 只用于创建邮箱，在 limiter 之后检查
+func setupAPIv1Routes(base *gin.RouterGroup, limiter, createLimiter gin.HandlerFunc) {
+	v1 := base.Group(apiV1Prefix, envelopeMiddleware())
+
+	api := v1.Group("/")
+	if limiter != nil {
+		api.Use(limiter)
+	}
+	if config().MaxMailboxes > 0 {
+		api.Use(mailboxAccessMiddleware())
+	}
+	api.GET("/domains", handleAllowedDomains)
+	api.GET("/info", handleInfo)
+	if createLimiter != nil {
+		api.POST("/mailboxes", createLimiter, handleNewMailbox)
+	} else {
+		api.POST("/mailboxes", handleNewMailbox)
+	}
+	api.GET("/mailboxes/:address/messages", handleListMail)
+	api.GET("/mailboxes/:address/messages/latest", handleGetLatest)
+	api.GET("/mailboxes/:address/messages/:id", handleGetMessage)
+	api.POST("/mailboxes/:address/messages/pop", handleGetMail)
+	api.POST("/mailboxes/:address/messages/read", handleMarkAllRead)
+	api.POST("/mailboxes/:address/messages/:id/unread", handleMarkUnread)
+	api.GET("/mailboxes/:address/count", handleCountMail)
+	api.GET("/mailboxes/:address/messages/:id/links", handleGetLinks)
+	api.GET("/mailboxes/:address/messages/:id/raw", handleExportMail)
+	api.GET("/mailboxes/:address/mbox", handleExportMailbox)
+	api.GET("/mailboxes/:address/messages/:id/attachments/:index", handleGetAttachment)
+	api.GET("/mailboxes/:address/messages/:id/inline/:cid", handleGetInlinePart)
+	api.GET("/mailboxes/:address/code", handleGetCode)
+	api.GET("/imgproxy", handleImgProxy)
+}
+
+// setupAPIv1AdminRoutes 注册 /api/v1/admin，配置 ADMIN_PORT 时只挂在管理端口
+func setupAPIv1AdminRoutes(base *gin.RouterGroup) {
+	admin := base.Group(apiV1Prefix+"/admin", envelopeMiddleware(), apiKeyAuth())
+	admin.GET("/stats", handleAdminStats)
+	admin.GET("/mailboxes", handleAdminListMailboxes)
+	admin.POST("/mailboxes/batch", handleBatchListMail)
+	admin.DELETE("/mailboxes", handlePurgeMailBoxes)
+	admin.DELETE("/mailboxes/:address", handleDeleteMailBox)
+	admin.GET("/archive", handleSearchArchive)
+	admin.GET("/export", handleAdminExport)
+	admin.POST("/import", handleAdminImport)
+	admin.POST("/reload", handleAdminReload)
+}
+
+// mailboxParam 读取路径中的邮箱地址并转为规范形式，旧路由参数名为 randomString
+func mailboxParam(c *gin.Context) string {
+	if address := c.Param("address"); address != "" {
+		return normalizeAddress(address)
+	}
+	return normalizeAddress(c.Param("randomString"))
+}
+
+func isAPIv1(c *gin.Context) bool {
+	return c.GetBool("apiV1")
+}
+
+// envelopeWriter 缓冲 JSON 响应，请求结束后包装成 v1Envelope；其他类型（eml、图片）直接输出
+type envelopeWriter struct {
+	gin.ResponseWriter
+	buf       bytes.Buffer
+	decided   bool
+	capturing bool
+}
+
+func (w *envelopeWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		w.capturing = strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+	}
+	if w.capturing {
+		return w.buf.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap 让 http.ResponseController 能找到底层连接
+func (w *envelopeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *envelopeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// finish 把缓冲的响应体放入 data，错误响应的 error 字段转为 v1Error
+func (w *envelopeWriter) finish(c *gin.Context) {
+	if !w.capturing {
+		return
+	}
+
+	env := v1Envelope{Meta: v1Meta{APIVersion: "v1", RequestID: c.GetString("requestID")}}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.buf.Bytes(), &body); err != nil {
+		env.Data = json.RawMessage(w.buf.Bytes())
+	} else {
+		if status := w.Status(); status >= 400 {
+			message, _ := body["error"].(string)
+			env.Error = &v1Error{Status: status, Message: message}
+			delete(body, "error")
+		}
+		if len(body) > 0 {
+			env.Data = body
+		}
+	}
+
+	out, err := json.Marshal(env)
+	if err != nil {
+		reqLogger(c).Error("包装 v1 响应失败", "error", err)
+		w.ResponseWriter.Write(w.buf.Bytes())
+		return
+	}
+	w.ResponseWriter.Write(out)
+}
+
+func envelopeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("apiV1", true)
+		w := &envelopeWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		w.finish(c)
+	}
+}
+
+var deprecatedRoutesLogged sync.Map
+
+// deprecationMiddleware 旧路由继续可用，但响应带 Deprecation 头，每条路由首次访问时记录日志
+func deprecationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Link", `<`+config().BasePath+apiV1Prefix+`>; rel="successor-version"`)
+		if _, logged := deprecatedRoutesLogged.LoadOrStore(c.FullPath(), true); !logged {
+			reqLogger(c).Warn("已弃用的接口被调用", "method", c.Request.Method, "route", c.FullPath(), "successor", apiV1Prefix)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jsonShape 把 JSON 值归约成只含字段名和类型的字符串，键按字母排序，数组取第一个元素的形状。
+// 字段增删、改名或改类型都会改变形状
+func jsonShape(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			parts[i] = k + ":" + jsonShape(v[k])
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	case []interface{}:
+		if len(v) == 0 {
+			return "[]"
+		}
+		return "[" + jsonShape(v[0]) + "]"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	}
+	return "null"
+}
+
+const metaShape = "meta:{apiVersion:string,requestId:string}"
+
+// TestAPIv1Contract 固定 /api/v1 各接口的 JSON 结构，字段变化会让测试失败，需要确认是否破坏了客户端
+func TestAPIv1Contract(t *testing.T) {
+	setupTest(t, map[string]string{"ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+
+	expires := time.Now().Add(time.Hour)
+	mailStore.Append(mailContent{ID: "m1", TraceID: "t1", To: "user@test.local", From: "a@example.com", Subject: "hello",
+		Text: "Your code is 482913", HTML: `<p>Verify <a href="https://example.com/verify">here</a></p>`,
+		Attachments: []attachment{{Filename: "a.txt", ContentType: "text/plain", Size: 2, data: []byte("hi")}},
+		ReceivedAt:  time.Now(), ExpiresAt: &expires})
+
+	const (
+		attachmentShape = "[{contentType:string,filename:string,size:number}]"
+		summaryShape    = "{attachments:" + attachmentShape + ",expires_at:string,from:string,id:string,read:bool,received_at:string,spam:null,subject:string,trace_id:string}"
+		mailShape       = "{attachments:" + attachmentShape + ",client_ip:string,dns:{checked:bool,fcrdns:bool,heloResolves:bool,ptr:string},dnsbl:null,expires_at:string,from:string,helo:string,html:string,id:string,read:bool,received_at:string,spam:null,subject:string,text:string,to:string,trace_id:string}"
+	)
+	for _, tc := range []struct {
+		method, path string
+		admin        bool
+		status       int
+		shape        string
+	}{
+		{"GET", "/domains", false, 200, "{data:{allowedDomains:[string],displayDomains:[string]},error:null," + metaShape + "}"},
+		{"POST", "/mailboxes", false, 201, "{data:{address:string},error:null," + metaShape + "}"},
+		{"GET", "/mailboxes/user@test.local/messages", false, 200, "{data:{mails:[" + summaryShape + "]},error:null," + metaShape + "}"},
+		{"GET", "/mailboxes/empty@test.local/messages", false, 200, "{data:{mails:[]},error:null," + metaShape + "}"},
+		{"GET", "/mailboxes/user@test.local/messages/m1", false, 200, "{data:{mail:" + mailShape + "},error:null," + metaShape + "}"},
+		{"GET", "/mailboxes/user@test.local/messages/nope", false, 404, "{data:null,error:{message:string,status:number}," + metaShape + "}"},
+		{"GET", "/mailboxes/user@test.local/count", false, 200, "{data:{count:number},error:null," + metaShape + "}"},
+		{"GET", "/mailboxes/user@test.local/code", false, 200, "{data:{code:string,id:string},error:null," + metaShape + "}"},
+		{"GET", "/mailboxes/user@test.local/messages/m1/links", false, 200, "{data:{confirmationGuess:{text:string,url:string},links:[{text:string,url:string}]},error:null," + metaShape + "}"},
+		{"POST", "/mailboxes/user@test.local/messages/read", false, 200, "{data:{marked:number},error:null," + metaShape + "}"},
+		{"POST", "/mailboxes/user@test.local/messages/m1/unread", false, 200, "{data:{ok:bool},error:null," + metaShape + "}"},
+		{"GET", "/admin/stats", false, 401, "{data:null,error:{message:string,status:number}," + metaShape + "}"},
+		{"GET", "/admin/mailboxes", true, 200, "{data:{limit:number,mailboxes:[{address:string,bytes:number,firstDelivery:string,lastDelivery:string,messages:number}],offset:number,total:number},error:null," + metaShape + "}"},
+		{"POST", "/mailboxes/user@test.local/messages/pop", false, 200, "{data:{mail:" + mailShape + "},error:null," + metaShape + "}"},
+		{"DELETE", "/admin/mailboxes/user@test.local", true, 200, "{data:{deleted:number},error:null," + metaShape + "}"},
+	} {
+		name := tc.method + " " + tc.path
+		req := httptest.NewRequest(tc.method, apiV1Prefix+tc.path, nil)
+		if tc.admin {
+			req.Header.Set("X-Api-Key", "secret")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var body interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: 响应不是 JSON: %v", name, err)
+			continue
+		}
+		if w.Code != tc.status {
+			t.Errorf("%s 返回 %d，应为 %d", name, w.Code, tc.status)
+		}
+		if got := jsonShape(body); got != tc.shape {
+			t.Errorf("%s 的结构变了:\n得到 %s\n应为 %s", name, got, tc.shape)
+		}
+		if w.Header().Get("Deprecation") != "" {
+			t.Errorf("%s 不应带 Deprecation 头", name)
+		}
+	}
+}
+
+// TestAPIv1MatchesLegacy 旧路由继续返回原来的结构并标记为弃用，v1 的 data 与旧路由的响应体一致
+func TestAPIv1MatchesLegacy(t *testing.T) {
+	setupTest(t, nil)
+	r := newRouter()
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", Subject: "hello", Text: "code 482913", ReceivedAt: time.Now()})
+
+	for legacy, v1 := range map[string]string{
+		"/getAllowedDomains":        "/domains",
+		"/listMail/user@test.local": "/mailboxes/user@test.local/messages",
+		"/getCode/user@test.local":  "/mailboxes/user@test.local/code",
+		"/getCode/none@test.local":  "/mailboxes/none@test.local/code",
+	} {
+		lw := httptest.NewRecorder()
+		r.ServeHTTP(lw, httptest.NewRequest("GET", legacy, nil))
+		vw := httptest.NewRecorder()
+		r.ServeHTTP(vw, httptest.NewRequest("GET", apiV1Prefix+v1, nil))
+
+		if lw.Header().Get("Deprecation") != "true" || !strings.Contains(lw.Header().Get("Link"), apiV1Prefix) {
+			t.Errorf("%s 缺少弃用标记: %v", legacy, lw.Header())
+		}
+		if lw.Code != vw.Code {
+			t.Errorf("%s 返回 %d，%s 返回 %d", legacy, lw.Code, v1, vw.Code)
+		}
+
+		var old map[string]interface{}
+		var env struct {
+			Data  map[string]interface{} `json:"data"`
+			Error *v1Error               `json:"error"`
+		}
+		json.Unmarshal(lw.Body.Bytes(), &old)
+		json.Unmarshal(vw.Body.Bytes(), &env)
+		// 错误信息从旧响应的 error 字段移到了 envelope 的 error 中
+		if message, ok := old["error"]; ok {
+			if env.Error == nil || env.Error.Message != message || env.Error.Status != lw.Code {
+				t.Errorf("%s 的错误 %v，v1 为 %+v", legacy, message, env.Error)
+			}
+			delete(old, "error")
+		}
+		if len(old) == 0 {
+			old = nil
+		}
+		if jsonShape(old) != jsonShape(env.Data) {
+			t.Errorf("%s 返回 %s，v1 的 data 为 %s", legacy, jsonShape(old), jsonShape(env.Data))
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 过期归档：配置 ARCHIVE_DIR 后，过期清理和定时清空删除邮件之前先把它们追加到归档文件，
+// 文件按收件日期命名为 <日期>-<序号>.jsonl.gz，超过 ARCHIVE_MAX_FILE_BYTES 后换下一个序号，
+// 每次追加写入一个新的 gzip 成员，读取时按多成员流连续解压。归档失败只记录日志，不影响删除
+
+const archiveDateLayout = "2006-01-02"
+
+// archivedMail 归档文件中的一行，包含附件内容和原始邮件
+type archivedMail struct {
+	ArchivedAt time.Time `json:"archived_at"`
+	storedMail
+}
+
+// archiveMu 保护归档文件的追加和清理
+var archiveMu sync.Mutex
+
+// archiveExpired 归档 now 之前过期的邮件，在 Expire 之前调用
+func archiveExpired(now time.Time) {
+	archiveMailboxes(now, func(m mailContent, _ int) bool { return m.expired(now) })
+}
+
+// archiveAll 定时清空之前归档所有邮件
+func archiveAll(now time.Time) {
+	archiveMailboxes(now, func(mailContent, int) bool { return true })
+}
+
+// archiveOlder 定时删减之前归档每个邮箱中最新 keep 封之外的邮件
+func archiveOlder(now time.Time, keep int) {
+	archiveMailboxes(now, func(_ mailContent, i int) bool { return i >= keep })
+}
+
+// archiveMailboxes 归档符合条件的邮件，match 的第二个参数为邮件在邮箱中的位置，最新的为 0
+func archiveMailboxes(now time.Time, match func(mailContent, int) bool) {
+	if config().ArchiveDir == "" {
+		return
+	}
+	summaries, err := mailStore.Mailboxes("")
+	if err != nil {
+		cleanupLogger.Error("归档邮件失败", "error", err)
+		return
+	}
+	var batch []mailContent
+	for _, sum := range summaries {
+		mails, err := mailStore.List(sum.Address)
+		if err != nil {
+			cleanupLogger.Error("归档邮箱失败", "mailbox", sum.Address, "error", err)
+			continue
+		}
+		for i, m := range mails {
+			if match(m, i) {
+				batch = append(batch, m)
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := writeArchive(batch, now); err != nil {
+			cleanupLogger.Error("归档邮件失败，邮件仍会被删除", "error", err)
+		} else {
+			cleanupLogger.Info("已归档邮件", "messages", len(batch))
+		}
+	}
+	pruneArchive(now)
+}
+
+// writeArchive 按收件日期分组追加到归档文件
+func writeArchive(mails []mailContent, now time.Time) error {
+	byDate := make(map[string][]mailContent)
+	for _, m := range mails {
+		date := m.ReceivedAt.Local().Format(archiveDateLayout)
+		byDate[date] = append(byDate[date], m)
+	}
+
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	if err := os.MkdirAll(config().ArchiveDir, 0700); err != nil {
+		return err
+	}
+	for date, group := range byDate {
+		if err := appendArchive(currentArchiveFile(date), group, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentArchiveFile 当天序号最大的文件，已超过大小上限时返回下一个序号
+func currentArchiveFile(date string) string {
+	files := archiveFiles(date)
+	if len(files) == 0 {
+		return archiveFileName(date, 0)
+	}
+	last := files[len(files)-1]
+	info, err := os.Stat(last)
+	if err != nil || info.Size() < config().ArchiveMaxFileBytes {
+		return last
+	}
+	return archiveFileName(date, len(files))
+}
+
+func archiveFileName(date string, seq int) string {
+	return filepath.Join(config().ArchiveDir, fmt.Sprintf("%s-%03d.jsonl.gz", date, seq))
+}
+
+// archiveFiles 某天的所有归档文件，按序号排列
+func archiveFiles(date string) []string {
+	files, _ := filepath.Glob(filepath.Join(config().ArchiveDir, date+"-*.jsonl.gz"))
+	sort.Strings(files)
+	return files
+}
+
+func appendArchive(path string, mails []mailContent, now time.Time) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, m := range mails {
+		if err = enc.Encode(archivedMail{ArchivedAt: now, storedMail: newStoredMail(m)}); err != nil {
+			break
+		}
+	}
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// pruneArchive 删除收件日期早于 ARCHIVE_RETENTION 的归档文件
+func pruneArchive(now time.Time) {
+	if config().ArchiveRetention <= 0 {
+		return
+	}
+	cutoff := now.Add(-config().ArchiveRetention).Format(archiveDateLayout)
+
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+	files, _ := filepath.Glob(filepath.Join(config().ArchiveDir, "*.jsonl.gz"))
+	for _, path := range files {
+		name := filepath.Base(path)
+		if len(name) < len(archiveDateLayout) || name[:len(archiveDateLayout)] >= cutoff {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			cleanupLogger.Warn("删除归档文件失败", "file", name, "error", err)
+		}
+	}
+}
+
+// searchArchive 在某天的归档中查找发给 address 的邮件，id 不为空时只返回这一封。
+// 文件末尾不完整（写入时进程退出）时返回已读到的部分
+func searchArchive(address, date, id string) ([]mailContent, error) {
+	archiveMu.Lock()
+	files := archiveFiles(date)
+	archiveMu.Unlock()
+
+	mails := []mailContent{}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = scanArchive(f, func(rec archivedMail) {
+			if strings.EqualFold(rec.To, address) && (id == "" || rec.ID == id) {
+				mails = append(mails, rec.mail())
+			}
+		})
+		f.Close()
+		if err != nil {
+			cleanupLogger.Warn("读取归档文件出错，跳过其余部分", "file", filepath.Base(path), "error", err)
+		}
+	}
+	return mails, nil
+}
+
+func scanArchive(r io.Reader, fn func(archivedMail)) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	dec := json.NewDecoder(zr)
+	for {
+		var rec archivedMail
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(rec)
+	}
+}
+
+// handleSearchArchive 按地址和收件日期查询已归档的邮件
+func handleSearchArchive(c *gin.Context) {
+	if config().ArchiveDir == "" {
+		c.JSON(404, gin.H{"error": msg("archive_disabled")})
+		return
+	}
+	address := normalizeAddress(strings.TrimSpace(c.Query("address")))
+	date := c.Query("date")
+	if address == "" {
+		c.JSON(400, gin.H{"error": msg("missing_address")})
+		return
+	}
+	if _, err := time.Parse(archiveDateLayout, date); err != nil {
+		c.JSON(400, gin.H{"error": msg("invalid_archive_date")})
+		return
+	}
+	mails, err := searchArchive(address, date, c.Query("id"))
+	if err != nil {
+		c.JSON(500, gin.H{"error": msg("archive_read_failed")})
+		return
+	}
+	views := make([]mailView, 0, len(mails))
+	for _, m := range mails {
+		views = append(views, newMailView(m))
+	}
+	c.JSON(200, archiveResponse{Mails: views})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleGetAttachment 按序号下载附件，序号为 attachments 数组中的下标
+func handleGetAttachment(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 0 {
+		c.JSON(400, gin.H{"error": msg("invalid_attachment_index")})
+		return
+	}
+
+	m, ok, err := mailStore.Get(mailboxParam(c), c.Param("id"))
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": msg("mail_not_found")})
+		return
+	}
+	if index >= len(m.Attachments) {
+		c.JSON(404, gin.H{"error": msg("attachment_not_found")})
+		return
+	}
+
+	a := m.Attachments[index]
+	// 外置到对象存储的附件先确认能读取，再写响应头，出错时返回普通的 JSON 错误
+	var blob *http.Response
+	if a.blob != "" {
+		if blob, err = blobs.get(c.Request.Context(), a.blob); err != nil {
+			reqLogger(c).Error("读取外置附件失败", "key", a.blob, "error", err)
+			c.JSON(502, gin.H{"error": msg("attachment_read_failed")})
+			return
+		}
+		defer blob.Body.Close()
+		// 启用静态加密时完整读出后解密，以前未加密的对象原样返回
+		if len(encryptionKeys) > 0 {
+			data, err := io.ReadAll(blob.Body)
+			if err == nil {
+				a.data, err = openBytes(data)
+			}
+			if err != nil {
+				reqLogger(c).Error("读取外置附件失败", "key", a.blob, "error", err)
+				c.JSON(502, gin.H{"error": msg("attachment_read_failed")})
+				return
+			}
+			blob = nil
+		}
+	}
+
+	filename := a.Filename
+	if filename == "" {
+		filename = "attachment-" + strconv.Itoa(index)
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	if blob != nil {
+		c.DataFromReader(200, blob.ContentLength, a.ContentType, blob.Body, nil)
+		return
+	}
+	c.Data(200, a.ContentType, a.data)
+}
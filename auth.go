@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var warnNoAPIKeys sync.Once
+
+// apiKeyAuth 校验 X-Api-Key 或 Bearer Token，支持配置多个 key 以便轮换
+func apiKeyAuth() gin.HandlerFunc {
+	if len(config().AdminAPIKeys) == 0 {
+		warnNoAPIKeys.Do(func() {
+			log.Printf("未配置 ADMIN_API_KEYS，管理接口已禁用")
+		})
+	}
+
+	return func(c *gin.Context) {
+		if !validAPIKey(presentedAPIKey(c)) {
+			reqLogger(c).Warn("管理接口认证失败", "method", c.Request.Method, "path", c.Request.URL.Path, "ip", c.ClientIP())
+			c.AbortWithStatusJSON(401, gin.H{"error": msg("unauthorized")})
+			return
+		}
+		c.Next()
+	}
+}
+
+func presentedAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("X-Api-Key"); key != "" {
+		return key
+	}
+	auth := c.GetHeader("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// validAPIKey 使用常量时间比较，避免时序攻击
+func validAPIKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	valid := false
+	for _, k := range config().AdminAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
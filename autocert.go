@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager 启用 ENABLE_AUTOCERT 时通过 Let's Encrypt 自动申请和续期证书，未启用时为 nil
+var acmeManager *autocert.Manager
+
+func newAutocertManager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config().HTTPSHostnames...),
+		Cache:      autocert.DirCache(config().AutocertCacheDir),
+		Email:      config().AutocertEmail,
+	}
+}
+
+// serverTLSConfig HTTPS、STARTTLS、SMTPS 共用的 TLS 配置，按模式使用自动证书或证书文件
+func serverTLSConfig() *tls.Config {
+	if acmeManager == nil {
+		return certs.tlsConfig()
+	}
+
+	cfg := acmeManager.TLSConfig()
+	cfg.MinVersion = tls.VersionTLS12
+	getCertificate := cfg.GetCertificate
+	cfg.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// 不少 SMTP 客户端不发送 SNI，使用 SMTP 主机名的证书
+		if hello.ServerName == "" {
+			hello.ServerName = config().SMTPHostname
+		}
+		return getCertificate(hello)
+	}
+	return cfg
+}
+
+// acmeChallengeHandler 在明文 HTTP 上响应 HTTP-01 验证，其余请求交给 next
+func acmeChallengeHandler(next http.Handler) http.Handler {
+	if acmeManager == nil {
+		return next
+	}
+	return acmeManager.HTTPHandler(next)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAutocertConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{"默认使用白名单域名，跳过通配域名", map[string]string{"ALLOWED_DOMAINS": "a.test,*.wild.test,b.test"}, []string{"a.test", "b.test"}},
+		{"STARTTLS 时加上 SMTP 主机名", map[string]string{"ALLOWED_DOMAINS": "a.test", "SMTP_HOSTNAME": "mx.a.test", "ENABLE_STARTTLS": "true"}, []string{"a.test", "mx.a.test"}},
+		{"HTTPS_HOSTNAMES 优先", map[string]string{"ALLOWED_DOMAINS": "a.test", "HTTPS_HOSTNAMES": "web.a.test, api.a.test"}, []string{"web.a.test", "api.a.test"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := map[string]string{"ENABLE_AUTOCERT": "true", "AUTOCERT_CACHE_DIR": "/var/cache/acme", "AUTOCERT_EMAIL": "ops@a.test"}
+			for k, v := range tc.env {
+				env[k] = v
+			}
+			cfg := newTestConfig(t, env)
+			if !reflect.DeepEqual(cfg.HTTPSHostnames, tc.want) {
+				t.Errorf("HTTPSHostnames = %q，应为 %q", cfg.HTTPSHostnames, tc.want)
+			}
+			// 自动证书模式总是开启 HTTPS 监听
+			if !cfg.EnableHTTPS || cfg.AutocertCacheDir != "/var/cache/acme" || cfg.AutocertEmail != "ops@a.test" {
+				t.Errorf("EnableHTTPS=%v AutocertCacheDir=%q AutocertEmail=%q", cfg.EnableHTTPS, cfg.AutocertCacheDir, cfg.AutocertEmail)
+			}
+		})
+	}
+
+	// 未开启时仍使用证书文件
+	if cfg := newTestConfig(t, nil); cfg.EnableAutocert || cfg.EnableHTTPS || cfg.HTTPSHostnames != nil {
+		t.Errorf("默认配置 EnableAutocert=%v EnableHTTPS=%v HTTPSHostnames=%q", cfg.EnableAutocert, cfg.EnableHTTPS, cfg.HTTPSHostnames)
+	}
+}
+
+func TestAutocertConflictsWithCertFiles(t *testing.T) {
+	for _, key := range []string{"CERT_FILE", "KEY_FILE"} {
+		t.Setenv("ALLOWED_DOMAINS", "a.test")
+		t.Setenv("ENABLE_AUTOCERT", "true")
+		t.Setenv("CERT_FILE", "")
+		t.Setenv("KEY_FILE", "")
+		t.Setenv(key, "/etc/ssl/server.pem")
+		configErrors = nil
+		parseConfig()
+		if !strings.Contains(strings.Join(configErrors, "\n"), "ENABLE_AUTOCERT 与 CERT_FILE/KEY_FILE 不能同时配置") {
+			t.Errorf("同时配置 ENABLE_AUTOCERT 和 %s 时应报错: %q", key, configErrors)
+		}
+	}
+	configErrors = nil
+}
+
+func TestAutocertHostPolicy(t *testing.T) {
+	setupTest(t, map[string]string{"ENABLE_AUTOCERT": "true", "ALLOWED_DOMAINS": "a.test,*.wild.test", "AUTOCERT_CACHE_DIR": t.TempDir()})
+	m := newAutocertManager()
+	for host, allowed := range map[string]bool{
+		"a.test":        true,
+		"evil.test":     false,
+		"x.a.test":      false,
+		"sub.wild.test": false, // 通配域名无法通过 HTTP-01 签发
+		"wild.test":     false,
+	} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != allowed {
+			t.Errorf("HostPolicy(%q) = %v", host, err)
+		}
+	}
+
+	// 不在白名单中的主机名在申请证书前就被拒绝，不会访问 ACME 服务器
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.test"}); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("未知主机名应被拒绝: %v", err)
+	}
+}
+
+// writeAutocertCache 在自动证书缓存中放入 host 的自签名 ECDSA 证书，格式与 autocert 写入的一致
+func writeAutocertCache(t *testing.T, dir, host string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{host},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(90 * 24 * time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := os.WriteFile(filepath.Join(dir, host), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTLSConfigWithoutSNI(t *testing.T) {
+	dir := t.TempDir()
+	setupTest(t, map[string]string{"ENABLE_AUTOCERT": "true", "ALLOWED_DOMAINS": "a.test", "SMTP_HOSTNAME": "mx.a.test",
+		"ENABLE_STARTTLS": "true", "AUTOCERT_CACHE_DIR": dir})
+	writeAutocertCache(t, dir, "mx.a.test")
+	acmeManager = newAutocertManager()
+	t.Cleanup(func() { acmeManager = nil })
+
+	cfg := serverTLSConfig()
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("MinVersion = %x", cfg.MinVersion)
+	}
+	// 不发送 SNI 的 SMTP 客户端拿到 SMTP 主机名的证书
+	hello := &tls.ClientHelloInfo{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+	cert, err := cfg.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname("mx.a.test"); err != nil {
+		t.Errorf("证书不是 SMTP 主机名的: %v", err)
+	}
+}
+
+func TestACMEChallengeHandler(t *testing.T) {
+	setupTest(t, map[string]string{"HTTPS_REDIRECT": "true", "ENABLE_HTTPS": "false", "ENABLE_AUTOCERT": "true",
+		"ALLOWED_DOMAINS": "a.test", "AUTOCERT_CACHE_DIR": t.TempDir()})
+	redirect := httpsRedirectHandler(newRouter())
+
+	// 未启用自动证书时不包装
+	if h := acmeChallengeHandler(redirect); reflect.ValueOf(h).Pointer() != reflect.ValueOf(redirect).Pointer() {
+		t.Error("未启用自动证书时应直接返回原 handler")
+	}
+
+	acmeManager = newAutocertManager()
+	t.Cleanup(func() { acmeManager = nil })
+	h := acmeChallengeHandler(redirect)
+
+	get := func(host, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	// 验证请求在重定向之前处理：未知 token 返回 404，未知主机名返回 403，都不会被重定向到 HTTPS
+	if code := get("a.test", "/.well-known/acme-challenge/unknown-token"); code != 404 {
+		t.Errorf("未知 token 返回 %d", code)
+	}
+	if code := get("evil.test", "/.well-known/acme-challenge/unknown-token"); code != 403 {
+		t.Errorf("未知主机名返回 %d", code)
+	}
+	if code := get("a.test", "/getAllowedDomains"); code != 301 {
+		t.Errorf("其他请求应重定向到 HTTPS，返回 %d", code)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 附件外置：配置 S3_BUCKET 后，投递时把超过 ATTACHMENT_OFFLOAD_BYTES 的附件写入 S3 兼容的对象存储
+// （AWS S3、MinIO 等），邮件存储中只保留对象键和元数据，下载附件时从对象存储转发。
+// 邮件被取出、删除、过期或清空后删除对应的对象。对象存储不可用时附件照常保存在邮件存储中
+
+// blobs 未配置 S3_BUCKET 时为 nil
+var blobs *blobStore
+
+// blobStore 使用路径风格地址（<endpoint>/<bucket>/<key>）和 SigV4 签名访问对象存储，只用到 PUT、GET、DELETE
+type blobStore struct {
+	client *http.Client
+}
+
+// initBlobStore 配置 S3_BUCKET 时启用附件外置，用 offloadStore 包装当前存储
+func initBlobStore() {
+	if config().S3Bucket == "" {
+		return
+	}
+	blobs = &blobStore{client: &http.Client{
+		// 下载附件时响应体的读取时间随大小增长，只限制等待响应头的时间
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, ResponseHeaderTimeout: config().S3Timeout},
+	}}
+	mailStore = &offloadStore{MailStore: mailStore}
+	log.Printf("已启用附件外置：超过 %d 字节的附件保存到 %s/%s/%s", config().AttachmentOffloadBytes, config().S3Endpoint, config().S3Bucket, config().S3Prefix)
+}
+
+// errBlobNotFound 对象不存在
+var errBlobNotFound = errors.New("对象不存在")
+
+// put 写入一个对象
+func (b *blobStore) put(key, contentType string, data []byte) error {
+	ctx, cancel := b.ctx()
+	defer cancel()
+	resp, err := b.do(ctx, http.MethodPut, key, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// get 读取一个对象，调用方负责关闭返回的 Body
+func (b *blobStore) get(ctx context.Context, key string) (*http.Response, error) {
+	if b == nil {
+		return nil, errors.New("未配置对象存储")
+	}
+	return b.do(ctx, http.MethodGet, key, nil, "")
+}
+
+// remove 删除若干对象，失败只记录日志。对象不存在时 S3 同样返回成功
+func (b *blobStore) remove(keys []string) {
+	for _, key := range keys {
+		ctx, cancel := b.ctx()
+		resp, err := b.do(ctx, http.MethodDelete, key, nil, "")
+		cancel()
+		if err != nil {
+			storeLogger.Warn("删除外置附件失败", "key", key, "error", err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+func (b *blobStore) ctx() (context.Context, context.CancelFunc) {
+	if config().S3Timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), config().S3Timeout)
+}
+
+// do 发送签名后的请求，非 2xx 响应转为错误
+func (b *blobStore) do(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+	u, err := url.Parse(config().S3Endpoint + "/" + escapeS3Path(config().S3Bucket+"/"+key))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	signS3Request(req, body, time.Now())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("对象存储返回 %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// escapeS3Path 按 SigV4 的要求转义对象路径，除非保留字符和 / 外全部百分号编码
+func escapeS3Path(p string) string {
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+// signS3Request 按 AWS Signature Version 4 签名，签入 Host 和请求上已设置的所有头
+func signS3Request(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + config().S3Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+config().S3SecretKey), date)
+	for _, part := range []string{config().S3Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config().S3AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// offload 把超过阈值的附件写入对象存储，返回写入的对象键。写入失败时其余附件不再尝试，
+// 全部保存在邮件存储中
+func (b *blobStore) offload(m *mailContent) []string {
+	var keys []string
+	copied := false
+	for i, a := range m.Attachments {
+		if a.blob != "" || len(a.data) < config().AttachmentOffloadBytes {
+			continue
+		}
+		key := fmt.Sprintf("%s%s/%d", config().S3Prefix, m.ID, i)
+		data, err := sealBytes(a.data)
+		if err == nil {
+			err = b.put(key, a.ContentType, data)
+		}
+		if err != nil {
+			storeLogger.Warn("附件写入对象存储失败，保存在邮件存储中", "mailbox", m.To, "id", m.ID, "error", err)
+			break
+		}
+		// 多个收件人共用解析出的附件列表，修改前先复制
+		if !copied {
+			m.Attachments = append([]attachment(nil), m.Attachments...)
+			copied = true
+		}
+		m.Attachments[i].data, m.Attachments[i].blob = nil, key
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// attachmentBlobs 邮件中外置附件的对象键，与 Attachments 一一对应；没有外置附件时返回 nil
+func attachmentBlobs(m mailContent) []string {
+	var keys []string
+	for i, a := range m.Attachments {
+		if a.blob == "" {
+			continue
+		}
+		if keys == nil {
+			keys = make([]string, len(m.Attachments))
+		}
+		keys[i] = a.blob
+	}
+	return keys
+}
+
+// deleteMailBlobs 在后台删除这些邮件的外置附件，未启用时什么也不做
+func deleteMailBlobs(mails []mailContent) {
+	if blobs == nil {
+		return
+	}
+	var keys []string
+	for _, m := range mails {
+		for _, a := range m.Attachments {
+			if a.blob != "" {
+				keys = append(keys, a.blob)
+			}
+		}
+	}
+	if len(keys) > 0 {
+		go blobs.remove(keys)
+	}
+}
+
+// offloadStore 在存储之外维护外置附件：保存前写入对象存储，邮件被取出、删除、过期或清空后删除对象。
+// 删除类方法只返回数量，先列出将被删除的邮件再调用存储
+type offloadStore struct {
+	MailStore
+}
+
+// backendStore 去掉 offloadStore 包装后的实际存储
+func backendStore() MailStore {
+	if s, ok := mailStore.(*offloadStore); ok {
+		return s.MailStore
+	}
+	return mailStore
+}
+
+func (s *offloadStore) Append(m mailContent) error {
+	keys := blobs.offload(&m)
+	err := s.MailStore.Append(m)
+	if err != nil && len(keys) > 0 {
+		go blobs.remove(keys)
+	}
+	return err
+}
+
+func (s *offloadStore) PopLatest(mailbox string) (mailContent, bool, error) {
+	m, ok, err := s.MailStore.PopLatest(mailbox)
+	if ok {
+		deleteMailBlobs([]mailContent{m})
+	}
+	return m, ok, err
+}
+
+func (s *offloadStore) Remove(mailbox string, ids []string) (int, error) {
+	list, err := s.MailStore.List(mailbox)
+	if err != nil {
+		return 0, err
+	}
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	var mails []mailContent
+	for _, m := range list {
+		if remove[m.ID] {
+			mails = append(mails, m)
+		}
+	}
+	n, err := s.MailStore.Remove(mailbox, ids)
+	if err == nil {
+		deleteMailBlobs(mails)
+	}
+	return n, err
+}
+
+func (s *offloadStore) Delete(mailbox string) (int, error) {
+	mails, err := s.MailStore.List(mailbox)
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.MailStore.Delete(mailbox)
+	if err == nil {
+		deleteMailBlobs(mails)
+	}
+	return n, err
+}
+
+func (s *offloadStore) Clear() error {
+	mails, err := s.collect(func(mailContent) bool { return true })
+	if err != nil {
+		return err
+	}
+	if err := s.MailStore.Clear(); err != nil {
+		return err
+	}
+	deleteMailBlobs(mails)
+	return nil
+}
+
+func (s *offloadStore) Expire(now time.Time) (int, error) {
+	mails, err := s.collect(func(m mailContent) bool { return m.expired(now) })
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.MailStore.Expire(now)
+	if err == nil {
+		deleteMailBlobs(mails)
+	}
+	return n, err
+}
+
+func (s *offloadStore) Trim(keep int) (int, int, error) {
+	// 只收集此刻最新 keep 封之外的邮件；之后新到的邮件会让更多邮件被删除，
+	// 这些邮件的对象留在对象存储中，但不会误删保留下来的附件
+	mails, err := s.collectOlder(keep)
+	if err != nil {
+		return 0, 0, err
+	}
+	removed, trimmed, err := s.MailStore.Trim(keep)
+	if err == nil {
+		deleteMailBlobs(mails)
+	}
+	return removed, trimmed, err
+}
+
+// collectOlder 列出每个邮箱中最新 keep 封之外、有外置附件的邮件
+func (s *offloadStore) collectOlder(keep int) ([]mailContent, error) {
+	summaries, err := s.MailStore.Mailboxes("")
+	if err != nil {
+		return nil, err
+	}
+	var mails []mailContent
+	for _, sum := range summaries {
+		if sum.Messages <= keep {
+			continue
+		}
+		list, err := s.MailStore.List(sum.Address)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range list[min(keep, len(list)):] {
+			if attachmentBlobs(m) != nil {
+				mails = append(mails, m)
+			}
+		}
+	}
+	return mails, nil
+}
+
+// collect 列出所有邮箱中符合条件且有外置附件的邮件
+func (s *offloadStore) collect(match func(mailContent) bool) ([]mailContent, error) {
+	summaries, err := s.MailStore.Mailboxes("")
+	if err != nil {
+		return nil, err
+	}
+	var mails []mailContent
+	for _, sum := range summaries {
+		list, err := s.MailStore.List(sum.Address)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range list {
+			if attachmentBlobs(m) != nil && match(m) {
+				mails = append(mails, m)
+			}
+		}
+	}
+	return mails, nil
+}
+
+// Close 关闭被包装的存储，平滑升级和退出时调用
+func (s *offloadStore) Close() error {
+	if closer, ok := s.MailStore.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout 等待数据库文件锁的时间，超时说明文件被其他进程占用
+const boltOpenTimeout = 5 * time.Second
+
+var (
+	boltMailboxesBucket = []byte("mailboxes")
+	boltRevisionsBucket = []byte("revisions")
+	boltMetaBucket      = []byte("meta")
+	boltCountsBucket    = []byte("counts")
+
+	boltRevClearedKey  = []byte("revcleared")
+	boltLastCleanupKey = []byte("last_cleanup")
+	boltUIDValidityKey = []byte("uid_validity")
+)
+
+// boltStore 基于 bbolt 的单文件持久化存储，重启后邮件仍在。
+//
+// 桶结构：
+//   - mailboxes/<地址>：每个邮箱一个子桶，包括没有邮件的空邮箱。键为 8 字节接收时间（纳秒）加 8 字节序号，
+//     按时间排序，从末尾向前遍历即为最新在前；值与 Redis 相同，为 "<过期毫秒时间戳>|<字节数>|<JSON>"
+//   - counts：各邮箱的邮件数，8 字节，与增删邮件在同一个事务中更新，没有邮件的邮箱没有这个键
+//   - revisions：各邮箱的版本；meta：版本和邮件序号共用的计数（桶序号）、清空时的版本、上次清空时间和 UIDVALIDITY
+//
+// 总邮件数、字节数和每分钟收件数保存在内存中，启动时遍历文件重建，counts 也在这时重新核对
+type boltStore struct {
+	db       *bolt.DB
+	started  time.Time
+	validity uint32
+
+	mu    sync.Mutex
+	stats storeCounters
+}
+
+// openBoltStore 打开或创建数据库文件，并遍历一遍所有邮件重建统计，文件损坏时返回错误而不是在运行中崩溃
+func openBoltStore(path string) (s *boltStore, err error) {
+	hint := fmt.Sprintf("可以用 `bbolt check %s` 检查，或移走该文件后重新启动", path)
+	var db *bolt.DB
+	// bbolt 遇到损坏的页面会 panic（打开时读取空闲列表也会），启动时遍历所有数据，把问题转成错误
+	defer func() {
+		if r := recover(); r != nil {
+			if db != nil {
+				db.Close()
+			}
+			s, err = nil, fmt.Errorf("%s 已损坏: %v，%s", path, r, hint)
+		}
+	}()
+
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		switch {
+		case errors.Is(err, bolt.ErrTimeout):
+			return nil, fmt.Errorf("%s 被其他进程占用（是否已有实例在运行？）", path)
+		case errors.Is(err, bolt.ErrInvalid), errors.Is(err, bolt.ErrVersionMismatch), errors.Is(err, bolt.ErrChecksum):
+			return nil, fmt.Errorf("%s 已损坏或不是 bbolt 数据库: %v，%s", path, err, hint)
+		}
+		return nil, err
+	}
+
+	s = &boltStore{db: db, started: time.Now()}
+	if err := s.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("读取 %s 失败: %v，%s", path, err, hint)
+	}
+	return s, nil
+}
+
+// load 创建顶层桶，重建内存中的统计和各邮箱的邮件数
+func (s *boltStore) load() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// 反正要遍历所有邮件，counts 每次启动都重建，早期版本的文件没有这个桶
+		if err := tx.DeleteBucket(boltCountsBucket); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		for _, name := range [][]byte{boltMailboxesBucket, boltRevisionsBucket, boltMetaBucket, boltCountsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(boltMetaBucket)
+		if v := meta.Get(boltLastCleanupKey); len(v) == 8 {
+			s.stats.lastCleanup = time.UnixMilli(int64(binary.BigEndian.Uint64(v)))
+		}
+		// UIDVALIDITY 在创建文件（或升级后第一次打开）时确定，之后不变
+		if v := meta.Get(boltUIDValidityKey); len(v) == 4 {
+			s.validity = binary.BigEndian.Uint32(v)
+		} else {
+			s.validity = uint32(time.Now().Unix())
+			if err := meta.Put(boltUIDValidityKey, binary.BigEndian.AppendUint32(nil, s.validity)); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(boltMailboxesBucket).ForEachBucket(func(name []byte) error {
+			n := 0
+			err := s.mailbox(tx, string(name)).ForEach(func(k, v []byte) error {
+				if len(k) != 16 {
+					return fmt.Errorf("邮箱 %s 中有无效的键", name)
+				}
+				if _, err := decodeStoredMail(string(v)); err != nil {
+					return fmt.Errorf("邮箱 %s 中有无法解析的邮件: %v", name, err)
+				}
+				s.stats.addedSized(boltKeyTime(k), storedMailSize(v))
+				n++
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			return s.addCount(tx, string(name), n)
+		})
+	})
+}
+
+// boltMailKey 接收时间加序号，保证同一纳秒投递的邮件也不冲突
+func boltMailKey(receivedAt time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(receivedAt.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+func boltKeyTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+}
+
+// boltDecode 解码邮件。早期版本没有在邮件中保存序号，用键中的邮箱内序号代替：
+// 它不大于当时的版本计数，而之后分配的序号都取自版本计数，仍然递增、不重复
+func boltDecode(k, v []byte) (mailContent, error) {
+	m, err := decodeStoredMail(string(v))
+	if err == nil && m.seq == 0 {
+		m.seq = binary.BigEndian.Uint64(k[8:])
+	}
+	return m, err
+}
+
+// storedMailExpiry 从编码后的邮件中取过期时间（毫秒），0 表示不过期
+func storedMailExpiry(v []byte) int64 {
+	i := bytes.IndexByte(v, '|')
+	if i < 0 {
+		return 0
+	}
+	ms, _ := strconv.ParseInt(string(v[:i]), 10, 64)
+	return ms
+}
+
+func (s *boltStore) mailbox(tx *bolt.Tx, mailbox string) *bolt.Bucket {
+	return tx.Bucket(boltMailboxesBucket).Bucket([]byte(mailbox))
+}
+
+// touch 更新邮箱版本，版本计数使用 meta 桶的序号，重启后不会回退
+func (s *boltStore) touch(tx *bolt.Tx, mailbox string) error {
+	rev, err := tx.Bucket(boltMetaBucket).NextSequence()
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltRevisionsBucket).Put([]byte(mailbox), encodeBoltRevision(rev, time.Now()))
+}
+
+// boltCount 读取邮箱的邮件数
+func boltCount(tx *bolt.Tx, mailbox string) int {
+	if v := tx.Bucket(boltCountsBucket).Get([]byte(mailbox)); len(v) == 8 {
+		return int(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+// addCount 按 delta 调整邮箱的邮件数，减到 0 时删除键
+func (s *boltStore) addCount(tx *bolt.Tx, mailbox string, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	counts := tx.Bucket(boltCountsBucket)
+	n := boltCount(tx, mailbox) + delta
+	if n <= 0 {
+		return counts.Delete([]byte(mailbox))
+	}
+	return counts.Put([]byte(mailbox), binary.BigEndian.AppendUint64(nil, uint64(n)))
+}
+
+func encodeBoltRevision(rev uint64, modified time.Time) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v, rev)
+	binary.BigEndian.PutUint64(v[8:], uint64(modified.UnixMilli()))
+	return v
+}
+
+func decodeBoltRevision(v []byte) mailboxRevision {
+	return mailboxRevision{
+		revision: binary.BigEndian.Uint64(v),
+		modified: time.UnixMilli(int64(binary.BigEndian.Uint64(v[8:]))),
+	}
+}
+
+func (s *boltStore) Append(m mailContent) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltMailboxesBucket).CreateBucketIfNotExists([]byte(m.To))
+		if err != nil {
+			return err
+		}
+		// 邮件序号与版本共用 meta 桶的计数，整个文件内递增、不重复
+		m.seq, err = tx.Bucket(boltMetaBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		value, err := encodeStoredMail(m)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(boltMailKey(m.ReceivedAt, m.seq), []byte(value)); err != nil {
+			return err
+		}
+		if err := s.addCount(tx, m.To, 1); err != nil {
+			return err
+		}
+		return s.touch(tx, m.To)
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.stats.added(m)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *boltStore) Create(mailbox string) (bool, error) {
+	created := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if s.mailbox(tx, mailbox) != nil {
+			return nil
+		}
+		if _, err := tx.Bucket(boltMailboxesBucket).CreateBucket([]byte(mailbox)); err != nil {
+			return err
+		}
+		created = true
+		return s.touch(tx, mailbox)
+	})
+	return created, err
+}
+
+func (s *boltStore) Exists(mailbox string) (bool, error) {
+	exists := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		exists = s.mailbox(tx, mailbox) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// Count 读取 counts 桶中的计数，不用遍历邮箱
+func (s *boltStore) Count(mailbox string) (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = boltCount(tx, mailbox)
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltStore) Size(mailbox string) (int64, error) {
+	var size int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := s.mailbox(tx, mailbox); b != nil {
+			return b.ForEach(func(_, v []byte) error {
+				size += storedMailSize(v)
+				return nil
+			})
+		}
+		return nil
+	})
+	return size, err
+}
+
+// PopLatest 在同一个写事务中读取并删除，并发取件不会拿到同一封邮件
+func (s *boltStore) PopLatest(mailbox string) (mailContent, bool, error) {
+	var key, value []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := s.mailbox(tx, mailbox)
+		if b == nil {
+			return nil
+		}
+		k, v := b.Cursor().Last()
+		if k == nil {
+			return nil
+		}
+		// 键和值只在事务内有效，需要复制出来
+		key, value = append([]byte(nil), k...), append([]byte(nil), v...)
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+		if err := s.addCount(tx, mailbox, -1); err != nil {
+			return err
+		}
+		return s.touch(tx, mailbox)
+	})
+	if err != nil || value == nil {
+		return mailContent{}, false, err
+	}
+	s.mu.Lock()
+	s.stats.removedSized(1, storedMailSize(value))
+	s.mu.Unlock()
+	m, err := boltDecode(key, value)
+	return m, err == nil, err
+}
+
+func (s *boltStore) Remove(mailbox string, ids []string) (int, error) {
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	removed := 0
+	var size int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := s.mailbox(tx, mailbox)
+		if b == nil {
+			return nil
+		}
+		// 游标遍历中删除会跳过元素，先收集再删除
+		var dropped [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			m, err := boltDecode(k, v)
+			if err != nil {
+				return err
+			}
+			if remove[m.ID] {
+				dropped = append(dropped, k)
+				size += storedMailSize(v)
+			}
+		}
+		if len(dropped) == 0 {
+			return nil
+		}
+		for _, k := range dropped {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(dropped)
+		if err := s.addCount(tx, mailbox, -removed); err != nil {
+			return err
+		}
+		return s.touch(tx, mailbox)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.stats.removedSized(removed, size)
+	s.mu.Unlock()
+	return removed, nil
+}
+
+func (s *boltStore) Latest(mailbox string) (mailContent, bool, error) {
+	var m mailContent
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.mailbox(tx, mailbox)
+		if b == nil {
+			return nil
+		}
+		k, v := b.Cursor().Last()
+		if k == nil {
+			return nil
+		}
+		var err error
+		m, err = boltDecode(k, v)
+		found = err == nil
+		return err
+	})
+	return m, found, err
+}
+
+func (s *boltStore) List(mailbox string) ([]mailContent, error) {
+	var newestFirst []mailContent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.mailbox(tx, mailbox)
+		if b == nil {
+			return nil
+		}
+		newestFirst = make([]mailContent, 0, boltCount(tx, mailbox))
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			m, err := boltDecode(k, v)
+			if err != nil {
+				return err
+			}
+			newestFirst = append(newestFirst, m)
+		}
+		return nil
+	})
+	return newestFirst, err
+}
+
+func (s *boltStore) Get(mailbox, id string) (mailContent, bool, error) {
+	var m mailContent
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := s.mailbox(tx, mailbox)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			candidate, err := boltDecode(k, v)
+			if err != nil {
+				return err
+			}
+			if candidate.ID == id {
+				m, found = candidate, true
+				return nil
+			}
+		}
+		return nil
+	})
+	return m, found, err
+}
+
+func (s *boltStore) SetRead(mailbox, id string, read bool) (int, error) {
+	matched := 0
+	var delta int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := s.mailbox(tx, mailbox)
+		if b == nil {
+			return nil
+		}
+		changed := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			m, err := boltDecode(k, v)
+			if err != nil {
+				return err
+			}
+			if id != "" && m.ID != id {
+				return nil
+			}
+			matched++
+			if m.Read == read {
+				return nil
+			}
+			m.Read = read
+			encoded, err := encodeStoredMail(m)
+			if err != nil {
+				return err
+			}
+			// 遍历中不能修改桶，先记下再统一写回
+			changed[string(k)] = []byte(encoded)
+			delta += mailSize(m) - storedMailSize(v)
+			return nil
+		})
+		if err != nil || len(changed) == 0 {
+			return err
+		}
+		for k, v := range changed {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return s.touch(tx, mailbox)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.stats.bytes += delta
+	s.mu.Unlock()
+	return matched, nil
+}
+
+func (s *boltStore) Delete(mailbox string) (int, error) {
+	n := 0
+	var size int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := s.mailbox(tx, mailbox)
+		if b != nil {
+			if err := b.ForEach(func(k, v []byte) error {
+				n++
+				size += storedMailSize(v)
+				return nil
+			}); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltMailboxesBucket).DeleteBucket([]byte(mailbox)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltCountsBucket).Delete([]byte(mailbox)); err != nil {
+				return err
+			}
+		}
+		return s.touch(tx, mailbox)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.stats.removedSized(n, size)
+	s.mu.Unlock()
+	return n, nil
+}
+
+// Clear 删除所有邮箱和版本记录；版本计数保留，保证版本号不会回退。文件大小不会因此缩小，释放的页面留给之后的邮件复用
+func (s *boltStore) Clear() error {
+	now := time.Now()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMailboxesBucket, boltRevisionsBucket, boltCountsBucket} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(boltMetaBucket)
+		rev, err := meta.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(boltRevClearedKey, encodeBoltRevision(rev, now)); err != nil {
+			return err
+		}
+		ms := make([]byte, 8)
+		binary.BigEndian.PutUint64(ms, uint64(now.UnixMilli()))
+		return meta.Put(boltLastCleanupKey, ms)
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.stats.cleared(now)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *boltStore) Expire(now time.Time) (int, error) {
+	removed := 0
+	var size int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(boltMailboxesBucket)
+		var emptied [][]byte
+		err := root.ForEachBucket(func(name []byte) error {
+			b := root.Bucket(name)
+			// 游标遍历中删除会跳过元素，先收集再删除
+			var expired [][]byte
+			total := 0
+			if err := b.ForEach(func(k, v []byte) error {
+				total++
+				if ms := storedMailExpiry(v); ms > 0 && ms <= now.UnixMilli() {
+					expired = append(expired, k)
+					size += storedMailSize(v)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if len(expired) == 0 {
+				return nil
+			}
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			removed += len(expired)
+			if err := s.addCount(tx, string(name), -len(expired)); err != nil {
+				return err
+			}
+			if len(expired) == total {
+				emptied = append(emptied, append([]byte(nil), name...))
+			}
+			return s.touch(tx, string(name))
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range emptied {
+			if err := root.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.stats.removedSized(removed, size)
+	s.mu.Unlock()
+	return removed, nil
+}
+
+func (s *boltStore) Trim(keep int) (int, int, error) {
+	removed, trimmed := 0, 0
+	var size int64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(boltMailboxesBucket)
+		return root.ForEachBucket(func(name []byte) error {
+			b := root.Bucket(name)
+			n := boltCount(tx, string(name)) - keep
+			if n <= 0 {
+				return nil
+			}
+			// 键按投递时间排序，最早的在前；游标遍历中删除会跳过元素，先收集再删除
+			dropped := make([][]byte, 0, n)
+			c := b.Cursor()
+			for k, v := c.First(); k != nil && len(dropped) < n; k, v = c.Next() {
+				dropped = append(dropped, k)
+				size += storedMailSize(v)
+			}
+			for _, k := range dropped {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			removed += len(dropped)
+			trimmed++
+			if err := s.addCount(tx, string(name), -len(dropped)); err != nil {
+				return err
+			}
+			return s.touch(tx, string(name))
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	s.mu.Lock()
+	s.stats.removedSized(removed, size)
+	s.mu.Unlock()
+	return removed, trimmed, nil
+}
+
+func (s *boltStore) Revision(mailbox string) (mailboxRevision, error) {
+	rev := mailboxRevision{modified: s.started}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltRevisionsBucket).Get([]byte(mailbox)); len(v) == 16 {
+			rev = decodeBoltRevision(v)
+		} else if v := tx.Bucket(boltMetaBucket).Get(boltRevClearedKey); len(v) == 16 {
+			rev = decodeBoltRevision(v)
+		}
+		return nil
+	})
+	return rev, err
+}
+
+func (s *boltStore) Mailboxes(prefix string) ([]mailboxSummary, error) {
+	prefix = strings.ToLower(prefix)
+	var summaries []mailboxSummary
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(boltMailboxesBucket)
+		return root.ForEachBucket(func(name []byte) error {
+			address := string(name)
+			if !strings.HasPrefix(strings.ToLower(address), prefix) {
+				return nil
+			}
+			sum := mailboxSummary{Address: address}
+			c := root.Bucket(name).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				if sum.Messages == 0 {
+					sum.FirstDelivery = boltKeyTime(k)
+				}
+				sum.LastDelivery = boltKeyTime(k)
+				sum.Messages++
+				sum.Bytes += storedMailSize(v)
+			}
+			if sum.Messages > 0 {
+				summaries = append(summaries, sum)
+			}
+			return nil
+		})
+	})
+	return summaries, err
+}
+
+func (s *boltStore) Stats(now time.Time) (storeStats, error) {
+	var st storeStats
+	err := s.db.View(func(tx *bolt.Tx) error {
+		st.FileBytes = tx.Size()
+		return tx.Bucket(boltMailboxesBucket).ForEachBucket(func(name []byte) error {
+			st.Mailboxes++
+			return nil
+		})
+	})
+	if err != nil {
+		return st, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.Messages = s.stats.messages
+	st.Bytes = s.stats.bytes
+	st.ReceivedLastHour = s.stats.receivedSince(now, 60)
+	st.ReceivedLastDay = s.stats.receivedSince(now, statsBuckets)
+	st.LastCleanup = s.stats.lastCleanup
+	return st, nil
+}
+
+func (s *boltStore) Sequence() (mailSequence, error) {
+	seq := mailSequence{validity: s.validity}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		seq.next = tx.Bucket(boltMetaBucket).Sequence() + 1
+		return nil
+	})
+	return seq, err
+}
+
+// Close 关闭数据库文件
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/html"
+)
+
+var (
+	// 关键词附近的验证码，如 "code is 123456"、"验证码：AB12CD"
+	keywordCodePattern = regexp.MustCompile(`(?i)(?:(?:verification|security|login|confirmation)\s+code|code|verification|verify|otp|passcode|pin|验证码|校验码|动态码)[^A-Za-z0-9\n]{0,20}(?:(?:is|was)\s*[:：]?\s*)?([A-Za-z0-9]{4,8})\b`)
+	// 独立的 4-8 位数字
+	digitCodePattern = regexp.MustCompile(`\b\d{4,8}\b`)
+	yearPattern      = regexp.MustCompile(`^(19|20)\d{2}$`)
+	hasDigitPattern  = regexp.MustCompile(`\d`)
+)
+
+// extractCode 从文本中提取最可能的验证码，优先关键词附近的候选，其次是独立数字
+func extractCode(text string) (string, bool) {
+	best, bestScore := "", 0
+
+	for _, m := range keywordCodePattern.FindAllStringSubmatch(text, -1) {
+		candidate := m[1]
+		if !hasDigitPattern.MatchString(candidate) {
+			continue
+		}
+		score := 4
+		if digitCodePattern.MatchString(candidate) && len(candidate) == len(digitCodePattern.FindString(candidate)) {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+
+	for _, candidate := range digitCodePattern.FindAllString(text, -1) {
+		score := 2
+		if len(candidate) == 6 {
+			score++
+		}
+		if yearPattern.MatchString(candidate) {
+			score = 1
+		}
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+
+	return best, bestScore > 0
+}
+
+// htmlToText 提取 HTML 中可见的文本
+func htmlToText(body string) string {
+	var sb strings.Builder
+	z := html.NewTokenizer(strings.NewReader(body))
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return sb.String()
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				sb.Write(z.Text())
+				sb.WriteString("\n")
+			}
+		}
+	}
+}
+
+// handleGetCode 从最新一封邮件中提取验证码，不会删除邮件
+func handleGetCode(c *gin.Context) {
+	mailHead := mailboxParam(c)
+
+	latest, ok, err := mailStore.Latest(mailHead)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": msg("no_mail")})
+		return
+	}
+
+	code, ok := extractCode(latest.Text)
+	if !ok {
+		code, ok = extractCode(htmlToText(latest.HTML))
+	}
+	if !ok {
+		if legacyJSON(c) {
+			c.JSON(404, gin.H{"error": msg("code_not_found"), "id": latest.ID, "title": latest.Subject})
+			return
+		}
+		c.JSON(404, codeNotFoundResponse{Error: msg("code_not_found"), ID: latest.ID, Subject: latest.Subject})
+		return
+	}
+	c.JSON(200, codeResponse{Code: code, ID: latest.ID})
+}
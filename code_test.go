@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExtractCode(t *testing.T) {
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{"Your verification code is 482913.", "482913"},
+		{"Your code was: 7788", "7788"},
+		{"Security code 99ab12 expires soon", "99ab12"},
+		{"验证码：AB12CD，5 分钟内有效", "AB12CD"},
+		{"您的校验码为 5521，请勿泄露", "5521"},
+		{"OTP - 12345678", "12345678"},
+		// 关键词附近的候选优先于独立数字
+		{"Order 20241 shipped. Your PIN 1234", "1234"},
+		// 没有关键词时取独立数字，6 位优先
+		{"Call 1234 or use 654321 to sign in", "654321"},
+		// 年份不作为验证码，除非没有其他候选
+		{"© 2024 Example Inc. Sign in with 5823", "5823"},
+		// 关键词后没有数字的单词不是验证码
+		{"Verify your account: enter 246810", "246810"},
+		{"Hello, welcome aboard", ""},
+		{"Code: ABCDEF", ""},
+		{"Tracking 123", ""},
+	} {
+		got, ok := extractCode(tc.text)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("extractCode(%q) = %q, %v，应为 %q", tc.text, got, ok, tc.want)
+		}
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	text := htmlToText(`<style>.x{color:red}</style><p>Code: <b>123456</b></p><script>var n = 999999</script>`)
+	if got, _ := extractCode(text); got != "123456" {
+		t.Errorf("HTML 中的验证码 = %q，文本 %q", got, text)
+	}
+}
+
+func TestGetCode(t *testing.T) {
+	setupTest(t, nil)
+	r := newRouter()
+	const path = "/api/v1/mailboxes/user@test.local/code"
+
+	if w := testRequest(r, "GET", path, "192.0.2.1"); w.Code != 404 {
+		t.Errorf("空邮箱返回 %d", w.Code)
+	}
+
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", Subject: "hello", Text: "no code here", ReceivedAt: time.Now()})
+	var missing struct {
+		Data  codeNotFoundResponse `json:"data"`
+		Error *v1Error             `json:"error"`
+	}
+	w := testRequest(r, "GET", path, "192.0.2.1")
+	json.Unmarshal(w.Body.Bytes(), &missing)
+	if w.Code != 404 || missing.Data.ID != "m1" || missing.Data.Subject != "hello" || missing.Error == nil {
+		t.Errorf("没有验证码时返回 %d %s", w.Code, w.Body)
+	}
+
+	// 只有 HTML 正文时从可见文本中提取，取最新的一封
+	mailStore.Append(mailContent{ID: "m2", To: "user@test.local", HTML: "<p>验证码 <b>AB12CD</b></p>", ReceivedAt: time.Now()})
+	mailStore.Append(mailContent{ID: "m3", To: "user@test.local", Text: "Your code is 482913", ReceivedAt: time.Now()})
+	var found struct {
+		Data codeResponse `json:"data"`
+	}
+	w = testRequest(r, "GET", path, "192.0.2.1")
+	json.Unmarshal(w.Body.Bytes(), &found)
+	if w.Code != 200 || found.Data.Code != "482913" || found.Data.ID != "m3" {
+		t.Errorf("GET code 返回 %d %s", w.Code, w.Body)
+	}
+	if n, _ := mailStore.Count("user@test.local"); n != 3 {
+		t.Errorf("提取验证码不应删除邮件，剩余 %d 封", n)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newCompressRouter() *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gzipMiddleware())
+	r.GET("/large", func(c *gin.Context) { c.String(200, strings.Repeat("a", 4096)) })
+	r.GET("/small", func(c *gin.Context) { c.String(200, "ok") })
+	r.GET("/image", func(c *gin.Context) { c.Data(200, "image/png", make([]byte, 4096)) })
+	r.GET("/attachment", func(c *gin.Context) {
+		c.Header("Content-Disposition", `attachment; filename="a.txt"`)
+		c.Data(200, "text/plain", make([]byte, 4096))
+	})
+	// 分多次写入，跨过阈值后改为流式压缩
+	r.GET("/chunks", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain")
+		for range 8 {
+			c.Writer.WriteString(strings.Repeat("b", 512))
+		}
+	})
+	// 未到阈值就 Flush 时按已写入的大小决定，之后不再压缩
+	r.GET("/flushed", func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain")
+		for range 8 {
+			c.Writer.WriteString(strings.Repeat("b", 512))
+			c.Writer.Flush()
+		}
+	})
+	return r
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	setupTest(t, map[string]string{"COMPRESSION_MIN_BYTES": "1024"})
+	r := newCompressRouter()
+
+	for _, tc := range []struct {
+		path, acceptEncoding string
+		gzipped              bool
+		size                 int
+	}{
+		{"/large", "gzip, deflate", true, 4096},
+		{"/large", "", false, 4096},
+		{"/large", "br", false, 4096},
+		{"/small", "gzip", false, 2},
+		{"/image", "gzip", false, 4096},
+		{"/attachment", "gzip", false, 4096},
+		{"/chunks", "gzip", true, 4096},
+		{"/flushed", "gzip", false, 4096},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tc.gzipped {
+			t.Errorf("%s (Accept-Encoding %q): 压缩 = %v，应为 %v", tc.path, tc.acceptEncoding, got, tc.gzipped)
+			continue
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary = %q", tc.path, w.Header().Get("Vary"))
+		}
+		body := w.Body.Bytes()
+		if tc.gzipped {
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.path, err)
+			}
+			if body, err = io.ReadAll(zr); err != nil {
+				t.Fatalf("%s: 解压: %v", tc.path, err)
+			}
+		}
+		if len(body) != tc.size {
+			t.Errorf("%s: 响应 %d 字节，应为 %d", tc.path, len(body), tc.size)
+		}
+	}
+}
+
+func TestGzipHead(t *testing.T) {
+	setupTest(t, nil)
+	r := newCompressRouter()
+	r.HEAD("/large", func(c *gin.Context) { c.Status(200) })
+	req := httptest.NewRequest("HEAD", "/large", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Error("HEAD 请求不应压缩")
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	for _, tc := range []struct {
+		contentType, encoding, disposition string
+		want                               bool
+	}{
+		{"application/json; charset=utf-8", "", "", true},
+		{"text/html", "", "inline", true},
+		{"message/rfc822", "", "", true},
+		{"text/plain", "br", "", false},
+		{"text/plain", "", `Attachment; filename="x"`, false},
+		{"IMAGE/JPEG", "", "", false},
+		{"application/zip", "", "", false},
+		{"application/octet-stream", "", "", false},
+	} {
+		if got := compressible(tc.contentType, tc.encoding, tc.disposition); got != tc.want {
+			t.Errorf("compressible(%q, %q, %q) = %v", tc.contentType, tc.encoding, tc.disposition, got)
+		}
+	}
+}
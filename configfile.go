@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// 配置文件：用 --config 或 CONFIG_FILE 指定 YAML（.yaml/.yml）或 TOML（.toml）文件，键与环境变量同名，
+// 大小写均可，如 allowed_domains。列表和按域名的设置可以直接写成 YAML/TOML 的列表和映射。
+// 环境变量（包括 .env）优先于文件，没有配置文件时只读环境变量
+
+var (
+	// fileValues 配置文件中的值，已转为环境变量的写法，键为大写
+	fileValues map[string]string
+	// configKeys parseConfig 读取过的配置项，用于找出配置文件中拼错的键
+	configKeys map[string]bool
+)
+
+// getEnv 读取配置项：命令行参数优先，其次是环境变量，最后是配置文件中的值
+func getEnv(key string) string {
+	configKeys[key] = true
+	if discovering {
+		describeOption(key, "", false)
+		return ""
+	}
+	if value := flagValues[key]; value != "" {
+		return value
+	}
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fileValues[key]
+}
+
+// configFilePath --config 优先于 CONFIG_FILE
+func configFilePath() string {
+	if path := flagValues["CONFIG_FILE"]; path != "" {
+		return path
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// loadConfigFile 读取配置文件到 fileValues，错误记入 configErrors。启动和重新加载时由 parseConfig 调用
+func loadConfigFile() {
+	fileValues, configKeys = map[string]string{}, map[string]bool{}
+	path := configFilePath()
+	if path == "" || discovering {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		configError("读取配置文件失败: %v", err)
+		return
+	}
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		configError("配置文件 %s 的格式无法识别，扩展名应为 .yaml、.yml 或 .toml", path)
+		return
+	}
+	if err != nil {
+		configError("解析配置文件 %s 失败: %v", path, err)
+		return
+	}
+	for k, v := range doc {
+		key := strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		value, err := configValue(v)
+		if err != nil {
+			configError("配置文件中的 %s %v", k, err)
+			continue
+		}
+		fileValues[key] = value
+	}
+	log.Printf("已读取配置文件 %s（%d 项）", path, len(fileValues))
+}
+
+// warnUnknownConfigKeys 配置文件中没有被读取的键多半是拼错了，逐个警告
+func warnUnknownConfigKeys() {
+	var unknown []string
+	for key := range fileValues {
+		if !configKeys[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		log.Printf("警告：配置文件中的 %s 不是已知的配置项，已忽略", key)
+	}
+}
+
+// configValue 把文件中的值转为环境变量的写法：列表用逗号连接，映射写成 键:值（FORWARD_RULES 的格式），
+// 值为映射时写成 键:子键=值;子键=值（DOMAIN_POLICIES 的格式）
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := configScalar(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		items := make([]string, 0, len(v))
+		for _, k := range sortedKeys(v) {
+			var s string
+			var err error
+			if settings, ok := v[k].(map[string]interface{}); ok {
+				s, err = configSettings(settings)
+			} else {
+				s, err = configScalar(v[k])
+			}
+			if err != nil {
+				return "", err
+			}
+			items = append(items, k+":"+s)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return configScalar(v)
+}
+
+// configSettings 把一个域名的设置写成 子键=值;子键=值
+func configSettings(m map[string]interface{}) (string, error) {
+	settings := make([]string, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		s, err := configScalar(m[k])
+		if err != nil {
+			return "", err
+		}
+		settings = append(settings, k+"="+s)
+	}
+	return strings.Join(settings, ";"), nil
+}
+
+func configScalar(v interface{}) (string, error) {
+	switch v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}, map[string]interface{}:
+		return "", fmt.Errorf("嵌套层级过深")
+	}
+	return fmt.Sprint(v), nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// secretFields 打印配置时隐藏的字段
+var secretFields = map[string]bool{
+	"AdminAPIKeys":        true,
+	"RedisPassword":       true,
+	"PostgresDSN":         true,
+	"S3AccessKey":         true,
+	"S3SecretKey":         true,
+	"ForwardSMTPPassword": true,
+	"EncryptionKeys":      true,
+	"MailboxTokenSecret":  true,
+}
+
+// logEffectiveConfig 启动时逐项打印合并环境变量、.env 和配置文件后生效的配置，密码和密钥只显示是否设置
+func logEffectiveConfig(cfg *Config) {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, field := v.Type().Field(i).Name, v.Field(i)
+		value := fmt.Sprint(field.Interface())
+		if secretFields[name] && !field.IsZero() {
+			value = "******"
+		}
+		log.Printf("配置 %s = %s", name, value)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsMiddleware 按配置返回 CORS 响应头，预检请求直接应答，不进入邮件处理逻辑
+func corsMiddleware() gin.HandlerFunc {
+	methods := strings.Join(config().CORSAllowedMethods, ", ")
+	headers := strings.Join(config().CORSAllowedHeaders, ", ")
+	maxAge := strconv.Itoa(config().CORSMaxAge)
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Origin")
+		allowed := originAllowed(origin)
+		if allowed {
+			c.Header("Access-Control-Allow-Origin", origin)
+			if config().CORSAllowCredentials {
+				c.Header("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if c.Request.Method == "OPTIONS" && c.GetHeader("Access-Control-Request-Method") != "" {
+			if !allowed {
+				c.AbortWithStatus(403)
+				return
+			}
+			c.Header("Access-Control-Allow-Methods", methods)
+			c.Header("Access-Control-Allow-Headers", headers)
+			c.Header("Access-Control-Max-Age", maxAge)
+			c.AbortWithStatus(204)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// originAllowed 判断来源是否在允许列表中，支持 * 通配，如 https://*.example.com
+func originAllowed(origin string) bool {
+	for _, pattern := range config().CORSAllowedOrigins {
+		if originMatches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin))
+	return ok
+}
+
+// originMatchesAny 模式是否匹配任意网站（*、https://* 等），而不是限定在某个域名下
+func originMatchesAny(pattern string) bool {
+	return originMatches(pattern, "https://unrelated-site.invalid") || originMatches(pattern, "http://unrelated-site.invalid")
+}
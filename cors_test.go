@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func corsRequest(t *testing.T, method, origin string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/v1/domains", nil)
+	req.Header.Set("Origin", origin)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	setupTest(t, map[string]string{
+		"CORS_ALLOWED_ORIGINS":   "https://app.example.com,https://*.tools.example.com",
+		"CORS_ALLOW_CREDENTIALS": "true",
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		for _, origin := range []string{"https://app.example.com", "https://APP.example.com", "https://a.tools.example.com"} {
+			w := corsRequest(t, "GET", origin, nil)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+				t.Errorf("%s: Access-Control-Allow-Origin = %q", origin, got)
+			}
+			if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("%s: 应允许携带凭据", origin)
+			}
+			if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Origin") {
+				t.Errorf("%s: 响应应带 Vary: Origin", origin)
+			}
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		for _, origin := range []string{"https://evil.example", "http://app.example.com", "https://tools.example.com.evil.example"} {
+			w := corsRequest(t, "GET", origin, nil)
+			if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+				t.Errorf("%s 不在允许列表中，不应返回 CORS 头: %v", origin, w.Header())
+			}
+			w = corsRequest(t, "OPTIONS", origin, map[string]string{"Access-Control-Request-Method": "DELETE"})
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s 的预检应返回 403，实际 %d", origin, w.Code)
+			}
+		}
+	})
+
+	t.Run("delete preflight", func(t *testing.T) {
+		w := corsRequest(t, "OPTIONS", "https://app.example.com", map[string]string{
+			"Access-Control-Request-Method":  "DELETE",
+			"Access-Control-Request-Headers": "X-Api-Key",
+		})
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("预检应返回 204，实际 %d", w.Code)
+		}
+		if methods := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, "DELETE") {
+			t.Errorf("Access-Control-Allow-Methods = %q", methods)
+		}
+		if headers := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(headers, "X-Api-Key") {
+			t.Errorf("Access-Control-Allow-Headers = %q", headers)
+		}
+		if w.Header().Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("Access-Control-Max-Age = %q", w.Header().Get("Access-Control-Max-Age"))
+		}
+	})
+}
+
+// TestCORSWildcardWithCredentials 匹配任意网站的来源不能与凭据同时开启，限定域名的通配可以
+func TestCORSWildcardWithCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		origins string
+		ok      bool
+	}{
+		{"*", false},
+		{"https://*", false},
+		{"https://app.example.com,*", false},
+		{"https://*.example.com", true},
+		{"https://app.example.com", true},
+	} {
+		t.Setenv("ALLOWED_DOMAINS", "test.local")
+		t.Setenv("CORS_ALLOWED_ORIGINS", tc.origins)
+		t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+		configErrors = nil
+		parseConfig()
+		if ok := len(configErrors) == 0; ok != tc.ok {
+			t.Errorf("%s: 配置错误 %q", tc.origins, configErrors)
+		}
+	}
+	configErrors = nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// 去重范围
+const (
+	dedupOff     = "off"
+	dedupMailbox = "mailbox"
+	dedupGlobal  = "global"
+)
+
+// dedupEntry 记录某个 Message-ID 第一次被保存的投递
+type dedupEntry struct {
+	deliveryID string
+	seen       time.Time
+}
+
+// dedupSeen 由 dedupMu 保护
+var (
+	dedupSeen = make(map[string]dedupEntry)
+	dedupMu   sync.Mutex
+)
+
+// dedupKey 按去重范围生成键，mailbox 模式下同一 Message-ID 在不同邮箱互不影响
+func dedupKey(mailbox, messageID string) string {
+	if config().DedupMode == dedupGlobal {
+		return messageID
+	}
+	return strings.ToLower(mailbox) + "|" + messageID
+}
+
+// isDuplicate 判断邮件是否已在去重窗口内保存过，没有时记下本次投递。
+// global 模式下同一次投递发给多个收件人不算重复，只有上游重试（新的投递）才会被跳过
+func isDuplicate(mailbox, messageID, deliveryID string) bool {
+	if config().DedupMode == dedupOff || messageID == "" {
+		return false
+	}
+
+	key := dedupKey(mailbox, messageID)
+	now := time.Now()
+
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+
+	if entry, ok := dedupSeen[key]; ok && now.Sub(entry.seen) <= config().DedupWindow {
+		return entry.deliveryID != deliveryID
+	}
+	dedupSeen[key] = dedupEntry{deliveryID: deliveryID, seen: now}
+	return false
+}
+
+// forgetDelivery 保存失败时撤销记录，让发件方重试时可以正常投递
+func forgetDelivery(mailbox, messageID, deliveryID string) {
+	if config().DedupMode == dedupOff || messageID == "" {
+		return
+	}
+	key := dedupKey(mailbox, messageID)
+
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	if entry, ok := dedupSeen[key]; ok && entry.deliveryID == deliveryID {
+		delete(dedupSeen, key)
+	}
+}
+
+// pruneDedup 清理超出去重窗口的记录
+func pruneDedup(now time.Time) {
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	for key, entry := range dedupSeen {
+		if now.Sub(entry.seen) > config().DedupWindow {
+			delete(dedupSeen, key)
+		}
+	}
+}
+
+// forgetMailboxDedup 删除这些邮箱的去重记录；global 模式下记录不属于某个邮箱，保留不动
+func forgetMailboxDedup(mailboxes []string) {
+	if config().DedupMode != dedupMailbox || len(mailboxes) == 0 {
+		return
+	}
+	prefixes := make([]string, 0, len(mailboxes))
+	for _, mailbox := range mailboxes {
+		prefixes = append(prefixes, strings.ToLower(mailbox)+"|")
+	}
+
+	dedupMu.Lock()
+	defer dedupMu.Unlock()
+	for key := range dedupSeen {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				delete(dedupSeen, key)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	dnsblTimeout  = 3 * time.Second
+	dnsblCacheTTL = 10 * time.Minute
+)
+
+type dnsblCacheEntry struct {
+	listed  []string
+	expires time.Time
+}
+
+var (
+	dnsblCache   = make(map[string]dnsblCacheEntry)
+	dnsblCacheMu sync.Mutex
+)
+
+// checkDNSBL 查询连接方 IP 是否在黑名单中，启用 DNSBL_REJECT 时直接拒绝，否则只记录在邮件上
+func checkDNSBL(s *smtpSession) error {
+	if len(config().DNSBLZones) == 0 {
+		return nil
+	}
+
+	s.dnsbl = lookupDNSBL(s.remoteIP)
+	if len(s.dnsbl) > 0 && config().DNSBLReject {
+		smtpLogger.Info("拒绝连接: 命中黑名单", "ip", s.remoteIP, "dnsbl", strings.Join(s.dnsbl, ","))
+		return smtpReply{550, smtp.EnhancedCode{5, 7, 1}, "smtp_dnsbl_blocked"}.err(s.remoteIP, s.dnsbl[0])
+	}
+	return nil
+}
+
+// lookupDNSBL 返回命中的黑名单，结果短暂缓存；DNS 超时或出错视为未命中
+func lookupDNSBL(ip string) []string {
+	now := time.Now()
+	dnsblCacheMu.Lock()
+	if entry, ok := dnsblCache[ip]; ok && now.Before(entry.expires) {
+		dnsblCacheMu.Unlock()
+		return entry.listed
+	}
+	dnsblCacheMu.Unlock()
+
+	reversed := reverseIP(ip)
+	if reversed == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsblTimeout)
+	defer cancel()
+
+	var listed []string
+	for _, zone := range config().DNSBLZones {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, reversed+"."+zone)
+		if err == nil && len(addrs) > 0 {
+			listed = append(listed, zone)
+		}
+	}
+
+	dnsblCacheMu.Lock()
+	for key, entry := range dnsblCache {
+		if now.After(entry.expires) {
+			delete(dnsblCache, key)
+		}
+	}
+	dnsblCache[ip] = dnsblCacheEntry{listed: listed, expires: now.Add(dnsblCacheTTL)}
+	dnsblCacheMu.Unlock()
+	return listed
+}
+
+// reverseIP 生成 DNSBL 查询用的反转地址，IPv6 按半字节反转
+func reverseIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for i := len(parsed) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hexDigits[parsed[i]&0xf]), string(hexDigits[parsed[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
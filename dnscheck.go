@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const dnsCheckTimeout = 5 * time.Second
+
+// dnsCheckResult 反向解析和 HELO 校验结果
+type dnsCheckResult struct {
+	Checked      bool   `json:"checked"`
+	PTR          string `json:"ptr"`
+	FCrDNS       bool   `json:"fcrdns"`
+	HeloResolves bool   `json:"heloResolves"`
+}
+
+// checkSender 在 MAIL FROM 阶段校验连接方，启用 REQUIRE_FCRDNS 时拒绝未通过的连接
+func checkSender(s *smtpSession) error {
+	if !config().CheckRDNS && !config().RequireFCrDNS {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsCheckTimeout)
+	defer cancel()
+
+	s.dns = dnsCheckResult{Checked: true}
+	s.dns.PTR, s.dns.FCrDNS = lookupFCrDNS(ctx, s.remoteIP)
+	s.dns.HeloResolves = heloResolves(ctx, s.helo)
+
+	if config().RequireFCrDNS && !s.dns.FCrDNS {
+		smtpLogger.Info("拒绝连接: 反向解析校验失败", "ip", s.remoteIP, "helo", s.helo)
+		return smtpReply{550, smtp.EnhancedCode{5, 7, 25}, "smtp_rdns_failed"}.err()
+	}
+	return nil
+}
+
+// lookupFCrDNS 查询 PTR 记录，并确认 PTR 域名能正向解析回同一 IP
+func lookupFCrDNS(ctx context.Context, ip string) (string, bool) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+	if err != nil || len(names) == 0 {
+		return "", false
+	}
+
+	for _, name := range names {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.String() == ip {
+				return strings.TrimSuffix(name, "."), true
+			}
+		}
+	}
+	return strings.TrimSuffix(names[0], "."), false
+}
+
+// heloResolves 判断 HELO 名称能否解析，地址字面量如 [1.2.3.4] 视为有效
+func heloResolves(ctx context.Context, helo string) bool {
+	if helo == "" {
+		return false
+	}
+	if strings.HasPrefix(helo, "[") && strings.HasSuffix(helo, "]") {
+		return net.ParseIP(strings.TrimPrefix(strings.Trim(helo, "[]"), "IPv6:")) != nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, helo)
+	return err == nil && len(addrs) > 0
+}
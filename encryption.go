@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// 静态加密：设置 ENCRYPTION_KEY 后，Redis、Postgres、bolt、内存存储的快照和对象存储中的正文、原始邮件、
+// 附件和内嵌图片用 AES-256-GCM 加密，读取时自动解密，接口返回的内容不变。内存存储本身不加密。
+// 每段密文都带有密钥 ID（密钥 SHA-256 的前 8 位十六进制）。ENCRYPTION_KEY 可以用逗号分隔多个密钥，
+// 第一个用于加密，其余只用于解密旧数据；轮换时把新密钥加到最前面，旧数据过期后再删除旧密钥。
+// 读到密文但没有对应的密钥时返回错误，不会把密文当作正文返回；未加密的旧数据照常读取
+
+// sealedPrefix 密文的前缀，其后为 "<密钥 ID>:" 和 nonce+密文。字符串字段中的 nonce+密文为 base64
+const sealedPrefix = "tmenc1:"
+
+// encryptionKey 一个解析后的密钥
+type encryptionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// encryptionKeys 启动时由 initEncryption 设置，第一个用于加密；为空时不加密
+var encryptionKeys []encryptionKey
+
+// errEncryptionKey 密文对应的密钥没有配置
+var errEncryptionKey = errors.New("邮件已加密，但没有配置对应的 ENCRYPTION_KEY")
+
+// parseEncryptionKeys 密钥为 32 字节，写成 base64 或 64 位十六进制
+func parseEncryptionKeys(values []string) ([]encryptionKey, error) {
+	var keys []encryptionKey
+	for _, v := range values {
+		raw, err := hex.DecodeString(v)
+		if err != nil || len(v) != 64 {
+			raw, err = base64.StdEncoding.DecodeString(v)
+		}
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("密钥应为 32 字节的 base64 或 64 位十六进制，可用 openssl rand -base64 32 生成")
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		keys = append(keys, encryptionKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+	}
+	return keys, nil
+}
+
+// initEncryption 启用静态加密，需在初始化存储之前调用。密钥已在 parseConfig 中校验
+func initEncryption() {
+	encryptionKeys, _ = parseEncryptionKeys(config().EncryptionKeys)
+	if len(encryptionKeys) == 0 {
+		return
+	}
+	ids := make([]string, len(encryptionKeys))
+	for i, k := range encryptionKeys {
+		ids[i] = k.id
+	}
+	log.Printf("已启用静态加密，加密密钥 ID %s，可解密的密钥 ID %s", ids[0], strings.Join(ids, ","))
+}
+
+// sealBytes 用当前密钥加密，未启用加密或内容为空时原样返回
+func sealBytes(plain []byte) ([]byte, error) {
+	if len(encryptionKeys) == 0 || len(plain) == 0 {
+		return plain, nil
+	}
+	key := encryptionKeys[0]
+	out := make([]byte, 0, len(sealedPrefix)+len(key.id)+1+key.aead.NonceSize()+len(plain)+key.aead.Overhead())
+	out = append(append(append(out, sealedPrefix...), key.id...), ':')
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return key.aead.Seal(out, nonce, plain, nil), nil
+}
+
+// openBytes 解密 sealBytes 的结果，不是密文时原样返回
+func openBytes(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sealedPrefix)) {
+		return data, nil
+	}
+	id, sealed, ok := bytes.Cut(data[len(sealedPrefix):], []byte(":"))
+	if !ok {
+		return nil, errors.New("密文格式无效")
+	}
+	return openSealed(string(id), sealed)
+}
+
+func sealString(plain string) (string, error) {
+	if len(encryptionKeys) == 0 || plain == "" {
+		return plain, nil
+	}
+	sealed, err := sealBytes([]byte(plain))
+	if err != nil {
+		return "", err
+	}
+	header := len(sealedPrefix) + len(encryptionKeys[0].id) + 1
+	return string(sealed[:header]) + base64.StdEncoding.EncodeToString(sealed[header:]), nil
+}
+
+func openString(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	id, encoded, ok := strings.Cut(value[len(sealedPrefix):], ":")
+	if !ok {
+		return "", errors.New("密文格式无效")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("密文格式无效")
+	}
+	plain, err := openSealed(id, sealed)
+	return string(plain), err
+}
+
+// openSealed 用 ID 对应的密钥解密 nonce+密文，没有该密钥时返回 errEncryptionKey
+func openSealed(id string, sealed []byte) ([]byte, error) {
+	for _, key := range encryptionKeys {
+		if key.id != id {
+			continue
+		}
+		if len(sealed) < key.aead.NonceSize() {
+			return nil, errors.New("密文格式无效")
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		plain, err := key.aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return nil, fmt.Errorf("解密失败（密钥 ID %s）: %v", id, err)
+		}
+		return plain, nil
+	}
+	return nil, fmt.Errorf("%w（密钥 ID %s）", errEncryptionKey, id)
+}
+
+// sealMail 加密正文、原始邮件、附件和内嵌图片，返回副本，不修改多个收件人共用的附件列表
+func sealMail(m mailContent) (mailContent, error) {
+	if len(encryptionKeys) == 0 {
+		return m, nil
+	}
+	var err error
+	if m.Text, err = sealString(m.Text); err != nil {
+		return m, err
+	}
+	if m.HTML, err = sealString(m.HTML); err != nil {
+		return m, err
+	}
+	if m.raw, err = sealBytes(m.raw); err != nil {
+		return m, err
+	}
+	m.Attachments = append([]attachment(nil), m.Attachments...)
+	for i := range m.Attachments {
+		if m.Attachments[i].data, err = sealBytes(m.Attachments[i].data); err != nil {
+			return m, err
+		}
+	}
+	m.inline = append([]inlinePart(nil), m.inline...)
+	for i := range m.inline {
+		if m.inline[i].data, err = sealBytes(m.inline[i].data); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// openMail 解密 sealMail 加密的字段，未加密的字段原样保留
+func openMail(m mailContent) (mailContent, error) {
+	var err error
+	if m.Text, err = openString(m.Text); err != nil {
+		return m, err
+	}
+	if m.HTML, err = openString(m.HTML); err != nil {
+		return m, err
+	}
+	if m.raw, err = openBytes(m.raw); err != nil {
+		return m, err
+	}
+	for i := range m.Attachments {
+		if m.Attachments[i].data, err = openBytes(m.Attachments[i].data); err != nil {
+			return m, err
+		}
+	}
+	for i := range m.inline {
+		if m.inline[i].data, err = openBytes(m.inline[i].data); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleExportMail 以 .eml 文件形式下载单封邮件，不会删除邮件
+func handleExportMail(c *gin.Context) {
+	mailHead := mailboxParam(c)
+	id := c.Param("id")
+
+	m, ok, err := mailStore.Get(mailHead, id)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": msg("mail_not_found")})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.eml"`, m.ID))
+	data := m.raw
+	if len(data) == 0 {
+		data = buildEML(m)
+	}
+	c.Data(200, "message/rfc822", data)
+}
+
+// handleExportMailbox 以 mbox（mboxrd）文件下载整个邮箱，按收信顺序从旧到新，不会删除邮件。
+// 逐封写出并刷新，不在内存中拼出整个文件；邮箱为空时返回空文件
+func handleExportMailbox(c *gin.Context) {
+	mailHead := mailboxParam(c)
+
+	mails, err := mailStore.List(mailHead)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "application/mbox")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.mbox"`, mailHead))
+	c.Status(200)
+
+	rc := http.NewResponseController(c.Writer)
+	w := bufio.NewWriter(c.Writer)
+	// List 最新在前
+	for i := len(mails) - 1; i >= 0; i-- {
+		extendDeadline(rc.SetWriteDeadline, config().HTTPWriteTimeout)
+		if err := writeMboxMessage(w, mails[i]); err != nil {
+			reqLogger(c).Warn("导出邮箱中断", "mailbox", mailHead, "error", err)
+			return
+		}
+		if err := w.Flush(); err != nil {
+			reqLogger(c).Warn("导出邮箱中断", "mailbox", mailHead, "error", err)
+			return
+		}
+		c.Writer.Flush()
+	}
+	reqLogger(c).Info("已导出邮箱", "mailbox", mailHead, "messages", len(mails))
+}
+
+// writeMboxMessage 写出一封邮件：From_ 分隔行、换行统一为 LF 的邮件内容、结尾空行。
+// 正文中以若干个 > 加 "From " 开头的行再加一个 >（mboxrd），读取时去掉一个即可还原
+func writeMboxMessage(w io.Writer, m mailContent) error {
+	data := m.raw
+	if len(data) == 0 {
+		data = buildEML(m)
+	}
+	sender := m.From
+	if sender == "" || strings.ContainsAny(sender, " \t") {
+		sender = "MAILER-DAEMON"
+	}
+	if _, err := fmt.Fprintf(w, "From %s %s\n", sender, m.ReceivedAt.UTC().Format(time.ANSIC)); err != nil {
+		return err
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			if _, err := io.WriteString(w, ">"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// buildEML 根据已保存的字段重建一封最小的 RFC822 邮件
+func buildEML(m mailContent) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Date: %s\r\n", m.ReceivedAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "From: <%s>\r\n", m.From)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", m.ID, config().SMTPHostname)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	switch {
+	case m.Text != "" && m.HTML != "":
+		w := multipart.NewWriter(&buf)
+		fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", w.Boundary())
+		writeQPPart(w, "text/plain; charset=utf-8", m.Text)
+		writeQPPart(w, "text/html; charset=utf-8", m.HTML)
+		w.Close()
+	case m.HTML != "":
+		writeQPBody(&buf, "text/html; charset=utf-8", m.HTML)
+	default:
+		writeQPBody(&buf, "text/plain; charset=utf-8", m.Text)
+	}
+	return buf.Bytes()
+}
+
+func writeQPPart(w *multipart.Writer, contentType, body string) {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write([]byte(body))
+	qp.Close()
+}
+
+func writeQPBody(buf *bytes.Buffer, contentType, body string) {
+	fmt.Fprintf(buf, "Content-Type: %s\r\n", contentType)
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(buf)
+	qp.Write([]byte(body))
+	qp.Close()
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 命令行参数：每个配置项都有同名参数，环境变量名转小写、下划线换成连字符，如 SMTP_PORT 对应 --smtp-port。
+// 优先级为 命令行参数 > 环境变量（包括 .env）> 配置文件 > 默认值。参数列表由 parseConfig 本身生成，
+// 新增配置项不需要另外登记，--help 中的默认值也与 parseConfig 一致
+
+var (
+	// flagValues 命令行中给出的配置项，键为环境变量名
+	flagValues map[string]string
+	// discovering 为 true 时 parseConfig 只登记读取的配置项和默认值，所有配置项都按未设置处理
+	discovering bool
+	// configOptions 登记的配置项，按 parseConfig 读取的顺序
+	configOptions []configOption
+)
+
+// configOption 一个配置项
+type configOption struct {
+	key          string
+	defaultValue string
+	isBool       bool
+}
+
+// flagAliases 常用参数的简写
+var flagAliases = map[string]string{
+	"domains": "ALLOWED_DOMAINS",
+	"config":  "CONFIG_FILE",
+}
+
+// configOptionUsage --help 中每个配置项的说明，详细说明见 .env 和 README
+var configOptionUsage = map[string]string{
+	"CONFIG_FILE":                "配置文件路径（YAML 或 TOML）",
+	"ALLOWED_DOMAINS":            "允许的域名，逗号分隔，支持 *.example.com 通配",
+	"SMTP_PORT":                  "SMTP 端口",
+	"HTTP_PORT":                  "HTTP 端口",
+	"HTTPS_PORT":                 "HTTPS 端口",
+	"SMTP_BIND":                  "SMTP/SMTPS/POP3/IMAP 监听的本机 IP",
+	"HTTP_BIND":                  "HTTP/HTTPS 和管理端口监听的本机 IP",
+	"CERT_FILE":                  "TLS 证书文件",
+	"KEY_FILE":                   "TLS 私钥文件",
+	"ENABLE_HTTPS":               "启用 HTTPS",
+	"ENABLE_AUTOCERT":            "通过 ACME 自动申请证书",
+	"HTTPS_HOSTNAMES":            "自动证书的主机名，逗号分隔",
+	"AUTOCERT_CACHE_DIR":         "自动证书的缓存目录",
+	"AUTOCERT_EMAIL":             "ACME 账户邮箱",
+	"ENABLE_STARTTLS":            "SMTP 支持 STARTTLS",
+	"ENABLE_SMTPS":               "启用隐式 TLS 的 SMTPS",
+	"SMTPS_PORT":                 "SMTPS 端口",
+	"HTTPS_REDIRECT":             "HTTP 请求重定向到 HTTPS",
+	"HTTPS_REDIRECT_HOST":        "重定向使用的主机名",
+	"HSTS_MAX_AGE":               "HSTS 有效期，0 为不发送",
+	"HSTS_INCLUDE_SUBDOMAINS":    "HSTS 包含子域名",
+	"CORS_ALLOWED_ORIGINS":       "CORS 允许的来源，逗号分隔",
+	"CORS_ALLOWED_METHODS":       "CORS 允许的方法",
+	"CORS_ALLOWED_HEADERS":       "CORS 允许的请求头",
+	"CORS_ALLOW_CREDENTIALS":     "CORS 允许携带凭据，来源不能为 *",
+	"CORS_MAX_AGE":               "预检结果缓存秒数",
+	"ADMIN_API_KEYS":             "管理接口 API Key，逗号分隔，留空禁用管理接口",
+	"ADMIN_PATH":                 "管理接口路径",
+	"ADMIN_PORT":                 "管理接口单独使用的端口",
+	"STORE_RAW":                  "保存原始邮件",
+	"CHECK_RDNS":                 "记录发件方的反向解析和 HELO 校验结果",
+	"REQUIRE_FCRDNS":             "拒收反向解析不一致的连接",
+	"GREYLIST":                   "启用灰名单",
+	"GREYLIST_DELAY":             "灰名单的最短重试间隔",
+	"GREYLIST_EXPIRY":            "灰名单记录的有效期",
+	"DEDUP_MODE":                 "重复邮件去重：" + dedupOff + "、" + dedupMailbox + "、" + dedupGlobal,
+	"DEDUP_WINDOW":               "去重的时间窗口",
+	"RATE_LIMIT_RPM":             "每个 IP 每分钟的请求数，0 为不限流",
+	"RATE_LIMIT_BURST":           "限流的突发数，默认等于每分钟请求数",
+	"CREATE_RATE_LIMIT_RPM":      "每个 IP 每分钟创建邮箱的次数，0 为不单独限流",
+	"CREATE_RATE_LIMIT_BURST":    "创建邮箱限流的突发数，默认等于每分钟次数",
+	"DNSBL_ZONES":                "DNSBL 查询的区域，逗号分隔",
+	"DNSBL_REJECT":               "拒收命中 DNSBL 的连接",
+	"SPAM_CHECK_URL":             "垃圾邮件评分的 HTTP 地址",
+	"SPAM_CHECK_COMMAND":         "垃圾邮件评分的命令",
+	"SPAM_CHECK_TIMEOUT":         "垃圾邮件评分的超时",
+	"SPAM_REJECT_THRESHOLD":      "拒收的垃圾邮件分数，0 为不拒收",
+	"SMTP_PROXY_PROTOCOL":        "SMTP 连接使用 PROXY 协议",
+	"TRUSTED_PROXIES":            "可信代理的 IP 或 CIDR，逗号分隔",
+	"REAL_IP_HEADERS":            "读取客户端 IP 的请求头",
+	"IMAGE_MODE":                 "外部图片：" + imageModeOriginal + "、" + imageModeBlocked + "、" + imageModeProxied,
+	"IMGPROXY_MAX_BYTES":         "图片代理的单张图片大小上限",
+	"BASE_PATH":                  "部署在子路径下时的路径前缀",
+	"COMPRESSION":                "压缩响应",
+	"COMPRESSION_MIN_BYTES":      "压缩响应的最小字节数",
+	"METRICS":                    "提供 /metrics",
+	"STATS_INTERVAL":             "定时打印统计的间隔，0 为不打印",
+	"ENABLE_PPROF":               "提供 /debug/pprof",
+	"CATCH_ALL":                  "接收允许域名下的任意地址",
+	"RECIPIENT_ALLOWLIST":        "关闭 catch-all 时接收的地址，逗号分隔",
+	"MAIL_TTL":                   "邮件保留时长，0 为不过期",
+	"MAX_MAILBOX_MESSAGES":       "每个邮箱最多保留的邮件数",
+	"MAX_MAILBOX_BYTES":          "每个邮箱最多保留的字节数",
+	"MAX_MAILBOXES":              "最多保留的邮箱数（memory）",
+	"DAILY_CLEANUP":              "按 CLEANUP_SCHEDULE 定时清空邮箱",
+	"CLEANUP_KEEP_LAST":          "定时清理时每个邮箱保留的最新邮件数",
+	"STORE_PARTS":                "保存的正文：" + storePartsBoth + "、" + storePartsText + "、" + storePartsHTML,
+	"ARCHIVE_DIR":                "归档过期邮件的目录",
+	"ARCHIVE_MAX_FILE_BYTES":     "单个归档文件的大小上限",
+	"ARCHIVE_RETENTION":          "归档文件的保留时长",
+	"STORE_BACKEND":              "邮件存储：memory、redis、postgres、bolt、maildir",
+	"REDIS_ADDR":                 "Redis 地址",
+	"REDIS_PASSWORD":             "Redis 密码",
+	"REDIS_DB":                   "Redis 数据库编号",
+	"REDIS_PREFIX":               "Redis 键前缀",
+	"BOLT_PATH":                  "bolt 数据文件",
+	"MAILDIR_PATH":               "Maildir 根目录",
+	"SNAPSHOT_PATH":              "内存存储的快照文件",
+	"POSTGRES_DSN":               "PostgreSQL 连接串",
+	"POSTGRES_MAX_CONNS":         "PostgreSQL 最大连接数",
+	"POSTGRES_STATEMENT_TIMEOUT": "PostgreSQL 语句超时",
+	"STORE_RETRY_BUFFER_BYTES":   "存储不可用时暂存邮件的字节数上限",
+	"STORE_RETRY_INTERVAL":       "存储重试间隔",
+	"S3_ENDPOINT":                "S3 地址",
+	"S3_BUCKET":                  "外置附件的 S3 存储桶",
+	"S3_REGION":                  "S3 区域",
+	"S3_ACCESS_KEY":              "S3 Access Key",
+	"S3_SECRET_KEY":              "S3 Secret Key",
+	"S3_PREFIX":                  "S3 对象键前缀",
+	"S3_TIMEOUT":                 "S3 请求超时",
+	"ATTACHMENT_OFFLOAD_BYTES":   "超过该大小的附件存到 S3",
+	"FORWARD_RULES":              "转发规则，如 a@example.com:b@example.org",
+	"FORWARD_SMTP_HOST":          "转发使用的 SMTP 服务器",
+	"FORWARD_SMTP_USER":          "转发 SMTP 用户名",
+	"FORWARD_SMTP_PASSWORD":      "转发 SMTP 密码",
+	"LEGACY_JSON":                "旧接口使用旧的 JSON 格式",
+	"LEGACY_EMPTY_MAIL":          "旧接口 getMail 在邮箱为空时返回 201",
+	"OPENAPI_UI":                 "提供 OpenAPI 文档页面",
+	"LOCALE":                     "接口错误和 SMTP 回复的语言：en 或 zh，为空时按 LANG",
+	"SMTP_IDLE_TIMEOUT":          "SMTP 连接空闲超时",
+	"SMTP_COMMAND_TIMEOUT":       "SMTP 单条命令超时",
+	"SMTP_TRANSACTION_TIMEOUT":   "SMTP 单封邮件的传输超时",
+	"INLINE_IMAGE_MODE":          "内嵌图片：" + inlineModeURL + " 或 " + inlineModeData,
+	"ENABLE_POP3":                "启用 POP3 取信",
+	"POP3_PORT":                  "POP3 端口",
+	"MAILBOX_TOKEN_SECRET":       "邮箱令牌的签名密钥，设置后 POP3/IMAP 的密码须为令牌",
+	"ENABLE_IMAP":                "启用 IMAP 取信",
+	"IMAP_PORT":                  "IMAP 端口",
+	"IMAP_READ_ONLY":             "IMAP 只读，不能删除邮件，只更新 \\Seen；false 时可以删除",
+	"ENCRYPTION_KEY":             "静态加密的密钥，逗号分隔，第一个用于加密",
+	"MAX_RCPT_PER_MESSAGE":       "每封邮件最多接受的收件人数，0 为不限制",
+	"LOG_LEVEL":                  "日志级别：debug、info、warn、error",
+	"LOG_FORMAT":                 "日志格式：text 或 json",
+	"LOG_LEGACY_FORMAT":          "保持旧的日志格式（将在下一个版本移除）",
+	"LOG_FILE":                   "日志文件路径，为空时写到标准错误",
+	"LOG_MAX_SIZE_MB":            "日志文件超过该大小（MB）时轮转，0 为不按大小轮转",
+	"LOG_MAX_BACKUPS":            "保留的旧日志文件数，0 为不限制",
+	"LOG_MAX_AGE_DAYS":           "旧日志文件保留天数，0 为不限制",
+	"WEB_UI":                     "提供网页界面",
+	"GRACEFUL_UPGRADE":           "SIGUSR2 时平滑升级",
+	"UPGRADE_TIMEOUT":            "平滑升级等待新进程的超时",
+	"HTTP_READ_HEADER_TIMEOUT":   "读取请求头的超时",
+	"HTTP_READ_TIMEOUT":          "读取请求的超时",
+	"HTTP_WRITE_TIMEOUT":         "写响应的超时",
+	"HTTP_IDLE_TIMEOUT":          "HTTP 连接空闲超时",
+	"HTTP_MAX_HEADER_BYTES":      "请求头大小上限",
+	"HTTP_MAX_BODY_BYTES":        "请求体大小上限",
+	"SHUTDOWN_TIMEOUT":           "停止时等待请求完成的超时",
+	"SMTP_HOSTNAME":              "SMTP 欢迎语和 EHLO 使用的主机名，默认为第一个非通配域名",
+	"FORWARD_FROM":               "转发邮件的发件人，默认为 forward@SMTP_HOSTNAME",
+	"DOMAIN_POLICIES":            "按域名的保留策略和大小上限",
+	"CLEANUP_SCHEDULE":           "定时清理的 cron 表达式",
+	"RELAY_REJECT_CODE":          "拒收非允许域名时的回复码",
+	"RELAY_REJECT_MESSAGE":       "拒收非允许域名时的回复内容",
+	"RECIPIENT_REJECT_CODE":      "拒收不存在的地址时的回复码",
+	"RECIPIENT_REJECT_MESSAGE":   "拒收不存在的地址时的回复内容",
+}
+
+// describeOption 登记配置项和默认值，只在 discovering 时生效，同一配置项以第一次登记为准
+func describeOption(key, defaultValue string, isBool bool) {
+	if !discovering {
+		return
+	}
+	for _, o := range configOptions {
+		if o.key == key {
+			return
+		}
+	}
+	configOptions = append(configOptions, configOption{key: key, defaultValue: defaultValue, isBool: isBool})
+}
+
+// discoverConfigOptions 以所有配置项都未设置的方式运行一次 parseConfig，得到全部配置项和默认值
+func discoverConfigOptions() []configOption {
+	if configOptions != nil {
+		return configOptions
+	}
+	configOptions = []configOption{{key: "CONFIG_FILE"}}
+	discovering = true
+	parseConfig()
+	discovering = false
+	configErrors = nil
+	return configOptions
+}
+
+// flagName SMTP_PORT -> smtp-port
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// configFlag 一个配置项对应的命令行参数，值写入 values
+type configFlag struct {
+	option configOption
+	values map[string]string
+}
+
+func (f *configFlag) String() string {
+	if f == nil || f.values == nil {
+		return ""
+	}
+	if v, ok := f.values[f.option.key]; ok {
+		return v
+	}
+	return f.option.defaultValue
+}
+
+// Set 布尔参数接受 strconv.ParseBool 支持的写法，统一保存为 true/false
+func (f *configFlag) Set(value string) error {
+	if f.option.isBool {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("不是有效的布尔值")
+		}
+		value = strconv.FormatBool(b)
+	}
+	f.values[f.option.key] = value
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.option.isBool
+}
+
+// parseFlags 解析命令行参数，返回给出的配置项（键为环境变量名）。--help 时打印用法并返回 flag.ErrHelp，
+// 其余错误也已打印到 output
+func parseFlags(args []string, output io.Writer) (map[string]string, error) {
+	values := map[string]string{}
+	fs := flag.NewFlagSet("tempmail", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	options := discoverConfigOptions()
+	flags := map[string]*configFlag{}
+	for _, o := range options {
+		flags[o.key] = &configFlag{option: o, values: values}
+		fs.Var(flags[o.key], flagName(o.key), optionUsage(o))
+	}
+	for alias, key := range flagAliases {
+		fs.Var(flags[key], alias, "同 --"+flagName(key))
+	}
+	fs.Usage = func() { printUsage(output, fs, options) }
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		err := fmt.Errorf("无法识别的参数: %s", strings.Join(fs.Args(), " "))
+		fmt.Fprintln(output, err)
+		return nil, err
+	}
+	return values, nil
+}
+
+// optionUsage 参数说明，附上对应的环境变量和默认值。说明中已写明默认值的（默认值由其他配置项推出）不再重复
+func optionUsage(o configOption) string {
+	usage := configOptionUsage[o.key]
+	explained := strings.Contains(usage, "默认")
+	if usage != "" {
+		usage += "，"
+	}
+	usage += "环境变量 " + o.key
+	if o.defaultValue != "" && !explained && !(o.isBool && o.defaultValue == "false") {
+		usage += "，默认 " + o.defaultValue
+	}
+	return usage
+}
+
+// printUsage 按 parseConfig 读取的顺序列出参数，简写列在最后
+func printUsage(w io.Writer, fs *flag.FlagSet, options []configOption) {
+	fmt.Fprintln(w, "用法: tempmail [参数]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "每个参数对应一个同名环境变量，优先级为 命令行参数 > 环境变量（包括 .env）> 配置文件 > 默认值。")
+	fmt.Fprintln(w, "布尔参数可以只写参数名，如 --enable-pop3，关闭时写 --catch-all=false。")
+	fmt.Fprintln(w, "")
+	printFlag := func(name string) {
+		f := fs.Lookup(name)
+		arg := " value"
+		if f.Value.(*configFlag).IsBoolFlag() {
+			arg = ""
+		}
+		fmt.Fprintf(w, "  --%s%s\n        %s\n", name, arg, f.Usage)
+	}
+	for _, o := range options {
+		printFlag(flagName(o.key))
+	}
+	for _, alias := range []string{"config", "domains"} {
+		printFlag(alias)
+	}
+}
+
+var configKeyPattern = regexp.MustCompile(`\b[A-Z][A-Z0-9_]+\b`)
+
+// withFlagNames 在配置错误中的配置项后注明对应的命令行参数，如 CERT_FILE（--cert-file）
+func withFlagNames(msg string) string {
+	known := map[string]bool{}
+	for _, o := range configOptions {
+		known[o.key] = true
+	}
+	return configKeyPattern.ReplaceAllStringFunc(msg, func(key string) string {
+		if !known[key] {
+			return key
+		}
+		return key + "（--" + flagName(key) + "）"
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useFlags 解析 args 作为命令行参数，测试结束后恢复
+func useFlags(t *testing.T, args ...string) {
+	t.Helper()
+	values, err := parseFlags(args, new(bytes.Buffer))
+	if err != nil {
+		t.Fatalf("parseFlags(%q): %v", args, err)
+	}
+	old := flagValues
+	flagValues = values
+	t.Cleanup(func() { flagValues = old })
+}
+
+func TestParseFlags(t *testing.T) {
+	values, err := parseFlags([]string{"--smtp-port", "2525", "--http-port=8080", "--domains", "test.local",
+		"--enable-pop3", "--catch-all=false", "-store-raw=1", "--config", "tempmail.yaml"}, new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"SMTP_PORT": "2525", "HTTP_PORT": "8080", "ALLOWED_DOMAINS": "test.local",
+		"ENABLE_POP3": "true", "CATCH_ALL": "false", "STORE_RAW": "true", "CONFIG_FILE": "tempmail.yaml"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("parseFlags = %v，应为 %v", values, want)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--no-such-flag"}, "no-such-flag"},
+		{[]string{"--enable-pop3=maybe"}, "不是有效的布尔值"},
+		{[]string{"--smtp-port"}, "smtp-port"},
+		{[]string{"--http-port", "8080", "extra"}, "无法识别的参数: extra"},
+	} {
+		var out bytes.Buffer
+		if _, err := parseFlags(tc.args, &out); err == nil || !strings.Contains(out.String(), tc.want) {
+			t.Errorf("parseFlags(%q) = %v，输出 %q 应包含 %q", tc.args, err, out.String(), tc.want)
+		}
+	}
+}
+
+// TestFlagsHelp --help 由登记的配置项生成，每个配置项都有参数、说明和默认值
+func TestFlagsHelp(t *testing.T) {
+	var out bytes.Buffer
+	if _, err := parseFlags([]string{"--help"}, &out); err != flag.ErrHelp {
+		t.Fatalf("--help 返回 %v", err)
+	}
+	help := out.String()
+	for _, o := range discoverConfigOptions() {
+		if !strings.Contains(help, "--"+flagName(o.key)) || !strings.Contains(help, "环境变量 "+o.key) {
+			t.Errorf("--help 中没有 %s", o.key)
+		}
+		if configOptionUsage[o.key] == "" {
+			t.Errorf("%s 没有说明", o.key)
+		}
+	}
+	for _, want := range []string{"--smtp-port value", "默认 25", "--enable-pop3\n", "--domains value", "同 --allowed-domains"} {
+		if !strings.Contains(help, want) {
+			t.Errorf("--help 中没有 %q", want)
+		}
+	}
+	// 说明中列出的配置项都要被 parseConfig 读取，否则 --help 与实际不符
+	known := map[string]bool{}
+	for _, o := range discoverConfigOptions() {
+		known[o.key] = true
+	}
+	for key := range configOptionUsage {
+		if !known[key] {
+			t.Errorf("%s 有说明但 parseConfig 没有读取", key)
+		}
+	}
+}
+
+// TestFlagsHelpValues --help 中列出的每个可选值都能通过对应参数解析，不会报配置错误
+func TestFlagsHelpValues(t *testing.T) {
+	t.Setenv("ALLOWED_DOMAINS", "test.local")
+	t.Setenv("POSTGRES_DSN", "postgres://localhost/tempmail")
+	for _, key := range []string{"DEDUP_MODE", "IMAGE_MODE", "STORE_PARTS", "STORE_BACKEND", "LOCALE",
+		"INLINE_IMAGE_MODE", "LOG_LEVEL", "LOG_FORMAT"} {
+		_, list, ok := strings.Cut(configOptionUsage[key], "：")
+		if !ok {
+			t.Fatalf("%s 的说明中没有可选值: %q", key, configOptionUsage[key])
+		}
+		list, _, _ = strings.Cut(list, "，")
+		for _, value := range strings.FieldsFunc(list, func(r rune) bool { return r == '、' || r == ' ' || r == '或' }) {
+			useFlags(t, "--"+flagName(key)+"="+value)
+			configErrors = nil
+			parseConfig()
+			if len(configErrors) != 0 {
+				t.Errorf("--%s=%s: 配置错误 %q", flagName(key), value, configErrors)
+			}
+		}
+	}
+	configErrors = nil
+}
+
+// TestFlagPrecedence 命令行参数 > 环境变量 > 配置文件 > 默认值
+func TestFlagPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tempmail.yaml")
+	os.WriteFile(path, []byte("smtp_port: 2001\nhttp_port: 2002\nhttps_port: 2003\n"), 0o600)
+	useFlags(t, "--config", path, "--smtp-port", "3001")
+	cfg := newTestConfig(t, map[string]string{"SMTP_PORT": "4001", "HTTP_PORT": "4002"})
+	if cfg.SMTPPort != "3001" || cfg.HTTPPort != "4002" || cfg.HTTPSPort != "2003" || cfg.SMTPSPort != "465" {
+		t.Errorf("SMTP %s，HTTP %s，HTTPS %s，SMTPS %s", cfg.SMTPPort, cfg.HTTPPort, cfg.HTTPSPort, cfg.SMTPSPort)
+	}
+
+	// --config 优先于 CONFIG_FILE
+	other := filepath.Join(t.TempDir(), "other.yaml")
+	os.WriteFile(other, []byte("https_port: 5003\n"), 0o600)
+	if cfg := newTestConfig(t, map[string]string{"CONFIG_FILE": other}); cfg.HTTPSPort != "2003" {
+		t.Errorf("--config 应优先于 CONFIG_FILE: HTTPS %s", cfg.HTTPSPort)
+	}
+}
+
+// TestFlagConfigErrors 使用了命令行参数时配置错误中注明对应的参数名
+func TestFlagConfigErrors(t *testing.T) {
+	useFlags(t, "--enable-https", "--cert-file", filepath.Join(t.TempDir(), "missing.pem"))
+	t.Setenv("ALLOWED_DOMAINS", "test.local")
+	configErrors = nil
+	parseConfig()
+	defer func() { configErrors = nil }()
+	var msgs []string
+	for _, msg := range configErrors {
+		msgs = append(msgs, withFlagNames(msg))
+	}
+	joined := strings.Join(msgs, "；")
+	if !strings.Contains(joined, "CERT_FILE（--cert-file）") || !strings.Contains(joined, "KEY_FILE（--key-file）") {
+		t.Errorf("配置错误 %q 应注明参数名", joined)
+	}
+
+	if got := withFlagNames("ENABLE_AUTOCERT 与 CERT_FILE/KEY_FILE 不能同时配置，HTTPS 端口"); got !=
+		"ENABLE_AUTOCERT（--enable-autocert） 与 CERT_FILE（--cert-file）/KEY_FILE（--key-file） 不能同时配置，HTTPS 端口" {
+		t.Errorf("withFlagNames = %q", got)
+	}
+}
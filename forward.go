@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	netsmtp "net/smtp"
+	"strings"
+	"time"
+)
+
+const (
+	forwardQueueSize   = 100
+	forwardWorkers     = 2
+	forwardMaxAttempts = 5
+)
+
+// forwardJob 一次转发任务
+type forwardJob struct {
+	rcpt    string
+	dest    string
+	raw     []byte
+	traceID string
+	attempt int
+}
+
+var forwardQueue = make(chan forwardJob, forwardQueueSize)
+
+// parseForwardRules 解析 local_part:forward_address 列表
+func parseForwardRules(value string) map[string]string {
+	rules := make(map[string]string)
+	for _, item := range splitList(value) {
+		local, dest, ok := strings.Cut(item, ":")
+		if !ok || strings.TrimSpace(local) == "" || !strings.Contains(dest, "@") {
+			forwardLogger.Warn("忽略无效的转发规则", "rule", item)
+			continue
+		}
+		rules[strings.ToLower(strings.TrimSpace(local))] = strings.TrimSpace(dest)
+	}
+	return rules
+}
+
+func startForwarder() {
+	if len(config().ForwardRules) == 0 {
+		return
+	}
+	if config().ForwardSMTPHost == "" {
+		forwardLogger.Warn("已配置转发规则但未设置 FORWARD_SMTP_HOST，转发不会生效")
+		return
+	}
+	for i := 0; i < forwardWorkers; i++ {
+		go func() {
+			for job := range forwardQueue {
+				deliverForward(job)
+			}
+		}()
+	}
+	log.Printf("已启用邮件转发，共 %d 条规则", len(config().ForwardRules))
+}
+
+// forwardMessage 收件人命中转发规则时异步转发，不影响本地保存
+func forwardMessage(rcpt string, raw []byte, traceID string) {
+	if config().ForwardSMTPHost == "" {
+		return
+	}
+	local := strings.ToLower(rcpt)
+	if i := strings.LastIndex(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+	dest, ok := config().ForwardRules[local]
+	if !ok {
+		return
+	}
+	enqueueForward(forwardJob{rcpt: rcpt, dest: dest, raw: raw, traceID: traceID})
+}
+
+func enqueueForward(job forwardJob) {
+	select {
+	case forwardQueue <- job:
+	default:
+		forwardLogger.Error("转发队列已满，放弃转发", "delivery_id", job.traceID, "mailbox", job.rcpt, "dest", job.dest)
+	}
+}
+
+// deliverForward 发送失败时按指数退避重试
+func deliverForward(job forwardJob) {
+	job.attempt++
+	err := netsmtp.SendMail(config().ForwardSMTPHost, forwardAuth(), config().ForwardFrom, []string{job.dest}, resentMessage(job))
+	if err == nil {
+		forwardLogger.Info("已转发邮件", "delivery_id", job.traceID, "mailbox", job.rcpt, "dest", job.dest)
+		return
+	}
+
+	if job.attempt >= forwardMaxAttempts {
+		forwardLogger.Error("转发失败，已放弃", "delivery_id", job.traceID, "mailbox", job.rcpt, "dest", job.dest, "error", err)
+		return
+	}
+	delay := time.Duration(1<<(job.attempt-1)) * time.Minute
+	forwardLogger.Warn("转发失败，稍后重试", "delivery_id", job.traceID, "mailbox", job.rcpt, "dest", job.dest, "retry_in", delay, "error", err)
+	time.AfterFunc(delay, func() { enqueueForward(job) })
+}
+
+func forwardAuth() netsmtp.Auth {
+	if config().ForwardSMTPUser == "" {
+		return nil
+	}
+	host := config().ForwardSMTPHost
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	return netsmtp.PlainAuth("", config().ForwardSMTPUser, config().ForwardSMTPPassword, host)
+}
+
+// resentMessage 保留原始邮件头，在最前面加上 Resent-* 头
+func resentMessage(job forwardJob) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Resent-From: <%s>\r\n", config().ForwardFrom)
+	fmt.Fprintf(&buf, "Resent-To: <%s>\r\n", job.dest)
+	fmt.Fprintf(&buf, "Resent-Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Resent-Message-ID: <%s.%s@%s>\r\n", job.traceID, newMailID(), config().SMTPHostname)
+	buf.Write(job.raw)
+	return buf.Bytes()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// greylistEntry 记录一个 (IP, 发件人, 收件人) 三元组
+type greylistEntry struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// greylist 由 greylistMu 保护，存储不实现 greylistBackend 时使用
+var (
+	greylist   = make(map[string]greylistEntry)
+	greylistMu sync.Mutex
+)
+
+var errGreylisted = smtpReply{451, smtp.EnhancedCode{4, 7, 1}, "smtp_greylisted"}
+
+// greylistBackend 共享存储（Redis、Postgres）实现它，灰名单记录保存在存储中，
+// 发件方重试时连到另一个实例也能放行
+type greylistBackend interface {
+	// greylistSeen 记下三元组在 now 出现，返回它第一次出现的时间；超过 expiry 没有出现过的记录作废，从 now 重新计时
+	greylistSeen(key string, now time.Time, expiry time.Duration) (time.Time, error)
+	// pruneGreylist 删除 before 之后没有出现过的记录
+	pruneGreylist(before time.Time) error
+}
+
+// greylistCheck 首次出现的三元组暂时拒绝，超过延迟后重试才接收
+func greylistCheck(ip, from, to string) error {
+	if !config().Greylist {
+		return nil
+	}
+
+	key := ip + "|" + strings.ToLower(from) + "|" + strings.ToLower(to)
+	// 共享存储中的时间精确到毫秒，比较首次出现时间时需要一致
+	now := time.Now().Truncate(time.Millisecond)
+
+	firstSeen, err := greylistSeen(key, now)
+	if err != nil {
+		smtpLogger.Error("灰名单: 读取记录失败", "ip", ip, "error", err)
+		return errStoreUnavailable.err()
+	}
+	if firstSeen.Equal(now) {
+		smtpLogger.Info("灰名单: 暂时拒绝", "ip", ip, "from", from, "mailbox", to)
+		return errGreylisted.err()
+	}
+	if now.Sub(firstSeen) < config().GreylistDelay {
+		return errGreylisted.err()
+	}
+	return nil
+}
+
+// greylistSeen 记下三元组本次出现，返回第一次出现的时间，首次出现（或记录已过期）时即为 now
+func greylistSeen(key string, now time.Time) (time.Time, error) {
+	if b, ok := backendStore().(greylistBackend); ok {
+		return b.greylistSeen(key, now, config().GreylistExpiry)
+	}
+
+	greylistMu.Lock()
+	defer greylistMu.Unlock()
+	entry, ok := greylist[key]
+	if !ok || now.Sub(entry.lastSeen) > config().GreylistExpiry {
+		entry.firstSeen = now
+	}
+	entry.lastSeen = now
+	greylist[key] = entry
+	return entry.firstSeen, nil
+}
+
+// pruneGreylist 清理过期的灰名单记录
+func pruneGreylist(now time.Time) {
+	if b, ok := backendStore().(greylistBackend); ok {
+		if err := b.pruneGreylist(now.Add(-config().GreylistExpiry)); err != nil {
+			cleanupLogger.Error("清理灰名单失败", "error", err)
+		}
+		return
+	}
+	greylistMu.Lock()
+	defer greylistMu.Unlock()
+	for key, entry := range greylist {
+		if now.Sub(entry.lastSeen) > config().GreylistExpiry {
+			delete(greylist, key)
+		}
+	}
+}
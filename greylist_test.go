@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testGreylistTimeline 按有效期 1 小时检查首次出现时间的计算，advance 把存储的时钟同步向前拨
+func testGreylistTimeline(t *testing.T, advance func(time.Duration)) {
+	t.Helper()
+	start := time.Now().Truncate(time.Millisecond)
+	var elapsed time.Duration
+	for _, step := range []struct {
+		after time.Duration
+		first time.Duration
+	}{
+		{0, 0},
+		{30 * time.Second, 0},
+		{2 * time.Minute, 0},
+		// 上次出现后 1 小时内再次出现，仍按最早一次计时
+		{61 * time.Minute, 0},
+		// 超过 1 小时没有出现，从这次重新计时
+		{3 * time.Hour, 3 * time.Hour},
+	} {
+		advance(step.after - elapsed)
+		elapsed = step.after
+		got, err := greylistSeen("1.2.3.4|a@example.com|u@test.local", start.Add(step.after))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := start.Add(step.first); !got.Equal(want) {
+			t.Errorf("%v 时首次出现时间为 %v，应为 %v", step.after, got.Sub(start), step.first)
+		}
+	}
+}
+
+func TestGreylistMemory(t *testing.T) {
+	setupTest(t, map[string]string{"GREYLIST": "true", "GREYLIST_EXPIRY": "1h"})
+	t.Cleanup(func() { greylist = make(map[string]greylistEntry) })
+	testGreylistTimeline(t, func(time.Duration) {})
+}
+
+// TestGreylistRedis 记录保存在 Redis 中，两个实例共用；有效期靠键的过期时间
+func TestGreylistRedis(t *testing.T) {
+	mr, rs := startTestRedis(t, map[string]string{"GREYLIST": "true", "GREYLIST_EXPIRY": "1h"})
+	testGreylistTimeline(t, mr.FastForward)
+
+	if err := greylistCheck("5.6.7.8", "a@example.com", "u@test.local"); err == nil {
+		t.Fatal("首次出现应暂时拒绝")
+	}
+	// 另一个实例看到同一条记录
+	other := newRedisStore()
+	defer other.client.Close()
+	first, err := other.greylistSeen("5.6.7.8|a@example.com|u@test.local", time.Now().Add(2*time.Minute), time.Hour)
+	if err != nil || time.Since(first) > time.Minute {
+		t.Fatalf("另一个实例取到的首次出现时间 %v, %v", first, err)
+	}
+
+	mr.FastForward(61 * time.Minute)
+	if mr.Exists(rs.key("greylist", "5.6.7.8|a@example.com|u@test.local")) {
+		t.Error("超过有效期后记录应过期")
+	}
+}
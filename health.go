@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const storeCheckTimeout = time.Second
+
+// listenerState 记录 SMTP 监听状态，供就绪检查使用
+var (
+	smtpStateMu sync.RWMutex
+	smtpBound   bool
+	smtpErr     error
+)
+
+func setSMTPState(bound bool, err error) {
+	smtpStateMu.Lock()
+	smtpBound, smtpErr = bound, err
+	smtpStateMu.Unlock()
+}
+
+// handleHealthz 存活检查，只要 HTTP 在服务就返回 200
+func handleHealthz(c *gin.Context) {
+	c.JSON(200, statusResponse{Status: "ok"})
+}
+
+// handleReadyz 就绪检查：SMTP 已监听且存储可用
+func handleReadyz(c *gin.Context) {
+	smtpStateMu.RLock()
+	bound, err := smtpBound, smtpErr
+	smtpStateMu.RUnlock()
+
+	if !bound {
+		reason := "SMTP 未监听"
+		if err != nil {
+			reason = "SMTP 启动失败: " + err.Error()
+		}
+		c.JSON(503, statusResponse{Status: "unavailable", Reason: reason})
+		return
+	}
+	if !storeUsable() {
+		c.JSON(503, statusResponse{Status: "unavailable", Reason: "存储不可用"})
+		return
+	}
+	c.JSON(200, statusResponse{Status: "ok"})
+}
+
+// storeUsable 确认存储能在超时内正常响应（内存存储能拿到读锁，网络存储能连通）
+func storeUsable() bool {
+	done := make(chan error, 1)
+	go func() {
+		_, err := mailStore.Stats(time.Now())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(storeCheckTimeout):
+		return false
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingStatsStore Stats 总是失败，模拟连不上的存储
+type failingStatsStore struct {
+	MailStore
+}
+
+func (failingStatsStore) Stats(time.Time) (storeStats, error) {
+	return storeStats{}, errors.New("connection refused")
+}
+
+func TestHealthProbes(t *testing.T) {
+	setupTest(t, nil)
+	t.Cleanup(func() { setSMTPState(false, nil) })
+	r := newRouter()
+
+	probe := func(path string) (int, statusResponse) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var resp statusResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	if code, resp := probe("/healthz"); code != 200 || resp.Status != "ok" {
+		t.Errorf("healthz = %d %+v", code, resp)
+	}
+
+	setSMTPState(false, nil)
+	if code, resp := probe("/readyz"); code != 503 || resp.Reason != "SMTP 未监听" {
+		t.Errorf("SMTP 未监听时 readyz = %d %+v", code, resp)
+	}
+	setSMTPState(false, errors.New("address already in use"))
+	if code, resp := probe("/readyz"); code != 503 || !strings.Contains(resp.Reason, "address already in use") {
+		t.Errorf("SMTP 启动失败时 readyz = %d %+v", code, resp)
+	}
+
+	setSMTPState(true, nil)
+	if code, resp := probe("/readyz"); code != 200 || resp.Status != "ok" {
+		t.Errorf("就绪后 readyz = %d %+v", code, resp)
+	}
+
+	mailStore = failingStatsStore{mailStore}
+	if code, resp := probe("/readyz"); code != 503 || resp.Reason != "存储不可用" {
+		t.Errorf("存储不可用时 readyz = %d %+v", code, resp)
+	}
+	// 存活检查不依赖存储
+	if code, _ := probe("/healthz"); code != 200 {
+		t.Errorf("存储不可用时 healthz = %d", code)
+	}
+}
+
+func TestHealthProbesOnAdminPort(t *testing.T) {
+	setupTest(t, map[string]string{"ADMIN_PORT": "9090"})
+	t.Cleanup(func() { setSMTPState(false, nil) })
+	setSMTPState(true, nil)
+	r := newAdminRouter()
+	for _, path := range []string{"/healthz", "/readyz"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != 200 {
+			t.Errorf("管理端口 %s = %d", path, w.Code)
+		}
+	}
+}
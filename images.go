@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/html"
+)
+
+// 远程图片处理模式
+const (
+	imageModeOriginal = "original"
+	imageModeBlocked  = "blocked"
+	imageModeProxied  = "proxied"
+)
+
+const (
+	imgProxyTimeout    = 10 * time.Second
+	imgProxyCacheTTL   = 10 * time.Minute
+	imgProxyCacheLimit = 256
+)
+
+// imageMode 取请求指定的图片模式，未指定或无效时使用服务端默认值
+func imageMode(c *gin.Context) string {
+	switch mode := c.Query("images"); mode {
+	case imageModeOriginal, imageModeBlocked, imageModeProxied:
+		return mode
+	}
+	return config().ImageMode
+}
+
+// rewriteRemoteImages 按模式改写 HTML 中的远程图片，防止追踪像素泄露读信人 IP。
+// 只有 blocked 和 proxied 会改写，其他值原样返回，不会被当作代理
+func rewriteRemoteImages(body, mode string) string {
+	if body == "" || (mode != imageModeBlocked && mode != imageModeProxied) {
+		return body
+	}
+
+	var out bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := z.Raw()
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(raw)
+			continue
+		}
+
+		tok := z.Token()
+		src := -1
+		if tok.Data == "img" {
+			for i, attr := range tok.Attr {
+				if attr.Key == "src" && isRemoteURL(attr.Val) {
+					src = i
+				}
+			}
+		}
+		if src < 0 {
+			out.Write(raw)
+			continue
+		}
+
+		switch mode {
+		case imageModeBlocked:
+			alt := "remote image"
+			for _, attr := range tok.Attr {
+				if attr.Key == "alt" && attr.Val != "" {
+					alt = attr.Val
+				}
+			}
+			fmt.Fprintf(&out, `<span class="blocked-image">[%s]</span>`, html.EscapeString(alt))
+		case imageModeProxied:
+			tok.Attr[src].Val = config().BasePath + "/imgproxy?src=" + url.QueryEscape(tok.Attr[src].Val)
+			out.WriteString(tok.String())
+		}
+	}
+	return out.String()
+}
+
+func isRemoteURL(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "//")
+}
+
+// safeImageType 只接受位图类型，SVG 可以携带脚本
+func safeImageType(contentType string) bool {
+	return strings.HasPrefix(contentType, "image/") && contentType != "image/svg+xml"
+}
+
+type cachedImage struct {
+	contentType string
+	data        []byte
+	expires     time.Time
+}
+
+var (
+	imgCache   = make(map[string]cachedImage)
+	imgCacheMu sync.Mutex
+)
+
+// imgProxyClient 只连接公网地址，连接时校验实际 IP，防止 SSRF 和 DNS 重绑定
+var imgProxyClient = &http.Client{
+	Timeout: imgProxyTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: imgProxyTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+					return errors.New("禁止访问内网地址")
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("重定向次数过多")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errors.New("不支持的协议")
+		}
+		return nil
+	},
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// handleImgProxy 代理获取远程图片，限制大小和类型并缓存
+func handleImgProxy(c *gin.Context) {
+	src := c.Query("src")
+	if strings.HasPrefix(src, "//") {
+		src = "https:" + src
+	}
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.JSON(400, gin.H{"error": msg("invalid_image_url")})
+		return
+	}
+
+	now := time.Now()
+	imgCacheMu.Lock()
+	img, ok := imgCache[src]
+	imgCacheMu.Unlock()
+	if !ok || now.After(img.expires) {
+		img, err = fetchImage(c.Request.Context(), src)
+		if err != nil {
+			reqLogger(c).Warn("图片代理获取失败", "src", src, "error", err)
+			c.JSON(502, gin.H{"error": msg("image_fetch_failed")})
+			return
+		}
+		img.expires = now.Add(imgProxyCacheTTL)
+		storeCachedImage(src, img, now)
+	}
+
+	c.Header("Cache-Control", "private, max-age=600")
+	c.Header("Content-Security-Policy", "default-src 'none'")
+	c.Data(200, img.contentType, img.data)
+}
+
+func fetchImage(ctx context.Context, src string) (cachedImage, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", src, nil)
+	if err != nil {
+		return cachedImage{}, err
+	}
+	resp, err := imgProxyClient.Do(req)
+	if err != nil {
+		return cachedImage{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return cachedImage{}, fmt.Errorf("状态码 %d", resp.StatusCode)
+	}
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+	if !safeImageType(contentType) {
+		return cachedImage{}, fmt.Errorf("不支持的类型 %q", contentType)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, config().ImgProxyMaxBytes+1))
+	if err != nil {
+		return cachedImage{}, err
+	}
+	if int64(len(data)) > config().ImgProxyMaxBytes {
+		return cachedImage{}, errors.New("图片过大")
+	}
+	return cachedImage{contentType: contentType, data: data}, nil
+}
+
+func storeCachedImage(src string, img cachedImage, now time.Time) {
+	imgCacheMu.Lock()
+	defer imgCacheMu.Unlock()
+
+	if len(imgCache) >= imgProxyCacheLimit {
+		for key, cached := range imgCache {
+			if now.After(cached.expires) {
+				delete(imgCache, key)
+			}
+		}
+	}
+	if len(imgCache) >= imgProxyCacheLimit {
+		return
+	}
+	imgCache[src] = img
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteRemoteImages(t *testing.T) {
+	setupTest(t, nil)
+	const body = `<p>hi</p><img src="https://track.example.com/p.gif" alt="logo"><img src="cid:inline">`
+	for _, tc := range []struct {
+		mode, want, absent string
+	}{
+		{imageModeOriginal, `src="https://track.example.com/p.gif"`, "imgproxy"},
+		{imageModeBlocked, `<span class="blocked-image">[logo]</span>`, "track.example.com"},
+		{imageModeProxied, "/imgproxy?src=https%3A%2F%2Ftrack.example.com%2Fp.gif", `src="https://`},
+		// 未知的模式原样返回，不会走代理
+		{"proxy", `src="https://track.example.com/p.gif"`, "imgproxy"},
+	} {
+		out := rewriteRemoteImages(body, tc.mode)
+		if !strings.Contains(out, tc.want) || strings.Contains(out, tc.absent) {
+			t.Errorf("%s: 得到 %s", tc.mode, out)
+		}
+		if !strings.Contains(out, `src="cid:inline"`) {
+			t.Errorf("%s: 非远程图片不应改写: %s", tc.mode, out)
+		}
+	}
+}
+
+// TestImageModeConfig 无效的 IMAGE_MODE 作为配置错误报告，不会带着它启动
+func TestImageModeConfig(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		ok   bool
+	}{
+		{imageModeOriginal, true},
+		{imageModeBlocked, true},
+		{imageModeProxied, true},
+		{"proxy", false},
+		{"block", false},
+	} {
+		t.Setenv("ALLOWED_DOMAINS", "test.local")
+		t.Setenv("IMAGE_MODE", tc.mode)
+		configErrors = nil
+		parseConfig()
+		if ok := len(configErrors) == 0; ok != tc.ok || (!ok && !strings.Contains(configErrors[0], "IMAGE_MODE")) {
+			t.Errorf("IMAGE_MODE=%s: 配置错误 %q", tc.mode, configErrors)
+		}
+	}
+	configErrors = nil
+}
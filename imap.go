@@ -0,0 +1,1253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// IMAP：开启 ENABLE_IMAP 后在 IMAP_PORT 上提供精简的 IMAP4rev1（RFC 3501）服务，只有一个 INBOX，
+// 用户名为邮箱地址，密码任意。SELECT 时取邮箱当前邮件的快照，UID 为存储分配的邮件序号，UIDVALIDITY 取自存储，
+// 重新 SELECT、断线重连都不变，客户端可以只取新邮件。\Seen 对应邮件的已读状态，
+// \Deleted 只在会话内有效，EXPUNGE 或 CLOSE 时才从存储中删除。默认 IMAP_READ_ONLY=true，不能删除邮件，
+// 唯一的写操作是 \Seen；EXAMINE 打开时 \Seen 也不改。
+// 没有使用 go-imap：v1 只做维护，v2 仍是 beta，而这里只需要单个 INBOX 的一小部分命令，
+// 自己解析可以直接沿用 POP3 的邮件数据、令牌校验和会话计数，不为此再引入一组依赖
+
+const (
+	// imapIdleTimeout 两条命令之间的最长间隔，RFC 3501 要求不少于 30 分钟
+	imapIdleTimeout = 30 * time.Minute
+	// imapMaxLiteral 客户端发送的 literal 上限，不支持 APPEND，只有 LOGIN 等命令的参数会用到
+	imapMaxLiteral = 8 * 1024
+)
+
+// imapLastUIDValidity 上一次按会话编号时分配的 UIDVALIDITY，保证同一进程内不重复
+var imapLastUIDValidity atomic.Uint32
+
+// nextUIDValidity 按会话编号时取当前秒数作为 UIDVALIDITY，同一秒内多次 SELECT 时依次加一
+func nextUIDValidity() uint32 {
+	for {
+		last := imapLastUIDValidity.Load()
+		next := uint32(time.Now().Unix())
+		if next <= last {
+			next = last + 1
+		}
+		if imapLastUIDValidity.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// imapMessage 已选中邮箱中的一封邮件，data 为 CRLF 换行的原始邮件
+type imapMessage struct {
+	uid     uint32
+	mail    mailContent
+	data    []byte
+	deleted bool
+}
+
+func (m *imapMessage) flags() string {
+	var flags []string
+	if m.mail.Read {
+		flags = append(flags, `\Seen`)
+	}
+	if m.deleted {
+		flags = append(flags, `\Deleted`)
+	}
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+type imapSession struct {
+	conn     net.Conn
+	tp       *textproto.Conn
+	remoteIP string
+	tls      bool
+
+	user string
+	// 已选中 INBOX 时 selected 为 true，readOnly 为 EXAMINE，noDelete 为 IMAP_READ_ONLY（只能改 \Seen）
+	selected    bool
+	readOnly    bool
+	noDelete    bool
+	messages    []*imapMessage
+	uidValidity uint32
+	uidNext     uint32
+	// stableUIDs 为 false 时邮箱中有没有序号的旧邮件，UID 按会话从 1 开始编号
+	stableUIDs bool
+}
+
+// startIMAPServer 监听 IMAP 端口，每个连接一个会话
+func startIMAPServer() {
+	if !config().EnableIMAP {
+		return
+	}
+	ln, err := listen("imap", listenAddr(config().SMTPBind, config().IMAPPort))
+	if err != nil {
+		imapLogger.Error("IMAP服务器启动失败", "error", err)
+		return
+	}
+	log.Printf("IMAP服务器正在启动于 %s...", ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !draining.Load() {
+					imapLogger.Error("IMAP服务器停止", "error", err)
+				}
+				return
+			}
+			go newIMAPSession(conn).serve()
+		}
+	}()
+}
+
+func newIMAPSession(conn net.Conn) *imapSession {
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return &imapSession{conn: conn, tp: textproto.NewConn(conn), remoteIP: ip}
+}
+
+func (s *imapSession) serve() {
+	retrievalSessions.Add(1)
+	defer retrievalSessions.Add(-1)
+	// STARTTLS 后 s.conn 会换成 TLS 连接
+	defer func() { s.conn.Close() }()
+	// 处理命令时 panic 只断开这个连接，不影响 SMTP、HTTP 等其他服务
+	defer func() {
+		if err := recover(); err != nil {
+			imapLogger.Error("IMAP 会话 panic，断开连接", "ip", s.remoteIP, "mailbox", s.user, "error", err, "stack", string(debug.Stack()))
+		}
+	}()
+	s.untagged("OK [CAPABILITY %s] %s IMAP4rev1 ready", s.capabilities(), config().SMTPHostname)
+	for {
+		s.conn.SetDeadline(time.Now().Add(imapIdleTimeout))
+		line, err := s.readCommand()
+		if err != nil {
+			if err == errIMAPLiteralTooLarge {
+				s.untagged("BYE literal too large")
+			}
+			return
+		}
+		args, err := imapParse(line)
+		if err != nil || len(args) < 2 {
+			s.untagged("BAD invalid command")
+			continue
+		}
+		tag, _ := args[0].(string)
+		cmd, _ := args[1].(string)
+		if tag == "" || cmd == "" {
+			s.untagged("BAD invalid command")
+			continue
+		}
+		if !s.handle(tag, strings.ToUpper(cmd), args[2:]) {
+			return
+		}
+	}
+}
+
+var errIMAPLiteralTooLarge = errors.New("literal too large")
+
+var imapLiteralPattern = regexp.MustCompile(`\{(\d+)(\+?)\}$`)
+
+// readCommand 读取一条命令，命令中的 literal（{n}）读出后改写为带引号的字符串
+func (s *imapSession) readCommand() (string, error) {
+	var cmd strings.Builder
+	for {
+		line, err := s.tp.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		m := imapLiteralPattern.FindStringSubmatch(line)
+		if m == nil {
+			cmd.WriteString(line)
+			return cmd.String(), nil
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n > imapMaxLiteral {
+			return "", errIMAPLiteralTooLarge
+		}
+		if m[2] == "" {
+			s.send("+ go ahead")
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(s.tp.R, buf); err != nil {
+			return "", err
+		}
+		cmd.WriteString(line[:len(line)-len(m[0])])
+		cmd.WriteString(imapQuote(string(buf)))
+	}
+}
+
+func (s *imapSession) send(format string, args ...interface{}) {
+	s.tp.PrintfLine(format, args...)
+}
+
+func (s *imapSession) untagged(format string, args ...interface{}) {
+	s.send("* "+format, args...)
+}
+
+func (s *imapSession) capabilities() string {
+	caps := "IMAP4rev1 LITERAL+ UNSELECT"
+	if config().EnableSTARTTLS && !s.tls {
+		caps += " STARTTLS"
+	}
+	return caps
+}
+
+// handle 处理一条命令，返回 false 时结束会话
+func (s *imapSession) handle(tag, cmd string, args []interface{}) bool {
+	ok := func(format string, a ...interface{}) { s.send(tag+" OK "+format, a...) }
+	no := func(format string, a ...interface{}) { s.send(tag+" NO "+format, a...) }
+	bad := func(format string, a ...interface{}) { s.send(tag+" BAD "+format, a...) }
+
+	// 任何状态都可以使用的命令
+	switch cmd {
+	case "CAPABILITY":
+		s.untagged("CAPABILITY %s", s.capabilities())
+		ok("CAPABILITY completed")
+		return true
+	case "NOOP", "CHECK":
+		if s.selected {
+			s.refresh()
+		}
+		ok("%s completed", cmd)
+		return true
+	case "LOGOUT":
+		s.untagged("BYE logging out")
+		ok("LOGOUT completed")
+		return false
+	}
+
+	// 未认证状态
+	if s.user == "" {
+		switch cmd {
+		case "STARTTLS":
+			if !config().EnableSTARTTLS || s.tls {
+				bad("STARTTLS not available")
+				return true
+			}
+			ok("begin TLS negotiation")
+			s.startTLS()
+		case "LOGIN":
+			// 未设置 MAILBOX_TOKEN_SECRET 时任何密码都可以登录
+			user, _ := imapArg(args, 0)
+			password, given := imapArg(args, 1)
+			if !given || user == "" {
+				bad("usage: LOGIN user password")
+				return true
+			}
+			address := normalizeAddress(user)
+			if !strings.Contains(address, "@") || !domainAllowed(addressDomain(address)) {
+				no("[AUTHENTICATIONFAILED] no such mailbox")
+				return true
+			}
+			if !mailboxPasswordOK(address, password) {
+				imapLogger.Warn("IMAP 登录失败", "mailbox", address, "ip", s.remoteIP)
+				no("[AUTHENTICATIONFAILED] invalid password")
+				return true
+			}
+			s.user = address
+			imapLogger.Info("IMAP 登录", "mailbox", s.user, "ip", s.remoteIP)
+			ok("LOGIN completed")
+		case "AUTHENTICATE":
+			no("use LOGIN")
+		default:
+			bad("command not valid in this state")
+		}
+		return true
+	}
+
+	// 已认证状态
+	switch cmd {
+	case "SELECT", "EXAMINE":
+		name, _ := imapArg(args, 0)
+		s.selected = false
+		if !strings.EqualFold(name, "INBOX") {
+			no("[NONEXISTENT] only INBOX exists")
+			return true
+		}
+		if !s.selectInbox(cmd == "EXAMINE") {
+			no("[UNAVAILABLE] mailbox temporarily unavailable")
+			return true
+		}
+		if s.readOnly {
+			ok("[READ-ONLY] %s completed", cmd)
+		} else {
+			ok("[READ-WRITE] %s completed", cmd)
+		}
+		return true
+	case "LIST", "LSUB":
+		pattern, given := imapArg(args, 1)
+		if !given {
+			bad("usage: %s reference mailbox", cmd)
+			return true
+		}
+		if pattern == "" {
+			s.untagged(`%s (\Noselect) "/" ""`, cmd)
+		} else if imapMatch(pattern, "INBOX") {
+			s.untagged(`%s (\HasNoChildren) "/" INBOX`, cmd)
+		}
+		ok("%s completed", cmd)
+		return true
+	case "STATUS":
+		name, _ := imapArg(args, 0)
+		items, _ := imapListArg(args, 1)
+		if !strings.EqualFold(name, "INBOX") {
+			no("[NONEXISTENT] only INBOX exists")
+			return true
+		}
+		status, err := s.status(items)
+		if err != nil {
+			no("[UNAVAILABLE] mailbox temporarily unavailable")
+			return true
+		}
+		s.untagged("STATUS INBOX (%s)", status)
+		ok("STATUS completed")
+		return true
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		ok("%s completed", cmd)
+		return true
+	case "CREATE", "DELETE", "RENAME", "APPEND", "COPY", "MOVE":
+		no("[CANNOT] %s not supported", cmd)
+		return true
+	}
+
+	if !s.selected {
+		bad("command not valid in this state")
+		return true
+	}
+
+	// 已选中状态
+	uid := false
+	if cmd == "UID" {
+		sub, given := imapArg(args, 0)
+		if !given {
+			bad("usage: UID command arguments")
+			return true
+		}
+		cmd, args, uid = strings.ToUpper(sub), args[1:], true
+		if cmd != "FETCH" && cmd != "STORE" && cmd != "SEARCH" {
+			bad("unknown UID command")
+			return true
+		}
+	}
+	switch cmd {
+	case "CLOSE", "UNSELECT":
+		if cmd == "CLOSE" && !s.readOnly && !s.noDelete {
+			s.expunge(false)
+		}
+		s.selected, s.messages = false, nil
+		ok("%s completed", cmd)
+	case "EXPUNGE":
+		if s.readOnly {
+			no("[READ-ONLY] mailbox is read-only")
+			return true
+		}
+		if s.noDelete {
+			no("%v", errIMAPNoDelete)
+			return true
+		}
+		if err := s.expunge(true); err != nil {
+			no("[UNAVAILABLE] some deleted messages not removed")
+			return true
+		}
+		ok("EXPUNGE completed")
+	case "FETCH":
+		set, _ := imapArg(args, 0)
+		if len(args) < 2 {
+			bad("usage: FETCH set items")
+			return true
+		}
+		if err := s.fetch(set, args[1], uid); err != nil {
+			bad("%v", err)
+			return true
+		}
+		ok("FETCH completed")
+	case "STORE":
+		if s.readOnly {
+			no("[READ-ONLY] mailbox is read-only")
+			return true
+		}
+		if err := s.store(args, uid); err != nil {
+			if errors.Is(err, errIMAPNoDelete) {
+				no("%v", err)
+			} else {
+				bad("%v", err)
+			}
+			return true
+		}
+		ok("STORE completed")
+	case "SEARCH":
+		ids, err := s.search(args, uid)
+		if err != nil {
+			bad("%v", err)
+			return true
+		}
+		s.untagged("SEARCH%s", ids)
+		ok("SEARCH completed")
+	default:
+		bad("unknown command")
+	}
+	return true
+}
+
+// selectInbox 取邮箱当前的邮件，UID 按 imapNumbering 编号
+func (s *imapSession) selectInbox(readOnly bool) bool {
+	mails, err := mailStore.List(s.user)
+	if err == nil {
+		var n imapNumbering
+		if n, err = imapUIDs(mails); err == nil {
+			s.messages, s.uidValidity, s.uidNext, s.stableUIDs = nil, n.validity, n.next, n.stable
+		}
+	}
+	if err != nil {
+		imapLogger.Error("IMAP 读取邮箱失败", "mailbox", s.user, "error", err)
+		return false
+	}
+	// List 最新在前
+	for i := len(mails) - 1; i >= 0; i-- {
+		s.add(mails[i])
+	}
+	// 时钟回拨时存储中的顺序可能与序号不一致，IMAP 要求 UID 随序号递增
+	sort.SliceStable(s.messages, func(i, j int) bool { return s.messages[i].uid < s.messages[j].uid })
+	s.selected, s.readOnly, s.noDelete = true, readOnly, config().IMAPReadOnly
+
+	s.untagged(`FLAGS (\Seen \Deleted)`)
+	switch {
+	case readOnly:
+		s.untagged("OK [PERMANENTFLAGS ()] read-only")
+	case s.noDelete:
+		s.untagged(`OK [PERMANENTFLAGS (\Seen)] only \Seen permitted`)
+	default:
+		s.untagged(`OK [PERMANENTFLAGS (\Seen \Deleted)] flags permitted`)
+	}
+	s.untagged("%d EXISTS", len(s.messages))
+	s.untagged("0 RECENT")
+	for i, m := range s.messages {
+		if !m.mail.Read {
+			s.untagged("OK [UNSEEN %d] first unseen", i+1)
+			break
+		}
+	}
+	s.untagged("OK [UIDVALIDITY %d] UIDs valid", s.uidValidity)
+	s.untagged("OK [UIDNEXT %d] predicted next UID", s.uidNext)
+	return true
+}
+
+// imapNumbering 邮箱的 UID 编号方式。stable 时 UID 为存储分配的邮件序号，UIDVALIDITY 和 UIDNEXT 取自存储；
+// 存储中有没有序号的旧邮件（升级前写入 Redis 的）时按会话从 1 开始编号，每次换一个新的 UIDVALIDITY
+type imapNumbering struct {
+	validity uint32
+	next     uint32
+	stable   bool
+}
+
+func imapUIDs(mails []mailContent) (imapNumbering, error) {
+	for _, m := range mails {
+		if m.seq == 0 {
+			return imapNumbering{validity: nextUIDValidity(), next: 1}, nil
+		}
+	}
+	seq, err := mailStore.Sequence()
+	if err != nil {
+		return imapNumbering{}, err
+	}
+	return imapNumbering{validity: seq.validity, next: uint32(seq.next), stable: true}, nil
+}
+
+func (s *imapSession) add(m mailContent) {
+	uid := s.uidNext
+	if s.stableUIDs {
+		uid = uint32(m.seq)
+	}
+	s.messages = append(s.messages, &imapMessage{uid: uid, mail: m, data: pop3Data(m)})
+	if uid >= s.uidNext {
+		s.uidNext = uid + 1
+	}
+}
+
+// refresh NOOP/CHECK 时把选中后收到的新邮件加到末尾。被其他途径删除的邮件仍保留在快照中，
+// 直到重新 SELECT；序号比已有邮件小的（并发投递时提交顺序不同）也等到重新 SELECT 时出现
+func (s *imapSession) refresh() {
+	mails, err := mailStore.List(s.user)
+	if err != nil {
+		return
+	}
+	known := make(map[string]bool, len(s.messages))
+	var last uint32
+	for _, m := range s.messages {
+		known[m.mail.ID] = true
+		last = m.uid
+	}
+	var fresh []mailContent
+	for i := len(mails) - 1; i >= 0; i-- {
+		if m := mails[i]; !known[m.ID] && (!s.stableUIDs || uint32(m.seq) > last) {
+			fresh = append(fresh, m)
+		}
+	}
+	sort.SliceStable(fresh, func(i, j int) bool { return fresh[i].seq < fresh[j].seq })
+	for _, m := range fresh {
+		s.add(m)
+	}
+	if len(fresh) > 0 {
+		s.untagged("%d EXISTS", len(s.messages))
+	}
+}
+
+// status 未选中邮箱时 UIDNEXT 和 UIDVALIDITY 按下一次 SELECT 的编号方式给出
+func (s *imapSession) status(items []interface{}) (string, error) {
+	messages, unseen, uidNext, uidValidity := len(s.messages), 0, s.uidNext, s.uidValidity
+	if s.selected {
+		for _, m := range s.messages {
+			if !m.mail.Read {
+				unseen++
+			}
+		}
+	} else {
+		mails, err := mailStore.List(s.user)
+		if err != nil {
+			return "", err
+		}
+		n, err := imapUIDs(mails)
+		if err != nil {
+			return "", err
+		}
+		messages, uidNext, uidValidity = len(mails), n.next, n.validity
+		if !n.stable {
+			uidNext = uint32(len(mails) + 1)
+		}
+		for _, m := range mails {
+			if !m.Read {
+				unseen++
+			}
+		}
+	}
+	var out []string
+	for _, item := range items {
+		name, _ := item.(string)
+		switch strings.ToUpper(name) {
+		case "MESSAGES":
+			out = append(out, fmt.Sprintf("MESSAGES %d", messages))
+		case "RECENT":
+			out = append(out, "RECENT 0")
+		case "UIDNEXT":
+			out = append(out, fmt.Sprintf("UIDNEXT %d", uidNext))
+		case "UIDVALIDITY":
+			out = append(out, fmt.Sprintf("UIDVALIDITY %d", uidValidity))
+		case "UNSEEN":
+			out = append(out, fmt.Sprintf("UNSEEN %d", unseen))
+		}
+	}
+	return strings.Join(out, " "), nil
+}
+
+// expunge 从存储中删除标记为 \Deleted 的邮件。report 为 true 时逐封发送 EXPUNGE 响应，
+// 从后往前发送，每条响应中的序号都是删除前的序号
+func (s *imapSession) expunge(report bool) error {
+	var ids []string
+	for _, m := range s.messages {
+		if m.deleted {
+			ids = append(ids, m.mail.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	n, err := mailStore.Remove(s.user, ids)
+	if err != nil {
+		imapLogger.Error("IMAP 删除邮件失败", "mailbox", s.user, "error", err)
+		return err
+	}
+	imapLogger.Info("IMAP 删除邮件", "mailbox", s.user, "ip", s.remoteIP, "deleted", n)
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].deleted {
+			if report {
+				s.untagged("%d EXPUNGE", i+1)
+			}
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+		}
+	}
+	return nil
+}
+
+// matching 按序号或 UID 集合找出邮件，返回邮件的下标
+func (s *imapSession) matching(set string, uid bool) ([]int, error) {
+	star := uint32(len(s.messages))
+	if uid {
+		star = 0
+		if len(s.messages) > 0 {
+			star = s.messages[len(s.messages)-1].uid
+		}
+	}
+	ranges, err := imapSeqSet(set, star)
+	if err != nil {
+		return nil, err
+	}
+	var matched []int
+	for i, m := range s.messages {
+		n := uint32(i + 1)
+		if uid {
+			n = m.uid
+		}
+		if imapInSet(ranges, n) {
+			matched = append(matched, i)
+		}
+	}
+	return matched, nil
+}
+
+// fetch 处理 FETCH 和 UID FETCH，UID FETCH 的响应总是包含 UID
+func (s *imapSession) fetch(set string, itemsArg interface{}, uid bool) error {
+	items, err := imapFetchItems(itemsArg)
+	if err != nil {
+		return err
+	}
+	matched, err := s.matching(set, uid)
+	if err != nil {
+		return err
+	}
+	for _, i := range matched {
+		m := s.messages[i]
+		var out bytes.Buffer
+		fmt.Fprintf(&out, "* %d FETCH (", i+1)
+		first := true
+		write := func(format string, a ...interface{}) {
+			if !first {
+				out.WriteByte(' ')
+			}
+			first = false
+			fmt.Fprintf(&out, format, a...)
+		}
+		if uid && !containsFold(items, "UID") {
+			write("UID %d", m.uid)
+		}
+		seen := false
+		for _, item := range items {
+			upper := strings.ToUpper(item)
+			switch upper {
+			case "UID":
+				write("UID %d", m.uid)
+			case "FLAGS":
+				write("FLAGS %s", m.flags())
+			case "INTERNALDATE":
+				write(`INTERNALDATE "%s"`, m.mail.ReceivedAt.Format("02-Jan-2006 15:04:05 -0700"))
+			case "RFC822.SIZE":
+				write("RFC822.SIZE %d", len(m.data))
+			case "ENVELOPE":
+				header, _ := imapSplit(m.data)
+				write("ENVELOPE %s", imapEnvelope(header))
+			case "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+				header, body := imapSplit(m.data)
+				data := map[string][]byte{"RFC822": m.data, "RFC822.HEADER": header, "RFC822.TEXT": body}[upper]
+				write("%s %s", upper, imapLiteral(data))
+				seen = seen || upper != "RFC822.HEADER"
+			default:
+				name, data, peek, err := imapBodySection(item, m.data)
+				if err != nil {
+					return err
+				}
+				write("%s %s", name, imapLiteral(data))
+				seen = seen || !peek
+			}
+		}
+		if seen {
+			recordFetched()
+			if !s.readOnly && !m.mail.Read {
+				if _, err := mailStore.SetRead(s.user, m.mail.ID, true); err == nil {
+					m.mail.Read = true
+					if !containsFold(items, "FLAGS") {
+						write("FLAGS %s", m.flags())
+					}
+				}
+			}
+		}
+		out.WriteString(")\r\n")
+		s.tp.W.Write(out.Bytes())
+	}
+	return s.tp.W.Flush()
+}
+
+// imapFetchItems 展开 FETCH 的数据项，支持 ALL、FAST 宏和单个数据项
+func imapFetchItems(arg interface{}) ([]string, error) {
+	var items []string
+	switch arg := arg.(type) {
+	case string:
+		switch strings.ToUpper(arg) {
+		case "ALL", "FULL":
+			return []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}, nil
+		case "FAST":
+			return []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}, nil
+		}
+		items = []string{arg}
+	case []interface{}:
+		for _, item := range arg {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid fetch item")
+			}
+			items = append(items, name)
+		}
+	}
+	for _, item := range items {
+		switch upper := strings.ToUpper(item); {
+		case upper == "UID", upper == "FLAGS", upper == "INTERNALDATE", upper == "RFC822.SIZE", upper == "ENVELOPE",
+			upper == "RFC822", upper == "RFC822.HEADER", upper == "RFC822.TEXT",
+			strings.HasPrefix(upper, "BODY[") || strings.HasPrefix(upper, "BODY.PEEK["):
+		default:
+			return nil, fmt.Errorf("unsupported fetch item %s", item)
+		}
+	}
+	return items, nil
+}
+
+// imapBodySection 取 BODY[section]<partial>，返回响应中的名称和内容。
+// 支持整封邮件、HEADER、TEXT、HEADER.FIELDS 和 HEADER.FIELDS.NOT
+func imapBodySection(item string, data []byte) (name string, section []byte, peek bool, err error) {
+	open, end := strings.Index(item, "["), strings.LastIndex(item, "]")
+	if open < 0 || end < open {
+		return "", nil, false, fmt.Errorf("invalid fetch item %s", item)
+	}
+	peek = strings.EqualFold(item[:open], "BODY.PEEK")
+	spec, partial := item[open+1:end], item[end+1:]
+	header, body := imapSplit(data)
+	upper := strings.ToUpper(spec)
+	switch {
+	case upper == "":
+		section = data
+	case upper == "HEADER":
+		section = header
+	case upper == "TEXT":
+		section = body
+	case strings.HasPrefix(upper, "HEADER.FIELDS"):
+		fields, perr := imapParse(spec[strings.Index(spec, " ")+1:])
+		if perr != nil || len(fields) != 1 || !strings.Contains(spec, " ") {
+			return "", nil, false, fmt.Errorf("invalid header field list")
+		}
+		list, _ := fields[0].([]interface{})
+		section = imapHeaderFields(header, list, strings.HasPrefix(upper, "HEADER.FIELDS.NOT"))
+	default:
+		return "", nil, false, fmt.Errorf("unsupported body section %s", spec)
+	}
+	name = "BODY[" + spec + "]"
+	if partial != "" {
+		var offset, length int
+		if _, perr := fmt.Sscanf(partial, "<%d.%d>", &offset, &length); perr != nil || offset < 0 || length <= 0 {
+			return "", nil, false, fmt.Errorf("invalid partial %s", partial)
+		}
+		name += fmt.Sprintf("<%d>", offset)
+		if offset > len(section) {
+			offset = len(section)
+		}
+		section = section[offset:]
+		if length < len(section) {
+			section = section[:length]
+		}
+	}
+	return name, section, peek, nil
+}
+
+// imapSplit 拆分头部（含结尾的空行）和正文
+func imapSplit(data []byte) (header, body []byte) {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return data[:i+4], data[i+4:]
+	}
+	return data, nil
+}
+
+// imapHeaderFields 只保留（not 为 true 时去掉）列出的头部字段，折行的字段整体保留或去掉
+func imapHeaderFields(header []byte, fields []interface{}, not bool) []byte {
+	want := map[string]bool{}
+	for _, f := range fields {
+		if name, ok := f.(string); ok {
+			want[strings.ToLower(name)] = true
+		}
+	}
+	var out bytes.Buffer
+	keep := false
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "\r\n" || line == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := strings.Cut(line, ":")
+			keep = want[strings.ToLower(strings.TrimSpace(name))] != not
+		}
+		if keep {
+			out.WriteString(line)
+		}
+	}
+	out.WriteString("\r\n")
+	return out.Bytes()
+}
+
+// imapEnvelope 由头部生成 ENVELOPE，日期和主题保持原样（包括编码字）
+func imapEnvelope(header []byte) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(header))
+	if err != nil {
+		return "(NIL NIL NIL NIL NIL NIL NIL NIL NIL NIL)"
+	}
+	h := msg.Header
+	from := imapAddresses(h.Get("From"))
+	sender, replyTo := imapAddresses(h.Get("Sender")), imapAddresses(h.Get("Reply-To"))
+	if sender == "NIL" {
+		sender = from
+	}
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return "(" + strings.Join([]string{
+		imapNString(h.Get("Date")),
+		imapNString(h.Get("Subject")),
+		from, sender, replyTo,
+		imapAddresses(h.Get("To")),
+		imapAddresses(h.Get("Cc")),
+		imapAddresses(h.Get("Bcc")),
+		imapNString(h.Get("In-Reply-To")),
+		imapNString(h.Get("Message-Id")),
+	}, " ") + ")"
+}
+
+// imapAddresses 地址列表写成 ((名称 NIL 用户名 域名) ...)，非 ASCII 的名称重新编码
+func imapAddresses(value string) string {
+	if value == "" {
+		return "NIL"
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil || len(list) == 0 {
+		return "NIL"
+	}
+	var out []string
+	for _, a := range list {
+		name := a.Name
+		if name != "" && !isASCII(name) {
+			name = mime.QEncoding.Encode("utf-8", name)
+		}
+		local, host, _ := strings.Cut(a.Address, "@")
+		out = append(out, "("+imapNString(name)+" NIL "+imapNString(local)+" "+imapNString(host)+")")
+	}
+	return "(" + strings.Join(out, "") + ")"
+}
+
+// errIMAPNoDelete IMAP_READ_ONLY 时设置 \Deleted 或 EXPUNGE 的回复
+var errIMAPNoDelete = errors.New("[CANNOT] deleting messages is disabled")
+
+// store 处理 STORE 和 UID STORE：\Seen 改已读状态，\Deleted 标记删除，其他标志忽略
+func (s *imapSession) store(args []interface{}, uid bool) error {
+	set, _ := imapArg(args, 0)
+	op, _ := imapArg(args, 1)
+	if len(args) < 3 {
+		return fmt.Errorf("usage: STORE set FLAGS (flags)")
+	}
+	var flags []interface{}
+	if list, ok := args[2].([]interface{}); ok {
+		flags = list
+	} else {
+		flags = args[2:]
+	}
+	op = strings.ToUpper(op)
+	silent := strings.HasSuffix(op, ".SILENT")
+	op = strings.TrimSuffix(op, ".SILENT")
+	if op != "FLAGS" && op != "+FLAGS" && op != "-FLAGS" {
+		return fmt.Errorf("unsupported STORE operation %s", op)
+	}
+	var seen, deleted bool
+	for _, f := range flags {
+		name, _ := f.(string)
+		switch strings.ToLower(name) {
+		case `\seen`:
+			seen = true
+		case `\deleted`:
+			deleted = true
+		}
+	}
+	if deleted && s.noDelete && op != "-FLAGS" {
+		return errIMAPNoDelete
+	}
+	matched, err := s.matching(set, uid)
+	if err != nil {
+		return err
+	}
+	for _, i := range matched {
+		m := s.messages[i]
+		read, del := m.mail.Read, m.deleted
+		switch op {
+		case "FLAGS":
+			read, del = seen, deleted
+		case "+FLAGS":
+			read, del = read || seen, del || deleted
+		case "-FLAGS":
+			read, del = read && !seen, del && !deleted
+		}
+		m.deleted = del
+		if read != m.mail.Read {
+			if _, err := mailStore.SetRead(s.user, m.mail.ID, read); err == nil {
+				m.mail.Read = read
+			}
+		}
+		if silent {
+			continue
+		}
+		if uid {
+			s.untagged("%d FETCH (UID %d FLAGS %s)", i+1, m.uid, m.flags())
+		} else {
+			s.untagged("%d FETCH (FLAGS %s)", i+1, m.flags())
+		}
+	}
+	return nil
+}
+
+// search 处理 SEARCH 和 UID SEARCH，多个条件同时满足。支持 ALL、SEEN、UNSEEN、NEW、DELETED、UNDELETED、
+// FROM、TO、SUBJECT、BODY、TEXT、BEFORE、ON、SINCE、SENTBEFORE、SENTON、SENTSINCE、UID 和序号集合，
+// 字符串不区分大小写按包含匹配，日期只比较年月日
+func (s *imapSession) search(args []interface{}, uid bool) (string, error) {
+	var conds []func(i int, m *imapMessage) bool
+	var parse func(args []interface{}) error
+	parse = func(args []interface{}) error {
+		for k := 0; k < len(args); k++ {
+			if list, ok := args[k].([]interface{}); ok {
+				if err := parse(list); err != nil {
+					return err
+				}
+				continue
+			}
+			key, _ := args[k].(string)
+			next := func() (string, error) {
+				k++
+				if v, ok := imapArg(args, k); ok {
+					return v, nil
+				}
+				return "", fmt.Errorf("missing argument for %s", key)
+			}
+			contains := func(field func(m *imapMessage) string) error {
+				v, err := next()
+				v = strings.ToLower(v)
+				conds = append(conds, func(_ int, m *imapMessage) bool {
+					return strings.Contains(strings.ToLower(field(m)), v)
+				})
+				return err
+			}
+			// date 按比较结果（-1、0、1）筛选，when 取邮件的收信时间或 Date 头
+			date := func(when func(m *imapMessage) (time.Time, bool), want ...int) error {
+				v, err := next()
+				if err != nil {
+					return err
+				}
+				day, err := time.Parse("2-Jan-2006", strings.Trim(v, `"`))
+				if err != nil {
+					return fmt.Errorf("invalid date %q for %s", v, key)
+				}
+				conds = append(conds, func(_ int, m *imapMessage) bool {
+					t, ok := when(m)
+					if !ok {
+						return false
+					}
+					t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+					c := t.Compare(day)
+					for _, w := range want {
+						if c == w {
+							return true
+						}
+					}
+					return false
+				})
+				return nil
+			}
+			var err error
+			switch strings.ToUpper(key) {
+			case "ALL":
+			case "CHARSET":
+				_, err = next()
+			case "SEEN":
+				conds = append(conds, func(_ int, m *imapMessage) bool { return m.mail.Read })
+			case "UNSEEN", "NEW":
+				conds = append(conds, func(_ int, m *imapMessage) bool { return !m.mail.Read })
+			case "DELETED":
+				conds = append(conds, func(_ int, m *imapMessage) bool { return m.deleted })
+			case "UNDELETED":
+				conds = append(conds, func(_ int, m *imapMessage) bool { return !m.deleted })
+			case "FROM":
+				err = contains(func(m *imapMessage) string { return m.mail.From })
+			case "TO":
+				err = contains(func(m *imapMessage) string { return m.mail.To })
+			case "SUBJECT":
+				err = contains(func(m *imapMessage) string { return m.mail.Subject })
+			case "BODY":
+				err = contains(func(m *imapMessage) string { return m.mail.Text + "\n" + m.mail.HTML })
+			case "TEXT":
+				err = contains(func(m *imapMessage) string {
+					return m.mail.Subject + "\n" + m.mail.From + "\n" + m.mail.To + "\n" + m.mail.Text + "\n" + m.mail.HTML
+				})
+			case "BEFORE":
+				err = date(imapInternalDate, -1)
+			case "ON":
+				err = date(imapInternalDate, 0)
+			case "SINCE":
+				err = date(imapInternalDate, 0, 1)
+			case "SENTBEFORE":
+				err = date(imapSentDate, -1)
+			case "SENTON":
+				err = date(imapSentDate, 0)
+			case "SENTSINCE":
+				err = date(imapSentDate, 0, 1)
+			case "UID":
+				var set string
+				if set, err = next(); err == nil {
+					var matched []int
+					if matched, err = s.matching(set, true); err == nil {
+						conds = append(conds, imapIndexCond(matched))
+					}
+				}
+			default:
+				matched, merr := s.matching(key, false)
+				if merr != nil {
+					return fmt.Errorf("unsupported search key %s", key)
+				}
+				conds = append(conds, imapIndexCond(matched))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := parse(args); err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for i, m := range s.messages {
+		match := true
+		for _, cond := range conds {
+			if !cond(i, m) {
+				match = false
+				break
+			}
+		}
+		if match {
+			n := uint32(i + 1)
+			if uid {
+				n = m.uid
+			}
+			fmt.Fprintf(&out, " %d", n)
+		}
+	}
+	return out.String(), nil
+}
+
+func imapInternalDate(m *imapMessage) (time.Time, bool) {
+	return m.mail.ReceivedAt, true
+}
+
+// imapSentDate 取 Date 头，没有或无法解析时不匹配任何 SENT* 条件
+func imapSentDate(m *imapMessage) (time.Time, bool) {
+	header, _ := imapSplit(m.data)
+	parsed, err := mail.ReadMessage(bytes.NewReader(header))
+	if err != nil {
+		return time.Time{}, false
+	}
+	t, err := parsed.Header.Date()
+	return t, err == nil
+}
+
+func imapIndexCond(matched []int) func(i int, m *imapMessage) bool {
+	set := map[int]bool{}
+	for _, i := range matched {
+		set[i] = true
+	}
+	return func(i int, _ *imapMessage) bool { return set[i] }
+}
+
+// startTLS 升级为 TLS，之后重新读取命令
+func (s *imapSession) startTLS() {
+	conn := tls.Server(s.conn, serverTLSConfig())
+	if err := conn.Handshake(); err != nil {
+		s.conn.Close()
+		return
+	}
+	s.conn, s.tp, s.tls = conn, textproto.NewConn(conn), true
+}
+
+// imapParse 把命令解析为原子、字符串和括号列表（[]interface{}）。原子中的 [...] 整体保留，
+// 以便 BODY[HEADER.FIELDS (From To)] 作为一个数据项
+func imapParse(line string) ([]interface{}, error) {
+	p := &imapParser{s: line}
+	return p.list(0)
+}
+
+type imapParser struct {
+	s string
+	i int
+}
+
+func (p *imapParser) list(end byte) ([]interface{}, error) {
+	items := []interface{}{}
+	for {
+		for p.i < len(p.s) && p.s[p.i] == ' ' {
+			p.i++
+		}
+		if p.i >= len(p.s) {
+			if end != 0 {
+				return nil, fmt.Errorf("unbalanced parentheses")
+			}
+			return items, nil
+		}
+		switch p.s[p.i] {
+		case ')':
+			if end != ')' {
+				return nil, fmt.Errorf("unbalanced parentheses")
+			}
+			p.i++
+			return items, nil
+		case '(':
+			p.i++
+			sub, err := p.list(')')
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, sub)
+		case '"':
+			str, err := p.quoted()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, str)
+		default:
+			items = append(items, p.atom())
+		}
+	}
+}
+
+func (p *imapParser) quoted() (string, error) {
+	var b strings.Builder
+	for p.i++; p.i < len(p.s); p.i++ {
+		switch c := p.s[p.i]; c {
+		case '\\':
+			p.i++
+			if p.i < len(p.s) {
+				b.WriteByte(p.s[p.i])
+			}
+		case '"':
+			p.i++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (p *imapParser) atom() string {
+	start, depth := p.i, 0
+	for ; p.i < len(p.s); p.i++ {
+		c := p.s[p.i]
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+		} else if depth == 0 && (c == ' ' || c == '(' || c == ')') {
+			break
+		}
+	}
+	return p.s[start:p.i]
+}
+
+// imapArg 取第 i 个字符串参数
+func imapArg(args []interface{}, i int) (string, bool) {
+	if i >= len(args) {
+		return "", false
+	}
+	s, ok := args[i].(string)
+	return s, ok
+}
+
+// imapListArg 取第 i 个括号列表参数
+func imapListArg(args []interface{}, i int) ([]interface{}, bool) {
+	if i >= len(args) {
+		return nil, false
+	}
+	list, ok := args[i].([]interface{})
+	return list, ok
+}
+
+// imapSeqSet 解析 1:3,5,7:* 形式的集合，star 为 * 代表的值
+func imapSeqSet(set string, star uint32) ([][2]uint32, error) {
+	num := func(s string) (uint32, error) {
+		if s == "*" {
+			return star, nil
+		}
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("invalid sequence set %s", set)
+		}
+		return uint32(n), nil
+	}
+	var ranges [][2]uint32
+	for _, part := range strings.Split(set, ",") {
+		lo, hi, isRange := strings.Cut(part, ":")
+		a, err := num(lo)
+		if err != nil {
+			return nil, err
+		}
+		b := a
+		if isRange {
+			if b, err = num(hi); err != nil {
+				return nil, err
+			}
+		}
+		if a > b {
+			a, b = b, a
+		}
+		ranges = append(ranges, [2]uint32{a, b})
+	}
+	return ranges, nil
+}
+
+func imapInSet(ranges [][2]uint32, n uint32) bool {
+	for _, r := range ranges {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// imapMatch LIST 的通配：* 匹配任意字符，% 不匹配层级分隔符 /
+func imapMatch(pattern, name string) bool {
+	expr := strings.NewReplacer(`\*`, ".*", "%", "[^/]*").Replace(regexp.QuoteMeta(pattern))
+	ok, _ := regexp.MatchString("(?i)^"+expr+"$", name)
+	return ok
+}
+
+// imapQuote 写成带引号的字符串
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// imapNString 空字符串为 NIL，含换行或非 ASCII 字符时用 literal
+func imapNString(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	if strings.ContainsAny(s, "\r\n") || !isASCII(s) {
+		return imapLiteral([]byte(s))
+	}
+	return imapQuote(s)
+}
+
+func imapLiteral(data []byte) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(data), data)
+}
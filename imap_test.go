@@ -0,0 +1,254 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// imapTestClient 连接到测试用 IMAP 会话的客户端，命令的标签依次为 a1、a2……
+type imapTestClient struct {
+	t    *testing.T
+	addr string
+	tp   *textproto.Conn
+	tag  int
+}
+
+// startTestIMAP 在临时端口上提供 IMAP 会话并连接，返回已读过问候行的客户端
+func startTestIMAP(t *testing.T) *imapTestClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go newIMAPSession(conn).serve()
+		}
+	}()
+	return dialTestIMAP(t, ln.Addr().String())
+}
+
+func dialTestIMAP(t *testing.T, addr string) *imapTestClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &imapTestClient{t: t, addr: addr, tp: textproto.NewConn(conn)}
+	t.Cleanup(func() { c.tp.Close() })
+	if line, err := c.tp.ReadLine(); err != nil || !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("问候行 %q, %v", line, err)
+	}
+	return c
+}
+
+// do 发送一条命令，返回未标记的响应行和带标签的结果行
+func (c *imapTestClient) do(command string) (untagged []string, result string) {
+	c.t.Helper()
+	c.tag++
+	tag := "a" + strconv.Itoa(c.tag)
+	if err := c.tp.PrintfLine("%s %s", tag, command); err != nil {
+		c.t.Fatalf("发送 %s: %v", command, err)
+	}
+	for {
+		line, err := c.tp.ReadLine()
+		if err != nil {
+			c.t.Fatalf("%s: 读取响应: %v", command, err)
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return untagged, strings.TrimPrefix(line, tag+" ")
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+// expect 发送命令并要求结果以 want（OK、NO 或 BAD）开头
+func (c *imapTestClient) expect(command, want string) []string {
+	c.t.Helper()
+	untagged, result := c.do(command)
+	if !strings.HasPrefix(result, want) {
+		c.t.Fatalf("%s: 结果 %q，应为 %s", command, result, want)
+	}
+	return untagged
+}
+
+func TestIMAPBareUIDDoesNotCrash(t *testing.T) {
+	setupTest(t, nil)
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", From: "a@example.com", Subject: "hi", Text: "hello", ReceivedAt: time.Now()})
+
+	c := startTestIMAP(t)
+	c.expect("LOGIN user@test.local x", "OK")
+	c.expect("SELECT INBOX", "OK")
+	c.expect("UID", "BAD")
+	c.expect("UID FETCH", "BAD")
+	// 会话仍然可用
+	c.expect("NOOP", "OK")
+	c.expect("UID FETCH 1 (FLAGS)", "OK")
+}
+
+func TestIMAPPanicClosesOnlyThatSession(t *testing.T) {
+	setupTest(t, nil)
+	c := startTestIMAP(t)
+	c.expect("LOGIN user@test.local x", "OK")
+
+	// 存储为 nil 时 SELECT 会 panic，会话应被断开，进程继续运行
+	store := mailStore
+	mailStore = nil
+	c.tag++
+	c.tp.PrintfLine("a%d SELECT INBOX", c.tag)
+	if line, err := c.tp.ReadLine(); err == nil {
+		t.Fatalf("panic 后连接应断开，读到 %q", line)
+	}
+	mailStore = store
+
+	other := dialTestIMAP(t, c.addr)
+	other.expect("LOGIN user@test.local x", "OK")
+	other.expect("SELECT INBOX", "OK")
+}
+
+func TestIMAPReadOnlyByDefault(t *testing.T) {
+	setupTest(t, nil)
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", From: "a@example.com", Subject: "hi", Text: "hello", ReceivedAt: time.Now()})
+
+	c := startTestIMAP(t)
+	c.expect("LOGIN user@test.local x", "OK")
+	untagged := c.expect("SELECT INBOX", "OK")
+	if !containsLine(untagged, `PERMANENTFLAGS (\Seen)`) {
+		t.Errorf("只读时 PERMANENTFLAGS 应只有 \\Seen: %q", untagged)
+	}
+	c.expect(`STORE 1 +FLAGS (\Deleted)`, "NO")
+	c.expect("EXPUNGE", "NO")
+	c.expect("CLOSE", "OK")
+
+	// \Seen 仍然写回存储
+	c.expect("SELECT INBOX", "OK")
+	c.expect("FETCH 1 (BODY[])", "OK")
+	if m, ok, _ := mailStore.Get("user@test.local", "m1"); !ok || !m.Read {
+		t.Errorf("读取后应标记已读，ok=%v read=%v", ok, m.Read)
+	}
+	if n, _ := mailStore.Count("user@test.local"); n != 1 {
+		t.Errorf("只读时不应删除邮件，剩余 %d 封", n)
+	}
+}
+
+func TestIMAPDeleteWhenWritable(t *testing.T) {
+	setupTest(t, map[string]string{"IMAP_READ_ONLY": "false"})
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", Subject: "one", ReceivedAt: time.Now()})
+	mailStore.Append(mailContent{ID: "m2", To: "user@test.local", Subject: "two", ReceivedAt: time.Now()})
+
+	c := startTestIMAP(t)
+	c.expect("LOGIN user@test.local x", "OK")
+	c.expect("SELECT INBOX", "OK")
+	c.expect(`STORE 1 +FLAGS (\Deleted)`, "OK")
+	c.expect("EXPUNGE", "OK")
+	if _, ok, _ := mailStore.Get("user@test.local", "m1"); ok {
+		t.Error("EXPUNGE 后邮件应被删除")
+	}
+
+	// EXAMINE 始终只读
+	c.expect("EXAMINE INBOX", "OK")
+	c.expect(`STORE 1 +FLAGS (\Deleted)`, "NO")
+}
+
+func TestIMAPSearchByDate(t *testing.T) {
+	setupTest(t, nil)
+	received := time.Date(2024, 2, 10, 12, 0, 0, 0, time.UTC)
+	mailStore.Append(mailContent{ID: "old", To: "user@test.local", ReceivedAt: received.AddDate(0, 0, -5),
+		raw: []byte("Date: Mon, 1 Jan 2024 23:30:00 -0800\r\nSubject: old\r\n\r\nbody\r\n")})
+	mailStore.Append(mailContent{ID: "new", To: "user@test.local", ReceivedAt: received,
+		raw: []byte("Subject: no date header\r\n\r\nbody\r\n")})
+
+	c := startTestIMAP(t)
+	c.expect("LOGIN user@test.local x", "OK")
+	c.expect("SELECT INBOX", "OK")
+	for _, tc := range []struct{ query, want string }{
+		{"ON 10-Feb-2024", "* SEARCH 2"},
+		{"SINCE 10-Feb-2024", "* SEARCH 2"},
+		{"SINCE 5-Feb-2024", "* SEARCH 1 2"},
+		{"BEFORE 10-Feb-2024", "* SEARCH 1"},
+		{"BEFORE 5-Feb-2024", "* SEARCH"},
+		// Date 头按其自身的时区取日期，没有 Date 头的邮件不匹配
+		{"SENTON 1-Jan-2024", "* SEARCH 1"},
+		{"SENTSINCE 2-Jan-2024", "* SEARCH"},
+		{"SENTBEFORE 2-Jan-2024", "* SEARCH 1"},
+	} {
+		untagged := c.expect("SEARCH "+tc.query, "OK")
+		if len(untagged) != 1 || untagged[0] != tc.want {
+			t.Errorf("SEARCH %s = %q，应为 %q", tc.query, untagged, tc.want)
+		}
+	}
+	c.expect("SEARCH SINCE yesterday", "BAD")
+}
+
+func TestIMAPUIDsStableAcrossSessions(t *testing.T) {
+	setupTest(t, nil)
+	// 其他邮箱的邮件也占用序号，UID 不必连续
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", ReceivedAt: time.Now()})
+	mailStore.Append(mailContent{ID: "x1", To: "other@test.local", ReceivedAt: time.Now()})
+	mailStore.Append(mailContent{ID: "m2", To: "user@test.local", ReceivedAt: time.Now()})
+
+	c := startTestIMAP(t)
+	c.expect("LOGIN user@test.local x", "OK")
+	first := c.expect("SELECT INBOX", "OK")
+	uids := c.expect("UID SEARCH ALL", "OK")
+	if len(uids) != 1 || uids[0] != "* SEARCH 1 3" {
+		t.Fatalf("UID SEARCH ALL = %q，应为 * SEARCH 1 3", uids)
+	}
+
+	// 重新 SELECT 和另一个连接看到相同的 UIDVALIDITY、UIDNEXT 和 UID
+	other := dialTestIMAP(t, c.addr)
+	other.expect("LOGIN user@test.local x", "OK")
+	status := other.expect("STATUS INBOX (UIDNEXT UIDVALIDITY)", "OK")
+	again := other.expect("SELECT INBOX", "OK")
+	for _, want := range []string{"UIDVALIDITY", "UIDNEXT"} {
+		line := lineWith(first, want)
+		if line == "" || lineWith(again, want) != line {
+			t.Errorf("%s 在两次 SELECT 之间变化: %q / %q", want, first, again)
+		}
+	}
+	if !containsLine(status, "UIDNEXT 4") {
+		t.Errorf("STATUS = %q，UIDNEXT 应为 4", status)
+	}
+	if got := other.expect("UID SEARCH ALL", "OK"); got[0] != uids[0] {
+		t.Errorf("另一个连接中 UID SEARCH ALL = %q，应为 %q", got, uids)
+	}
+
+	// 新邮件的 UID 大于已有的，NOOP 时出现
+	mailStore.Append(mailContent{ID: "m3", To: "user@test.local", ReceivedAt: time.Now()})
+	if untagged := c.expect("NOOP", "OK"); !containsLine(untagged, "* 3 EXISTS") {
+		t.Errorf("NOOP = %q，应报告 3 EXISTS", untagged)
+	}
+	if got := c.expect("UID SEARCH ALL", "OK"); got[0] != "* SEARCH 1 3 4" {
+		t.Errorf("收到新邮件后 UID SEARCH ALL = %q", got)
+	}
+
+	// 删除邮件不影响其他邮件的 UID
+	mailStore.Remove("user@test.local", []string{"m1"})
+	c.expect("SELECT INBOX", "OK")
+	if got := c.expect("UID SEARCH ALL", "OK"); got[0] != "* SEARCH 3 4" {
+		t.Errorf("删除后 UID SEARCH ALL = %q", got)
+	}
+}
+
+func lineWith(lines []string, substr string) string {
+	for _, l := range lines {
+		if strings.Contains(l, substr) {
+			return l
+		}
+	}
+	return ""
+}
+
+func containsLine(lines []string, substr string) bool {
+	return lineWith(lines, substr) != ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/v1/info 返回服务的能力和限制，客户端和网页据此调整行为，不必写死域名、大小上限和保留时长。
+// 只包含可以公开的配置，不返回密钥、存储地址等内部信息
+
+// maxMessageBytes SMTP 接收的单封邮件大小上限，DOMAIN_POLICIES 的 max_message_bytes 可按域名覆盖
+const maxMessageBytes = 1024 * 1024
+
+// maxMessageBytesLimit 按域名覆盖时允许的最大值，邮件整封读入内存
+const maxMessageBytesLimit = 64 * 1024 * 1024
+
+// infoResponse 服务能力概要
+type infoResponse struct {
+	Version string       `json:"version"`
+	Domains []infoDomain `json:"domains"`
+	// 收件服务器的主机名，发件方投递到该主机的 25 端口
+	SMTPHostname    string `json:"smtpHostname"`
+	MaxMessageBytes int    `json:"maxMessageBytes"`
+	// wait 参数的上限（秒）
+	MaxWaitSeconds int `json:"maxWaitSeconds"`
+	// 保存哪些正文（both、text、html），以及是否保存原始邮件（决定 raw 下载是否为原样）
+	StoreParts string `json:"storeParts"`
+	StoreRaw   bool   `json:"storeRaw"`
+	// 附件总是保存，可以通过 attachments 接口下载
+	Attachments bool `json:"attachments"`
+	// 邮件接口不需要认证，管理接口需要 API Key
+	AuthRequired bool `json:"authRequired"`
+	// 每个 IP 每分钟的请求数和突发数，未限流时不返回
+	RateLimit *infoRateLimit `json:"rateLimit,omitempty"`
+	// 每个 IP 每分钟创建邮箱的次数和突发数，未单独限流时不返回
+	CreateRateLimit *infoRateLimit `json:"createRateLimit,omitempty"`
+	// 下一次定时清空所有邮箱的时间，未开启时不返回
+	NextCleanup *time.Time `json:"nextCleanup,omitempty"`
+	// 可选功能中已启用的部分
+	Features []string `json:"features"`
+}
+
+// infoDomain 一个可用域名及其生效的策略
+type infoDomain struct {
+	// punycode 形式，生成地址和调用接口时使用
+	Domain string `json:"domain"`
+	// Unicode 展示形式
+	DisplayDomain string `json:"displayDomain"`
+	// 邮件保留秒数，0 表示不过期
+	TTLSeconds  int64 `json:"ttlSeconds"`
+	MaxMessages int   `json:"maxMessages"`
+	MaxBytes    int64 `json:"maxBytes"`
+	CatchAll    bool  `json:"catchAll"`
+	// 发往该域名的单封邮件大小上限
+	MaxMessageBytes int `json:"maxMessageBytes"`
+}
+
+type infoRateLimit struct {
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	Burst             int `json:"burst"`
+}
+
+// newInfoRateLimit 未限流时返回 nil，突发数未设置时等于每分钟请求数
+func newInfoRateLimit(perMinute, burst int) *infoRateLimit {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &infoRateLimit{RequestsPerMinute: perMinute, Burst: burst}
+}
+
+func handleInfo(c *gin.Context) {
+	info := infoResponse{
+		Version:         buildInfo().Version,
+		SMTPHostname:    config().SMTPHostname,
+		MaxMessageBytes: maxMessageBytes,
+		MaxWaitSeconds:  int(maxWait().Seconds()),
+		StoreParts:      config().StoreParts,
+		StoreRaw:        config().StoreRaw,
+		Attachments:     true,
+		Domains:         publicDomainSettings(),
+		Features:        enabledFeatures(),
+	}
+	info.RateLimit = newInfoRateLimit(config().RateLimitRPM, config().RateLimitBurst)
+	info.CreateRateLimit = newInfoRateLimit(config().CreateRateLimitRPM, config().CreateRateLimitBurst)
+	if next := nextCleanupTime(); !next.IsZero() {
+		info.NextCleanup = &next
+	}
+	c.JSON(200, info)
+}
+
+// enabledFeatures 列出已启用的可选功能
+func enabledFeatures() []string {
+	features := []string{"longPoll", "readState", "code", "links", "inlineImages", "imageProxy", "smtputf8"}
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"webUI", config().WebUI},
+		{"pop3", config().EnablePOP3},
+		{"imap", config().EnableIMAP},
+		{"starttls", config().EnableSTARTTLS},
+		{"smtps", config().EnableSMTPS},
+		{"greylist", config().Greylist},
+		{"dnsbl", len(config().DNSBLZones) > 0},
+		{"spamScore", spamCheckEnabled()},
+		{"dedup", config().DedupMode != dedupOff},
+	} {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+	return features
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/html"
+)
+
+// cid: 内嵌图片的改写方式
+const (
+	inlineModeURL  = "url"  // 改写为内嵌图片接口的地址
+	inlineModeData = "data" // 改写为 data URI
+)
+
+// rewriteInlineImages 把 <img src="cid:..."> 改写为可访问的地址，找不到对应部分或类型不安全的保持原样
+func rewriteInlineImages(body, mailbox string, m mailContent) string {
+	if body == "" || len(m.inline) == 0 {
+		return body
+	}
+
+	var out bytes.Buffer
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := z.Raw()
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			out.Write(raw)
+			continue
+		}
+
+		tok := z.Token()
+		rewritten := false
+		if tok.Data == "img" {
+			for i, attr := range tok.Attr {
+				if attr.Key != "src" {
+					continue
+				}
+				if src, ok := inlineImageURL(attr.Val, mailbox, m); ok {
+					tok.Attr[i].Val = src
+					rewritten = true
+				}
+			}
+		}
+		if rewritten {
+			out.WriteString(tok.String())
+		} else {
+			out.Write(raw)
+		}
+	}
+	return out.String()
+}
+
+func inlineImageURL(src, mailbox string, m mailContent) (string, bool) {
+	if len(src) < 4 || !strings.EqualFold(src[:4], "cid:") {
+		return "", false
+	}
+	cid, err := url.PathUnescape(src[4:])
+	if err != nil {
+		cid = src[4:]
+	}
+	part, ok := findInlinePart(m, cid)
+	if !ok || !safeImageType(part.contentType) {
+		return "", false
+	}
+
+	if config().InlineImageMode == inlineModeData {
+		return "data:" + part.contentType + ";base64," + base64.StdEncoding.EncodeToString(part.data), true
+	}
+	return config().BasePath + apiV1Prefix + "/mailboxes/" + url.PathEscape(mailbox) + "/messages/" + m.ID + "/inline/" + url.PathEscape(cid), true
+}
+
+func findInlinePart(m mailContent, cid string) (inlinePart, bool) {
+	for _, p := range m.inline {
+		if strings.EqualFold(p.cid, cid) {
+			return p, true
+		}
+	}
+	return inlinePart{}, false
+}
+
+// handleGetInlinePart 按 Content-ID 返回内嵌图片，只提供位图类型，避免在本站域名下返回可执行内容
+func handleGetInlinePart(c *gin.Context) {
+	m, ok, err := mailStore.Get(mailboxParam(c), c.Param("id"))
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": msg("mail_not_found")})
+		return
+	}
+	part, ok := findInlinePart(m, c.Param("cid"))
+	if !ok || !safeImageType(part.contentType) {
+		c.JSON(404, gin.H{"error": msg("inline_image_not_found")})
+		return
+	}
+
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Data(200, part.contentType, part.data)
+}
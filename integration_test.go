@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestSMTP 在临时端口上运行 newSMTPServer，返回监听地址
+func startTestSMTP(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newSMTPServer()
+	// 与 startSMTPServer 一样经 timeoutListener 提供服务，会话能找到自己的连接
+	go s.Serve(timeoutListener{ln})
+	t.Cleanup(func() { s.Close() })
+	return ln.Addr().String()
+}
+
+// sendTestMail 用 net/smtp 投递一封邮件，body 为完整的邮件内容（头部加正文）
+func sendTestMail(t *testing.T, addr, from string, to []string, body string) error {
+	t.Helper()
+	return smtp.SendMail(addr, nil, from, to, []byte(strings.ReplaceAll(body, "\n", "\r\n")))
+}
+
+// getJSON 请求 newRouter 提供的接口并把 JSON 响应解到 v 中，返回状态码
+func getJSON(t *testing.T, srv *httptest.Server, method, path string, v interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: 解析响应: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// TestReceiveAndFetch 从 SMTP 收信到 HTTP 取信的完整流程
+func TestReceiveAndFetch(t *testing.T) {
+	setupTest(t, nil)
+	smtpAddr := startTestSMTP(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	err := sendTestMail(t, smtpAddr, "alice@example.com", []string{"bob@test.local"}, `From: Alice <alice@example.com>
+To: bob@test.local
+Subject: =?UTF-8?B?5L2g5aW9?= integration
+Date: Mon, 02 Jan 2006 15:04:05 +0000
+Content-Type: text/plain; charset=utf-8
+
+Your code is 482913.
+`)
+	if err != nil {
+		t.Fatalf("投递失败: %v", err)
+	}
+
+	var list struct {
+		Data struct {
+			Mails []mailSummary `json:"mails"`
+		} `json:"data"`
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(list.Data.Mails) == 0 && time.Now().Before(deadline) {
+		getJSON(t, srv, "GET", "/api/v1/mailboxes/bob@test.local/messages", &list)
+	}
+	if len(list.Data.Mails) != 1 {
+		t.Fatalf("邮箱中应有 1 封邮件，实际 %d", len(list.Data.Mails))
+	}
+
+	var got struct {
+		Data getMailResponse `json:"data"`
+	}
+	if code := getJSON(t, srv, "GET", "/api/v1/mailboxes/bob@test.local/messages/"+list.Data.Mails[0].ID, &got); code != 200 {
+		t.Fatalf("读取邮件返回 %d", code)
+	}
+	m := got.Data.Mail
+	if !strings.Contains(m.From, "alice@example.com") {
+		t.Errorf("From = %q", m.From)
+	}
+	if m.Subject != "你好 integration" {
+		t.Errorf("Subject = %q", m.Subject)
+	}
+	if m.Text == nil || strings.TrimSpace(*m.Text) != "Your code is 482913." {
+		t.Errorf("Text = %v", m.Text)
+	}
+
+	// 旧接口取出后删除
+	var legacy map[string]interface{}
+	if code := getJSON(t, srv, "GET", "/getMail/bob@test.local", &legacy); code != 200 {
+		t.Fatalf("getMail 返回 %d", code)
+	}
+	if code := getJSON(t, srv, "GET", "/getMail/bob@test.local", nil); code != 204 {
+		t.Errorf("取出后 getMail 应返回 204，实际 %d", code)
+	}
+}
+
+func TestReceiveRejectsOtherDomains(t *testing.T) {
+	setupTest(t, nil)
+	smtpAddr := startTestSMTP(t)
+
+	err := sendTestMail(t, smtpAddr, "alice@example.com", []string{"bob@other.example"}, "Subject: x\n\nbody\n")
+	if err == nil || !strings.Contains(err.Error(), "550") {
+		t.Fatalf("其他域名应以 550 拒收，实际 %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/html"
+)
+
+// mailLink 邮件中的链接
+type mailLink struct {
+	URL  string `json:"url"`
+	Text string `json:"text"`
+}
+
+var (
+	bareURLPattern = regexp.MustCompile(`https?://[^\s<>"'\x60]+`)
+	// 确认类链接的关键词及权重
+	confirmKeywords = map[string]int{
+		"verify": 3, "verification": 3, "confirm": 3, "activate": 3, "activation": 3, "validate": 2,
+		"验证": 3, "确认": 3, "激活": 3,
+		"token": 1, "signup": 1, "register": 1, "email": 1,
+	}
+	unsubscribeKeywords = []string{"unsubscribe", "退订", "取消订阅", "preferences"}
+)
+
+// extractLinks 提取 HTML 中的 <a> 链接和纯文本中的裸链接，按出现顺序去重，只保留 http(s) 绝对链接
+func extractLinks(htmlBody, textBody string) []mailLink {
+	seen := make(map[string]bool)
+	links := make([]mailLink, 0)
+	add := func(u, text string) {
+		u = strings.TrimSpace(u)
+		lower := strings.ToLower(u)
+		if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+			return
+		}
+		if seen[u] {
+			return
+		}
+		seen[u] = true
+		links = append(links, mailLink{URL: u, Text: strings.Join(strings.Fields(text), " ")})
+	}
+
+	z := html.NewTokenizer(strings.NewReader(htmlBody))
+	var href string
+	var text strings.Builder
+	inAnchor := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		switch tt {
+		case html.StartTagToken:
+			tok := z.Token()
+			if tok.Data != "a" {
+				continue
+			}
+			inAnchor, href = true, ""
+			text.Reset()
+			for _, attr := range tok.Attr {
+				if attr.Key == "href" {
+					href = attr.Val
+				}
+			}
+		case html.TextToken:
+			if inAnchor {
+				text.Write(z.Text())
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "a" && inAnchor {
+				add(href, text.String())
+				inAnchor = false
+			}
+		}
+	}
+
+	for _, u := range bareURLPattern.FindAllString(textBody, -1) {
+		add(strings.TrimRight(u, ".,;:!?)]}>"), "")
+	}
+	return links
+}
+
+// guessConfirmationLink 根据链接地址和文字中的关键词猜测确认/激活链接
+func guessConfirmationLink(links []mailLink) *mailLink {
+	var best *mailLink
+	bestScore := 0
+	for i := range links {
+		s := strings.ToLower(links[i].URL + " " + links[i].Text)
+		score := 0
+		for keyword, weight := range confirmKeywords {
+			if strings.Contains(s, keyword) {
+				score += weight
+			}
+		}
+		for _, keyword := range unsubscribeKeywords {
+			if strings.Contains(s, keyword) {
+				score = 0
+			}
+		}
+		if score > bestScore {
+			best, bestScore = &links[i], score
+		}
+	}
+	return best
+}
+
+// handleGetLinks 返回邮件中的链接，不会删除邮件
+func handleGetLinks(c *gin.Context) {
+	mailHead := mailboxParam(c)
+
+	m, ok, err := mailStore.Get(mailHead, c.Param("id"))
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": msg("mail_not_found")})
+		return
+	}
+
+	links := extractLinks(m.HTML, m.Text)
+	c.JSON(200, linksResponse{Links: links, ConfirmationGuess: guessConfirmationLink(links)})
+}
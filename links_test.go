@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExtractLinks(t *testing.T) {
+	links := extractLinks(
+		`<p>Hi</p>
+<a href="https://example.com/verify?token=abc&amp;u=1">  Verify
+   your email </a>
+<a href="javascript:alert(1)">bad</a>
+<a href="mailto:help@example.com">mail</a>
+<a href="/relative">relative</a>
+<a href="https://example.com/verify?token=abc&amp;u=1">duplicate</a>
+<a name="anchor">no href</a>`,
+		"Or open https://example.com/plain, or (http://example.com/paren).\nAlso https://example.com/verify?token=abc&u=1")
+
+	want := []mailLink{
+		{URL: "https://example.com/verify?token=abc&u=1", Text: "Verify your email"},
+		{URL: "https://example.com/plain"},
+		{URL: "http://example.com/paren"},
+	}
+	if len(links) != len(want) {
+		t.Fatalf("提取到 %+v，应为 %+v", links, want)
+	}
+	for i := range want {
+		if links[i] != want[i] {
+			t.Errorf("第 %d 个链接 %+v，应为 %+v", i+1, links[i], want[i])
+		}
+	}
+
+	if links := extractLinks("", ""); links == nil || len(links) != 0 {
+		t.Errorf("没有链接时应返回空数组，得到 %#v", links)
+	}
+}
+
+func TestGuessConfirmationLink(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		links []mailLink
+		want  string
+	}{
+		{"按关键词选择", []mailLink{
+			{URL: "https://example.com/", Text: "Home"},
+			{URL: "https://example.com/a?id=1", Text: "Confirm your account"},
+			{URL: "https://example.com/help", Text: "Help"},
+		}, "https://example.com/a?id=1"},
+		{"地址中的关键词", []mailLink{
+			{URL: "https://example.com/blog", Text: "Blog"},
+			{URL: "https://example.com/activate/xyz", Text: "click here"},
+		}, "https://example.com/activate/xyz"},
+		{"中文关键词", []mailLink{{URL: "https://example.cn/x", Text: "点击激活账号"}}, "https://example.cn/x"},
+		{"权重高的优先", []mailLink{
+			{URL: "https://example.com/signup", Text: "Sign up"},
+			{URL: "https://example.com/v?token=1", Text: "Verify email"},
+		}, "https://example.com/v?token=1"},
+		{"退订链接不算", []mailLink{{URL: "https://example.com/unsubscribe?email=a", Text: "Confirm unsubscribe"}}, ""},
+		{"没有关键词", []mailLink{{URL: "https://example.com/", Text: "Home"}}, ""},
+		{"没有链接", nil, ""},
+	} {
+		got := guessConfirmationLink(tc.links)
+		if (got == nil) != (tc.want == "") || got != nil && got.URL != tc.want {
+			t.Errorf("%s: guessConfirmationLink = %+v，应为 %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGetLinks(t *testing.T) {
+	setupTest(t, nil)
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", ReceivedAt: time.Now(),
+		HTML: `<a href="https://example.com/">Home</a> <a href="https://example.com/confirm/1">Confirm</a>`})
+	r := newRouter()
+
+	var resp struct {
+		Data linksResponse `json:"data"`
+	}
+	w := testRequest(r, "GET", "/api/v1/mailboxes/user@test.local/messages/m1/links", "192.0.2.1")
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != 200 || len(resp.Data.Links) != 2 || resp.Data.ConfirmationGuess == nil ||
+		resp.Data.ConfirmationGuess.URL != "https://example.com/confirm/1" {
+		t.Errorf("GET links 返回 %d %s", w.Code, w.Body)
+	}
+	if w := testRequest(r, "GET", "/api/v1/mailboxes/user@test.local/messages/nope/links", "192.0.2.1"); w.Code != 404 {
+		t.Errorf("不存在的邮件返回 %d", w.Code)
+	}
+	if n, _ := mailStore.Count("user@test.local"); n != 1 {
+		t.Errorf("提取链接不应删除邮件")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 日志文件：设置 LOG_FILE 后日志写入该文件，超过 LOG_MAX_SIZE_MB 时改名为 <文件名>.<时间> 并新建文件，
+// 只保留最近 LOG_MAX_BACKUPS 个、不超过 LOG_MAX_AGE_DAYS 天的旧文件。收到 SIGUSR1 时立即轮转，
+// 也可以让 logrotate 移走文件后发送 SIGUSR1 重新打开。未设置 LOG_FILE 时写到标准错误
+
+// logBackupTimeFormat 旧日志文件名中的时间，按字典序即按时间排序
+const logBackupTimeFormat = "20060102-150405.000"
+
+// rotatingFile 按大小轮转的日志文件，SMTP、HTTP 等协程并发写入时由 mu 保证每条日志完整写入同一个文件
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open 以追加方式打开日志文件，沿用已有内容的大小
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// 轮转失败时继续写原文件，不丢日志
+			fmt.Fprintf(os.Stderr, "轮转日志文件失败: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Rotate 立即轮转。文件已被外部移走时（logrotate）只重新打开
+func (r *rotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rotate()
+}
+
+func (r *rotatingFile) rotate() error {
+	if _, err := os.Stat(r.path); err == nil {
+		backup := r.path + "." + time.Now().Format(logBackupTimeFormat)
+		if err := os.Rename(r.path, backup); err != nil {
+			return err
+		}
+	}
+	if r.file != os.Stderr {
+		r.file.Close()
+	}
+	if err := r.open(); err != nil {
+		// 新文件打不开时写到标准错误，下次轮转再试
+		r.file, r.size = os.Stderr, 0
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune 删除超出数量或时长的旧日志文件
+func (r *rotatingFile) prune() {
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(logBackupTimeFormat, strings.TrimPrefix(m, r.path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// 新的在前
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, b := range backups {
+		expired := false
+		if r.maxAge > 0 {
+			if info, err := os.Stat(b); err == nil && time.Since(info.ModTime()) > r.maxAge {
+				expired = true
+			}
+		}
+		if (r.maxBackups > 0 && i >= r.maxBackups) || expired {
+			if err := os.Remove(b); err != nil {
+				fmt.Fprintf(os.Stderr, "删除旧日志文件 %s 失败: %v\n", b, err)
+			}
+		}
+	}
+}
+
+// logFile 设置 LOG_FILE 时的日志文件
+var logFile *rotatingFile
+
+// logOutput 打开日志输出，需在 initLogging 中创建 handler 之前调用
+func logOutput() io.Writer {
+	if config().LogFile == "" {
+		return os.Stderr
+	}
+	var err error
+	logFile, err = openRotatingFile(config().LogFile, int64(config().LogMaxSizeMB)*1024*1024,
+		config().LogMaxBackups, time.Duration(config().LogMaxAgeDays)*24*time.Hour)
+	if err != nil {
+		log.Fatalf("打开日志文件失败: %v", err)
+	}
+	watchLogRotateSignal()
+	return logFile
+}
+
+// watchLogRotateSignal 收到 SIGUSR1 时立即轮转日志文件
+func watchLogRotateSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			if err := logFile.Rotate(); err != nil {
+				logger.Error("轮转日志文件失败", "error", err)
+				continue
+			}
+			logger.Info("收到 SIGUSR1，日志文件已轮转", "file", config().LogFile)
+		}
+	}()
+}
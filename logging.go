@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 日志：全部经由 log/slog 输出，LOG_LEVEL 控制级别（debug、info、warn、error），LOG_FORMAT 选择 text 或 json。
+// 各模块的日志带 component 字段（smtp、http、pop3、imap、cleanup、store、forward、config），
+// 标准库 log 的输出（启动信息等）也转到 slog，级别为 info。
+// LOG_LEGACY_FORMAT=true 时保持旧的输出格式（日期时间 + 消息 + 键=值，不带级别和 component），下一个版本移除。
+// 默认写到标准错误，设置 LOG_FILE 时写入按大小轮转的文件，见 logfile.go
+
+// logLevel 当前的日志级别，重新加载配置时更新
+var logLevel = new(slog.LevelVar)
+
+var (
+	// logger 结构化日志，HTTP 请求使用带 request_id 的子 logger
+	logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+
+	// 各模块的 logger，由 initLogging 按配置重新创建
+	smtpLogger    = logger
+	httpLogger    = logger
+	pop3Logger    = logger
+	imapLogger    = logger
+	cleanupLogger = logger
+	storeLogger   = logger
+	forwardLogger = logger
+	configLogger  = logger
+)
+
+// initLogging 按配置设置日志级别和格式，需在读取配置之后、输出其他日志之前调用
+func initLogging() {
+	logLevel.Set(config().LogLevel)
+	out := logOutput()
+	log.SetOutput(out)
+	var handler slog.Handler
+	switch {
+	case config().LogLegacyFormat:
+		handler = legacyHandler{}
+	case config().LogFormat == "json":
+		handler = slog.NewJSONHandler(out, &slog.HandlerOptions{Level: logLevel})
+	default:
+		handler = slog.NewTextHandler(out, &slog.HandlerOptions{Level: logLevel})
+	}
+	logger = slog.New(handler)
+	if !config().LogLegacyFormat {
+		// 标准库 log 的输出改由 logger 处理，旧格式下 legacyHandler 本身经由标准库 log 输出
+		slog.SetDefault(logger)
+	}
+
+	smtpLogger = componentLogger("smtp")
+	httpLogger = componentLogger("http")
+	pop3Logger = componentLogger("pop3")
+	imapLogger = componentLogger("imap")
+	cleanupLogger = componentLogger("cleanup")
+	storeLogger = componentLogger("store")
+	forwardLogger = componentLogger("forward")
+	configLogger = componentLogger("config")
+
+	// gin 自身的输出（调试信息、错误）同样经由 slog
+	gin.DefaultWriter = slog.NewLogLogger(httpLogger.Handler(), slog.LevelDebug).Writer()
+	gin.DefaultErrorWriter = slog.NewLogLogger(httpLogger.Handler(), slog.LevelError).Writer()
+}
+
+// componentLogger 带 component 字段的 logger，旧格式下不加
+func componentLogger(name string) *slog.Logger {
+	if config().LogLegacyFormat {
+		return logger
+	}
+	return logger.With("component", name)
+}
+
+// legacyHandler 旧的输出格式：经由标准库 log 输出 "日期 时间 消息 键=值 ..."，不带级别
+type legacyHandler struct {
+	attrs []slog.Attr
+}
+
+func (h legacyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h legacyHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	log.Print(b.String())
+	return nil
+}
+
+func (h legacyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return legacyHandler{attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h legacyHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+type loggerKey struct{}
+
+// reqLogger 取当前请求的 logger，日志会带上 request_id
+func reqLogger(c *gin.Context) *slog.Logger {
+	if l, ok := c.Get("logger"); ok {
+		return l.(*slog.Logger)
+	}
+	return httpLogger
+}
+
+// loggerFrom 从 context 取 logger，供拿不到 gin.Context 的代码使用
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return httpLogger
+}
+
+// accessLogMiddleware 为每个请求生成或沿用 X-Request-ID，并输出一行结构化访问日志。
+// 访问日志为 info 级别，LOG_LEVEL=warn 时不输出
+func accessLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		l := httpLogger.With("request_id", requestID(c))
+		c.Set("logger", l)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), loggerKey{}, l))
+
+		c.Next()
+
+		l.Info("HTTP 请求",
+			"method", c.Request.Method,
+			"path", path,
+			"status", c.Writer.Status(),
+			"ip", c.ClientIP(),
+			"duration", time.Since(start),
+		)
+	}
+}
+
+// recoveryMiddleware 处理请求时 panic 返回 500，并把错误和调用栈写入该请求的日志
+func recoveryMiddleware() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(nil, func(c *gin.Context, err interface{}) {
+		reqLogger(c).Error("处理请求时发生 panic", "error", err, "stack", string(debug.Stack()))
+		c.AbortWithStatus(500)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxLongPollWait wait 参数的上限，同时不超过 HTTP 写超时
+const maxLongPollWait = 2 * time.Minute
+
+var (
+	// mailWaiters 按邮箱登记等待新邮件的请求
+	mailWaiters   = make(map[string]map[chan struct{}]struct{})
+	mailWaitersMu sync.Mutex
+)
+
+// notifyMailbox 唤醒等待该邮箱的请求，邮件保存之后调用
+func notifyMailbox(mailHead string) {
+	mailWaitersMu.Lock()
+	defer mailWaitersMu.Unlock()
+	for ch := range mailWaiters[mailHead] {
+		close(ch)
+	}
+	delete(mailWaiters, mailHead)
+}
+
+func addMailWaiter(mailHead string, ch chan struct{}) {
+	mailWaitersMu.Lock()
+	defer mailWaitersMu.Unlock()
+	if mailWaiters[mailHead] == nil {
+		mailWaiters[mailHead] = make(map[chan struct{}]struct{})
+	}
+	mailWaiters[mailHead][ch] = struct{}{}
+}
+
+func removeMailWaiter(mailHead string, ch chan struct{}) {
+	mailWaitersMu.Lock()
+	defer mailWaitersMu.Unlock()
+	delete(mailWaiters[mailHead], ch)
+	if len(mailWaiters[mailHead]) == 0 {
+		delete(mailWaiters, mailHead)
+	}
+}
+
+// waitParam 解析 wait 参数，支持 30s 这样的 duration 或秒数，超出上限时截断
+func waitParam(c *gin.Context) (time.Duration, bool) {
+	value := c.Query("wait")
+	if value == "" {
+		return 0, true
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, false
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, false
+	}
+
+	return min(wait, maxWait()), true
+}
+
+// maxWait wait 参数实际生效的上限，留出写响应的时间，避免等待结束时连接已被写超时关闭
+func maxWait() time.Duration {
+	limit := maxLongPollWait
+	if config().HTTPWriteTimeout > 0 && config().HTTPWriteTimeout-time.Second < limit {
+		limit = config().HTTPWriteTimeout - time.Second
+	}
+	return limit
+}
+
+// sharedStorePollInterval 共享存储下定期重新检查的间隔
+const sharedStorePollInterval = time.Second
+
+// waitForMail 邮箱已有邮件时立即返回 true，否则等待新邮件投递，超时或客户端断开时返回 false
+func waitForMail(ctx context.Context, mailHead string, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	// 共享存储中其他实例投递的邮件不会通知本实例，需要定期检查
+	var poll <-chan time.Time
+	if storeShared {
+		ticker := time.NewTicker(sharedStorePollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		ch := make(chan struct{})
+		// 先登记再检查：投递在保存之后才通知，检查之后到达的邮件一定会唤醒等待
+		addMailWaiter(mailHead, ch)
+		// 存储出错时不再等待，由调用方取邮件时返回错误
+		if n, err := mailStore.Count(mailHead); err != nil || n > 0 {
+			removeMailWaiter(mailHead, ch)
+			return true
+		}
+
+		select {
+		case <-ch:
+			// 邮件可能已被其他请求取走，重新检查
+		case <-poll:
+			removeMailWaiter(mailHead, ch)
+		case <-timer.C:
+			removeMailWaiter(mailHead, ch)
+			return false
+		case <-ctx.Done():
+			removeMailWaiter(mailHead, ch)
+			return false
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 空闲邮箱淘汰：配置 MAX_MAILBOXES 后记录每个邮箱最近一次投递或接口读取的时间，
+// 邮箱总数超过上限时，后台按最久未访问的顺序删除多出的邮箱。只适用于内存存储
+
+// mailboxEvictInterval 检查邮箱数是否超过上限的间隔
+const mailboxEvictInterval = 10 * time.Second
+
+type mailboxAccess struct {
+	address      string
+	lastAccessed time.Time
+}
+
+// accessTracker 按访问时间排列邮箱的链表，最近访问的在头部。访问时把节点移到头部，
+// 淘汰时从尾部取，都不需要遍历。有自己的锁，总是在分片锁之后获取
+type accessTracker struct {
+	mu    sync.Mutex
+	order *list.List
+	index map[string]*list.Element
+}
+
+func newAccessTracker() *accessTracker {
+	return &accessTracker{order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// add 投递或创建邮箱时调用，没有记录时新建。t 为 nil 表示未启用淘汰
+func (t *accessTracker) add(address string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.index[address]; ok {
+		e.Value.(*mailboxAccess).lastAccessed = time.Now()
+		t.order.MoveToFront(e)
+		return
+	}
+	t.index[address] = t.order.PushFront(&mailboxAccess{address: address, lastAccessed: time.Now()})
+}
+
+// touch 接口读取时调用，只更新已有的记录，读取不存在的邮箱不会留下记录
+func (t *accessTracker) touch(address string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.index[address]; ok {
+		e.Value.(*mailboxAccess).lastAccessed = time.Now()
+		t.order.MoveToFront(e)
+	}
+}
+
+func (t *accessTracker) forget(address string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.index[address]; ok {
+		t.order.Remove(e)
+		delete(t.index, address)
+	}
+}
+
+func (t *accessTracker) reset() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.order.Init()
+	t.index = make(map[string]*list.Element)
+}
+
+func (t *accessTracker) has(address string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.index[address]
+	return ok
+}
+
+// popOldest 取出最久未访问的邮箱
+func (t *accessTracker) popOldest() (mailboxAccess, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.order.Back()
+	if e == nil {
+		return mailboxAccess{}, false
+	}
+	a := t.order.Remove(e).(*mailboxAccess)
+	delete(t.index, a.address)
+	return *a, true
+}
+
+// evictedMailbox 被淘汰的邮箱
+type evictedMailbox struct {
+	mailboxAccess
+	mails []mailContent
+}
+
+// evictIdle 邮箱数超过 limit 时删除最久未访问的邮箱。版本号照常更新而不是删除记录，
+// 客户端缓存的 ETag 和 Last-Modified 不会在淘汰后误判为未修改
+func (s *memoryStore) evictIdle(limit int) []evictedMailbox {
+	var evicted []evictedMailbox
+	for excess := s.mailboxCount() - limit; excess > 0; {
+		a, ok := s.access.popOldest()
+		if !ok {
+			break
+		}
+		sh := s.shard(a.address)
+		sh.mu.Lock()
+		mb := sh.mailboxes[a.address]
+		if mb == nil {
+			sh.mu.Unlock()
+			continue
+		}
+		mb.mu.Lock()
+		// 取出记录之后又有投递时记录会重新出现，说明邮箱刚被访问过，不再淘汰
+		if s.access.has(a.address) {
+			mb.mu.Unlock()
+			sh.mu.Unlock()
+			continue
+		}
+		mails := sh.remove(a.address, mb)
+		mb.mu.Unlock()
+		sh.mu.Unlock()
+		evicted = append(evicted, evictedMailbox{mailboxAccess: a, mails: mails})
+		excess--
+	}
+	return evicted
+}
+
+// evictIdleMailboxes 淘汰多出的邮箱并记录日志，同时删除它们的去重记录和外置附件，
+// 淘汰后的邮箱与从未出现过的邮箱表现一致
+func evictIdleMailboxes(ms *memoryStore) {
+	evicted := ms.evictIdle(config().MaxMailboxes)
+	if len(evicted) == 0 {
+		return
+	}
+	addresses := make([]string, 0, len(evicted))
+	for _, e := range evicted {
+		cleanupLogger.Info("邮箱数超过上限，已淘汰最久未访问的邮箱", "limit", config().MaxMailboxes,
+			"mailbox", e.address, "messages", len(e.mails), "last_accessed", e.lastAccessed.Format(time.RFC3339))
+		addresses = append(addresses, e.address)
+		deleteMailBlobs(e.mails)
+	}
+	forgetMailboxDedup(addresses)
+}
+
+// enableMailboxEviction 配置 MAX_MAILBOXES 时开始记录内存存储的访问时间，需在恢复快照之前调用
+func enableMailboxEviction(ms *memoryStore) {
+	if config().MaxMailboxes > 0 {
+		ms.access = newAccessTracker()
+	}
+}
+
+// startMailboxEvictor 定期检查邮箱数，超过上限时淘汰
+func startMailboxEvictor() {
+	ms, ok := backendStore().(*memoryStore)
+	if !ok || ms.access == nil {
+		return
+	}
+	log.Printf("已启用空闲邮箱淘汰，邮箱数超过 %d 时删除最久未访问的邮箱", config().MaxMailboxes)
+	go func() {
+		ticker := time.NewTicker(mailboxEvictInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			evictIdleMailboxes(ms)
+		}
+	}()
+}
+
+// mailboxAccessMiddleware 接口读取邮箱时更新访问时间，在 handler 之前更新，请求期间不会被淘汰
+func mailboxAccessMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ms, ok := backendStore().(*memoryStore); ok {
+			if address := mailboxParam(c); address != "" {
+				ms.access.touch(address)
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxMailboxPageSize = 500
+	maxBatchMailboxes  = 50
+)
+
+// mailboxSummary 管理接口中单个邮箱的概要
+type mailboxSummary struct {
+	Address       string    `json:"address"`
+	Messages      int       `json:"messages"`
+	Bytes         int64     `json:"bytes"`
+	FirstDelivery time.Time `json:"firstDelivery"`
+	LastDelivery  time.Time `json:"lastDelivery"`
+}
+
+func handleAdminListMailboxes(c *gin.Context) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(400, gin.H{"error": msg("invalid_offset")})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > maxMailboxPageSize {
+		c.JSON(400, gin.H{"error": msg("out_of_range", "limit", 1, maxMailboxPageSize)})
+		return
+	}
+
+	summaries, err := mailStore.Mailboxes(c.Query("prefix"))
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	// 最近有投递的排在前面，时间相同时按地址排序保证分页稳定
+	sort.Slice(summaries, func(i, j int) bool {
+		if !summaries[i].LastDelivery.Equal(summaries[j].LastDelivery) {
+			return summaries[i].LastDelivery.After(summaries[j].LastDelivery)
+		}
+		return summaries[i].Address < summaries[j].Address
+	})
+
+	total := len(summaries)
+	page := summaries[min(offset, total):min(offset+limit, total)]
+	c.JSON(200, mailboxListResponse{Total: total, Offset: offset, Limit: limit, Mailboxes: page})
+}
+
+const newMailboxLocalLength = 10
+
+// newMailboxResponse 新建邮箱的返回
+type newMailboxResponse struct {
+	Address string `json:"address"`
+	// 设置 MAILBOX_TOKEN_SECRET 时返回，作为 POP3/IMAP 的登录密码
+	Token string `json:"token,omitempty"`
+}
+
+// mailboxToken 邮箱的登录令牌：MAILBOX_TOKEN_SECRET 对地址的 HMAC-SHA256，取前 16 字节的十六进制。
+// 令牌不保存，随时可以重新计算，更换密钥后旧令牌全部失效
+func mailboxToken(address string) string {
+	mac := hmac.New(sha256.New, []byte(config().MailboxTokenSecret))
+	mac.Write([]byte(normalizeAddress(address)))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// mailboxPasswordOK POP3/IMAP 登录的密码检查：未设置 MAILBOX_TOKEN_SECRET 时任何密码都可以，否则必须为邮箱令牌
+func mailboxPasswordOK(address, password string) bool {
+	if config().MailboxTokenSecret == "" {
+		return true
+	}
+	return hmac.Equal([]byte(password), []byte(mailboxToken(address)))
+}
+
+// handleNewMailbox 生成一个随机地址，domain 参数指定域名，默认使用第一个非通配域名。
+// 地址会登记为空邮箱，关闭 catch-all 时也能收信
+func handleNewMailbox(c *gin.Context) {
+	domain := config().primaryDomain()
+	if d := c.Query("domain"); d != "" {
+		d = normalizeDomain(d)
+		if !domainAllowed(d) {
+			c.JSON(400, gin.H{"error": msg("unsupported_domain")})
+			return
+		}
+		domain = d
+	}
+	if domain == "" {
+		c.JSON(400, gin.H{"error": msg("subdomain_required")})
+		return
+	}
+
+	for {
+		local, err := randomLocalPart(newMailboxLocalLength)
+		if err != nil {
+			reqLogger(c).Error("生成随机地址失败", "error", err)
+			c.JSON(500, gin.H{"error": msg("address_generation_fail")})
+			return
+		}
+		address := local + "@" + domain
+		created, err := mailStore.Create(address)
+		if err != nil {
+			storeUnavailable(c, err)
+			return
+		}
+		if !created {
+			continue
+		}
+		resp := newMailboxResponse{Address: address}
+		if config().MailboxTokenSecret != "" {
+			resp.Token = mailboxToken(address)
+		}
+		c.JSON(201, resp)
+		return
+	}
+}
+
+// randomLocalPart 生成由小写字母和数字组成的随机本地部分
+func randomLocalPart(n int) (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = letters[int(b[i])%len(letters)]
+	}
+	return string(b), nil
+}
+
+// handleBatchListMail 一次返回多个邮箱的邮件概要（不删除），请求体为地址数组，按请求顺序返回，重复地址只返回一次
+func handleBatchListMail(c *gin.Context) {
+	var addresses []string
+	if err := c.ShouldBindJSON(&addresses); err != nil {
+		c.JSON(400, gin.H{"error": msg("mailbox_list_expected")})
+		return
+	}
+	if len(addresses) == 0 || len(addresses) > maxBatchMailboxes {
+		c.JSON(400, gin.H{"error": msg("mailbox_count", maxBatchMailboxes)})
+		return
+	}
+
+	seen := make(map[string]bool, len(addresses))
+	result := make([]batchMailbox, 0, len(addresses))
+	for _, address := range addresses {
+		address = normalizeAddress(address)
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		mails, err := mailStore.List(address)
+		if err != nil {
+			storeUnavailable(c, err)
+			return
+		}
+		list := make([]mailSummary, 0, len(mails))
+		for _, m := range mails {
+			list = append(list, mailSummary{ID: m.ID, TraceID: m.TraceID, From: m.From, Subject: m.Subject, ReceivedAt: m.ReceivedAt, Spam: m.Spam, Attachments: m.Attachments})
+		}
+		result = append(result, batchMailbox{Address: address, Mails: list})
+	}
+
+	c.JSON(200, batchMailResponse{Mailboxes: result})
+}
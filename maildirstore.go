@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maildirMetaHeader 投递时加在邮件最前面的头，保存 API 需要但原始邮件中没有的信息
+const maildirMetaHeader = "X-Tempmail-Meta"
+
+// maildirMeta maildirMetaHeader 中的 JSON，RawOffset 为加在原始邮件前的头部长度
+type maildirMeta struct {
+	ID         string         `json:"id"`
+	TraceID    string         `json:"trace_id"`
+	From       string         `json:"from"`
+	ReceivedAt time.Time      `json:"received_at"`
+	ExpiresAt  *time.Time     `json:"expires_at,omitempty"`
+	ClientIP   string         `json:"client_ip"`
+	Helo       string         `json:"helo"`
+	DNS        dnsCheckResult `json:"dns"`
+	DNSBL      []string       `json:"dnsbl"`
+	Spam       *spamVerdict   `json:"spam,omitempty"`
+	RawOffset  int            `json:"raw_offset"`
+}
+
+// maildirStore 把每封邮件写成 Maildir 中的一个文件，mutt、notmuch 等工具可以直接读取。
+//
+// 每个邮箱一个目录（地址经过路径转义），下有 tmp、new、cur；文件先写入 tmp 再改名到 new，
+// 标记已读时按约定移到 cur 并在文件名后加 :2,S 标志。
+// 文件开头加上 Return-Path、Delivered-To、Received 和 X-Tempmail-Meta 头，其后为原始邮件。
+// 读取都走内存中的索引（memoryStore），启动时从目录重建；文件系统出错时只记录日志，邮件仍保存在内存中，不会退信
+type maildirStore struct {
+	root  string
+	index *memoryStore
+
+	// files 由 mu 保护，邮件 ID 到文件路径，写文件失败的邮件没有记录
+	mu    sync.Mutex
+	files map[string]string
+
+	seq      atomic.Uint64
+	hostname string
+}
+
+func openMaildirStore(root string) (*maildirStore, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	// 文件名中 / 和 : 有特殊含义
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+	s := &maildirStore{
+		root:     root,
+		index:    newMemoryStore(),
+		files:    make(map[string]string),
+		hostname: hostname,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *maildirStore) mailboxDir(mailbox string) string {
+	return filepath.Join(s.root, url.PathEscape(mailbox))
+}
+
+// ensureMaildir 创建邮箱的 tmp、new、cur 目录
+func (s *maildirStore) ensureMaildir(mailbox string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(s.mailboxDir(mailbox), sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load 扫描目录重建索引，无法解析的文件跳过并记录日志
+func (s *maildirStore) load() error {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		mailbox, err := url.PathUnescape(entry.Name())
+		if err != nil || !strings.Contains(mailbox, "@") {
+			storeLogger.Warn("Maildir: 跳过无法识别的目录", "dir", entry.Name())
+			continue
+		}
+		s.index.Create(mailbox)
+
+		var mails []mailContent
+		paths := make(map[string]string)
+		for _, sub := range []string{"new", "cur"} {
+			dir := filepath.Join(s.root, entry.Name(), sub)
+			files, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				if f.IsDir() {
+					continue
+				}
+				path := filepath.Join(dir, f.Name())
+				m, err := readMaildirFile(path, mailbox)
+				if err != nil {
+					storeLogger.Warn("Maildir: 跳过无法解析的文件", "file", path, "error", err)
+					continue
+				}
+				mails = append(mails, m)
+				paths[m.ID] = path
+			}
+		}
+		sort.SliceStable(mails, func(i, j int) bool { return mails[i].ReceivedAt.Before(mails[j].ReceivedAt) })
+		for _, m := range mails {
+			s.index.Append(m)
+			s.files[m.ID] = paths[m.ID]
+		}
+	}
+	return nil
+}
+
+// readMaildirFile 读取一封邮件；不是本服务写入的文件（没有 X-Tempmail-Meta）用文件名和修改时间补全
+func readMaildirFile(path, mailbox string) (mailContent, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return mailContent{}, err
+	}
+
+	var meta maildirMeta
+	if value := leadingHeader(data, maildirMetaHeader); value != "" {
+		if err := json.Unmarshal([]byte(value), &meta); err != nil {
+			return mailContent{}, fmt.Errorf("%s 无效: %v", maildirMetaHeader, err)
+		}
+	}
+	if meta.RawOffset < 0 || meta.RawOffset > len(data) {
+		return mailContent{}, fmt.Errorf("%s 中的 raw_offset 无效", maildirMetaHeader)
+	}
+	raw := data[meta.RawOffset:]
+	msg, err := parseMail(raw)
+	if err != nil {
+		return mailContent{}, err
+	}
+
+	m := mailContent{
+		ID:          meta.ID,
+		TraceID:     meta.TraceID,
+		From:        meta.From,
+		To:          mailbox,
+		Subject:     msg.Subject,
+		Text:        msg.TextBody,
+		HTML:        msg.HTMLBody,
+		Attachments: msg.Attachments,
+		inline:      msg.Inline,
+		ReceivedAt:  meta.ReceivedAt,
+		ClientIP:    meta.ClientIP,
+		Helo:        meta.Helo,
+		DNS:         meta.DNS,
+		DNSBL:       meta.DNSBL,
+		Spam:        meta.Spam,
+		ExpiresAt:   meta.ExpiresAt,
+		Read:        maildirSeen(path),
+	}
+	if config().StoreRaw {
+		m.raw = raw
+	}
+	if m.ID == "" {
+		// 文件名中第一个 : 之前的部分在 Maildir 中唯一
+		m.ID, _, _ = strings.Cut(filepath.Base(path), ":")
+	}
+	if m.ReceivedAt.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			m.ReceivedAt = info.ModTime()
+		}
+	}
+	return m, nil
+}
+
+// leadingHeader 在文件开头的头部中查找指定的头，只支持单行的值
+func leadingHeader(data []byte, name string) string {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" {
+			break
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(key, name) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// deliveryHeaders 写在原始邮件前面的投递信息
+func (s *maildirStore) deliveryHeaders(m mailContent) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%s>\r\n", m.From)
+	fmt.Fprintf(&buf, "Delivered-To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Received: from %s ([%s])\r\n\tby %s with SMTP id %s\r\n\tfor <%s>; %s\r\n",
+		m.Helo, m.ClientIP, config().SMTPHostname, m.TraceID, m.To, m.ReceivedAt.Format(time.RFC1123Z))
+
+	meta := maildirMeta{
+		ID: m.ID, TraceID: m.TraceID, From: m.From, ReceivedAt: m.ReceivedAt,
+		ClientIP: m.ClientIP, Helo: m.Helo, DNS: m.DNS, DNSBL: m.DNSBL, Spam: m.Spam, ExpiresAt: m.ExpiresAt,
+	}
+	// RawOffset 包含这一行自身，数字位数会影响行长，重复计算直到不再变化
+	offset := buf.Len()
+	for {
+		meta.RawOffset = offset
+		line, err := json.Marshal(meta)
+		if err != nil {
+			return nil, err
+		}
+		header := fmt.Sprintf("%s: %s\r\n", maildirMetaHeader, line)
+		if buf.Len()+len(header) == offset {
+			buf.WriteString(header)
+			return buf.Bytes(), nil
+		}
+		offset = buf.Len() + len(header)
+	}
+}
+
+// writeMail 按 Maildir 约定先写入 tmp 再改名到 new，读取方不会看到写了一半的文件
+func (s *maildirStore) writeMail(m mailContent) (string, error) {
+	if err := s.ensureMaildir(m.To); err != nil {
+		return "", err
+	}
+	head, err := s.deliveryHeaders(m)
+	if err != nil {
+		return "", err
+	}
+	raw := m.raw
+	if len(raw) == 0 {
+		raw = buildEML(m)
+	}
+
+	name := fmt.Sprintf("%d.M%dP%dQ%d_%s.%s", m.ReceivedAt.Unix(), m.ReceivedAt.Nanosecond()/1000, os.Getpid(), s.seq.Add(1), m.ID, s.hostname)
+	dir := s.mailboxDir(m.To)
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(append(head, raw...))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	path := filepath.Join(dir, "new", name)
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return path, nil
+}
+
+// maildirSeen 文件名的标志中是否有 S（已读）
+func maildirSeen(path string) bool {
+	_, flags, ok := strings.Cut(filepath.Base(path), ":2,")
+	return ok && strings.Contains(flags, "S")
+}
+
+// maildirFlagPath 设置或去掉 S 标志后的路径，按约定放在 cur 中，标志按字母顺序排列
+func maildirFlagPath(path string, seen bool) string {
+	base, flags, _ := strings.Cut(filepath.Base(path), ":2,")
+	flags = strings.ReplaceAll(flags, "S", "")
+	if seen {
+		flags += "S"
+	}
+	sorted := []byte(flags)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return filepath.Join(filepath.Dir(filepath.Dir(path)), "cur", base+":2,"+string(sorted))
+}
+
+// renameSeen 按已读状态改名邮件文件，出错只记录日志，内存中的状态不受影响
+func (s *maildirStore) renameSeen(ids []string, seen bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		path, ok := s.files[id]
+		if !ok {
+			continue
+		}
+		target := maildirFlagPath(path, seen)
+		if err := os.Rename(path, target); err != nil {
+			storeLogger.Error("Maildir: 重命名失败", "file", path, "error", err)
+			continue
+		}
+		s.files[id] = target
+	}
+}
+
+// removeFiles 删除邮件文件，出错只记录日志
+func (s *maildirStore) removeFiles(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		path, ok := s.files[id]
+		if !ok {
+			continue
+		}
+		delete(s.files, id)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			storeLogger.Error("Maildir: 删除失败", "file", path, "error", err)
+		}
+	}
+}
+
+// removeMailbox 删除邮箱目录，出错只记录日志
+func (s *maildirStore) removeMailbox(mailbox string) {
+	if err := os.RemoveAll(s.mailboxDir(mailbox)); err != nil {
+		storeLogger.Error("Maildir: 删除邮箱目录失败", "mailbox", mailbox, "error", err)
+	}
+}
+
+func (s *maildirStore) Append(m mailContent) error {
+	path, err := s.writeMail(m)
+	if err != nil {
+		storeLogger.Error("Maildir: 写入邮件失败，只保存在内存中", "mailbox", m.To, "id", m.ID, "error", err)
+	} else {
+		s.mu.Lock()
+		s.files[m.ID] = path
+		s.mu.Unlock()
+	}
+	if !config().StoreRaw {
+		m.raw = nil
+	}
+	return s.index.Append(m)
+}
+
+func (s *maildirStore) Create(mailbox string) (bool, error) {
+	created, err := s.index.Create(mailbox)
+	if created {
+		if err := s.ensureMaildir(mailbox); err != nil {
+			storeLogger.Error("Maildir: 创建邮箱目录失败", "mailbox", mailbox, "error", err)
+		}
+	}
+	return created, err
+}
+
+func (s *maildirStore) Exists(mailbox string) (bool, error) {
+	return s.index.Exists(mailbox)
+}
+
+func (s *maildirStore) Count(mailbox string) (int, error) {
+	return s.index.Count(mailbox)
+}
+
+func (s *maildirStore) PopLatest(mailbox string) (mailContent, bool, error) {
+	m, ok, err := s.index.PopLatest(mailbox)
+	if ok {
+		s.removeFiles(m.ID)
+	}
+	return m, ok, err
+}
+
+func (s *maildirStore) Remove(mailbox string, ids []string) (int, error) {
+	// 文件表按 ID 索引，只删除确实属于该邮箱的邮件文件
+	mails, _ := s.index.List(mailbox)
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	var owned []string
+	for _, m := range mails {
+		if remove[m.ID] {
+			owned = append(owned, m.ID)
+		}
+	}
+	n, err := s.index.Remove(mailbox, owned)
+	s.removeFiles(owned...)
+	return n, err
+}
+
+func (s *maildirStore) Latest(mailbox string) (mailContent, bool, error) {
+	return s.index.Latest(mailbox)
+}
+
+func (s *maildirStore) List(mailbox string) ([]mailContent, error) {
+	return s.index.List(mailbox)
+}
+
+func (s *maildirStore) Get(mailbox, id string) (mailContent, bool, error) {
+	return s.index.Get(mailbox, id)
+}
+
+func (s *maildirStore) SetRead(mailbox, id string, read bool) (int, error) {
+	mails, _ := s.index.List(mailbox)
+	var changed []string
+	for _, m := range mails {
+		if (id == "" || m.ID == id) && m.Read != read {
+			changed = append(changed, m.ID)
+		}
+	}
+	n, err := s.index.SetRead(mailbox, id, read)
+	s.renameSeen(changed, read)
+	return n, err
+}
+
+func (s *maildirStore) Delete(mailbox string) (int, error) {
+	mails, _ := s.index.List(mailbox)
+	n, err := s.index.Delete(mailbox)
+	ids := make([]string, 0, len(mails))
+	for _, m := range mails {
+		ids = append(ids, m.ID)
+	}
+	s.removeFiles(ids...)
+	s.removeMailbox(mailbox)
+	return n, err
+}
+
+func (s *maildirStore) Clear() error {
+	if err := s.index.Clear(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.files = make(map[string]string)
+	s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		storeLogger.Error("Maildir: 读取目录失败", "dir", s.root, "error", err)
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if err := os.RemoveAll(filepath.Join(s.root, entry.Name())); err != nil {
+				storeLogger.Error("Maildir: 删除失败", "file", entry.Name(), "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *maildirStore) Expire(now time.Time) (int, error) {
+	// 先记下会过期的邮件，索引删除后再删文件
+	summaries, _ := s.index.Mailboxes("")
+	var expired []string
+	var mailboxes []string
+	for _, sum := range summaries {
+		mails, _ := s.index.List(sum.Address)
+		hit := false
+		for _, m := range mails {
+			if m.expired(now) {
+				expired = append(expired, m.ID)
+				hit = true
+			}
+		}
+		if hit {
+			mailboxes = append(mailboxes, sum.Address)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	n, err := s.index.Expire(now)
+	s.removeFiles(expired...)
+	// 因此变空的邮箱目录一并删除
+	for _, mailbox := range mailboxes {
+		if exists, _ := s.index.Exists(mailbox); !exists {
+			s.removeMailbox(mailbox)
+		}
+	}
+	return n, err
+}
+
+func (s *maildirStore) Trim(keep int) (int, int, error) {
+	// 先记下会被删除的邮件，索引删除后再删文件
+	summaries, _ := s.index.Mailboxes("")
+	var dropped []string
+	for _, sum := range summaries {
+		if sum.Messages <= keep {
+			continue
+		}
+		mails, _ := s.index.List(sum.Address)
+		for _, m := range mails[min(keep, len(mails)):] {
+			dropped = append(dropped, m.ID)
+		}
+	}
+	if len(dropped) == 0 {
+		return 0, 0, nil
+	}
+
+	n, trimmed, err := s.index.Trim(keep)
+	s.removeFiles(dropped...)
+	return n, trimmed, err
+}
+
+func (s *maildirStore) Revision(mailbox string) (mailboxRevision, error) {
+	return s.index.Revision(mailbox)
+}
+
+func (s *maildirStore) Size(mailbox string) (int64, error) {
+	return s.index.Size(mailbox)
+}
+
+func (s *maildirStore) Mailboxes(prefix string) ([]mailboxSummary, error) {
+	return s.index.Mailboxes(prefix)
+}
+
+func (s *maildirStore) Stats(now time.Time) (storeStats, error) {
+	return s.index.Stats(now)
+}
+
+// Sequence 序号由内存索引分配，重启后重新编号，UIDVALIDITY 随之改变
+func (s *maildirStore) Sequence() (mailSequence, error) {
+	return s.index.Sequence()
+}
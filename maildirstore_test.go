@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const maildirTestRaw = "From: Alice <alice@example.com>\r\n" +
+	"To: user@test.local\r\n" +
+	"Subject: =?UTF-8?B?5L2g5aW9?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Your code is 482913\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain; name=\"a.txt\"\r\n" +
+	"Content-Disposition: attachment; filename=\"a.txt\"\r\n" +
+	"\r\n" +
+	"hi\r\n" +
+	"--b1--\r\n"
+
+func openTestMaildir(t *testing.T, root string) *maildirStore {
+	t.Helper()
+	ms, err := openMaildirStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+// maildirFiles 列出邮箱 sub 目录（tmp、new、cur）中的文件
+func maildirFiles(t *testing.T, root, mailbox, sub string) []string {
+	t.Helper()
+	entries, _ := os.ReadDir(filepath.Join(root, url.PathEscape(mailbox), sub))
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, filepath.Join(root, url.PathEscape(mailbox), sub, e.Name()))
+	}
+	return paths
+}
+
+// TestMaildirFilesReadableByOtherParsers 用标准库的 net/mail 和 mime/multipart 而不是本服务用的 go-message 读取写入的文件
+func TestMaildirFilesReadableByOtherParsers(t *testing.T) {
+	setupTest(t, nil)
+	root := t.TempDir()
+	ms := openTestMaildir(t, root)
+
+	m := testMail("user@test.local", "m1", 0)
+	m.raw = []byte(maildirTestRaw)
+	m.ClientIP, m.Helo = "192.0.2.1", "mx.example.com"
+	if err := ms.Append(m); err != nil {
+		t.Fatal(err)
+	}
+	// 没有原始邮件时按正文生成
+	if err := ms.Append(testMail("user@test.local", "m2", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if tmp := maildirFiles(t, root, "user@test.local", "tmp"); len(tmp) != 0 {
+		t.Errorf("tmp 中留有文件: %q", tmp)
+	}
+	files := maildirFiles(t, root, "user@test.local", "new")
+	if len(files) != 2 {
+		t.Fatalf("new 中有 %d 个文件", len(files))
+	}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		msg, err := mail.ReadMessage(f)
+		if err != nil {
+			t.Fatalf("net/mail 无法解析 %s: %v", filepath.Base(path), err)
+		}
+		if msg.Header.Get("Delivered-To") != "user@test.local" || msg.Header.Get(maildirMetaHeader) == "" {
+			t.Errorf("缺少投递头: %v", msg.Header)
+		}
+
+		if !strings.Contains(path, "_m1.") {
+			body, _ := io.ReadAll(msg.Body)
+			if !strings.Contains(string(body), "body m2") {
+				t.Errorf("生成的邮件正文 %q", body)
+			}
+			continue
+		}
+		subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if subject != "你好" || msg.Header.Get("Return-Path") != "<sender@example.com>" {
+			t.Errorf("Subject = %q，Return-Path = %q", subject, msg.Header.Get("Return-Path"))
+		}
+		_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		var parts []string
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(p)
+			parts = append(parts, p.FileName()+":"+string(data))
+		}
+		if len(parts) != 2 || parts[0] != ":Your code is 482913" || parts[1] != "a.txt:hi" {
+			t.Errorf("MIME 部分 = %q", parts)
+		}
+	}
+}
+
+// TestMaildirReload 重启后从目录重建索引，已读状态保存在文件名中，其他工具放入的邮件也能读取
+func TestMaildirReload(t *testing.T) {
+	setupTest(t, nil)
+	root := t.TempDir()
+	ms := openTestMaildir(t, root)
+	appendAll(t, ms, testMail("user@test.local", "m1", 0), testMail("user@test.local", "m2", 1), testMail("other@test.local", "o1", 2))
+	if n, _ := ms.SetRead("user@test.local", "m1", true); n != 1 {
+		t.Fatalf("SetRead 返回 %d", n)
+	}
+	cur := maildirFiles(t, root, "user@test.local", "cur")
+	if len(cur) != 1 || !strings.HasSuffix(cur[0], ":2,S") {
+		t.Errorf("已读的邮件应移到 cur 并带 S 标志: %q", cur)
+	}
+
+	// 其他程序按 Maildir 约定投递的邮件
+	foreign := filepath.Join(root, url.PathEscape("user@test.local"), "new", "1700000000.M1P1.otherhost")
+	os.WriteFile(foreign, []byte("From: x@example.com\r\nSubject: foreign\r\n\r\nhello\r\n"), 0o600)
+	os.Chtimes(foreign, testEpoch.Add(time.Minute), testEpoch.Add(time.Minute))
+
+	reopened := openTestMaildir(t, root)
+	mails, _ := reopened.List("user@test.local")
+	if got := mailIDs(mails); strings.Join(got, ",") != "1700000000.M1P1.otherhost,m2,m1" {
+		t.Fatalf("重建后的邮件 %q", got)
+	}
+	if !mails[2].Read || mails[1].Read {
+		t.Errorf("已读状态 m1=%v m2=%v", mails[2].Read, mails[1].Read)
+	}
+	if mails[0].Subject != "foreign" || mails[0].Text != "hello\r\n" || !mails[0].ReceivedAt.Equal(testEpoch.Add(time.Minute)) {
+		t.Errorf("外部邮件 %+v", mails[0])
+	}
+	if mails[1].TraceID != "trace-m2" || !mails[1].ReceivedAt.Equal(testEpoch.Add(time.Second)) {
+		t.Errorf("元数据未恢复: %+v", mails[1])
+	}
+	if n, _ := reopened.Count("other@test.local"); n != 1 {
+		t.Errorf("other 有 %d 封", n)
+	}
+}
+
+func TestMaildirRemovesFiles(t *testing.T) {
+	setupTest(t, nil)
+	root := t.TempDir()
+	ms := openTestMaildir(t, root)
+	expired := testEpoch.Add(-time.Hour)
+	old := testMail("old@test.local", "x1", 0)
+	old.ExpiresAt = &expired
+	appendAll(t, ms, testMail("user@test.local", "m1", 0), testMail("user@test.local", "m2", 1), old)
+
+	if _, ok, _ := ms.PopLatest("user@test.local"); !ok {
+		t.Fatal("PopLatest 没有取到邮件")
+	}
+	if files := maildirFiles(t, root, "user@test.local", "new"); len(files) != 1 || !strings.Contains(files[0], "_m1.") {
+		t.Errorf("取出后剩下 %q", files)
+	}
+
+	if n, _ := ms.Expire(testEpoch); n != 1 {
+		t.Errorf("Expire 返回 %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(root, url.PathEscape("old@test.local"))); !os.IsNotExist(err) {
+		t.Errorf("过期后变空的邮箱目录应删除: %v", err)
+	}
+
+	ms.Delete("user@test.local")
+	if _, err := os.Stat(filepath.Join(root, url.PathEscape("user@test.local"))); !os.IsNotExist(err) {
+		t.Errorf("删除邮箱后目录应删除: %v", err)
+	}
+}
+
+// TestMaildirWriteFailure 写文件失败时邮件仍保存在内存中，不会退信
+func TestMaildirWriteFailure(t *testing.T) {
+	setupTest(t, nil)
+	root := t.TempDir()
+	ms := openTestMaildir(t, root)
+	// 邮箱目录的位置是一个普通文件，无法创建 new、cur、tmp
+	os.WriteFile(filepath.Join(root, url.PathEscape("user@test.local")), nil, 0o600)
+
+	if err := ms.Append(testMail("user@test.local", "m1", 0)); err != nil {
+		t.Fatalf("写文件失败不应返回错误: %v", err)
+	}
+	if _, ok, _ := ms.Get("user@test.local", "m1"); !ok {
+		t.Error("邮件应保存在内存中")
+	}
+	// 没有文件的邮件也能正常删除
+	if n, _ := ms.Delete("user@test.local"); n != 1 {
+		t.Errorf("Delete 返回 %d", n)
+	}
+}
+
+func TestMaildirFlagPath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		seen bool
+		want string
+	}{
+		{"/m/u/new/123.abc.host", true, "/m/u/cur/123.abc.host:2,S"},
+		{"/m/u/cur/123.abc.host:2,S", false, "/m/u/cur/123.abc.host:2,"},
+		{"/m/u/cur/123.abc.host:2,FR", true, "/m/u/cur/123.abc.host:2,FRS"},
+		{"/m/u/cur/123.abc.host:2,T", true, "/m/u/cur/123.abc.host:2,ST"},
+	} {
+		if got := maildirFlagPath(tc.path, tc.seen); got != tc.want {
+			t.Errorf("maildirFlagPath(%q, %v) = %q，应为 %q", tc.path, tc.seen, got, tc.want)
+		}
+		if maildirSeen(tc.want) != tc.seen {
+			t.Errorf("maildirSeen(%q) != %v", tc.want, tc.seen)
+		}
+	}
+}
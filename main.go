@@ -1,222 +1,1377 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"io"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/alash3al/go-smtpsrv/v3"
+	"github.com/emersion/go-smtp"
 	"github.com/gin-gonic/gin"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/pires/go-proxyproto"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Config 应用配置
 type Config struct {
 	AllowedDomains []string
+	SMTPHostname   string
 	SMTPPort       string
 	HTTPPort       string
 	HTTPSPort      string
 	CertFile       string
 	KeyFile        string
 	EnableHTTPS    bool
+
+	// 监听的本机 IP，为空时监听所有网卡。SMTP_BIND 用于 SMTP/SMTPS/POP3/IMAP，HTTP_BIND 用于 HTTP/HTTPS 和管理端口
+	SMTPBind string
+	HTTPBind string
+
+	// AllowedDomains 中的国际化域名已转为 punycode，这里是一一对应的 Unicode 展示形式
+	AllowedDomainsDisplay []string
+
+	// Let's Encrypt 自动证书，与 CERT_FILE/KEY_FILE 互斥
+	EnableAutocert   bool
+	HTTPSHostnames   []string
+	AutocertCacheDir string
+	AutocertEmail    string
+
+	EnableSTARTTLS bool
+	EnableSMTPS    bool
+	SMTPSPort      string
+
+	// 明文 HTTP 重定向到 HTTPS，以及 HTTPS 响应的 HSTS 头
+	HTTPSRedirect         bool
+	HTTPSRedirectHost     string
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+
+	// CORS 配置，未配置允许的来源时不启用
+	CORSAllowedOrigins   []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSAllowCredentials bool
+	CORSMaxAge           int
+
+	// 管理接口配置
+	AdminAPIKeys []string
+	AdminPath    string
+	// 非空时管理接口、指标和 pprof 只在这个端口提供，公开端口不再挂载
+	AdminPort string
+
+	// 是否保存原始邮件
+	StoreRaw bool
+
+	// 反向解析和 HELO 校验
+	CheckRDNS     bool
+	RequireFCrDNS bool
+
+	// 灰名单
+	Greylist       bool
+	GreylistDelay  time.Duration
+	GreylistExpiry time.Duration
+
+	// 按 Message-ID 去重：off、mailbox（同一邮箱内）或 global（所有邮箱），以及去重窗口
+	DedupMode   string
+	DedupWindow time.Duration
+
+	// HTTP 接口按 IP 限流，每分钟请求数为 0 时不限流
+	RateLimitRPM   int
+	RateLimitBurst int
+	// 创建邮箱另外按 IP 限流，在上面的限流之外再检查，每分钟请求数为 0 时不单独限流
+	CreateRateLimitRPM   int
+	CreateRateLimitBurst int
+
+	// DNS 黑名单
+	DNSBLZones  []string
+	DNSBLReject bool
+
+	// 外部垃圾邮件评分，URL 和命令二选一；拒收阈值为 0 时只记录分数
+	SpamCheckURL        string
+	SpamCheckCommand    string
+	SpamCheckTimeout    time.Duration
+	SpamRejectThreshold float64
+
+	// SMTP 监听是否要求 PROXY 协议头（位于负载均衡之后时启用）
+	SMTPProxyProtocol bool
+
+	// HTTP 位于反向代理之后时信任的代理地址（IP 或 CIDR），以及从哪些请求头读取客户端 IP
+	TrustedProxies []string
+	RealIPHeaders  []string
+
+	// 远程图片默认处理模式（original/blocked/proxied）和代理图片大小上限
+	ImageMode        string
+	ImgProxyMaxBytes int64
+
+	// 所有路由的前缀，如 /tempmail
+	BasePath string
+
+	// 响应压缩，小于阈值的响应不压缩
+	Compression         bool
+	CompressionMinBytes int
+
+	// 是否启用 Prometheus 指标
+	Metrics bool
+	// 定期打印统计日志的间隔，0 为不打印
+	StatsInterval time.Duration
+
+	// 是否启用 pprof，启用后仍需管理 API Key
+	EnablePprof bool
+
+	// 是否接收允许域名下的任意地址；关闭时只接收白名单或已存在的邮箱
+	CatchAll           bool
+	RecipientAllowlist []string
+
+	// 域名不在 ALLOWED_DOMAINS 和收件人不存在时的拒收回复
+	RelayReject     *smtp.SMTPError
+	RecipientReject *smtp.SMTPError
+
+	// 邮件保留时长（0 表示不过期）和每个邮箱的邮件数、字节数上限（0 表示不限制）
+	MailTTL            time.Duration
+	MaxMailboxMessages int
+	MaxMailboxBytes    int64
+	// 内存存储的邮箱数上限，超过时淘汰最久未访问的邮箱（0 表示不限制）
+	MaxMailboxes int
+	// 定时清空所有邮箱，时间由 CleanupSchedule 决定（默认每天零点）
+	DailyCleanup    bool
+	CleanupSchedule *cronSchedule
+	// 定时清空时每个邮箱保留的最新邮件数，0 为全部清空
+	CleanupKeepLast int
+	// 保存哪些正文：both、text 或 html
+	StoreParts string
+
+	// 过期邮件归档目录（为空不归档）、单个归档文件大小上限和归档保留时长
+	ArchiveDir          string
+	ArchiveMaxFileBytes int64
+	ArchiveRetention    time.Duration
+
+	// 按域名覆盖保留时长、邮件数上限和 catch-all，键为小写域名
+	DomainPolicies map[string]domainPolicy
+
+	// 邮件存储：memory（默认）、redis、postgres、bolt 或 maildir，多实例部署时使用 redis 或 postgres 共享邮件，
+	// 单机持久化使用 bolt，需要用邮件工具直接读取时使用 maildir
+	StoreBackend  string
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	RedisPrefix   string
+	// bolt 数据文件路径
+	BoltPath string
+	// Maildir 根目录，每个邮箱一个子目录
+	MaildirPath string
+	// 内存存储的快照文件，为空时不保存
+	SnapshotPath string
+	// Postgres 连接串、连接池大小和语句超时
+	PostgresDSN              string
+	PostgresMaxConns         int
+	PostgresStatementTimeout time.Duration
+	// 存储不可用时暂存邮件的重试队列上限（字节，0 为不启用）和重试间隔
+	StoreRetryBufferBytes int64
+	StoreRetryInterval    time.Duration
+
+	// 附件外置到 S3 兼容的对象存储，S3Bucket 为空时不启用。超过 AttachmentOffloadBytes 的附件写入对象存储
+	S3Endpoint             string
+	S3Bucket               string
+	S3Region               string
+	S3AccessKey            string
+	S3SecretKey            string
+	S3Prefix               string
+	S3Timeout              time.Duration
+	AttachmentOffloadBytes int
+
+	// 邮件转发：本地部分 -> 转发地址，经由上游 SMTP 发送
+	ForwardRules        map[string]string
+	ForwardSMTPHost     string
+	ForwardSMTPUser     string
+	ForwardSMTPPassword string
+	ForwardFrom         string
+
+	// 使用旧版 JSON 字段名（TextContent/HtmlContent/title 等）
+	LegacyJSON bool
+
+	// 旧接口 getMail 在邮箱为空时仍以 201 返回 {"mail":"没有邮件"}
+	LegacyEmptyMail bool
+
+	// 在 /docs 提供 Swagger UI 页面
+	OpenAPIUI bool
+
+	// API 错误和 SMTP 回复的语言，见 messages.go
+	Locale string
+
+	// SMTP 超时：等待下一条命令、命令/DATA 中途停顿、MAIL FROM 到 DATA 结束
+	SMTPIdleTimeout        time.Duration
+	SMTPCommandTimeout     time.Duration
+	SMTPTransactionTimeout time.Duration
+
+	// cid: 内嵌图片改写为接口地址（url）或 data URI（data）
+	InlineImageMode string
+
+	// 通过 POP3 取信，用户名为邮箱地址
+	EnablePOP3 bool
+	POP3Port   string
+
+	// 设置后新建邮箱时返回由它签名的令牌，POP3/IMAP 登录时密码必须为该令牌
+	MailboxTokenSecret string
+
+	// 通过 IMAP 取信，默认只读：不能删除邮件，只更新 \Seen
+	EnableIMAP   bool
+	IMAPPort     string
+	IMAPReadOnly bool
+
+	// 静态加密的密钥，第一个用于加密，其余只用于解密
+	EncryptionKeys []string
+
+	// 每封邮件最多接受的收件人数，0 表示不限制
+	MaxRcptPerMessage int
+
+	// 日志级别和格式，LogLegacyFormat 保持旧的输出格式
+	LogLevel        slog.Level
+	LogFormat       string
+	LogLegacyFormat bool
+
+	// 日志文件及其轮转，LogFile 为空时写到标准错误
+	LogFile       string
+	LogMaxSizeMB  int
+	LogMaxBackups int
+	LogMaxAgeDays int
+
+	// 在根路径提供内置的网页收件箱
+	WebUI bool
+
+	// 收到 SIGUSR2 时把监听交给新进程，旧进程等待会话结束后退出
+	GracefulUpgrade bool
+	UpgradeTimeout  time.Duration
+
+	// HTTP 服务器超时，防止慢速连接占住资源
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+
+	// 请求头和请求体大小上限（字节）
+	HTTPMaxHeaderBytes int
+	HTTPMaxBodyBytes   int64
+
+	// 收到 SIGTERM/SIGINT 后等待进行中的请求和 SMTP 会话结束的最长时间
+	ShutdownTimeout time.Duration
 }
 
-// MailContent 邮件内容结构
+// mailContent 邮件内容结构，JSON 字段名即 API 返回的字段名
 type mailContent struct {
-	from        string
-	to          string
-	title       string
-	TextContent string
-	HtmlContent string
-	receivedAt  time.Time
-}
-
-var (
-	mailBox = make(map[string][]mailContent)
-	mu      sync.RWMutex
-	config  Config
-)
+	ID         string    `json:"id"`
+	TraceID    string    `json:"trace_id"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Subject    string    `json:"subject"`
+	Text       string    `json:"text"`
+	HTML       string    `json:"html"`
+	ReceivedAt time.Time `json:"received_at"`
+	// 是否已通过不删除的接口读取过
+	Read bool `json:"read"`
+	raw  []byte
+	// 顶层邮件头，Postgres 保存在 headers 列中
+	headers map[string][]string
+	// 存储分配的序号，按投递顺序递增、不重复，IMAP 用作 UID；0 表示还没有保存到存储中
+	seq uint64
+
+	Attachments []attachment `json:"attachments"`
+	inline      []inlinePart
+	// 按域名保留时长计算的过期时间，nil 表示不过期
+	ExpiresAt *time.Time `json:"expires_at"`
 
-// 初始化配置
+	// 发件方连接信息
+	ClientIP string         `json:"client_ip"`
+	Helo     string         `json:"helo"`
+	DNS      dnsCheckResult `json:"dns"`
+	DNSBL    []string       `json:"dnsbl"`
+	// 外部垃圾邮件评分，未配置或评分失败时为 null
+	Spam *spamVerdict `json:"spam"`
+}
+
+var certs *certReloader
+
+// 初始化配置，有错误时退出
 func initConfig() Config {
+	cfg := parseConfig()
+	reportConfigErrors()
+	return cfg
+}
+
+// parseConfig 从环境变量和配置文件读取配置，错误记入 configErrors，启动和重新加载共用
+func parseConfig() Config {
+	loadConfigFile()
 	cfg := Config{
-		AllowedDomains: strings.Split(os.Getenv("ALLOWED_DOMAINS"), ","),
+		AllowedDomains: strings.Split(getEnv("ALLOWED_DOMAINS"), ","),
 		SMTPPort:       getEnvOrDefault("SMTP_PORT", "25"),
 		HTTPPort:       getEnvOrDefault("HTTP_PORT", "80"),
 		HTTPSPort:      getEnvOrDefault("HTTPS_PORT", "443"),
+		SMTPBind:       strings.TrimSpace(getEnv("SMTP_BIND")),
+		HTTPBind:       strings.TrimSpace(getEnv("HTTP_BIND")),
 		CertFile:       getEnvOrDefault("CERT_FILE", "./certs/server.pem"),
 		KeyFile:        getEnvOrDefault("KEY_FILE", "./certs/server.key"),
-		EnableHTTPS:    os.Getenv("ENABLE_HTTPS") == "true",
+		EnableHTTPS:    getEnvBool("ENABLE_HTTPS", false),
+
+		EnableAutocert:   getEnvBool("ENABLE_AUTOCERT", false),
+		HTTPSHostnames:   splitList(getEnv("HTTPS_HOSTNAMES")),
+		AutocertCacheDir: getEnvOrDefault("AUTOCERT_CACHE_DIR", "./autocert-cache"),
+		AutocertEmail:    getEnv("AUTOCERT_EMAIL"),
+
+		EnableSTARTTLS: getEnvBool("ENABLE_STARTTLS", false),
+		EnableSMTPS:    getEnvBool("ENABLE_SMTPS", false),
+		SMTPSPort:      getEnvOrDefault("SMTPS_PORT", "465"),
+
+		HTTPSRedirect:         getEnvBool("HTTPS_REDIRECT", false),
+		HTTPSRedirectHost:     getEnv("HTTPS_REDIRECT_HOST"),
+		HSTSMaxAge:            getEnvDuration("HSTS_MAX_AGE", 0),
+		HSTSIncludeSubdomains: getEnvBool("HSTS_INCLUDE_SUBDOMAINS", false),
+
+		CORSAllowedOrigins:   splitList(getEnv("CORS_ALLOWED_ORIGINS")),
+		CORSAllowedMethods:   splitList(getEnvOrDefault("CORS_ALLOWED_METHODS", "GET,POST,PUT,DELETE,OPTIONS")),
+		CORSAllowedHeaders:   splitList(getEnvOrDefault("CORS_ALLOWED_HEADERS", "Content-Type,Authorization,X-Api-Key")),
+		CORSAllowCredentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		CORSMaxAge:           getEnvInt("CORS_MAX_AGE", 600),
+
+		AdminAPIKeys: splitList(getEnv("ADMIN_API_KEYS")),
+		AdminPath:    getEnvOrDefault("ADMIN_PATH", "/admin"),
+		AdminPort:    getEnv("ADMIN_PORT"),
+
+		StoreRaw: getEnvBool("STORE_RAW", true),
+
+		CheckRDNS:     getEnvBool("CHECK_RDNS", false),
+		RequireFCrDNS: getEnvBool("REQUIRE_FCRDNS", false),
+
+		Greylist:       getEnvBool("GREYLIST", false),
+		GreylistDelay:  getEnvDuration("GREYLIST_DELAY", time.Minute),
+		GreylistExpiry: getEnvDuration("GREYLIST_EXPIRY", 24*time.Hour),
+
+		DedupMode:   strings.ToLower(getEnvOrDefault("DEDUP_MODE", dedupOff)),
+		DedupWindow: getEnvDuration("DEDUP_WINDOW", 24*time.Hour),
+
+		RateLimitRPM:   getEnvInt("RATE_LIMIT_RPM", 0),
+		RateLimitBurst: getEnvInt("RATE_LIMIT_BURST", 0),
+
+		CreateRateLimitRPM:   getEnvInt("CREATE_RATE_LIMIT_RPM", 0),
+		CreateRateLimitBurst: getEnvInt("CREATE_RATE_LIMIT_BURST", 0),
+
+		DNSBLZones:  splitList(getEnv("DNSBL_ZONES")),
+		DNSBLReject: getEnvBool("DNSBL_REJECT", false),
+
+		SpamCheckURL:        getEnv("SPAM_CHECK_URL"),
+		SpamCheckCommand:    getEnv("SPAM_CHECK_COMMAND"),
+		SpamCheckTimeout:    getEnvDuration("SPAM_CHECK_TIMEOUT", 5*time.Second),
+		SpamRejectThreshold: getEnvFloat("SPAM_REJECT_THRESHOLD", 0),
+
+		SMTPProxyProtocol: getEnvBool("SMTP_PROXY_PROTOCOL", false),
+
+		TrustedProxies: splitList(getEnv("TRUSTED_PROXIES")),
+		RealIPHeaders:  splitList(getEnvOrDefault("REAL_IP_HEADERS", "X-Forwarded-For,X-Real-IP")),
+
+		ImageMode:        getEnvOrDefault("IMAGE_MODE", imageModeOriginal),
+		ImgProxyMaxBytes: int64(getEnvInt("IMGPROXY_MAX_BYTES", 5*1024*1024)),
+
+		BasePath: normalizeBasePath(getEnv("BASE_PATH")),
+
+		Compression:         getEnvBool("COMPRESSION", true),
+		CompressionMinBytes: getEnvInt("COMPRESSION_MIN_BYTES", 1024),
+
+		Metrics:       getEnvBool("METRICS", false),
+		StatsInterval: getEnvDuration("STATS_INTERVAL", 0),
+
+		EnablePprof: getEnvBool("ENABLE_PPROF", false),
+
+		CatchAll:           getEnvBool("CATCH_ALL", true),
+		RecipientAllowlist: splitList(getEnv("RECIPIENT_ALLOWLIST")),
+
+		MailTTL:            getEnvDuration("MAIL_TTL", 24*time.Hour),
+		MaxMailboxMessages: getEnvInt("MAX_MAILBOX_MESSAGES", 0),
+		MaxMailboxBytes:    int64(getEnvInt("MAX_MAILBOX_BYTES", 0)),
+		MaxMailboxes:       getEnvInt("MAX_MAILBOXES", 0),
+		DailyCleanup:       getEnvBool("DAILY_CLEANUP", false),
+		CleanupKeepLast:    getEnvInt("CLEANUP_KEEP_LAST", 0),
+		StoreParts:         strings.ToLower(getEnvOrDefault("STORE_PARTS", storePartsBoth)),
+
+		ArchiveDir:          getEnv("ARCHIVE_DIR"),
+		ArchiveMaxFileBytes: int64(getEnvInt("ARCHIVE_MAX_FILE_BYTES", 100*1024*1024)),
+		ArchiveRetention:    getEnvDuration("ARCHIVE_RETENTION", 30*24*time.Hour),
+
+		StoreBackend:  getEnvOrDefault("STORE_BACKEND", "memory"),
+		RedisAddr:     getEnvOrDefault("REDIS_ADDR", "localhost:6379"),
+		RedisPassword: getEnv("REDIS_PASSWORD"),
+		RedisDB:       getEnvInt("REDIS_DB", 0),
+		RedisPrefix:   getEnvOrDefault("REDIS_PREFIX", "tempmail:"),
+		BoltPath:      getEnvOrDefault("BOLT_PATH", "./tempmail.db"),
+		MaildirPath:   getEnvOrDefault("MAILDIR_PATH", "./maildir"),
+		SnapshotPath:  getEnv("SNAPSHOT_PATH"),
+
+		PostgresDSN:              getEnv("POSTGRES_DSN"),
+		PostgresMaxConns:         getEnvInt("POSTGRES_MAX_CONNS", 10),
+		PostgresStatementTimeout: getEnvDuration("POSTGRES_STATEMENT_TIMEOUT", 5*time.Second),
+		StoreRetryBufferBytes:    int64(getEnvInt("STORE_RETRY_BUFFER_BYTES", 64*1024*1024)),
+		StoreRetryInterval:       getEnvDuration("STORE_RETRY_INTERVAL", 5*time.Second),
+
+		S3Endpoint:             strings.TrimSuffix(getEnv("S3_ENDPOINT"), "/"),
+		S3Bucket:               getEnv("S3_BUCKET"),
+		S3Region:               getEnvOrDefault("S3_REGION", "us-east-1"),
+		S3AccessKey:            getEnv("S3_ACCESS_KEY"),
+		S3SecretKey:            getEnv("S3_SECRET_KEY"),
+		S3Prefix:               getEnvOrDefault("S3_PREFIX", "attachments/"),
+		S3Timeout:              getEnvDuration("S3_TIMEOUT", 10*time.Second),
+		AttachmentOffloadBytes: getEnvInt("ATTACHMENT_OFFLOAD_BYTES", 256*1024),
+
+		ForwardRules:        parseForwardRules(getEnv("FORWARD_RULES")),
+		ForwardSMTPHost:     getEnv("FORWARD_SMTP_HOST"),
+		ForwardSMTPUser:     getEnv("FORWARD_SMTP_USER"),
+		ForwardSMTPPassword: getEnv("FORWARD_SMTP_PASSWORD"),
+
+		LegacyJSON: getEnvBool("LEGACY_JSON", false),
+		OpenAPIUI:  getEnvBool("OPENAPI_UI", false),
+
+		LegacyEmptyMail: getEnvBool("LEGACY_EMPTY_MAIL", false),
+
+		Locale: parseLocale(getEnv("LOCALE")),
+
+		SMTPIdleTimeout:        getEnvDuration("SMTP_IDLE_TIMEOUT", 5*time.Minute),
+		SMTPCommandTimeout:     getEnvDuration("SMTP_COMMAND_TIMEOUT", time.Minute),
+		SMTPTransactionTimeout: getEnvDuration("SMTP_TRANSACTION_TIMEOUT", 10*time.Minute),
+
+		InlineImageMode: getEnvOrDefault("INLINE_IMAGE_MODE", inlineModeURL),
+
+		EnablePOP3: getEnvBool("ENABLE_POP3", false),
+		POP3Port:   getEnvOrDefault("POP3_PORT", "110"),
+
+		MailboxTokenSecret: getEnv("MAILBOX_TOKEN_SECRET"),
+
+		EnableIMAP:   getEnvBool("ENABLE_IMAP", false),
+		IMAPPort:     getEnvOrDefault("IMAP_PORT", "143"),
+		IMAPReadOnly: getEnvBool("IMAP_READ_ONLY", true),
+
+		EncryptionKeys: splitList(getEnv("ENCRYPTION_KEY")),
+
+		MaxRcptPerMessage: getEnvInt("MAX_RCPT_PER_MESSAGE", 100),
+
+		LogFormat:       strings.ToLower(getEnvOrDefault("LOG_FORMAT", "text")),
+		LogLegacyFormat: getEnvBool("LOG_LEGACY_FORMAT", false),
+
+		LogFile:       getEnv("LOG_FILE"),
+		LogMaxSizeMB:  getEnvInt("LOG_MAX_SIZE_MB", 100),
+		LogMaxBackups: getEnvInt("LOG_MAX_BACKUPS", 7),
+		LogMaxAgeDays: getEnvInt("LOG_MAX_AGE_DAYS", 30),
+
+		WebUI: getEnvBool("WEB_UI", true),
+
+		GracefulUpgrade: getEnvBool("GRACEFUL_UPGRADE", false),
+		UpgradeTimeout:  getEnvDuration("UPGRADE_TIMEOUT", time.Minute),
+
+		HTTPReadHeaderTimeout: getEnvDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		HTTPReadTimeout:       getEnvDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		HTTPWriteTimeout:      getEnvDuration("HTTP_WRITE_TIMEOUT", 60*time.Second),
+		HTTPIdleTimeout:       getEnvDuration("HTTP_IDLE_TIMEOUT", 120*time.Second),
+
+		HTTPMaxHeaderBytes: getEnvInt("HTTP_MAX_HEADER_BYTES", 64*1024),
+		HTTPMaxBodyBytes:   int64(getEnvInt("HTTP_MAX_BODY_BYTES", 1024*1024)),
+
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+	}
+
+	// 域名统一转为 punycode 形式比较和保存，展示时再转回 Unicode
+	for i, d := range cfg.AllowedDomains {
+		d = strings.TrimSpace(d)
+		if strings.Contains(d, "*") && (!isWildcardDomain(d) || strings.Contains(d[2:], "*") || len(d) == 2) {
+			configError("ALLOWED_DOMAINS 中的 %q 无效，通配只支持 *.example.com 形式", d)
+			continue
+		}
+		if d == "" {
+			continue
+		}
+		ascii, err := asciiDomain(d)
+		if err != nil {
+			configError("ALLOWED_DOMAINS 中的 %q 不是有效的国际化域名: %v", d, err)
+			continue
+		}
+		cfg.AllowedDomains[i] = ascii
+	}
+	for _, d := range cfg.AllowedDomains {
+		cfg.AllowedDomainsDisplay = append(cfg.AllowedDomainsDisplay, displayDomain(strings.TrimSpace(d)))
+	}
+	for i, h := range cfg.HTTPSHostnames {
+		cfg.HTTPSHostnames[i] = normalizeDomain(h)
+	}
+	for i, r := range cfg.RecipientAllowlist {
+		cfg.RecipientAllowlist[i] = normalizeAddress(r)
+	}
+
+	// SMTP 欢迎语和 EHLO 使用的主机名，默认取第一个非通配域名
+	cfg.SMTPHostname = strings.TrimSpace(getEnvOrDefault("SMTP_HOSTNAME", cfg.primaryDomain()))
+	if cfg.SMTPHostname != "" {
+		cfg.SMTPHostname = normalizeDomain(cfg.SMTPHostname)
+	} else {
+		configError("SMTP_HOSTNAME 不能为空，ALLOWED_DOMAINS 只有通配域名时需要单独设置")
+	}
+	cfg.ForwardFrom = getEnvOrDefault("FORWARD_FROM", "forward@"+cfg.SMTPHostname)
+
+	policies, err := parseDomainPolicies(getEnv("DOMAIN_POLICIES"), cfg.defaultPolicy())
+	if err != nil {
+		configError("DOMAIN_POLICIES %v", err)
+	}
+	for domain := range policies {
+		if !containsFold(cfg.AllowedDomains, domain) {
+			configError("DOMAIN_POLICIES 中的域名 %s 不在 ALLOWED_DOMAINS 中", domain)
+		}
+	}
+	cfg.DomainPolicies = policies
+
+	if err := cfg.LogLevel.UnmarshalText([]byte(getEnvOrDefault("LOG_LEVEL", "info"))); err != nil {
+		configError("LOG_LEVEL 应为 debug、info、warn 或 error")
+	}
+
+	if cfg.CleanupSchedule, err = parseCron(getEnvOrDefault("CLEANUP_SCHEDULE", "0 0 * * *")); err != nil {
+		configError("CLEANUP_SCHEDULE %v", err)
+	}
+
+	if cfg.RelayReject, err = parseRejectReply(getEnv("RELAY_REJECT_CODE"), getEnv("RELAY_REJECT_MESSAGE"), errRelayDenied.in(cfg.Locale)); err != nil {
+		configError("RELAY_REJECT_CODE/RELAY_REJECT_MESSAGE %v", err)
+	}
+	if cfg.RecipientReject, err = parseRejectReply(getEnv("RECIPIENT_REJECT_CODE"), getEnv("RECIPIENT_REJECT_MESSAGE"), errNoSuchUser.in(cfg.Locale)); err != nil {
+		configError("RECIPIENT_REJECT_CODE/RECIPIENT_REJECT_MESSAGE %v", err)
 	}
 
-	if len(cfg.AllowedDomains) == 0 || cfg.AllowedDomains[0] == "" {
-		log.Fatal("错误：ALLOWED_DOMAINS 环境变量未设置")
+	if cfg.EnableAutocert {
+		if getEnv("CERT_FILE") != "" || getEnv("KEY_FILE") != "" {
+			configError("ENABLE_AUTOCERT 与 CERT_FILE/KEY_FILE 不能同时配置，请删除其中一种")
+		}
+		// 自动证书只用于 HTTPS 监听和 SMTP 的 TLS
+		cfg.EnableHTTPS = true
+		if len(cfg.HTTPSHostnames) == 0 {
+			// HTTP-01 无法签发通配证书，通配域名需要在 HTTPS_HOSTNAMES 中列出具体子域名
+			for _, d := range cfg.AllowedDomains {
+				if !isWildcardDomain(strings.TrimSpace(d)) {
+					cfg.HTTPSHostnames = append(cfg.HTTPSHostnames, d)
+				}
+			}
+			if (cfg.EnableSTARTTLS || cfg.EnableSMTPS) && !containsFold(cfg.HTTPSHostnames, cfg.SMTPHostname) {
+				cfg.HTTPSHostnames = append(cfg.HTTPSHostnames, cfg.SMTPHostname)
+			}
+		}
 	}
 
+	warnUnknownConfigKeys()
+	for _, msg := range cfg.Validate() {
+		configError("%s", msg)
+	}
 	return cfg
 }
 
+// primaryDomain 第一个非通配的允许域名，用作默认主机名和新建邮箱的默认域名
+func (cfg Config) primaryDomain() string {
+	for _, d := range cfg.AllowedDomains {
+		if d = strings.TrimSpace(d); d != "" && !isWildcardDomain(d) {
+			return d
+		}
+	}
+	return ""
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+	describeOption(key, defaultValue, false)
+	if value := getEnv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
 
-func handler(c *smtpsrv.Context) error {
-	to := strings.Trim(c.To().String(), "<>")
-	from := strings.Trim(c.From().String(), "<>")
-	msg, err := c.Parse()
+// getEnvBool 只有 "true" 为真，未设置时取默认值
+func getEnvBool(key string, defaultValue bool) bool {
+	describeOption(key, strconv.FormatBool(defaultValue), true)
+	value := getEnv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value == "true"
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	describeOption(key, strconv.Itoa(defaultValue), false)
+	value := getEnv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		log.Printf("解析邮件失败: %v", err)
-		return err
+		configError("%s %q 不是有效的整数", key, value)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	describeOption(key, strconv.FormatFloat(defaultValue, 'g', -1, 64), false)
+	value := getEnv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		configError("%s %q 不是有效的数字", key, value)
+		return defaultValue
+	}
+	return f
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	describeOption(key, defaultValue.String(), false)
+	value := getEnv(key)
+	if value == "" {
+		return defaultValue
 	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		configError("%s %q 不是有效的时长，如 30s、5m、24h", key, value)
+		return defaultValue
+	}
+	return d
+}
 
-	content := mailContent{
-		from:        from,
-		to:          to,
-		title:       msg.Subject,
-		TextContent: msg.TextBody,
-		HtmlContent: msg.HTMLBody,
-		receivedAt:  time.Now(),
+// normalizeBasePath 统一为以 / 开头、不以 / 结尾的形式，根路径返回空字符串
+func normalizeBasePath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
 	}
+	return "/" + p
+}
 
-	mu.Lock()
-	defer mu.Unlock()
+// splitList 按英文逗号拆分，去除空白和空项
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
 
-	if _, ok := mailBox[to]; !ok {
-		mailBox[to] = make([]mailContent, 0, 10)
+// containsFold 列表中是否有忽略大小写相同的项
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
 	}
-	mailBox[to] = append(mailBox[to], content)
+	return false
+}
+
+// newMailID 生成邮件ID
+func newMailID() string {
+	return randomHex(8)
+}
 
-	log.Printf("收到来自 %s 发送给 %s 的邮件", from, to)
+// newTraceID 生成追踪ID，一次投递的所有副本共用
+func newTraceID() string {
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+func handler(s *smtpSession, r io.Reader) error {
+	ctx, span := tracer.Start(context.Background(), "smtp.receive")
+	defer span.End()
+
+	from := strings.Trim(s.from, "<>")
+	traceID := newTraceID()
+	l := smtpLogger.With("delivery_id", traceID)
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		l.Warn("读取邮件失败", "ip", s.remoteIP, "error", err)
+		span.RecordError(err)
+		return err
+	}
+	// 只有一个 DATA 应答，超过任一收件人所在域名的上限时整封拒收，而不是悄悄丢掉该收件人的那份
+	for _, to := range s.to {
+		if len(raw) > settingsFor(addressDomain(to)).MaxMessageBytes {
+			recordRejected(addressDomain(to), "too_large")
+			l.Info("邮件超过域名的大小上限", "from", from, "ip", s.remoteIP, "mailbox", to, "size", len(raw))
+			return errMessageTooLarge.err()
+		}
+	}
+	parseStart := time.Now()
+	msg, err := parseMail(raw)
+	if err != nil {
+		l.Warn("解析邮件失败", "from", from, "ip", s.remoteIP, "error", err)
+		span.RecordError(err)
+		return err
+	}
+	l.Debug("已解析邮件", "message_id", msg.MessageID, "size", len(raw), "attachments", len(msg.Attachments), "duration", time.Since(parseStart))
+
+	domains := make([]string, 0, len(s.to))
+	for _, to := range s.to {
+		domains = append(domains, addressDomain(to))
+	}
+	span.SetAttributes(
+		attribute.String("mail.trace_id", traceID),
+		attribute.Int("mail.size", len(raw)),
+		attribute.Int("mail.recipients", len(s.to)),
+		attribute.StringSlice("mail.recipient_domains", domains),
+	)
+
+	// 评分失败时放行，邮件上不带评分
+	spam, err := checkSpam(s, raw)
+	if err != nil {
+		l.Warn("垃圾邮件评分失败，按未评分处理", "error", err)
+	} else if spam != nil {
+		span.SetAttributes(attribute.Float64("mail.spam_score", spam.Score))
+	}
+	if spamRejected(spam) {
+		l.Info("拒收垃圾邮件", "from", from, "ip", s.remoteIP, "score", spam.Score)
+		for _, to := range s.to {
+			recordRejected(addressDomain(to), "spam")
+		}
+		return errSpamRejected.err()
+	}
+
+	_, storeSpan := tracer.Start(ctx, "store.append")
+	start := time.Now()
+	defer func() {
+		storeSpan.End()
+		span.SetAttributes(attribute.Int64("store.latency_us", time.Since(start).Microseconds()))
+	}()
+
+	// 每个收件人保存一份
+	for _, to := range s.to {
+		// 上游重试导致的重复邮件照常返回成功，只是不再保存
+		if isDuplicate(to, msg.MessageID, traceID) {
+			l.Info("忽略重复邮件", "message_id", msg.MessageID, "mailbox", to)
+			continue
+		}
+
+		content := mailContent{
+			ID:          newMailID(),
+			TraceID:     traceID,
+			From:        from,
+			To:          to,
+			Subject:     msg.Subject,
+			Text:        msg.TextBody,
+			HTML:        msg.HTMLBody,
+			Attachments: msg.Attachments,
+			inline:      msg.Inline,
+			headers:     msg.Headers,
+			ReceivedAt:  time.Now(),
+			ClientIP:    s.remoteIP,
+			Helo:        s.helo,
+			DNS:         s.dns,
+			DNSBL:       s.dnsbl,
+			Spam:        spam,
+		}
+		// Maildir 总是写入原始邮件，是否在内存中保留由它自己按 STORE_RAW 决定
+		if config().StoreRaw || config().StoreBackend == "maildir" {
+			content.raw = raw
+		}
+		applyStoreParts(&content)
+		if ttl := settingsFor(addressDomain(to)).TTL; ttl > 0 {
+			expiresAt := content.ReceivedAt.Add(ttl)
+			content.ExpiresAt = &expiresAt
+		}
+
+		// 保存失败时放入重试队列；队列已满或未启用时返回 451 让发件方重试，
+		// 已保存的收件人可能收到重复邮件，好过丢信
+		if err := mailStore.Append(content); err != nil {
+			if !retryQueue.add(content) {
+				l.Error("保存邮件失败", "mailbox", to, "error", err)
+				forgetDelivery(to, msg.MessageID, traceID)
+				return errStoreUnavailable.err()
+			}
+			l.Warn("保存邮件失败，已放入重试队列", "mailbox", to, "error", err)
+		} else {
+			notifyMailbox(to)
+			recordReceived(addressDomain(to))
+		}
+		l.Info("收到邮件", "message_id", msg.MessageID, "from", from, "ip", s.remoteIP, "mailbox", to)
+
+		forwardMessage(to, raw, traceID)
+	}
 	return nil
 }
 
+// listenAddr 组合监听地址，bind 为空时监听所有网卡
+func listenAddr(bind, port string) string {
+	return net.JoinHostPort(bind, port)
+}
+
+// newSMTPServer 按配置创建 SMTP 服务，不绑定端口，调用方用 Serve 在任意监听上运行
+func newSMTPServer() *smtp.Server {
+	s := smtp.NewServer(smtpBackend{})
+	s.Domain = config().SMTPHostname
+	s.Addr = listenAddr(config().SMTPBind, config().SMTPPort)
+	// 调大某个域名的 max_message_bytes 到超过启动时的最大值需要重启
+	s.MaxMessageBytes = config().largestMessageBytes()
+	s.AuthDisabled = true
+	// 8BITMIME 和 CHUNKING 由 go-smtp 默认声明，BDAT 分块拼接后同样交给 handler，
+	// 累计大小超过 MaxMessageBytes 时回复 552 并断开连接；SMTPUTF8 允许信封中的 UTF-8 地址
+	s.EnableSMTPUTF8 = true
+	// 读超时由 timeoutConn 管理，这里只限制写
+	s.WriteTimeout = config().SMTPCommandTimeout
+	if config().EnableSTARTTLS {
+		s.TLSConfig = serverTLSConfig()
+	}
+	return s
+}
+
 func startSMTPServer() error {
-	cfg := smtpsrv.ServerConfig{
-		BannerDomain:    config.AllowedDomains[0],
-		ListenAddr:      ":" + config.SMTPPort,
-		MaxMessageBytes: 1024 * 1024,
-		Handler:         handler,
+	s := newSMTPServer()
+	if config().SMTPProxyProtocol {
+		log.Printf("SMTP 已启用 PROXY 协议")
+	}
+
+	// 465 端口隐式 TLS，与明文/STARTTLS 监听共用同一个服务和证书
+	if config().EnableSMTPS {
+		ln, err := smtpListener("smtps", listenAddr(config().SMTPBind, config().SMTPSPort))
+		if err != nil {
+			setSMTPState(false, err)
+			return err
+		}
+		go func() {
+			log.Printf("SMTPS服务器正在启动于 %s...", ln.Addr())
+			if err := s.Serve(timeoutListener{tls.NewListener(ln, serverTLSConfig())}); err != nil {
+				smtpLogger.Error("SMTPS服务器启动失败", "error", err)
+			}
+		}()
 	}
 
-	log.Printf("SMTP服务器正在启动于端口 %s...", config.SMTPPort)
-	return smtpsrv.ListenAndServe(&cfg)
+	ln, err := smtpListener("smtp", s.Addr)
+	if err != nil {
+		setSMTPState(false, err)
+		return err
+	}
+	setSMTPState(true, nil)
+	// SMTP 最后监听，此时所有端口都已就绪
+	notifyUpgradeReady()
+	log.Printf("SMTP服务器正在启动于 %s...", ln.Addr())
+	err = s.Serve(timeoutListener{ln})
+	setSMTPState(false, err)
+	if draining.Load() {
+		// 平滑升级或退出时由 drainAndExit 关闭监听并负责退出
+		select {}
+	}
+	return err
 }
 
-func startHTTPServer() {
+// smtpListener 监听 SMTP 端口（或使用从旧进程继承的监听），按配置解析 PROXY 协议头
+func smtpListener(name, addr string) (net.Listener, error) {
+	ln, err := listen(name, addr)
+	if err != nil {
+		return nil, err
+	}
+	if !config().SMTPProxyProtocol {
+		return ln, nil
+	}
+	// 要求每个连接都带 PROXY 头，格式错误的连接直接断开，不会被当作邮件数据
+	return &proxyproto.Listener{
+		Listener: ln,
+		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+	}, nil
+}
+
+// newRouter 创建挂好所有中间件和路由的 gin 引擎，可直接作为 http.Handler 使用
+func newRouter() *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
-	httpSrv := gin.Default()
+	r := gin.New()
 
-	// 添加恢复中间件
-	httpSrv.Use(gin.Recovery())
+	// 只有直连地址属于可信代理时才读取 REAL_IP_HEADERS，未配置时完全忽略这些头，防止伪造 IP。
+	// 访问日志、限流和管理接口日志都通过 ClientIP 取得客户端地址
+	r.ForwardedByClientIP = true
+	r.RemoteIPHeaders = config().RealIPHeaders
+	if err := r.SetTrustedProxies(config().TrustedProxies); err != nil {
+		log.Fatalf("设置可信代理失败: %v", err)
+	}
 
-	// 添加简单的访问日志
-	httpSrv.Use(func(c *gin.Context) {
-		start := time.Now()
-		path := c.Request.URL.Path
-		c.Next()
-		log.Printf("[%s] %s %s %v", c.Request.Method, path, c.ClientIP(), time.Since(start))
-	})
+	// 访问日志在恢复中间件之外，panic 的请求也会记录 500
+	r.Use(accessLogMiddleware(), recoveryMiddleware(), maxBodyMiddleware())
+
+	setupRoutes(r)
+	return r
+}
 
-	setupRoutes(httpSrv)
+// startHTTPServer 监听 HTTP/HTTPS 端口后在后台提供服务
+func startHTTPServer() {
+	httpSrv := newRouter()
+	log.Printf("HTTP 限制: 读请求头 %v，读请求 %v，写响应 %v，空闲 %v，请求头 %d 字节，请求体 %d 字节",
+		config().HTTPReadHeaderTimeout, config().HTTPReadTimeout, config().HTTPWriteTimeout, config().HTTPIdleTimeout,
+		config().HTTPMaxHeaderBytes, config().HTTPMaxBodyBytes)
 
 	// 启动 HTTP 服务器
+	var plain http.Handler = httpSrv
+	if config().HTTPSRedirect {
+		plain = httpsRedirectHandler(httpSrv)
+	}
+	httpServer = newHTTPServer(listenAddr(config().HTTPBind, config().HTTPPort), acmeChallengeHandler(plain))
+	if ln, err := listen("http", httpServer.Addr); err != nil {
+		httpLogger.Error("HTTP服务器启动失败", "error", err)
+	} else {
+		log.Printf("HTTP服务器正在启动于 %s...", ln.Addr())
+		go func() {
+			if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+				httpLogger.Error("HTTP服务器启动失败", "error", err)
+			}
+		}()
+	}
+
+	// 根据配置决定是否启动 HTTPS 服务器
+	if config().EnableHTTPS {
+		httpsServer = newHTTPServer(listenAddr(config().HTTPBind, config().HTTPSPort), httpSrv)
+		httpsServer.TLSConfig = serverTLSConfig()
+		ln, err := listen("https", httpsServer.Addr)
+		if err != nil {
+			httpLogger.Error("HTTPS服务器启动失败", "error", err)
+			return
+		}
+		log.Printf("HTTPS服务器正在启动于 %s...", ln.Addr())
+		go func() {
+			if err := httpsServer.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+				httpLogger.Error("HTTPS服务器启动失败", "error", err)
+			}
+		}()
+	}
+}
+
+// startAdminServer 配置 ADMIN_PORT 时单独监听管理端口
+func startAdminServer() {
+	if config().AdminPort == "" {
+		return
+	}
+	adminServer = newHTTPServer(listenAddr(config().HTTPBind, config().AdminPort), newAdminRouter())
+	ln, err := listen("admin", adminServer.Addr)
+	if err != nil {
+		httpLogger.Error("管理端口启动失败", "error", err)
+		return
+	}
+	log.Printf("管理接口正在启动于 %s...", ln.Addr())
 	go func() {
-		log.Printf("HTTP服务器正在启动于端口 %s...", config.HTTPPort)
-		if err := httpSrv.Run(":" + config.HTTPPort); err != nil {
-			log.Printf("HTTP服务器启动失败: %v", err)
+		if err := adminServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			httpLogger.Error("管理端口启动失败", "error", err)
 		}
 	}()
+}
 
-	// 根据配置决定是否启动 HTTPS 服务器
-	if config.EnableHTTPS {
-		log.Printf("HTTPS服务器正在启动于端口 %s...", config.HTTPSPort)
-		if err := httpSrv.RunTLS(":"+config.HTTPSPort, config.CertFile, config.KeyFile); err != nil {
-			log.Printf("HTTPS服务器启动失败: %v", err)
+// httpServer、httpsServer、adminServer 保存正在运行的服务器，供优雅退出使用
+var httpServer, httpsServer, adminServer *http.Server
+
+// newHTTPServer 按配置设置超时，替代 gin 的 Run
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: config().HTTPReadHeaderTimeout,
+		ReadTimeout:       config().HTTPReadTimeout,
+		WriteTimeout:      config().HTTPWriteTimeout,
+		IdleTimeout:       config().HTTPIdleTimeout,
+		MaxHeaderBytes:    config().HTTPMaxHeaderBytes,
+	}
+}
+
+// maxBodyMiddleware 限制请求体大小，Content-Length 超限时直接返回 413，否则读取超限时报错。导入接口除外
+func maxBodyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if importRoute(c) {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > config().HTTPMaxBodyBytes {
+			c.AbortWithStatusJSON(413, gin.H{"error": msg("body_too_large")})
+			return
+		}
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, config().HTTPMaxBodyBytes)
 		}
+		c.Next()
 	}
 }
 
+// requestID 取请求头 X-Request-ID，没有或不合法时生成一个，并写回响应头
+func requestID(c *gin.Context) string {
+	id := c.GetHeader("X-Request-ID")
+	if !validRequestID(id) {
+		id = newTraceID()
+	}
+	c.Set("requestID", id)
+	c.Header("X-Request-ID", id)
+	return id
+}
+
+// validRequestID 限制长度和字符，防止日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
 func setupRoutes(r *gin.Engine) {
-	r.GET("/getAllowedDomains", func(c *gin.Context) {
-		c.JSON(200, gin.H{"allowedDomains": config.AllowedDomains})
-	})
+	if config().HSTSMaxAge > 0 {
+		r.Use(hstsMiddleware())
+	}
+	if len(config().CORSAllowedOrigins) > 0 {
+		r.Use(corsMiddleware())
+	}
+	if config().Compression {
+		r.Use(gzipMiddleware())
+	}
+	if config().Metrics {
+		r.Use(metricsMiddleware())
+	}
+
+	base := r.Group(config().BasePath)
+
+	// 健康检查不经过认证和限流
+	base.GET("/healthz", handleHealthz)
+	base.GET("/readyz", handleReadyz)
+	base.GET("/version", handleVersion)
+	if config().AdminPort == "" {
+		setupOpsRoutes(base)
+	}
+	base.GET("/openapi.json", handleOpenAPI)
+	if config().WebUI {
+		setupWebUI(base)
+	}
+	if config().OpenAPIUI {
+		base.GET("/docs", handleSwaggerUI)
+	}
+
+	// 限流器总是挂载，未限流时直接放行，重新加载配置后可以开启或调整
+	rateLimiter = newIPRateLimiter(config().RateLimitRPM, config().RateLimitBurst)
+	createRateLimiter = newIPRateLimiter(config().CreateRateLimitRPM, config().CreateRateLimitBurst)
+	limiter := rateLimiter.middleware()
+	setupAPIv1Routes(base, limiter, createRateLimiter.middleware())
+
+	// 以下为旧路由，保持不变但已弃用，新功能只加到 /api/v1
+	api := base.Group("/", deprecationMiddleware(), limiter)
+	if config().MaxMailboxes > 0 {
+		api.Use(mailboxAccessMiddleware())
+	}
+
+	api.GET("/getAllowedDomains", handleAllowedDomains)
+
+	api.GET("/getMail/:randomString", handleGetMail)
+	api.GET("/getMail/:randomString/:id/links", handleGetLinks)
+	api.GET("/listMail/:randomString", handleListMail)
+	api.GET("/getCode/:randomString", handleGetCode)
+	api.GET("/export/:randomString/:id", handleExportMail)
+	api.GET("/exportMailbox/:randomString", handleExportMailbox)
+	api.GET("/imgproxy", handleImgProxy)
+
+	if config().AdminPort == "" {
+		setupAdminRoutes(base)
+	}
+}
 
-	r.GET("/getMail/:randomString", handleGetMail)
+// setupOpsRoutes 挂载指标和 pprof，配置 ADMIN_PORT 时只挂在管理端口
+func setupOpsRoutes(base *gin.RouterGroup) {
+	if config().Metrics {
+		base.GET("/metrics", metricsHandler())
+	}
+	if config().EnablePprof {
+		setupPprofRoutes(base)
+	}
+}
+
+// setupAdminRoutes 挂载需要 API Key 的管理接口（旧路由和 /api/v1/admin）
+func setupAdminRoutes(base *gin.RouterGroup) {
+	admin := base.Group(config().AdminPath, deprecationMiddleware(), apiKeyAuth())
+	admin.GET("/stats", handleAdminStats)
+	admin.GET("/mailboxes", handleAdminListMailboxes)
+	admin.DELETE("/mailboxes", handlePurgeMailBoxes)
+	admin.DELETE("/mailboxes/:randomString", handleDeleteMailBox)
+
+	setupAPIv1AdminRoutes(base)
+}
+
+// newAdminRouter 管理端口的路由，与公开端口共用存储和配置，
+// 不挂载收信接口、网页和 CORS，便于用防火墙只对内网开放
+func newAdminRouter() *gin.Engine {
+	r := gin.New()
+	r.ForwardedByClientIP = true
+	r.RemoteIPHeaders = config().RealIPHeaders
+	if err := r.SetTrustedProxies(config().TrustedProxies); err != nil {
+		log.Fatalf("设置可信代理失败: %v", err)
+	}
+	r.Use(accessLogMiddleware(), recoveryMiddleware(), maxBodyMiddleware())
+
+	base := r.Group(config().BasePath)
+	base.GET("/healthz", handleHealthz)
+	base.GET("/readyz", handleReadyz)
+	setupOpsRoutes(base)
+	setupAdminRoutes(base)
+	return r
 }
 
 func handleGetMail(c *gin.Context) {
-	mailHead := c.Param("randomString")
+	mailHead := mailboxParam(c)
 
-	mu.RLock() // 使用读锁提高并发性能
-	mails, exists := mailBox[mailHead]
-	if !exists || len(mails) == 0 {
-		mu.RUnlock()
-		c.JSON(201, gin.H{"mail": "没有邮件"})
+	// wait 参数：邮箱为空时等待新邮件，超时同样返回 204
+	wait, ok := waitParam(c)
+	if !ok {
+		c.JSON(400, gin.H{"error": msg("invalid_wait")})
+		return
+	}
+	if wait > 0 && !waitForMail(c.Request.Context(), mailHead, wait) {
+		c.Status(204)
 		return
 	}
 
-	lastIndex := len(mails) - 1
-	tmpMail := mails[lastIndex]
-	mu.RUnlock()
+	ctx, span := tracer.Start(c.Request.Context(), "http.getMail")
+	defer span.End()
+	span.SetAttributes(attribute.String("mail.recipient_domain", addressDomain(mailHead)))
 
-	mu.Lock() // 仅在需要修改时使用写锁
-	mailBox[mailHead] = mails[:lastIndex]
-	mu.Unlock()
+	_, storeSpan := tracer.Start(ctx, "store.popLatest")
+	tmpMail, ok, err := mailStore.PopLatest(mailHead)
+	storeSpan.End()
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if !ok {
+		if config().LegacyEmptyMail && !isAPIv1(c) {
+			c.JSON(201, emptyMailResponse{Mail: "没有邮件"})
+			return
+		}
+		c.Status(204)
+		return
+	}
 
-	c.JSON(200, gin.H{
-		"mail": gin.H{
-			"from":        tmpMail.from,
-			"title":       tmpMail.title,
-			"TextContent": tmpMail.TextContent,
-			"HtmlContent": tmpMail.HtmlContent,
-		},
-	})
+	span.SetAttributes(attribute.String("mail.trace_id", tmpMail.TraceID))
+	reqLogger(c).Info("取出邮件", "mailbox", mailHead, "delivery_id", tmpMail.TraceID)
+	recordFetched()
+
+	tmpMail.HTML = renderHTML(c, mailHead, tmpMail)
+	c.JSON(200, mailResponse(c, tmpMail))
 }
 
-func scheduleDailyMidnightTask(task func()) {
-	ticker := time.NewTicker(24 * time.Hour)
-	go func() {
-		for {
-			now := time.Now()
-			nextMidnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
-			duration := nextMidnight.Sub(now)
-
-			timer := time.NewTimer(duration)
-			select {
-			case <-timer.C:
-				task()
-			case <-ticker.C:
-				// 防止错过执行
-				task()
-			}
+// renderHTML 默认返回清洗后的 HTML，sanitized=false 时返回原始内容便于调试。
+// cid: 内嵌图片在清洗前改写，屏蔽远程图片时不改写
+func renderHTML(c *gin.Context, mailbox string, m mailContent) string {
+	html := m.HTML
+	mode := imageMode(c)
+	if mode != imageModeBlocked {
+		html = rewriteInlineImages(html, mailbox, m)
+	}
+	if c.DefaultQuery("sanitized", "true") != "false" {
+		html = sanitizeHTML(html)
+	}
+	return rewriteRemoteImages(html, mode)
+}
+
+// handleGetMessage 按ID读取单封邮件并标记为已读，不会删除邮件
+func handleGetMessage(c *gin.Context) {
+	mailbox := mailboxParam(c)
+	m, ok, err := mailStore.Get(mailbox, c.Param("id"))
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"error": msg("mail_not_found")})
+		return
+	}
+	if !m.Read {
+		if _, err := mailStore.SetRead(mailbox, m.ID, true); err != nil {
+			storeUnavailable(c, err)
+			return
 		}
-	}()
+		m.Read = true
+	}
+	recordFetched()
+
+	m.HTML = renderHTML(c, mailbox, m)
+	c.JSON(200, mailResponse(c, m))
 }
 
-func clearMailBox() {
-	mu.Lock()
-	defer mu.Unlock()
-	mailBox = make(map[string][]mailContent)
-	log.Printf("邮箱已在 %s 清空", time.Now().Format("2006-01-02 15:04:05"))
+// handleGetLatest 读取最新一封邮件，不删除也不标记为已读，邮箱为空时返回 204。
+// 适合轮询验证码等只关心最新邮件的场景，wait 参数与 pop 相同
+func handleGetLatest(c *gin.Context) {
+	mailbox := mailboxParam(c)
+	wait, ok := waitParam(c)
+	if !ok {
+		c.JSON(400, gin.H{"error": msg("invalid_wait")})
+		return
+	}
+	if wait > 0 && !waitForMail(c.Request.Context(), mailbox, wait) {
+		c.Status(204)
+		return
+	}
+
+	m, ok, err := mailStore.Latest(mailbox)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if !ok {
+		c.Status(204)
+		return
+	}
+	recordFetched()
+
+	m.HTML = renderHTML(c, mailbox, m)
+	c.JSON(200, mailResponse(c, m))
+}
+
+// handleListMail 列出邮箱中的邮件摘要，不会删除邮件
+func handleListMail(c *gin.Context) {
+	mailHead := mailboxParam(c)
+
+	rev, err := mailStore.Revision(mailHead)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if notModified(c, rev) {
+		return
+	}
+	mails, err := mailStore.List(mailHead)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	c.JSON(200, listResponse(c, mails))
+}
+
+func handlePurgeMailBoxes(c *gin.Context) {
+	if err := clearMailBox(); err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	c.JSON(200, okResponse{OK: true})
+}
+
+func handleDeleteMailBox(c *gin.Context) {
+	mailHead := mailboxParam(c)
+
+	count, err := mailStore.Delete(mailHead)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	c.JSON(200, deletedResponse{Deleted: count})
+}
+
+// trimMailBoxes 每个邮箱只保留最新的 keep 封邮件
+func trimMailBoxes(keep int) {
+	removed, trimmed, err := mailStore.Trim(keep)
+	if err != nil {
+		cleanupLogger.Error("删减邮箱失败", "removed", removed, "error", err)
+		return
+	}
+	pruneGreylist(time.Now())
+	pruneDedup(time.Now())
+	observeCleanup()
+	cleanupLogger.Info("邮箱已删减", "keep", keep, "mailboxes", trimmed, "removed", removed)
+}
+
+func clearMailBox() error {
+	if err := mailStore.Clear(); err != nil {
+		cleanupLogger.Error("清空邮箱失败", "error", err)
+		return err
+	}
+	pruneGreylist(time.Now())
+	pruneDedup(time.Now())
+	observeCleanup()
+	cleanupLogger.Info("邮箱已清空")
+	return nil
 }
 
 func main() {
-	// 初始化配置
-	config = initConfig()
+	// 初始化配置，命令行参数优先于环境变量和配置文件
+	values, err := parseFlags(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(2)
+	}
+	flagValues = values
+	setConfig(initConfig())
 
 	// 设置日志格式
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+	initLogging()
 
-	// 启动定时清理任务
-	scheduleDailyMidnightTask(clearMailBox)
+	info := buildInfo()
+	log.Printf("tempMail 版本 %s (commit %s, 构建于 %s, %s)", info.Version, info.Commit, info.BuildTime, info.GoVersion)
+	logEffectiveConfig(config())
 
-	// 启动 HTTP 服务器
-	go startHTTPServer()
+	if config().CatchAll {
+		log.Printf("收件模式: catch-all，接收 %s 下的任意地址", strings.Join(config().AllowedDomains, ","))
+	} else {
+		log.Printf("收件模式: 严格，只接收白名单中的 %d 个地址和已存在的邮箱", len(config().RecipientAllowlist))
+	}
+
+	initInheritedListeners()
+	watchUpgradeSignal()
+	watchShutdownSignal()
+	watchReloadSignal()
+
+	initEncryption()
+	initStore()
+	initBlobStore()
+	initRetryQueue()
+	initMetrics()
+	initTracing()
+	startForwarder()
+
+	// 加载证书，文件更新后自动重新加载；自动证书模式下按需申请
+	if config().EnableAutocert {
+		acmeManager = newAutocertManager()
+		log.Printf("已启用自动证书，域名: %s，缓存目录: %s", strings.Join(config().HTTPSHostnames, ","), config().AutocertCacheDir)
+	} else if config().EnableHTTPS || config().EnableSTARTTLS || config().EnableSMTPS {
+		var err error
+		if certs, err = newCertReloader(config().CertFile, config().KeyFile); err != nil {
+			log.Fatalf("加载证书失败（HTTPS/STARTTLS/SMTPS 需要证书，CERT_FILE=%s KEY_FILE=%s）: %v", config().CertFile, config().KeyFile, err)
+		}
+	}
+
+	// 启动定时清理任务，定时清空为可选的旧版行为
+	if config().DailyCleanup {
+		scheduleCleanup(backgroundCtx, config().CleanupSchedule, func() {
+			if config().CleanupKeepLast > 0 {
+				archiveOlder(time.Now(), config().CleanupKeepLast)
+				trimMailBoxes(config().CleanupKeepLast)
+				return
+			}
+			archiveAll(time.Now())
+			clearMailBox()
+		})
+	}
+	logDomainPolicies()
+	startExpirySweeper()
+	startMailboxEvictor()
+	startStatsLogger()
+
+	// 启动 HTTP 服务器，监听完成后返回
+	startHTTPServer()
+	startAdminServer()
+	startPOP3Server()
+	startIMAPServer()
 
 	// 启动 SMTP 服务器
 	if err := startSMTPServer(); err != nil {
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// godotenv/autoload 已把仓库中的示例 .env 读入环境变量，测试统一从默认配置开始
+	for _, o := range discoverConfigOptions() {
+		os.Unsetenv(o.key)
+	}
+	// 只输出错误日志，需要时用 go test -v 查看测试自身的输出
+	logLevel.Set(slog.LevelError)
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestConfig 默认配置，ALLOWED_DOMAINS 为 test.local，env 中的键覆盖默认值。解析或校验出错时测试失败
+func newTestConfig(t testing.TB, env map[string]string) Config {
+	t.Helper()
+	t.Setenv("ALLOWED_DOMAINS", "test.local")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	configErrors = nil
+	cfg := parseConfig()
+	if len(configErrors) > 0 {
+		t.Fatalf("配置错误: %s", strings.Join(configErrors, "；"))
+	}
+	return cfg
+}
+
+// setupTest 使用 newTestConfig 的配置和空的内存存储，测试结束后恢复原来的配置和存储
+func setupTest(t testing.TB, env map[string]string) Config {
+	t.Helper()
+	cfg := newTestConfig(t, env)
+	oldConfig, oldStore := config(), mailStore
+	setConfig(cfg)
+	mailStore = newMemoryStore()
+	t.Cleanup(func() {
+		if oldConfig != nil {
+			setConfig(*oldConfig)
+		}
+		mailStore = oldStore
+	})
+	return cfg
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// 消息目录：API 错误和 SMTP 回复的文字按 LOCALE（未设置时按 LANG）选择语言，默认英文。
+// 新增语言时在 messages 中加一个语言代码及其译文即可，缺少的消息回退到英文。
+// SMTP 回复只能是 ASCII，smtp_ 开头的消息只应翻译成使用拉丁字母的语言，中文目录不含这些消息
+
+// defaultLocale 未设置或无法识别 LANG 时使用的语言，也是缺少译文时的回退
+const defaultLocale = "en"
+
+// messages 语言代码 → 消息 ID → 文字，文字可以带 fmt 占位符
+var messages = map[string]map[string]string{
+	"en": {
+		"unauthorized":             "Unauthorized",
+		"rate_limited":             "Too many requests",
+		"body_too_large":           "Request body too large",
+		"store_unavailable":        "Storage temporarily unavailable, please try again later",
+		"out_of_range":             "%s must be between %d and %d",
+		"invalid_wait":             "Invalid wait parameter",
+		"invalid_offset":           "Invalid offset",
+		"no_mail":                  "No mail",
+		"mail_not_found":           "Mail not found",
+		"code_not_found":           "No verification code found",
+		"invalid_attachment_index": "Invalid attachment index",
+		"attachment_not_found":     "Attachment not found",
+		"attachment_read_failed":   "Failed to read attachment",
+		"inline_image_not_found":   "Inline image not found",
+		"invalid_image_url":        "Invalid image URL",
+		"image_fetch_failed":       "Failed to fetch image",
+		"unsupported_domain":       "Unsupported domain",
+		"subdomain_required":       "Specify a concrete subdomain with the domain parameter",
+		"address_generation_fail":  "Failed to generate address",
+		"mailbox_list_expected":    "Request body must be an array of mailbox addresses",
+		"mailbox_count":            "Number of mailboxes must be between 1 and %d",
+		"archive_disabled":         "Archiving is not enabled",
+		"missing_address":          "Missing address parameter",
+		"invalid_archive_date":     "date must be in 2006-01-02 format",
+		"archive_read_failed":      "Failed to read archive",
+		"import_line_invalid":      "Line %d is malformed: %v",
+		"import_line_incomplete":   "Line %d is missing mailbox or id",
+		"profile_in_progress":      "A CPU profile is already in progress",
+		"reload_failed":            "Failed to reload configuration, keeping the current one: %v",
+
+		"smtp_relay_denied":        "Relay access denied",
+		"smtp_no_such_user":        "No such user here",
+		"smtp_message_too_large":   "Message size exceeds limit for this recipient",
+		"smtp_mailbox_full":        "Mailbox full",
+		"smtp_too_many_recipients": "Too many recipients",
+		"smtp_need_smtputf8":       "Non-ASCII address requires SMTPUTF8",
+		"smtp_store_unavailable":   "Temporary storage failure, please try again later",
+		"smtp_spam_rejected":       "Message rejected as spam",
+		"smtp_greylisted":          "Greylisted, please try again later",
+		"smtp_dnsbl_blocked":       "Client host %s blocked using %s",
+		"smtp_rdns_failed":         "Reverse DNS validation failed",
+	},
+	"zh": {
+		"unauthorized":             "未授权",
+		"rate_limited":             "请求过于频繁",
+		"body_too_large":           "请求体过大",
+		"store_unavailable":        "存储暂不可用，请稍后重试",
+		"out_of_range":             "%s 需在 %d-%d 之间",
+		"invalid_wait":             "无效的 wait 参数",
+		"invalid_offset":           "offset 无效",
+		"no_mail":                  "没有邮件",
+		"mail_not_found":           "邮件不存在",
+		"code_not_found":           "未找到验证码",
+		"invalid_attachment_index": "附件序号无效",
+		"attachment_not_found":     "附件不存在",
+		"attachment_read_failed":   "读取附件失败",
+		"inline_image_not_found":   "内嵌图片不存在",
+		"invalid_image_url":        "无效的图片地址",
+		"image_fetch_failed":       "获取图片失败",
+		"unsupported_domain":       "不支持的域名",
+		"subdomain_required":       "请通过 domain 参数指定具体的子域名",
+		"address_generation_fail":  "生成地址失败",
+		"mailbox_list_expected":    "请求体应为邮箱地址数组",
+		"mailbox_count":            "邮箱数量应为 1 到 %d",
+		"archive_disabled":         "未启用归档",
+		"missing_address":          "缺少 address 参数",
+		"invalid_archive_date":     "date 格式应为 2006-01-02",
+		"archive_read_failed":      "读取归档失败",
+		"import_line_invalid":      "第 %d 行格式错误: %v",
+		"import_line_incomplete":   "第 %d 行缺少 mailbox 或 id",
+		"profile_in_progress":      "已有 CPU 采样在进行",
+		"reload_failed":            "重新加载配置失败，继续使用原配置: %v",
+	},
+}
+
+// msg 按当前配置的语言取消息并填入参数
+func msg(id string, args ...interface{}) string {
+	return localeMsg(config().Locale, id, args...)
+}
+
+// localeMsg 按指定语言取消息，缺少译文时用英文，英文也没有时返回消息 ID
+func localeMsg(locale, id string, args ...interface{}) string {
+	text, ok := messages[locale][id]
+	if !ok {
+		if text, ok = messages[defaultLocale][id]; !ok {
+			text = id
+		}
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// localeLanguage 取语言代码：zh_CN.UTF-8、zh-TW → zh，en_US → en
+func localeLanguage(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if i := strings.IndexAny(value, "_-.@"); i >= 0 {
+		value = value[:i]
+	}
+	return value
+}
+
+// parseLocale 解析 LOCALE，未设置时按 LANG。LOCALE 为不支持的语言时报错，LANG 不支持时用英文
+func parseLocale(value string) string {
+	if value != "" {
+		lang := localeLanguage(value)
+		if _, ok := messages[lang]; !ok {
+			configError("不支持的 LOCALE %q，可选 %s", value, strings.Join(supportedLocales(), "、"))
+			return defaultLocale
+		}
+		return lang
+	}
+	if lang := localeLanguage(os.Getenv("LANG")); messages[lang] != nil {
+		return lang
+	}
+	return defaultLocale
+}
+
+func supportedLocales() []string {
+	locales := make([]string, 0, len(messages))
+	for lang := range messages {
+		locales = append(locales, lang)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// smtpReply 固定状态码的 SMTP 回复，文字在回复时按当前语言从消息目录取
+type smtpReply struct {
+	code     int
+	enhanced smtp.EnhancedCode
+	id       string
+}
+
+func (r smtpReply) err(args ...interface{}) *smtp.SMTPError {
+	return r.in(config().Locale, args...)
+}
+
+// in 按指定语言生成回复，解析配置时 config() 还是旧配置，需用新配置的语言
+func (r smtpReply) in(locale string, args ...interface{}) *smtp.SMTPError {
+	return &smtp.SMTPError{Code: r.code, EnhancedCode: r.enhanced, Message: localeMsg(locale, r.id, args...)}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 指标只在 METRICS=true 时注册和采集
+var (
+	metricsRegistry *prometheus.Registry
+
+	messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempmail_messages_received_total",
+		Help: "收到并保存的邮件数",
+	}, []string{"domain"})
+	messagesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempmail_messages_rejected_total",
+		Help: "被拒绝的投递数",
+	}, []string{"domain", "reason"})
+	smtpSessions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tempmail_smtp_sessions_total",
+		Help: "SMTP 会话数",
+	})
+	smtpActiveSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tempmail_smtp_active_sessions",
+		Help: "当前 SMTP 会话数",
+	})
+	cleanups = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tempmail_cleanups_total",
+		Help: "邮箱清空次数",
+	})
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tempmail_http_requests_total",
+		Help: "HTTP 请求数",
+	}, []string{"route", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tempmail_http_request_duration_seconds",
+		Help:    "HTTP 请求耗时",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "status"})
+)
+
+func initMetrics() {
+	if !config().Metrics {
+		return
+	}
+
+	metricsRegistry = prometheus.NewRegistry()
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		messagesReceived, messagesRejected, smtpSessions, smtpActiveSessions,
+		cleanups, httpRequests, httpDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tempmail_mailboxes",
+			Help: "当前邮箱数",
+		}, func() float64 {
+			st, _ := mailStore.Stats(time.Now())
+			return float64(st.Mailboxes)
+		}),
+		newStoreCollector(),
+	)
+}
+
+// storeCollector 采集邮件数、字节数和数据文件大小
+type storeCollector struct {
+	messages        *prometheus.Desc
+	bytes           *prometheus.Desc
+	fileBytes       *prometheus.Desc
+	mailboxBytesMax *prometheus.Desc
+}
+
+func newStoreCollector() *storeCollector {
+	return &storeCollector{
+		messages:  prometheus.NewDesc("tempmail_messages_stored", "当前保存的邮件数", nil, nil),
+		bytes:     prometheus.NewDesc("tempmail_messages_stored_bytes", "当前保存的邮件字节数（估算）", nil, nil),
+		fileBytes: prometheus.NewDesc("tempmail_store_file_bytes", "bolt 数据文件大小", nil, nil),
+		// 按邮箱打标签会让标签基数随地址无限增长，只导出最大的邮箱
+		mailboxBytesMax: prometheus.NewDesc("tempmail_mailbox_bytes_max", "占用字节数最多的邮箱的字节数（估算）", nil, nil),
+	}
+}
+
+func (sc *storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sc.messages
+	ch <- sc.bytes
+	ch <- sc.fileBytes
+	ch <- sc.mailboxBytesMax
+}
+
+func (sc *storeCollector) Collect(ch chan<- prometheus.Metric) {
+	st, err := mailStore.Stats(time.Now())
+	if err != nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(sc.messages, prometheus.GaugeValue, float64(st.Messages))
+	ch <- prometheus.MustNewConstMetric(sc.bytes, prometheus.GaugeValue, float64(st.Bytes))
+	if config().StoreBackend == "bolt" {
+		ch <- prometheus.MustNewConstMetric(sc.fileBytes, prometheus.GaugeValue, float64(st.FileBytes))
+	}
+	// 内存和 Maildir 存储的邮箱字节数是现成的，其他存储每次采集都要读出所有邮箱，不导出
+	if config().StoreBackend == "memory" || config().StoreBackend == "maildir" {
+		summaries, err := mailStore.Mailboxes("")
+		if err != nil {
+			return
+		}
+		var largest int64
+		for _, sum := range summaries {
+			largest = max(largest, sum.Bytes)
+		}
+		ch <- prometheus.MustNewConstMetric(sc.mailboxBytesMax, prometheus.GaugeValue, float64(largest))
+	}
+}
+
+// metricDomain 只用允许的域名做标签，避免任意域名撑爆标签基数
+func metricDomain(domain string) string {
+	if domain == "" {
+		return "unknown"
+	}
+	pattern, ok := matchAllowedDomain(domain)
+	if !ok {
+		return "other"
+	}
+	// 通配域名下的子域名统一记为通配条目
+	if isWildcardDomain(pattern) {
+		return strings.ToLower(pattern)
+	}
+	return domain
+}
+
+func observeReceived(domain string) {
+	if config().Metrics {
+		messagesReceived.WithLabelValues(metricDomain(domain)).Inc()
+	}
+}
+
+func observeRejected(domain, reason string) {
+	if config().Metrics {
+		messagesRejected.WithLabelValues(metricDomain(domain), reason).Inc()
+	}
+}
+
+func observeSMTPSession(delta int) {
+	if !config().Metrics {
+		return
+	}
+	if delta > 0 {
+		smtpSessions.Inc()
+	}
+	smtpActiveSessions.Add(float64(delta))
+}
+
+func observeCleanup() {
+	if config().Metrics {
+		cleanups.Inc()
+	}
+}
+
+// metricsMiddleware 按路由和状态码统计请求数和耗时
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(route, status).Inc()
+		httpDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricDomain(t *testing.T) {
+	setupTest(t, map[string]string{"ALLOWED_DOMAINS": "test.local,*.wild.test"})
+	for domain, want := range map[string]string{
+		"":               "unknown",
+		"test.local":     "test.local",
+		"a.wild.test":    "*.wild.test",
+		"b.c.wild.test":  "*.wild.test",
+		"attacker.test":  "other",
+		"random123.test": "other",
+	} {
+		if got := metricDomain(domain); got != want {
+			t.Errorf("metricDomain(%q) = %q，应为 %q", domain, got, want)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	setupTest(t, map[string]string{"METRICS": "true"})
+	initMetrics()
+	r := newRouter()
+
+	received := testutil.ToFloat64(messagesReceived.WithLabelValues("test.local"))
+	observeReceived("test.local")
+	if got := testutil.ToFloat64(messagesReceived.WithLabelValues("test.local")) - received; got != 1 {
+		t.Errorf("收信计数增加 %v", got)
+	}
+
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", Text: strings.Repeat("x", 100), ReceivedAt: time.Now()})
+	testRequest(r, "GET", "/api/v1/mailboxes/user@test.local/messages", "192.0.2.1")
+	testRequest(r, "GET", "/api/v1/mailboxes/other@test.local/messages", "192.0.2.1")
+
+	w := testRequest(r, "GET", "/metrics", "192.0.2.1")
+	body, _ := io.ReadAll(w.Body)
+	if w.Code != 200 {
+		t.Fatalf("/metrics 返回 %d", w.Code)
+	}
+	for _, want := range []string{
+		"tempmail_mailboxes 1",
+		"tempmail_messages_stored 1",
+		`tempmail_messages_received_total{domain="test.local"}`,
+		// 路由标签使用路由模板，不随地址增长
+		`tempmail_http_requests_total{route="/api/v1/mailboxes/:address/messages",status="200"}`,
+		"tempmail_mailbox_bytes_max",
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics 中缺少 %s", want)
+		}
+	}
+	if strings.Contains(string(body), "user@test.local") {
+		t.Error("指标标签中不应出现邮箱地址")
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	setupTest(t, nil)
+	r := newRouter()
+	if w := testRequest(r, "GET", "/metrics", "192.0.2.1"); w.Code != 404 {
+		t.Errorf("未开启 METRICS 时 /metrics 返回 %d", w.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 整库迁移：GET /api/v1/admin/export 把所有邮箱输出为 NDJSON，每行一封邮件，附件和原始邮件为 base64；
+// POST /api/v1/admin/import 读取同样的格式写入当前存储，邮箱中已有相同 ID 的邮件跳过。
+// 两个接口都逐行处理，不把整个存储读入内存，用于在存储后端之间迁移
+
+const exportContentType = "application/x-ndjson"
+
+// exportedMail 导出文件中的一行
+type exportedMail struct {
+	Mailbox string `json:"mailbox"`
+	storedMail
+}
+
+// importResponse 导入结果
+type importResponse struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// extendDeadline 导出导入的耗时随邮件数增长，每处理一批把读或写超时往后推一个周期，
+// 客户端停止收发时仍会超时断开。timeout 为 0 表示未设置超时
+func extendDeadline(set func(time.Time) error, timeout time.Duration) {
+	if timeout > 0 {
+		set(time.Now().Add(timeout))
+	}
+}
+
+// handleAdminExport 按地址顺序逐个邮箱导出，每个邮箱内按投递顺序输出，导入后顺序不变。
+// 响应开始后存储出错只能中断，客户端会收到不完整的文件，日志中有记录
+func handleAdminExport(c *gin.Context) {
+	summaries, err := mailStore.Mailboxes("")
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Address < summaries[j].Address })
+
+	c.Header("Content-Type", exportContentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="tempmail-export-%s.jsonl"`, time.Now().Format("20060102-150405")))
+	c.Status(200)
+
+	rc := http.NewResponseController(c.Writer)
+	enc := json.NewEncoder(c.Writer)
+	count := 0
+	for _, sum := range summaries {
+		extendDeadline(rc.SetWriteDeadline, config().HTTPWriteTimeout)
+		mails, err := mailStore.List(sum.Address)
+		if err != nil {
+			reqLogger(c).Error("导出邮箱失败，导出文件不完整", "mailbox", sum.Address, "error", err)
+			return
+		}
+		for i := len(mails) - 1; i >= 0; i-- {
+			if err := enc.Encode(exportedMail{Mailbox: sum.Address, storedMail: newStoredMail(mails[i])}); err != nil {
+				reqLogger(c).Warn("导出中断", "error", err)
+				return
+			}
+			count++
+		}
+		c.Writer.Flush()
+	}
+	reqLogger(c).Info("已导出邮件", "mailboxes", len(summaries), "messages", count)
+}
+
+// handleAdminImport 逐行读取导出文件写入当前存储。某一行格式错误时停止，
+// 之前的行已经写入，返回中带有已导入和跳过的数量，修正后重新导入会跳过已导入的邮件
+func handleAdminImport(c *gin.Context) {
+	rc := http.NewResponseController(c.Writer)
+	dec := json.NewDecoder(c.Request.Body)
+	var result importResponse
+	for n := 1; ; n++ {
+		extendDeadline(rc.SetReadDeadline, config().HTTPReadTimeout)
+		var rec exportedMail
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			c.JSON(400, gin.H{"error": msg("import_line_invalid", n, err), "imported": result.Imported, "skipped": result.Skipped})
+			return
+		}
+		mailbox := normalizeAddress(rec.Mailbox)
+		if mailbox == "" || rec.ID == "" {
+			c.JSON(400, gin.H{"error": msg("import_line_incomplete", n), "imported": result.Imported, "skipped": result.Skipped})
+			return
+		}
+
+		_, exists, err := mailStore.Get(mailbox, rec.ID)
+		if err != nil {
+			storeUnavailable(c, err)
+			return
+		}
+		if exists {
+			result.Skipped++
+			continue
+		}
+		m := rec.mail()
+		m.To = mailbox
+		if err := mailStore.Append(m); err != nil {
+			storeUnavailable(c, err)
+			return
+		}
+		result.Imported++
+	}
+	reqLogger(c).Info("已导入邮件", "imported", result.Imported, "skipped", result.Skipped)
+	c.JSON(200, result)
+}
+
+// importRoute 导入接口的请求体是整个存储的导出，不受 HTTP_MAX_BODY_BYTES 限制，只有管理员能调用
+func importRoute(c *gin.Context) bool {
+	return c.FullPath() == config().BasePath+apiV1Prefix+"/admin/import"
+}
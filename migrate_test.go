@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminTransfer 以管理员身份调用导出或导入接口
+func adminTransfer(t *testing.T, method, path string, body []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/v1/admin/"+path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, req)
+	return w
+}
+
+// exportLines 把导出文件逐行解成 map 并去掉 seq，序号由各存储自行分配，不要求一致
+func exportLines(t *testing.T, data []byte) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("导出的行 %q: %v", sc.Text(), err)
+		}
+		delete(line, "seq")
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// TestExportImportRoundTrip 从内存存储导出，再导入到每种新的空存储，再次导出的内容与原来相同
+func TestExportImportRoundTrip(t *testing.T) {
+	forEachStore(t, func(t *testing.T, target MailStore) {
+		setupTest(t, map[string]string{"ADMIN_API_KEYS": "secret", "STORE_RAW": "true"})
+		// Redis 按过期时间给列表设置 TTL，需要晚于真实的当前时间
+		expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		rich := testMail("alice@test.local", "a1", 0)
+		rich.HTML = "<p>你好</p>"
+		rich.raw = []byte("Subject: subject a1\r\n\r\nbody a1\r\n")
+		rich.ExpiresAt = &expires
+		rich.ClientIP, rich.Helo, rich.DNSBL = "192.0.2.1", "mx.example.com", []string{"zen.example.org"}
+		rich.Spam = &spamVerdict{Score: 4.5, Verdict: "ham"}
+		rich.Attachments = []attachment{{Filename: "a.bin", ContentType: "application/octet-stream", Size: 3, data: []byte{0, 0xff, '\n'}}}
+		rich.inline = []inlinePart{{cid: "logo", contentType: "image/png", data: []byte{0x89, 'P', 'N', 'G'}}}
+		appendAll(t, mailStore, rich, testMail("alice@test.local", "a2", 1), testMail("bob@test.local", "b1", 2))
+		mailStore.SetRead("alice@test.local", "a2", true)
+
+		w := adminTransfer(t, "GET", "export", nil)
+		if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), exportContentType) {
+			t.Fatalf("导出返回 %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		exported := w.Body.Bytes()
+		want := exportLines(t, exported)
+		if len(want) != 3 || want[0]["id"] != "a1" || want[1]["id"] != "a2" || want[2]["id"] != "b1" {
+			t.Fatalf("导出的行 %v", want)
+		}
+
+		mailStore = target
+		w = adminTransfer(t, "POST", "import", exported)
+		var resp struct {
+			Data importResponse `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 || resp.Data != (importResponse{Imported: 3}) {
+			t.Fatalf("导入返回 %d %s", w.Code, w.Body)
+		}
+		if got := exportLines(t, adminTransfer(t, "GET", "export", nil).Body.Bytes()); !reflect.DeepEqual(got, want) {
+			t.Errorf("导入后再次导出不一致:\n得到 %v\n应为 %v", got, want)
+		}
+		m, ok, _ := target.Get("alice@test.local", "a1")
+		if !ok || string(m.raw) != string(rich.raw) || len(m.Attachments) != 1 || !bytes.Equal(m.Attachments[0].data, rich.Attachments[0].data) {
+			t.Errorf("导入的邮件 %+v", m)
+		}
+
+		// 再次导入时按 ID 跳过已有的邮件
+		w = adminTransfer(t, "POST", "import", exported)
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != 200 || resp.Data != (importResponse{Skipped: 3}) {
+			t.Errorf("重复导入返回 %d %s", w.Code, w.Body)
+		}
+		if n, _ := target.Count("alice@test.local"); n != 2 {
+			t.Errorf("重复导入后 alice 有 %d 封", n)
+		}
+	})
+}
+
+func TestImportInvalidLines(t *testing.T) {
+	setupTest(t, map[string]string{"ADMIN_API_KEYS": "secret"})
+	line := `{"mailbox":"user@test.local","id":"m1","subject":"hi","received_at":"2024-03-01T12:00:00Z"}` + "\n"
+	for _, tc := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"格式错误", line + "{not json\n", msg("import_line_invalid", 2, "")},
+		{"缺少 ID", line + `{"mailbox":"user@test.local"}` + "\n", msg("import_line_incomplete", 2)},
+		{"缺少邮箱", line + `{"id":"m2"}` + "\n", msg("import_line_incomplete", 2)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mailStore = newMemoryStore()
+			w := adminTransfer(t, "POST", "import", []byte(tc.body))
+			var resp struct {
+				Data  importResponse `json:"data"`
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != 400 || !strings.HasPrefix(resp.Error.Message, tc.want) {
+				t.Errorf("返回 %d %s，应以 %q 开头", w.Code, w.Body, tc.want)
+			}
+			// 出错之前的行已经写入，返回中带有已导入的数量
+			if n, _ := mailStore.Count("user@test.local"); n != 1 || resp.Data.Imported != 1 {
+				t.Errorf("出错前的行导入了 %d 封", n)
+			}
+		})
+	}
+}
+
+// TestExportImportRequireAdmin 导出和导入只有管理员能调用
+func TestExportImportRequireAdmin(t *testing.T) {
+	setupTest(t, map[string]string{"ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+	for _, tc := range []struct{ method, path string }{{"GET", "export"}, {"POST", "import"}} {
+		req := httptest.NewRequest(tc.method, "/api/v1/admin/"+tc.path, strings.NewReader(""))
+		req.Header.Set("Authorization", "Bearer wrong")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != 401 && w.Code != 403 {
+			t.Errorf("%s %s 未授权时返回 %d", tc.method, tc.path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiOperation 描述一个接口，OpenAPI 文档由此表和响应结构生成
+type apiOperation struct {
+	method    string
+	path      string // gin 风格路径，:name 会转换为 {name}；为空表示只有 v1 路由
+	summary   string
+	tag       string
+	admin     bool
+	v1        string // 对应的 /api/v1 路由，如 "GET /mailboxes/:address/messages"，为空表示没有
+	query     []apiParam
+	body      interface{} // JSON 请求体的零值，nil 表示没有请求体
+	responses []apiResponse
+}
+
+type apiParam struct {
+	name        string
+	description string
+	kind        string // string / integer / boolean
+}
+
+type apiResponse struct {
+	status      int
+	description string
+	body        interface{} // 响应结构的零值，nil 表示无 JSON 响应体
+	contentType string      // 非 JSON 响应的类型
+}
+
+func apiOperations() []apiOperation {
+	notFound := apiResponse{404, "邮件不存在", errorResponse{}, ""}
+	unauthorized := apiResponse{401, "未授权", errorResponse{}, ""}
+	limited := apiResponse{429, "请求过于频繁", errorResponse{}, ""}
+
+	return []apiOperation{
+		{method: "GET", path: "/healthz", summary: "存活检查", tag: "health",
+			responses: []apiResponse{{200, "正常", statusResponse{}, ""}}},
+		{method: "GET", path: "/readyz", summary: "就绪检查", tag: "health",
+			responses: []apiResponse{{200, "就绪", statusResponse{}, ""}, {503, "未就绪", statusResponse{}, ""}}},
+		{method: "GET", path: "/version", summary: "构建版本信息", tag: "health",
+			responses: []apiResponse{{200, "版本", versionResponse{}, ""}}},
+		{method: "GET", path: "/getAllowedDomains", v1: "GET /domains", summary: "获取所有域名后缀", tag: "mail",
+			query: []apiParam{
+				{"limits", "为 true 时附带各域名的保留时长和大小上限", "boolean"},
+			},
+			responses: []apiResponse{{200, "域名列表", allowedDomainsResponse{}, ""}, limited}},
+		{v1: "GET /info", summary: "服务能力和限制：域名及其策略、邮件大小上限、已启用的功能等", tag: "mail",
+			responses: []apiResponse{{200, "服务信息", infoResponse{}, ""}, limited}},
+		{method: "GET", path: "/getMail/:randomString", v1: "POST /mailboxes/:address/messages/pop", summary: "取出最新一封邮件（阅后即焚）", tag: "mail",
+			query: []apiParam{
+				{"sanitized", "为 false 时返回未清洗的 HTML", "boolean"},
+				{"images", "远程图片处理方式：original / blocked / proxied", "string"},
+				{"wait", "邮箱为空时等待新邮件的时长，如 30s，最长 2m 且不超过 HTTP 写超时", "string"},
+			},
+			responses: []apiResponse{{200, "邮件", getMailResponse{}, ""}, {201, "没有邮件（旧接口，LEGACY_EMPTY_MAIL=true 时）", emptyMailResponse{}, ""},
+				{204, "没有邮件，或等待超时仍没有邮件", nil, ""}, {400, "无效的 wait 参数", errorResponse{}, ""}, limited}},
+		{v1: "POST /mailboxes", summary: "新建随机邮箱地址", tag: "mail",
+			query:     []apiParam{{"domain", "域名，默认第一个域名", "string"}},
+			responses: []apiResponse{{201, "新地址", newMailboxResponse{}, ""}, {400, "不支持的域名", errorResponse{}, ""}, limited}},
+		{v1: "GET /mailboxes/:address/messages/latest", summary: "读取最新一封邮件（不删除，不标记为已读）", tag: "mail",
+			query: []apiParam{
+				{"sanitized", "为 false 时返回未清洗的 HTML", "boolean"},
+				{"images", "远程图片处理方式：original / blocked / proxied", "string"},
+				{"wait", "邮箱为空时等待新邮件的时长，如 30s，最长 2m 且不超过 HTTP 写超时", "string"},
+			},
+			responses: []apiResponse{{200, "邮件", getMailResponse{}, ""}, {204, "没有邮件", nil, ""},
+				{400, "无效的 wait 参数", errorResponse{}, ""}, limited}},
+		{v1: "GET /mailboxes/:address/messages/:id", summary: "读取单封邮件并标记为已读（不删除）", tag: "mail",
+			query: []apiParam{
+				{"sanitized", "为 false 时返回未清洗的 HTML", "boolean"},
+				{"images", "远程图片处理方式：original / blocked / proxied", "string"},
+			},
+			responses: []apiResponse{{200, "邮件", getMailResponse{}, ""}, notFound, limited}},
+		{v1: "POST /mailboxes/:address/messages/read", summary: "把邮箱中的所有邮件标记为已读", tag: "mail",
+			responses: []apiResponse{{200, "标记的邮件数", markedResponse{}, ""}, limited}},
+		{v1: "POST /mailboxes/:address/messages/:id/unread", summary: "把单封邮件标记为未读", tag: "mail",
+			responses: []apiResponse{{200, "已标记", okResponse{}, ""}, notFound, limited}},
+		{v1: "GET /mailboxes/:address/count", summary: "邮件数", tag: "mail",
+			query:     []apiParam{{"unread", "为 true 时只统计未读邮件", "boolean"}},
+			responses: []apiResponse{{200, "邮件数", countResponse{}, ""}, limited}},
+		{method: "GET", path: "/getMail/:randomString/:id/links", v1: "GET /mailboxes/:address/messages/:id/links", summary: "提取邮件中的链接", tag: "mail",
+			responses: []apiResponse{{200, "链接列表", linksResponse{}, ""}, notFound, limited}},
+		{method: "GET", path: "/listMail/:randomString", v1: "GET /mailboxes/:address/messages", summary: "列出邮件摘要（不删除）", tag: "mail",
+			responses: []apiResponse{{200, "邮件摘要，最新的在前", listMailResponse{}, ""}, {304, "邮箱没有变化", nil, ""}, limited}},
+		{method: "GET", path: "/getCode/:randomString", v1: "GET /mailboxes/:address/code", summary: "从最新邮件中提取验证码", tag: "mail",
+			responses: []apiResponse{{200, "验证码", codeResponse{}, ""}, {404, "没有邮件或未找到验证码", codeNotFoundResponse{}, ""}, limited}},
+		{method: "GET", path: "/export/:randomString/:id", v1: "GET /mailboxes/:address/messages/:id/raw", summary: "以 .eml 下载单封邮件", tag: "mail",
+			responses: []apiResponse{{200, "原始邮件", nil, "message/rfc822"}, notFound, limited}},
+		{method: "GET", path: "/exportMailbox/:randomString", v1: "GET /mailboxes/:address/mbox", summary: "以 mbox 下载整个邮箱（不删除）", tag: "mail",
+			responses: []apiResponse{{200, "mbox 文件，从旧到新，邮箱为空时为空文件", nil, "application/mbox"}, limited}},
+		{v1: "GET /mailboxes/:address/messages/:id/attachments/:index", summary: "下载附件，index 为 attachments 数组下标", tag: "mail",
+			responses: []apiResponse{{200, "附件内容，类型取自邮件", nil, "application/octet-stream"}, {400, "附件序号无效", errorResponse{}, ""}, {404, "邮件或附件不存在", errorResponse{}, ""},
+				{502, "外置的附件无法从对象存储读取", errorResponse{}, ""}, limited}},
+		{v1: "GET /mailboxes/:address/messages/:id/inline/:cid", summary: "按 Content-ID 获取内嵌图片", tag: "mail",
+			responses: []apiResponse{{200, "图片", nil, "image/*"}, {404, "邮件或内嵌图片不存在", errorResponse{}, ""}, limited}},
+		{method: "GET", path: "/imgproxy", v1: "GET /imgproxy", summary: "远程图片代理", tag: "mail",
+			query:     []apiParam{{"src", "图片地址", "string"}},
+			responses: []apiResponse{{200, "图片", nil, "image/*"}, {400, "无效的图片地址", errorResponse{}, ""}, {502, "获取图片失败", errorResponse{}, ""}, limited}},
+		{method: "GET", path: config().AdminPath + "/stats", v1: "GET /admin/stats", summary: "服务统计", tag: "admin", admin: true,
+			query:     []apiParam{{"top", "返回占用字节数最多的邮箱数量，默认 10，最大 100，0 表示不返回", "integer"}},
+			responses: []apiResponse{{200, "统计", adminStatsResponse{}, ""}, unauthorized}},
+		{method: "GET", path: config().AdminPath + "/mailboxes", v1: "GET /admin/mailboxes", summary: "列出邮箱", tag: "admin", admin: true,
+			query: []apiParam{
+				{"prefix", "按地址前缀过滤", "string"},
+				{"offset", "分页偏移", "integer"},
+				{"limit", "每页数量，最大 500", "integer"},
+			},
+			responses: []apiResponse{{200, "邮箱列表", mailboxListResponse{}, ""}, {400, "分页参数无效", errorResponse{}, ""}, unauthorized}},
+		{v1: "POST /admin/mailboxes/batch", summary: "批量获取多个邮箱的邮件概要（不删除）", tag: "admin", admin: true, body: []string{},
+			responses: []apiResponse{{200, "各邮箱的邮件概要", batchMailResponse{}, ""}, {400, "请求体无效或邮箱数量超过 50", errorResponse{}, ""}, unauthorized}},
+		{v1: "GET /admin/archive", summary: "查询已归档的过期邮件", tag: "admin", admin: true,
+			query: []apiParam{
+				{"address", "收件地址", "string"},
+				{"date", "收件日期，如 2024-01-02", "string"},
+				{"id", "只返回这封邮件", "string"},
+			},
+			responses: []apiResponse{{200, "归档的邮件", archiveResponse{}, ""}, {400, "参数无效", errorResponse{}, ""},
+				{404, "未启用归档", errorResponse{}, ""}, unauthorized}},
+		{v1: "GET /admin/export", summary: "导出所有邮件（NDJSON，每行一封，附件和原始邮件为 base64）", tag: "admin", admin: true,
+			responses: []apiResponse{{200, "导出文件", nil, exportContentType}, unauthorized}},
+		{v1: "POST /admin/import", summary: "导入 /admin/export 的导出文件，已存在的邮件 ID 跳过", tag: "admin", admin: true,
+			responses: []apiResponse{{200, "导入结果", importResponse{}, ""}, {400, "某一行格式错误，之前的行已导入", errorResponse{}, ""}, unauthorized}},
+		{v1: "POST /admin/reload", summary: "重新读取 .env 和配置文件，应用可以运行中修改的配置（同 SIGHUP）", tag: "admin", admin: true,
+			responses: []apiResponse{{200, "已更新和需要重启的配置", reloadResponse{}, ""}, {400, "新配置有错误，继续使用原配置", errorResponse{}, ""}, unauthorized}},
+		{method: "DELETE", path: config().AdminPath + "/mailboxes", v1: "DELETE /admin/mailboxes", summary: "清空所有邮箱", tag: "admin", admin: true,
+			responses: []apiResponse{{200, "已清空", okResponse{}, ""}, unauthorized}},
+		{method: "DELETE", path: config().AdminPath + "/mailboxes/:randomString", v1: "DELETE /admin/mailboxes/:address", summary: "删除单个邮箱", tag: "admin", admin: true,
+			responses: []apiResponse{{200, "删除的邮件数", deletedResponse{}, ""}, unauthorized}},
+	}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+	openAPIErr  error
+)
+
+// buildOpenAPI 生成 OpenAPI 3 文档，旧路由标记为 deprecated
+func buildOpenAPI() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]interface{})
+
+	for _, op := range apiOperations() {
+		if op.path != "" {
+			addOpenAPIOperation(paths, schemas, op, op.method, op.path, false)
+		}
+		if method, path, ok := strings.Cut(op.v1, " "); ok {
+			addOpenAPIOperation(paths, schemas, op, method, apiV1Prefix+path, true)
+		}
+	}
+
+	server := config().BasePath
+	if server == "" {
+		server = "/"
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "tempMail", "version": version},
+		"servers": []map[string]string{{"url": server}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// addOpenAPIOperation 登记一个路由，v1 为 true 时 JSON 响应包装在 v1Envelope 中
+func addOpenAPIOperation(paths, schemas map[string]interface{}, op apiOperation, method, ginPath string, v1 bool) {
+	path, params := openAPIPath(ginPath)
+	for _, q := range op.query {
+		params = append(params, map[string]interface{}{
+			"name": q.name, "in": "query", "description": q.description,
+			"schema": map[string]interface{}{"type": q.kind},
+		})
+	}
+
+	responses := make(map[string]interface{})
+	for _, r := range op.responses {
+		resp := map[string]interface{}{"description": r.description}
+		switch {
+		case r.body != nil:
+			schema := schemaFor(reflect.TypeOf(r.body), schemas)
+			if v1 {
+				schema = envelopeSchema(schema, r.status >= 400, schemas)
+			}
+			resp["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schema},
+			}
+		case r.contentType != "":
+			resp["content"] = map[string]interface{}{
+				r.contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+			}
+		}
+		responses[strconv.Itoa(r.status)] = resp
+	}
+
+	operation := map[string]interface{}{
+		"summary":   op.summary,
+		"tags":      []string{op.tag},
+		"responses": responses,
+	}
+	if len(params) > 0 {
+		operation["parameters"] = params
+	}
+	if op.body != nil {
+		operation["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemaFor(reflect.TypeOf(op.body), schemas)},
+			},
+		}
+	}
+	if op.admin {
+		operation["security"] = []map[string][]string{{"apiKey": {}}, {"bearer": {}}}
+	}
+	if !v1 && op.v1 != "" {
+		operation["deprecated"] = true
+	}
+
+	item, _ := paths[path].(map[string]interface{})
+	if item == nil {
+		item = make(map[string]interface{})
+		paths[path] = item
+	}
+	item[strings.ToLower(method)] = operation
+}
+
+// envelopeSchema 错误响应的 data 为 null（getCode 等附带的额外字段除外）
+func envelopeSchema(data map[string]interface{}, isError bool, schemas map[string]interface{}) map[string]interface{} {
+	if isError {
+		data = map[string]interface{}{"nullable": true}
+	} else {
+		data = map[string]interface{}{"allOf": []interface{}{data}}
+	}
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"data":  data,
+			"error": schemaFor(reflect.TypeOf(&v1Error{}), schemas),
+			"meta":  schemaFor(reflect.TypeOf(v1Meta{}), schemas),
+		},
+		"required": []string{"data", "error", "meta"},
+	}
+}
+
+// openAPIPath 把 gin 路径参数转换为 OpenAPI 格式
+func openAPIPath(ginPath string) (string, []map[string]interface{}) {
+	var params []map[string]interface{}
+	segments := strings.Split(ginPath, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, ":") {
+			name := seg[1:]
+			segments[i] = "{" + name + "}"
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor 根据 Go 类型生成 JSON Schema，结构体登记到 components 中并返回引用
+func schemaFor(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		s := schemaFor(t.Elem(), schemas)
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		// nil 切片会编码为 null
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem(), schemas), "nullable": true}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := t.Name()
+		if _, done := schemas[name]; !done {
+			schemas[name] = nil // 先占位，避免递归结构死循环
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema 按 encoding/json 的规则读取字段名，匿名嵌入的结构体展开，外层同名字段优先
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for _, f := range schemaFields(t, schemas) {
+		if _, shadowed := properties[f.name]; shadowed {
+			continue
+		}
+		properties[f.name] = f.schema
+		if f.required {
+			required = append(required, f.name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+type schemaField struct {
+	name     string
+	schema   map[string]interface{}
+	required bool
+}
+
+// schemaFields 按字段顺序列出 JSON 字段，嵌入结构体的字段排在外层字段之后，因此同名时外层先出现
+func schemaFields(t reflect.Type, schemas map[string]interface{}) []schemaField {
+	var fields []schemaField
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, field.Type)
+			continue
+		}
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, schemaField{name, schemaFor(field.Type, schemas), !strings.Contains(opts, "omitempty")})
+	}
+	for _, et := range embedded {
+		fields = append(fields, schemaFields(et, schemas)...)
+	}
+	return fields
+}
+
+func handleOpenAPI(c *gin.Context) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, openAPIErr = json.Marshal(buildOpenAPI())
+	})
+	if openAPIErr != nil {
+		reqLogger(c).Error("生成 OpenAPI 文档失败", "error", openAPIErr)
+		c.JSON(500, gin.H{"error": "生成文档失败"})
+		return
+	}
+	c.Data(200, "application/json; charset=utf-8", openAPIJSON)
+}
+
+// swaggerUIPage 引用 CDN 上的 Swagger UI 展示 openapi.json
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tempMail API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>`
+
+func handleSwaggerUI(c *gin.Context) {
+	c.Data(200, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
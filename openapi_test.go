@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openAPIDoc 解码后的 openapi.json
+type openAPIDoc map[string]interface{}
+
+func loadOpenAPI(t *testing.T, r http.Handler) openAPIDoc {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	var doc openAPIDoc
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); w.Code != 200 || err != nil {
+		t.Fatalf("openapi.json 返回 %d: %v", w.Code, err)
+	}
+	return doc
+}
+
+func (d openAPIDoc) object(path ...string) map[string]interface{} {
+	m := map[string]interface{}(d)
+	for _, key := range path {
+		m, _ = m[key].(map[string]interface{})
+	}
+	return m
+}
+
+// resolve 展开 $ref，只支持 #/components/schemas/ 下的引用
+func (d openAPIDoc) resolve(schema map[string]interface{}) (map[string]interface{}, error) {
+	ref, ok := schema["$ref"].(string)
+	if !ok {
+		return schema, nil
+	}
+	name := strings.TrimPrefix(ref, "#/components/schemas/")
+	target, _ := d.object("components", "schemas")[name].(map[string]interface{})
+	if name == ref || target == nil {
+		return nil, fmt.Errorf("无法解析的引用 %s", ref)
+	}
+	return target, nil
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// checkOpenAPIDocument 检查 buildOpenAPI 生成的文档结构：引用都能解析、路径参数都有声明、
+// 每个操作都有响应且状态码和类型合法
+func checkOpenAPIDocument(d openAPIDoc) []string {
+	var problems []string
+	if d["openapi"] != "3.0.3" {
+		problems = append(problems, fmt.Sprintf("openapi = %v", d["openapi"]))
+	}
+	if info := d.object("info"); info["title"] == nil || info["version"] == nil {
+		problems = append(problems, "info 缺少 title 或 version")
+	}
+	validTypes := map[string]bool{"string": true, "integer": true, "number": true, "boolean": true, "array": true, "object": true}
+	var walk func(v interface{}, at string)
+	walk = func(v interface{}, at string) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if _, ok := v["$ref"]; ok {
+				if _, err := d.resolve(v); err != nil {
+					problems = append(problems, at+": "+err.Error())
+				}
+			}
+			// securitySchemes 的 type 是 apiKey / http，不是 JSON 类型
+			if typ, ok := v["type"].(string); ok && !strings.Contains(at, "securitySchemes") && !validTypes[typ] {
+				problems = append(problems, fmt.Sprintf("%s: 未知类型 %s", at, typ))
+			}
+			for k, child := range v {
+				walk(child, at+"/"+k)
+			}
+		case []interface{}:
+			for i, child := range v {
+				walk(child, at+"/"+strconv.Itoa(i))
+			}
+		}
+	}
+	walk(map[string]interface{}(d), "")
+
+	for path, item := range d.object("paths") {
+		declared := pathParamPattern.FindAllStringSubmatch(path, -1)
+		for method, op := range item.(map[string]interface{}) {
+			op := op.(map[string]interface{})
+			name := strings.ToUpper(method) + " " + path
+			inPath := make(map[string]bool)
+			params, _ := op["parameters"].([]interface{})
+			for _, p := range params {
+				p := p.(map[string]interface{})
+				if p["in"] == "path" {
+					inPath[p["name"].(string)] = true
+					if p["required"] != true {
+						problems = append(problems, fmt.Sprintf("%s: 路径参数 %s 必须 required", name, p["name"]))
+					}
+				}
+			}
+			if len(inPath) != len(declared) {
+				problems = append(problems, fmt.Sprintf("%s: 声明了 %d 个路径参数，路径中有 %d 个", name, len(inPath), len(declared)))
+			}
+			for _, m := range declared {
+				if !inPath[m[1]] {
+					problems = append(problems, fmt.Sprintf("%s: 缺少路径参数 %s", name, m[1]))
+				}
+			}
+			responses, _ := op["responses"].(map[string]interface{})
+			if len(responses) == 0 {
+				problems = append(problems, name+": 没有响应")
+			}
+			for status, resp := range responses {
+				if code, err := strconv.Atoi(status); err != nil || code < 100 || code > 599 {
+					problems = append(problems, fmt.Sprintf("%s: 无效的状态码 %s", name, status))
+				}
+				if desc, _ := resp.(map[string]interface{})["description"].(string); desc == "" {
+					problems = append(problems, fmt.Sprintf("%s %s: 缺少 description", name, status))
+				}
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// checkSchema 按 schema 检查解码后的 JSON 值，只支持 buildOpenAPI 用到的关键字。
+// 声明了 properties 的对象不允许出现未声明的字段，文档遗漏字段时测试失败
+func (d openAPIDoc) checkSchema(schema map[string]interface{}, v interface{}, at string) []string {
+	schema, err := d.resolve(schema)
+	if err != nil {
+		return []string{at + ": " + err.Error()}
+	}
+	if v == nil {
+		if schema["nullable"] == true || len(schema) == 0 {
+			return nil
+		}
+		// allOf 包装的引用可能允许 null
+		if all, ok := schema["allOf"].([]interface{}); ok && len(all) == 1 {
+			if inner, _ := d.resolve(all[0].(map[string]interface{})); inner != nil && inner["nullable"] == true {
+				return nil
+			}
+		}
+		return []string{at + ": 不允许 null"}
+	}
+
+	var problems []string
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			problems = append(problems, d.checkSchema(s.(map[string]interface{}), v, at)...)
+		}
+	}
+	mismatch := func(want string) []string {
+		return append(problems, fmt.Sprintf("%s: 应为 %s，实际为 %T", at, want, v))
+	}
+	switch schema["type"] {
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return mismatch("string")
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q 不是 date-time", at, s))
+			}
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != math.Trunc(n) {
+			return mismatch("integer")
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return mismatch("number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return mismatch("boolean")
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return mismatch("array")
+		}
+		itemSchema, _ := schema["items"].(map[string]interface{})
+		for i, item := range items {
+			problems = append(problems, d.checkSchema(itemSchema, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch("object")
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: 缺少必需字段 %s", at, name))
+			}
+		}
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for key, value := range obj {
+			if prop, ok := props[key].(map[string]interface{}); ok {
+				problems = append(problems, d.checkSchema(prop, value, at+"."+key)...)
+			} else if additional != nil {
+				problems = append(problems, d.checkSchema(additional, value, at+"."+key)...)
+			} else if props != nil {
+				problems = append(problems, fmt.Sprintf("%s: 文档中没有字段 %s", at, key))
+			}
+		}
+	}
+	return problems
+}
+
+// findOperation 按请求路径找到文档中的操作，字面量段优先于路径参数（/messages/latest 先于 /messages/{id}）
+func (d openAPIDoc) findOperation(method, path string) (string, map[string]interface{}) {
+	segments := strings.Split(path, "/")
+	best, bestParams := "", -1
+	for candidate := range d.object("paths") {
+		parts := strings.Split(candidate, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		params := 0
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") {
+				params++
+			} else if part != segments[i] {
+				params = -1
+				break
+			}
+		}
+		if params >= 0 && d.object("paths", candidate)[strings.ToLower(method)] != nil && (bestParams < 0 || params < bestParams) {
+			best, bestParams = candidate, params
+		}
+	}
+	if best == "" {
+		return "", nil
+	}
+	return best, d.object("paths", best, strings.ToLower(method))
+}
+
+// checkResponse 检查状态码在文档中，JSON 响应体符合对应的 schema，无内容的响应没有响应体
+func (d openAPIDoc) checkResponse(method, path string, w *httptest.ResponseRecorder) []string {
+	docPath, op := d.findOperation(method, path)
+	if op == nil {
+		return []string{"文档中没有这个接口"}
+	}
+	resp, _ := op["responses"].(map[string]interface{})[strconv.Itoa(w.Code)].(map[string]interface{})
+	if resp == nil {
+		return []string{fmt.Sprintf("%s 的文档中没有状态码 %d", docPath, w.Code)}
+	}
+	content, _ := resp["content"].(map[string]interface{})
+	if content == nil {
+		if w.Body.Len() > 0 {
+			return []string{fmt.Sprintf("文档中没有响应体，实际返回 %d 字节", w.Body.Len())}
+		}
+		return nil
+	}
+	media, _ := content["application/json"].(map[string]interface{})
+	if media == nil {
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+			return []string{"文档中不是 JSON 响应，实际返回了 JSON"}
+		}
+		return nil
+	}
+	var body interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		return []string{fmt.Sprintf("响应不是 JSON: %v", err)}
+	}
+	return d.checkSchema(media["schema"].(map[string]interface{}), body, "$")
+}
+
+func TestOpenAPIDocumentValid(t *testing.T) {
+	setupTest(t, nil)
+	doc := loadOpenAPI(t, newRouter())
+	if len(doc.object("paths")) == 0 {
+		t.Fatal("文档中没有接口")
+	}
+	for _, problem := range checkOpenAPIDocument(doc) {
+		t.Error(problem)
+	}
+}
+
+// TestOpenAPICoversRoutes 文档中的接口和实际挂载的路由一一对应
+func TestOpenAPICoversRoutes(t *testing.T) {
+	setupTest(t, map[string]string{"ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+	doc := loadOpenAPI(t, r)
+
+	// 文档自身、网页和运维接口不在文档中
+	undocumented := map[string]bool{"/openapi.json": true, "/docs": true, "/metrics": true}
+	registered := make(map[string]bool)
+	for _, route := range r.Routes() {
+		path, _ := openAPIPath(route.Path)
+		key := route.Method + " " + path
+		registered[key] = true
+		if undocumented[route.Path] || route.Path == "/" || strings.HasPrefix(route.Path, "/assets/") || strings.HasPrefix(route.Path, "/debug/") {
+			continue
+		}
+		if doc.object("paths", path)[strings.ToLower(route.Method)] == nil {
+			t.Errorf("路由 %s 不在 OpenAPI 文档中", key)
+		}
+	}
+	for path, item := range doc.object("paths") {
+		for method := range item.(map[string]interface{}) {
+			if key := strings.ToUpper(method) + " " + path; !registered[key] {
+				t.Errorf("文档中的 %s 没有对应的路由", key)
+			}
+		}
+	}
+}
+
+// TestOpenAPIResponsesMatchSchema 实际响应的状态码和 JSON 结构符合文档，新旧路由都检查
+func TestOpenAPIResponsesMatchSchema(t *testing.T) {
+	setupTest(t, map[string]string{"ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+	doc := loadOpenAPI(t, r)
+
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", From: "a@example.com", Subject: "hello",
+		Text: "Your code is 482913", HTML: `<p>Verify <a href="https://example.com/verify">here</a></p>`,
+		Attachments: []attachment{{Filename: "a.txt", ContentType: "text/plain", Size: 2, data: []byte("hi")}},
+		ReceivedAt:  time.Now().Add(-time.Minute), raw: []byte("Subject: hello\r\n\r\nbody\r\n")})
+	mailStore.Append(mailContent{ID: "m2", To: "user@test.local", Subject: "plain", Text: "no code here", ReceivedAt: time.Now()})
+
+	for _, tc := range []struct {
+		method, path, body string
+		admin              bool
+		status             int
+	}{
+		{"GET", "/healthz", "", false, 200},
+		{"GET", "/readyz", "", false, 503},
+		{"GET", "/version", "", false, 200},
+		{"GET", "/getAllowedDomains", "", false, 200},
+		{"GET", "/api/v1/domains", "", false, 200},
+		{"GET", "/api/v1/domains?limits=true", "", false, 200},
+		{"GET", "/api/v1/info", "", false, 200},
+		{"POST", "/api/v1/mailboxes", "", false, 201},
+		{"POST", "/api/v1/mailboxes?domain=nope.example", "", false, 400},
+		{"GET", "/listMail/user@test.local", "", false, 200},
+		{"GET", "/api/v1/mailboxes/user@test.local/messages", "", false, 200},
+		{"GET", "/api/v1/mailboxes/user@test.local/messages/latest", "", false, 200},
+		{"GET", "/api/v1/mailboxes/empty@test.local/messages/latest", "", false, 204},
+		{"GET", "/api/v1/mailboxes/user@test.local/messages/m1", "", false, 200},
+		{"GET", "/api/v1/mailboxes/user@test.local/messages/nope", "", false, 404},
+		{"GET", "/api/v1/mailboxes/user@test.local/count?unread=true", "", false, 200},
+		{"POST", "/api/v1/mailboxes/user@test.local/messages/m1/unread", "", false, 200},
+		{"POST", "/api/v1/mailboxes/user@test.local/messages/nope/unread", "", false, 404},
+		{"POST", "/api/v1/mailboxes/user@test.local/messages/read", "", false, 200},
+		{"GET", "/getMail/user@test.local/m1/links", "", false, 200},
+		{"GET", "/api/v1/mailboxes/user@test.local/messages/m1/links", "", false, 200},
+		{"GET", "/api/v1/mailboxes/user@test.local/messages/m1/attachments/0", "", false, 200},
+		{"GET", "/api/v1/mailboxes/user@test.local/messages/m1/attachments/5", "", false, 404},
+		{"GET", "/api/v1/mailboxes/user@test.local/messages/m1/raw", "", false, 200},
+		{"GET", "/getCode/user@test.local", "", false, 404},
+		{"GET", "/api/v1/mailboxes/user@test.local/code", "", false, 404},
+		{"GET", "/admin/stats", "", true, 200},
+		{"GET", "/api/v1/admin/stats", "", true, 200},
+		{"GET", "/api/v1/admin/stats", "", false, 401},
+		{"GET", "/api/v1/admin/mailboxes?limit=1", "", true, 200},
+		{"GET", "/api/v1/admin/mailboxes?limit=-1", "", true, 400},
+		{"POST", "/api/v1/admin/mailboxes/batch", `["user@test.local","empty@test.local"]`, true, 200},
+		{"POST", "/api/v1/admin/mailboxes/batch", `{}`, true, 400},
+		{"GET", "/api/v1/admin/archive?address=user@test.local", "", true, 404},
+		{"POST", "/api/v1/mailboxes/user@test.local/messages/pop", "", false, 200},
+		{"GET", "/getMail/user@test.local", "", false, 200},
+		{"GET", "/getMail/user@test.local", "", false, 204},
+		{"DELETE", "/api/v1/admin/mailboxes/user@test.local", "", true, 200},
+		{"DELETE", "/admin/mailboxes", "", true, 200},
+		{"DELETE", "/api/v1/admin/mailboxes", "", true, 200},
+	} {
+		name := tc.method + " " + tc.path
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if tc.admin {
+			req.Header.Set("X-Api-Key", "secret")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s 返回 %d，应为 %d: %s", name, w.Code, tc.status, w.Body)
+			continue
+		}
+		path, _, _ := strings.Cut(tc.path, "?")
+		for _, problem := range doc.checkResponse(tc.method, path, w) {
+			t.Errorf("%s: %s", name, problem)
+		}
+	}
+}
+
+// TestOpenAPICheckSchema 校验器本身能发现类型错误、缺少的字段和文档遗漏的字段
+func TestOpenAPICheckSchema(t *testing.T) {
+	setupTest(t, nil)
+	doc := loadOpenAPI(t, newRouter())
+	schema := map[string]interface{}{"$ref": "#/components/schemas/countResponse"}
+	for body, want := range map[string]int{
+		`{"count": 3}`:               0,
+		`{"count": 1.5}`:             1,
+		`{"count": "3"}`:             1,
+		`{}`:                         1,
+		`{"count": 3, "extra": 1}`:   1,
+		`null`:                       1,
+		`{"count": null, "x": true}`: 2,
+	} {
+		var v interface{}
+		json.Unmarshal([]byte(body), &v)
+		if got := doc.checkSchema(schema, v, "$"); len(got) != want {
+			t.Errorf("%s: %d 个问题，应为 %d: %v", body, len(got), want, got)
+		}
+	}
+}
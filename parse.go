@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+	// 注册常见字符集（ISO-8859-*、GBK、GB18030、Big5、Shift_JIS 等），正文和头部按声明的字符集转为 UTF-8
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+)
+
+// parsedMail 解析后的邮件
+type parsedMail struct {
+	// 不带尖括号的 Message-ID，没有时为空
+	MessageID string
+	Subject   string
+	// 顶层邮件头，值解码为 UTF-8，同名字段按出现顺序排列
+	Headers     map[string][]string
+	TextBody    string
+	HTMLBody    string
+	Attachments []attachment
+	Inline      []inlinePart
+}
+
+// inlinePart 通过 Content-ID 被 HTML 中 cid: 引用的内嵌图片
+type inlinePart struct {
+	cid         string
+	contentType string
+	data        []byte
+}
+
+// attachment 附件，JSON 中只包含元数据，内容通过附件接口下载
+type attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	data        []byte
+	// 外置到对象存储时的对象键，此时 data 为空
+	blob string
+}
+
+// parseMail 解析原始邮件，取第一个 text/plain 和 text/html 正文，并保存附件。
+// 传输编码（quoted-printable、base64）由 go-message 解码；字符集未知时保留原始字节，无效的 UTF-8 替换为 U+FFFD
+func parseMail(raw []byte) (*parsedMail, error) {
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+	defer mr.Close()
+
+	msg := &parsedMail{}
+	msg.Subject, _ = mr.Header.Subject()
+	msg.MessageID, _ = mr.Header.MessageID()
+	msg.Headers = map[string][]string{}
+	for f := mr.Header.Fields(); f.Next(); {
+		v, err := f.Text()
+		if err != nil {
+			v = f.Value()
+		}
+		msg.Headers[f.Key()] = append(msg.Headers[f.Key()], v)
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !message.IsUnknownCharset(err) {
+			return nil, err
+		}
+
+		if ah, ok := p.Header.(*mail.AttachmentHeader); ok {
+			a := readAttachment(ah, p.Body)
+			// 没有 Content-Disposition 的非文本部分也会被当作附件；带 Content-ID 的可以被 cid: 引用，
+			// 只有明确标为 attachment 时才同时列入附件
+			cid := contentID(ah.Header)
+			if cid != "" {
+				msg.Inline = append(msg.Inline, inlinePart{cid: cid, contentType: a.ContentType, data: a.data})
+			}
+			if disp, _, _ := ah.ContentDisposition(); cid == "" || strings.EqualFold(disp, "attachment") {
+				msg.Attachments = append(msg.Attachments, a)
+			}
+			continue
+		}
+		h, ok := p.Header.(*mail.InlineHeader)
+		if !ok {
+			continue
+		}
+		contentType, _, _ := h.ContentType()
+		if cid := contentID(h.Header); cid != "" && !strings.HasPrefix(strings.ToLower(contentType), "text/") {
+			data, _ := io.ReadAll(p.Body)
+			msg.Inline = append(msg.Inline, inlinePart{cid: cid, contentType: strings.ToLower(contentType), data: data})
+			continue
+		}
+		body, _ := io.ReadAll(p.Body)
+		switch {
+		case strings.EqualFold(contentType, "text/html") && msg.HTMLBody == "":
+			msg.HTMLBody = strings.ToValidUTF8(string(body), "\uFFFD")
+		case (contentType == "" || strings.EqualFold(contentType, "text/plain")) && msg.TextBody == "":
+			msg.TextBody = strings.ToValidUTF8(string(body), "\uFFFD")
+		}
+	}
+	return msg, nil
+}
+
+// readAttachment 类型取自 MIME 头，不根据扩展名猜测
+func readAttachment(h *mail.AttachmentHeader, body io.Reader) attachment {
+	data, _ := io.ReadAll(body)
+	contentType, _, _ := h.ContentType()
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	filename, _ := h.Filename()
+	return attachment{
+		Filename:    filename,
+		ContentType: strings.ToLower(contentType),
+		Size:        len(data),
+		data:        data,
+	}
+}
+
+// contentID 取 Content-ID 并去掉尖括号
+func contentID(h message.Header) string {
+	return strings.Trim(strings.TrimSpace(h.Get("Content-Id")), "<>")
+}
+
+// 保存哪些正文
+const (
+	storePartsBoth = "both"
+	storePartsText = "text"
+	storePartsHTML = "html"
+)
+
+// applyStoreParts 按 STORE_PARTS 丢弃不保存的正文。只保存文本时没有纯文本部分的邮件从 HTML 提取，
+// 内嵌图片只在 HTML 中使用，一并丢弃；只保存 HTML 时没有 HTML 部分的邮件把纯文本转义后放进 <pre>
+func applyStoreParts(m *mailContent) {
+	switch config().StoreParts {
+	case storePartsText:
+		if strings.TrimSpace(m.Text) == "" && m.HTML != "" {
+			m.Text = htmlToText(m.HTML)
+		}
+		m.HTML = ""
+		m.inline = nil
+	case storePartsHTML:
+		if m.HTML == "" && m.Text != "" {
+			m.HTML = "<pre>" + html.EscapeString(m.Text) + "</pre>"
+		}
+		m.Text = ""
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMIME 拼出单个正文部分的原始邮件
+func testMIME(contentType, encoding, body string) []byte {
+	header := "From: a@example.com\r\nTo: user@test.local\r\nSubject: test\r\nContent-Type: " + contentType + "\r\n"
+	if encoding != "" {
+		header += "Content-Transfer-Encoding: " + encoding + "\r\n"
+	}
+	return []byte(header + "\r\n" + body)
+}
+
+func TestParseMailCharsets(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		raw        []byte
+		text, html string
+	}{
+		{"quoted-printable UTF-8", testMIME("text/plain; charset=utf-8", "quoted-printable", "caf=C3=A9 na=C3=AFve =E2=9C=93 soft=\r\nbreak"),
+			"café naïve ✓ softbreak", ""},
+		{"quoted-printable ISO-8859-1", testMIME(`text/plain; charset="ISO-8859-1"`, "quoted-printable", "Gr=FC=DFe aus K=F6ln, caf=E9"),
+			"Grüße aus Köln, café", ""},
+		{"8bit ISO-8859-1", testMIME("text/plain; charset=iso-8859-1", "8bit", "caf\xe9"),
+			"café", ""},
+		{"base64 GBK", testMIME("text/plain; charset=GBK", "base64", "xOO6w8rAvec="),
+			"你好世界", ""},
+		{"8bit GB2312 HTML", testMIME("text/html; charset=gb2312", "8bit", "<p>\xc4\xe3\xba\xc3</p>"),
+			"", "<p>你好</p>"},
+		{"quoted-printable GBK HTML", testMIME("text/html; charset=gbk", "quoted-printable", "<b>=C4=E3=BA=C3</b>"),
+			"", "<b>你好</b>"},
+		{"未声明字符集按 UTF-8", testMIME("text/plain", "quoted-printable", "=E4=BD=A0=E5=A5=BD"),
+			"你好", ""},
+		// 未知字符集保留原始字节，无效的 UTF-8 替换为 U+FFFD，不会让整封邮件解析失败
+		{"未知字符集", testMIME("text/plain; charset=x-unknown", "quoted-printable", "plain ascii and =FF"),
+			"plain ascii and �", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := parseMail(tc.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.TextBody != tc.text || msg.HTMLBody != tc.html {
+				t.Errorf("text = %q，html = %q，应为 %q、%q", msg.TextBody, msg.HTMLBody, tc.text, tc.html)
+			}
+		})
+	}
+}
+
+func TestParseMailMultipartCharsets(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: a@example.com",
+		"To: user@test.local",
+		"Subject: =?GBK?B?xOO6ww==?= =?ISO-8859-1?Q?caf=E9?=",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/alternative; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain; charset=iso-8859-1",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Code: 4829=E9",
+		"--b1",
+		"Content-Type: text/html; charset=gbk",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"PHA+xOO6wzwvcD4=",
+		"--b1--",
+		"",
+	}, "\r\n")
+
+	msg, err := parseMail([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != "你好café" {
+		t.Errorf("Subject = %q", msg.Subject)
+	}
+	if msg.TextBody != "Code: 4829é" {
+		t.Errorf("TextBody = %q", msg.TextBody)
+	}
+	if msg.HTMLBody != "<p>你好</p>" {
+		t.Errorf("HTMLBody = %q", msg.HTMLBody)
+	}
+}
+
+// TestParseMailHeaders 顶层邮件头按字段名归类，编码的值解码为 UTF-8，同名字段保持原顺序
+func TestParseMailHeaders(t *testing.T) {
+	raw := "Received: from b\r\nReceived: from a\r\nSubject: =?GBK?B?xOO6ww==?=\r\nx-custom: 1\r\n\r\nbody\r\n"
+	msg, err := parseMail([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"Received": {"from b", "from a"}, "Subject": {"你好"}, "X-Custom": {"1"}}
+	if !reflect.DeepEqual(msg.Headers, want) {
+		t.Errorf("Headers = %q，应为 %q", msg.Headers, want)
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgOpTimeout 单次 Postgres 操作的超时，超时按存储不可用处理；服务端另有 statement_timeout
+const pgOpTimeout = 10 * time.Second
+
+// pgMigrations 按顺序执行的建表语句，已执行的版本记录在 tempmail_schema_migrations 中，只能追加不能修改
+var pgMigrations = []string{
+	`CREATE TABLE tempmail_mailboxes (
+		address    text PRIMARY KEY,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);
+	CREATE TABLE tempmail_messages (
+		seq         bigserial PRIMARY KEY,
+		mailbox     text NOT NULL REFERENCES tempmail_mailboxes (address) ON DELETE CASCADE,
+		id          text NOT NULL,
+		trace_id    text NOT NULL,
+		received_at timestamptz NOT NULL,
+		expires_at  timestamptz,
+		"from"      text NOT NULL,
+		subject     text NOT NULL,
+		text        text NOT NULL,
+		html        text NOT NULL,
+		raw         bytea,
+		meta        jsonb NOT NULL,
+		parts       jsonb NOT NULL,
+		size        bigint NOT NULL,
+		UNIQUE (mailbox, id)
+	);
+	CREATE INDEX tempmail_messages_mailbox_idx ON tempmail_messages (mailbox, seq DESC);
+	CREATE INDEX tempmail_messages_expires_idx ON tempmail_messages (expires_at) WHERE expires_at IS NOT NULL;
+	CREATE TABLE tempmail_revisions (
+		address     text PRIMARY KEY,
+		revision    bigint NOT NULL,
+		modified_at timestamptz NOT NULL
+	);
+	CREATE SEQUENCE tempmail_revision_seq;
+	CREATE TABLE tempmail_received (
+		minute bigint PRIMARY KEY,
+		count  integer NOT NULL
+	);
+	CREATE TABLE tempmail_meta (
+		key         text PRIMARY KEY,
+		revision    bigint NOT NULL DEFAULT 0,
+		modified_at timestamptz NOT NULL
+	);`,
+	`ALTER TABLE tempmail_messages ADD COLUMN "read" boolean NOT NULL DEFAULT false;`,
+	`INSERT INTO tempmail_meta (key, revision, modified_at) VALUES ('uid_validity', extract(epoch FROM now())::bigint, now());`,
+	`CREATE TABLE tempmail_greylist (
+		key        text PRIMARY KEY,
+		first_seen timestamptz NOT NULL,
+		last_seen  timestamptz NOT NULL
+	);
+	CREATE INDEX tempmail_greylist_last_seen_idx ON tempmail_greylist (last_seen);`,
+}
+
+// pgStore 基于 Postgres 的存储，多个实例共享同一份邮件，取件用 DELETE ... RETURNING 保证并发取件拿到不同的邮件。
+//
+// 表（均带 tempmail_ 前缀，可以和其他业务共用一个库）：
+//   - mailboxes：所有邮箱，包括没有邮件的空邮箱；messages：邮件，seq 越大越新
+//   - revisions、revision_seq：邮箱版本；meta：清空时的版本和时间，以及 UIDVALIDITY（revision 列）
+//   - received：每分钟收件数，保留一天多；greylist：灰名单记录，按 GREYLIST_EXPIRY 定时清理
+type pgStore struct {
+	pool    *pgxpool.Pool
+	started time.Time
+}
+
+func newPgStore() (*pgStore, error) {
+	cfg, err := pgxpool.ParseConfig(config().PostgresDSN)
+	if err != nil {
+		return nil, fmt.Errorf("POSTGRES_DSN 无效: %v", err)
+	}
+	cfg.MaxConns = int32(config().PostgresMaxConns)
+	cfg.ConnConfig.RuntimeParams["statement_timeout"] = fmt.Sprint(config().PostgresStatementTimeout.Milliseconds())
+	cfg.ConnConfig.RuntimeParams["application_name"] = "tempmail"
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &pgStore{pool: pool, started: time.Now()}, nil
+}
+
+func (s *pgStore) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), pgOpTimeout)
+}
+
+// migrate 执行尚未执行的迁移，多个实例同时启动时用 advisory lock 串行
+func (s *pgStore) migrate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('tempmail_schema_migrations'))`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS tempmail_schema_migrations (
+			version    integer PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+			return err
+		}
+		var current int
+		if err := tx.QueryRow(ctx, `SELECT coalesce(max(version), 0) FROM tempmail_schema_migrations`).Scan(&current); err != nil {
+			return err
+		}
+		if current > len(pgMigrations) {
+			return fmt.Errorf("数据库版本 %d 比程序支持的 %d 新，请升级程序", current, len(pgMigrations))
+		}
+		for version := current + 1; version <= len(pgMigrations); version++ {
+			if _, err := tx.Exec(ctx, pgMigrations[version-1]); err != nil {
+				return fmt.Errorf("执行迁移 %d 失败: %v", version, err)
+			}
+			if _, err := tx.Exec(ctx, `INSERT INTO tempmail_schema_migrations (version) VALUES ($1)`, version); err != nil {
+				return err
+			}
+			log.Printf("Postgres 已执行迁移 %d", version)
+		}
+		return nil
+	})
+}
+
+// pgMeta 保存在 meta 列中的发件方连接信息
+type pgMeta struct {
+	ClientIP string         `json:"client_ip"`
+	Helo     string         `json:"helo"`
+	DNS      dnsCheckResult `json:"dns"`
+	DNSBL    []string       `json:"dnsbl"`
+	Spam     *spamVerdict   `json:"spam,omitempty"`
+}
+
+// pgParts 保存在 parts 列中的附件和内嵌图片，包括内容
+type pgParts struct {
+	Attachments    []attachment   `json:"attachments"`
+	AttachmentData [][]byte       `json:"attachment_data,omitempty"`
+	Inline         []storedInline `json:"inline,omitempty"`
+	// 外置到对象存储的附件的对象键
+	AttachmentBlobs []string `json:"attachment_blobs,omitempty"`
+}
+
+// pgMessageColumns 读取邮件时的列顺序，与 scanPgMessage 对应
+const pgMessageColumns = `seq, id, trace_id, mailbox, received_at, expires_at, "read", "from", subject, text, html, raw, meta, parts, headers`
+
+func scanPgMessage(row pgx.Row) (mailContent, error) {
+	var m mailContent
+	var seq int64
+	var meta pgMeta
+	var parts pgParts
+	if err := row.Scan(&seq, &m.ID, &m.TraceID, &m.To, &m.ReceivedAt, &m.ExpiresAt, &m.Read, &m.From, &m.Subject, &m.Text, &m.HTML, &m.raw, &meta, &parts, &m.headers); err != nil {
+		return mailContent{}, err
+	}
+	m.seq = uint64(seq)
+	m.ClientIP, m.Helo, m.DNS, m.DNSBL, m.Spam = meta.ClientIP, meta.Helo, meta.DNS, meta.DNSBL, meta.Spam
+	m.Attachments = parts.Attachments
+	for i := range m.Attachments {
+		if i < len(parts.AttachmentData) {
+			m.Attachments[i].data = parts.AttachmentData[i]
+		}
+		if i < len(parts.AttachmentBlobs) {
+			m.Attachments[i].blob = parts.AttachmentBlobs[i]
+		}
+	}
+	for _, p := range parts.Inline {
+		m.inline = append(m.inline, inlinePart{cid: p.CID, contentType: p.ContentType, data: p.Data})
+	}
+	return openMail(m)
+}
+
+func collectPgMessages(rows pgx.Rows) ([]mailContent, error) {
+	defer rows.Close()
+	var mails []mailContent
+	for rows.Next() {
+		m, err := scanPgMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		mails = append(mails, m)
+	}
+	return mails, rows.Err()
+}
+
+// touchPg 更新邮箱版本
+func touchPg(ctx context.Context, tx pgx.Tx, mailbox string) error {
+	_, err := tx.Exec(ctx, `INSERT INTO tempmail_revisions (address, revision, modified_at)
+		VALUES ($1, nextval('tempmail_revision_seq'), now())
+		ON CONFLICT (address) DO UPDATE SET revision = excluded.revision, modified_at = excluded.modified_at`, mailbox)
+	return err
+}
+
+func (s *pgStore) Append(m mailContent) error {
+	size := mailSize(m)
+	m, err := sealMail(m)
+	if err != nil {
+		return err
+	}
+	meta := pgMeta{ClientIP: m.ClientIP, Helo: m.Helo, DNS: m.DNS, DNSBL: m.DNSBL, Spam: m.Spam}
+	parts := pgParts{Attachments: m.Attachments}
+	if parts.Attachments == nil {
+		parts.Attachments = []attachment{}
+	}
+	for _, a := range m.Attachments {
+		parts.AttachmentData = append(parts.AttachmentData, a.data)
+	}
+	parts.AttachmentBlobs = attachmentBlobs(m)
+	for _, p := range m.inline {
+		parts.Inline = append(parts.Inline, storedInline{CID: p.cid, ContentType: p.contentType, Data: p.data})
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	partsJSON, err := json.Marshal(parts)
+	if err != nil {
+		return err
+	}
+	headers := m.headers
+	if headers == nil {
+		headers = map[string][]string{}
+	}
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := s.ctx()
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `INSERT INTO tempmail_mailboxes (address) VALUES ($1) ON CONFLICT DO NOTHING`, m.To); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO tempmail_messages
+			(mailbox, id, trace_id, received_at, expires_at, "from", subject, text, html, raw, meta, parts, headers, size)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+			m.To, m.ID, m.TraceID, m.ReceivedAt, m.ExpiresAt, m.From, m.Subject, m.Text, m.HTML, m.raw,
+			string(metaJSON), string(partsJSON), string(headersJSON), size); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO tempmail_received (minute, count) VALUES ($1, 1)
+			ON CONFLICT (minute) DO UPDATE SET count = tempmail_received.count + 1`, m.ReceivedAt.Unix()/60); err != nil {
+			return err
+		}
+		return touchPg(ctx, tx, m.To)
+	})
+}
+
+func (s *pgStore) Create(mailbox string) (bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	created := false
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `INSERT INTO tempmail_mailboxes (address) VALUES ($1) ON CONFLICT DO NOTHING`, mailbox)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		created = true
+		return touchPg(ctx, tx, mailbox)
+	})
+	return created, err
+}
+
+func (s *pgStore) Exists(mailbox string) (bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var exists bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM tempmail_mailboxes WHERE address = $1)`, mailbox).Scan(&exists)
+	return exists, err
+}
+
+func (s *pgStore) Count(mailbox string) (int, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var n int
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM tempmail_messages WHERE mailbox = $1`, mailbox).Scan(&n)
+	return n, err
+}
+
+func (s *pgStore) Size(mailbox string) (int64, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var size int64
+	err := s.pool.QueryRow(ctx, `SELECT coalesce(sum(size), 0)::bigint FROM tempmail_messages WHERE mailbox = $1`, mailbox).Scan(&size)
+	return size, err
+}
+
+// PopLatest 用 SKIP LOCKED 选中最新一封并删除，并发取件时各自拿到不同的邮件
+func (s *pgStore) PopLatest(mailbox string) (mailContent, bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var m mailContent
+	found := false
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		var err error
+		m, err = scanPgMessage(tx.QueryRow(ctx, `DELETE FROM tempmail_messages WHERE seq = (
+				SELECT seq FROM tempmail_messages WHERE mailbox = $1
+				ORDER BY seq DESC LIMIT 1 FOR UPDATE SKIP LOCKED
+			) RETURNING `+pgMessageColumns, mailbox))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		return touchPg(ctx, tx, mailbox)
+	})
+	if err != nil {
+		return mailContent{}, false, err
+	}
+	return m, found, nil
+}
+
+func (s *pgStore) Remove(mailbox string, ids []string) (int, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	removed := 0
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `DELETE FROM tempmail_messages WHERE mailbox = $1 AND id = ANY($2)`, mailbox, ids)
+		if err != nil {
+			return err
+		}
+		if removed = int(tag.RowsAffected()); removed == 0 {
+			return nil
+		}
+		return touchPg(ctx, tx, mailbox)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func (s *pgStore) Latest(mailbox string) (mailContent, bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	m, err := scanPgMessage(s.pool.QueryRow(ctx, `SELECT `+pgMessageColumns+` FROM tempmail_messages
+		WHERE mailbox = $1 ORDER BY seq DESC LIMIT 1`, mailbox))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return mailContent{}, false, nil
+	}
+	return m, err == nil, err
+}
+
+func (s *pgStore) List(mailbox string) ([]mailContent, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT `+pgMessageColumns+` FROM tempmail_messages
+		WHERE mailbox = $1 ORDER BY seq DESC`, mailbox)
+	if err != nil {
+		return nil, err
+	}
+	mails, err := collectPgMessages(rows)
+	if mails == nil && err == nil {
+		mails = []mailContent{}
+	}
+	return mails, err
+}
+
+func (s *pgStore) Get(mailbox, id string) (mailContent, bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	m, err := scanPgMessage(s.pool.QueryRow(ctx, `SELECT `+pgMessageColumns+` FROM tempmail_messages
+		WHERE mailbox = $1 AND id = $2`, mailbox, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return mailContent{}, false, nil
+	}
+	return m, err == nil, err
+}
+
+func (s *pgStore) SetRead(mailbox, id string, read bool) (int, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	matched := 0
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, `SELECT count(*) FROM tempmail_messages WHERE mailbox = $1 AND ($2 = '' OR id = $2)`,
+			mailbox, id).Scan(&matched); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `UPDATE tempmail_messages SET "read" = $3
+			WHERE mailbox = $1 AND ($2 = '' OR id = $2) AND "read" <> $3`, mailbox, id, read)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		return touchPg(ctx, tx, mailbox)
+	})
+	return matched, err
+}
+
+func (s *pgStore) Delete(mailbox string) (int, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	n := 0
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, `SELECT count(*) FROM tempmail_messages WHERE mailbox = $1`, mailbox).Scan(&n); err != nil {
+			return err
+		}
+		// 邮件随邮箱级联删除
+		if _, err := tx.Exec(ctx, `DELETE FROM tempmail_mailboxes WHERE address = $1`, mailbox); err != nil {
+			return err
+		}
+		return touchPg(ctx, tx, mailbox)
+	})
+	return n, err
+}
+
+// Clear 删除所有邮箱和版本记录；版本序列保留，保证版本号不会回退
+func (s *pgStore) Clear() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		for _, stmt := range []string{
+			`DELETE FROM tempmail_mailboxes`,
+			`DELETE FROM tempmail_revisions`,
+			`INSERT INTO tempmail_meta (key, revision, modified_at) VALUES ('cleared', nextval('tempmail_revision_seq'), now())
+				ON CONFLICT (key) DO UPDATE SET revision = excluded.revision, modified_at = excluded.modified_at`,
+		} {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM tempmail_received WHERE minute < $1`, time.Now().Unix()/60-statsBuckets)
+		return err
+	})
+}
+
+func (s *pgStore) Expire(now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	removed := 0
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `DELETE FROM tempmail_messages WHERE expires_at <= $1 RETURNING mailbox`, now)
+		if err != nil {
+			return err
+		}
+		touched := make(map[string]bool)
+		for rows.Next() {
+			var mailbox string
+			if err := rows.Scan(&mailbox); err != nil {
+				rows.Close()
+				return err
+			}
+			touched[mailbox] = true
+			removed++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(touched) == 0 {
+			return nil
+		}
+
+		mailboxes := make([]string, 0, len(touched))
+		for mailbox := range touched {
+			mailboxes = append(mailboxes, mailbox)
+			if err := touchPg(ctx, tx, mailbox); err != nil {
+				return err
+			}
+		}
+		// 因此变空的邮箱一并删除
+		_, err = tx.Exec(ctx, `DELETE FROM tempmail_mailboxes b WHERE address = ANY($1)
+			AND NOT EXISTS (SELECT 1 FROM tempmail_messages m WHERE m.mailbox = b.address)`, mailboxes)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func (s *pgStore) Trim(keep int) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	removed := 0
+	touched := make(map[string]bool)
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `DELETE FROM tempmail_messages WHERE seq IN (
+			SELECT seq FROM (
+				SELECT seq, row_number() OVER (PARTITION BY mailbox ORDER BY seq DESC) AS n FROM tempmail_messages
+			) ranked WHERE n > $1
+		) RETURNING mailbox`, keep)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var mailbox string
+			if err := rows.Scan(&mailbox); err != nil {
+				rows.Close()
+				return err
+			}
+			touched[mailbox] = true
+			removed++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for mailbox := range touched {
+			if err := touchPg(ctx, tx, mailbox); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return removed, len(touched), nil
+}
+
+func (s *pgStore) Revision(mailbox string) (mailboxRevision, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var rev int64
+	var modified time.Time
+	// 没有记录的邮箱使用清空时的版本
+	err := s.pool.QueryRow(ctx, `SELECT revision, modified_at FROM (
+			SELECT revision, modified_at, 0 AS source FROM tempmail_revisions WHERE address = $1
+			UNION ALL SELECT revision, modified_at, 1 FROM tempmail_meta WHERE key = 'cleared'
+		) r ORDER BY source LIMIT 1`, mailbox).Scan(&rev, &modified)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return mailboxRevision{modified: s.started}, nil
+	}
+	if err != nil {
+		return mailboxRevision{}, err
+	}
+	return mailboxRevision{revision: uint64(rev), modified: modified}, nil
+}
+
+func (s *pgStore) Mailboxes(prefix string) ([]mailboxSummary, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	rows, err := s.pool.Query(ctx, `SELECT mailbox, count(*), sum(size)::bigint, min(received_at), max(received_at)
+		FROM tempmail_messages WHERE starts_with(lower(mailbox), $1) GROUP BY mailbox`, strings.ToLower(prefix))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var summaries []mailboxSummary
+	for rows.Next() {
+		var sum mailboxSummary
+		if err := rows.Scan(&sum.Address, &sum.Messages, &sum.Bytes, &sum.FirstDelivery, &sum.LastDelivery); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, sum)
+	}
+	return summaries, rows.Err()
+}
+
+func (s *pgStore) Stats(now time.Time) (storeStats, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var st storeStats
+	var lastCleanup *time.Time
+	minute := now.Unix() / 60
+	err := s.pool.QueryRow(ctx, `SELECT
+		(SELECT count(*) FROM tempmail_mailboxes),
+		(SELECT count(*) FROM tempmail_messages),
+		(SELECT coalesce(sum(size), 0)::bigint FROM tempmail_messages),
+		(SELECT coalesce(sum(count), 0) FROM tempmail_received WHERE minute > $1 - 60 AND minute <= $1),
+		(SELECT coalesce(sum(count), 0) FROM tempmail_received WHERE minute > $1 - $2 AND minute <= $1),
+		(SELECT modified_at FROM tempmail_meta WHERE key = 'cleared')`, minute, statsBuckets).
+		Scan(&st.Mailboxes, &st.Messages, &st.Bytes, &st.ReceivedLastHour, &st.ReceivedLastDay, &lastCleanup)
+	if lastCleanup != nil {
+		st.LastCleanup = *lastCleanup
+	}
+	return st, err
+}
+
+// Close 关闭连接池
+// greylistSeen 上次出现早于 now - expiry 的记录从 now 重新计时
+func (s *pgStore) greylistSeen(key string, now time.Time, expiry time.Duration) (time.Time, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var first time.Time
+	err := s.pool.QueryRow(ctx, `INSERT INTO tempmail_greylist (key, first_seen, last_seen) VALUES ($1, $2, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			first_seen = CASE WHEN tempmail_greylist.last_seen < $3 THEN excluded.first_seen ELSE tempmail_greylist.first_seen END,
+			last_seen = excluded.last_seen
+		RETURNING first_seen`, key, now, now.Add(-expiry)).Scan(&first)
+	return first, err
+}
+
+func (s *pgStore) pruneGreylist(before time.Time) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.pool.Exec(ctx, `DELETE FROM tempmail_greylist WHERE last_seen < $1`, before)
+	return err
+}
+
+// Sequence 邮件序号即 seq 列，取自它的序列；Clear 不重置序列
+func (s *pgStore) Sequence() (mailSequence, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var validity, next int64
+	err := s.pool.QueryRow(ctx, `SELECT
+		(SELECT revision FROM tempmail_meta WHERE key = 'uid_validity'),
+		(SELECT CASE WHEN is_called THEN last_value + 1 ELSE last_value END FROM tempmail_messages_seq_seq)`).Scan(&validity, &next)
+	return mailSequence{validity: uint32(validity), next: uint64(next)}, err
+}
+
+func (s *pgStore) Close() error {
+	s.pool.Close()
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestPgStore 连接 TEST_POSTGRES_DSN 指向的库，执行迁移并清空邮件，未设置时跳过
+func openTestPgStore(t *testing.T, env map[string]string) *pgStore {
+	t.Helper()
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("未设置 TEST_POSTGRES_DSN")
+	}
+	cfg := map[string]string{"STORE_BACKEND": "postgres", "POSTGRES_DSN": dsn}
+	for k, v := range env {
+		cfg[k] = v
+	}
+	setupTest(t, cfg)
+	ps, err := newPgStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ps.Close() })
+	if err := ps.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+// TestNewPgStoreConfig 连接池大小和语句超时按配置设置，连接是惰性的，不需要数据库
+func TestNewPgStoreConfig(t *testing.T) {
+	setupTest(t, map[string]string{"STORE_BACKEND": "postgres", "POSTGRES_DSN": "postgres://tempmail@127.0.0.1:1/tempmail",
+		"POSTGRES_MAX_CONNS": "7", "POSTGRES_STATEMENT_TIMEOUT": "2500ms"})
+	ps, err := newPgStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+	cfg := ps.pool.Config()
+	if cfg.MaxConns != 7 {
+		t.Errorf("MaxConns = %d", cfg.MaxConns)
+	}
+	if got := cfg.ConnConfig.RuntimeParams["statement_timeout"]; got != "2500" {
+		t.Errorf("statement_timeout = %q", got)
+	}
+
+	setupTest(t, map[string]string{"STORE_BACKEND": "postgres", "POSTGRES_DSN": "postgres://%zz"})
+	if _, err := newPgStore(); err == nil || !strings.Contains(err.Error(), "POSTGRES_DSN") {
+		t.Errorf("无效的 DSN 应报错: %v", err)
+	}
+}
+
+func TestPgStoreMigrate(t *testing.T) {
+	ps := openTestPgStore(t, nil)
+	// 已是最新版本时再次执行不做任何事
+	if err := ps.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := ps.ctx()
+	defer cancel()
+	var versions, latest int
+	if err := ps.pool.QueryRow(ctx, `SELECT count(*), max(version) FROM tempmail_schema_migrations`).Scan(&versions, &latest); err != nil {
+		t.Fatal(err)
+	}
+	if versions != len(pgMigrations) || latest != len(pgMigrations) {
+		t.Errorf("迁移记录 %d 条，最新版本 %d，应为 %d", versions, latest, len(pgMigrations))
+	}
+	// 列表和过期清理用到的索引
+	for _, index := range []string{"tempmail_messages_mailbox_idx", "tempmail_messages_expires_idx"} {
+		var exists bool
+		if err := ps.pool.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, index).Scan(&exists); err != nil || !exists {
+			t.Errorf("缺少索引 %s: %v", index, err)
+		}
+	}
+}
+
+func TestPgStoreStatementTimeout(t *testing.T) {
+	ps := openTestPgStore(t, map[string]string{"POSTGRES_STATEMENT_TIMEOUT": "100ms"})
+	ctx, cancel := ps.ctx()
+	defer cancel()
+	var timeout string
+	if err := ps.pool.QueryRow(ctx, `SHOW statement_timeout`).Scan(&timeout); err != nil || timeout != "100ms" {
+		t.Errorf("statement_timeout = %q: %v", timeout, err)
+	}
+	if _, err := ps.pool.Exec(ctx, `SELECT pg_sleep(1)`); err == nil || !strings.Contains(err.Error(), "statement timeout") {
+		t.Errorf("超过语句超时应报错: %v", err)
+	}
+}
+
+// TestPgStoreConcurrentPop 多个实例同时取件时每封邮件只被取出一次
+func TestPgStoreConcurrentPop(t *testing.T) {
+	ps := openTestPgStore(t, nil)
+	const total, pollers = 60, 8
+	for i := range total {
+		if err := ps.Append(testMail("user@test.local", fmt.Sprintf("m%02d", i), i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	var wg sync.WaitGroup
+	for range pollers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				m, ok, err := ps.PopLatest("user@test.local")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !ok {
+					return
+				}
+				mu.Lock()
+				seen[m.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != total {
+		t.Errorf("取出 %d 封不同的邮件，应为 %d", len(seen), total)
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("%s 被取出 %d 次", id, n)
+		}
+	}
+	if n, _ := ps.Count("user@test.local"); n != 0 {
+		t.Errorf("取完后还剩 %d 封", n)
+	}
+}
+
+// TestPgStoreRoundTrip 原始邮件、发件方信息、附件和内嵌图片都原样保存
+func TestPgStoreRoundTrip(t *testing.T) {
+	ps := openTestPgStore(t, nil)
+	expires := testEpoch.Add(time.Hour)
+	m := testMail("user@test.local", "m1", 0)
+	m.HTML = "<p>body</p>"
+	m.raw = []byte("Subject: subject m1\r\n\r\nbody m1\r\n")
+	m.ExpiresAt = &expires
+	m.ClientIP, m.Helo, m.DNSBL = "192.0.2.1", "mx.example.com", []string{"zen.example.org"}
+	m.Spam = &spamVerdict{Score: 4.5, Verdict: "ham"}
+	m.Attachments = []attachment{{Filename: "a.txt", ContentType: "text/plain", Size: 2, data: []byte("hi")}}
+	m.inline = []inlinePart{{cid: "logo", contentType: "image/png", data: []byte{0x89, 'P', 'N', 'G'}}}
+	m.headers = map[string][]string{"Subject": {"subject m1"}, "Received": {"from a", "from b"}}
+	if err := ps.Append(m); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok, err := ps.Get("user@test.local", "m1")
+	if err != nil || !ok {
+		t.Fatalf("Get = %v, %v", ok, err)
+	}
+	if string(got.raw) != string(m.raw) || got.HTML != m.HTML || got.ExpiresAt == nil || !got.ExpiresAt.Equal(expires) {
+		t.Errorf("正文或过期时间不一致: %+v", got)
+	}
+	if got.ClientIP != m.ClientIP || got.Helo != m.Helo || !reflect.DeepEqual(got.DNSBL, m.DNSBL) || !reflect.DeepEqual(got.Spam, m.Spam) {
+		t.Errorf("发件方信息不一致: %+v", got)
+	}
+	if len(got.Attachments) != 1 || string(got.Attachments[0].data) != "hi" {
+		t.Errorf("附件 = %+v", got.Attachments)
+	}
+	if len(got.inline) != 1 || got.inline[0].cid != "logo" || string(got.inline[0].data) != string(m.inline[0].data) {
+		t.Errorf("内嵌图片 = %+v", got.inline)
+	}
+	if !reflect.DeepEqual(got.headers, m.headers) {
+		t.Errorf("邮件头 = %v", got.headers)
+	}
+	if !got.ReceivedAt.Equal(m.ReceivedAt) {
+		t.Errorf("ReceivedAt = %v", got.ReceivedAt)
+	}
+
+	// 没有邮件头时 headers 列为空对象
+	if err := ps.Append(testMail("user@test.local", "m2", 1)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := ps.ctx()
+	defer cancel()
+	var headers string
+	if err := ps.pool.QueryRow(ctx, `SELECT headers::text FROM tempmail_messages WHERE id = 'm2'`).Scan(&headers); err != nil || headers != "{}" {
+		t.Errorf("headers = %q: %v", headers, err)
+	}
+}
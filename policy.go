@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expirySweepInterval 过期邮件、灰名单和去重记录的清理间隔
+const expirySweepInterval = time.Minute
+
+var expirySweeperOnce sync.Once
+
+// domainPolicy 单个域名的收件策略，未覆盖的项沿用全局配置
+type domainPolicy struct {
+	// 邮件保留时长，0 表示不过期（开启 DAILY_CLEANUP 时在定时清空时删除）
+	TTL time.Duration
+	// 每个邮箱最多保存的邮件数，0 表示不限制
+	MaxMessages int
+	// 每个邮箱最多占用的字节数，0 表示不限制
+	MaxBytes int64
+	// 是否接收该域名下的任意地址
+	CatchAll bool
+	// 单封邮件的大小上限
+	MaxMessageBytes int
+}
+
+func (p domainPolicy) String() string {
+	return fmt.Sprintf("ttl=%v max_messages=%d max_bytes=%d catch_all=%t max_message_bytes=%d", p.TTL, p.MaxMessages, p.MaxBytes, p.CatchAll, p.MaxMessageBytes)
+}
+
+// defaultPolicy 由全局配置得到的默认策略
+func (cfg Config) defaultPolicy() domainPolicy {
+	return domainPolicy{TTL: cfg.MailTTL, MaxMessages: cfg.MaxMailboxMessages, MaxBytes: cfg.MaxMailboxBytes, CatchAll: cfg.CatchAll, MaxMessageBytes: maxMessageBytes}
+}
+
+// parseDomainPolicies 解析 域名:键=值;键=值 列表，如 temp.com:ttl=1h;max_messages=20;max_bytes=5000000,corp.com:ttl=168h;catch_all=false;max_message_bytes=10485760
+func parseDomainPolicies(value string, defaults domainPolicy) (map[string]domainPolicy, error) {
+	policies := make(map[string]domainPolicy)
+	for _, item := range splitList(value) {
+		domain, settings, ok := strings.Cut(item, ":")
+		domain = strings.TrimSpace(domain)
+		if !ok || domain == "" {
+			return nil, fmt.Errorf("无效的域名策略 %q", item)
+		}
+		domain, err := asciiDomain(domain)
+		if err != nil {
+			return nil, fmt.Errorf("域名策略 %q 中的域名无效: %v", item, err)
+		}
+
+		p := defaults
+		for _, setting := range strings.Split(settings, ";") {
+			if strings.TrimSpace(setting) == "" {
+				continue
+			}
+			key, val, _ := strings.Cut(setting, "=")
+			key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+			var err error
+			switch key {
+			case "ttl":
+				p.TTL, err = time.ParseDuration(val)
+				if err == nil && p.TTL < 0 {
+					err = fmt.Errorf("不能为负数")
+				}
+			case "max_messages":
+				p.MaxMessages, err = strconv.Atoi(val)
+				if err == nil && p.MaxMessages < 0 {
+					err = fmt.Errorf("不能为负数")
+				}
+			case "max_bytes":
+				p.MaxBytes, err = strconv.ParseInt(val, 10, 64)
+				if err == nil && p.MaxBytes < 0 {
+					err = fmt.Errorf("不能为负数")
+				}
+			case "catch_all":
+				p.CatchAll, err = strconv.ParseBool(val)
+			case "max_message_bytes":
+				p.MaxMessageBytes, err = strconv.Atoi(val)
+				if err == nil && (p.MaxMessageBytes <= 0 || p.MaxMessageBytes > maxMessageBytesLimit) {
+					err = fmt.Errorf("应在 1 到 %d 之间", maxMessageBytesLimit)
+				}
+			default:
+				err = fmt.Errorf("未知的设置")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("域名 %s 的设置 %q 无效: %v", domain, setting, err)
+			}
+		}
+		policies[domain] = p
+	}
+	return policies, nil
+}
+
+// settingsFor 取域名生效的设置：先找该域名自己的策略，子域名沿用所匹配通配域名的策略，都没有时返回全局默认。
+// SMTP 收件、过期清理和接口展示都经由这里取设置，不直接读全局配置
+func settingsFor(domain string) domainPolicy {
+	if p, ok := config().DomainPolicies[strings.ToLower(domain)]; ok {
+		return p
+	}
+	if pattern, ok := matchAllowedDomain(domain); ok {
+		if p, ok := config().DomainPolicies[strings.ToLower(pattern)]; ok {
+			return p
+		}
+	}
+	return config().defaultPolicy()
+}
+
+// largestMessageBytes 所有域名中最大的单封邮件上限，SMTP 服务按它读取邮件，再按收件人的域名检查
+func (cfg Config) largestMessageBytes() int {
+	largest := maxMessageBytes
+	for _, p := range cfg.DomainPolicies {
+		if p.MaxMessageBytes > largest {
+			largest = p.MaxMessageBytes
+		}
+	}
+	return largest
+}
+
+// publicDomainSettings 各可用域名可以公开的设置，供 /info 和 getAllowedDomains 展示
+func publicDomainSettings() []infoDomain {
+	domains := make([]infoDomain, 0, len(config().AllowedDomains))
+	for i, domain := range config().AllowedDomains {
+		p := settingsFor(domain)
+		domains = append(domains, infoDomain{
+			Domain:          domain,
+			DisplayDomain:   config().AllowedDomainsDisplay[i],
+			TTLSeconds:      int64(p.TTL.Seconds()),
+			MaxMessages:     p.MaxMessages,
+			MaxBytes:        p.MaxBytes,
+			CatchAll:        p.CatchAll,
+			MaxMessageBytes: p.MaxMessageBytes,
+		})
+	}
+	return domains
+}
+
+// logDomainPolicies 启动时打印各域名的策略
+func logDomainPolicies() {
+	domains := make([]string, 0, len(config().DomainPolicies))
+	for d := range config().DomainPolicies {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	for _, d := range domains {
+		log.Printf("域名策略 %s: %v", d, config().DomainPolicies[d])
+	}
+}
+
+// sweepClock 过期清理使用的时钟，测试中可以替换为固定时间
+var sweepClock = time.Now
+
+// expired 邮件是否已到过期时间
+func (m mailContent) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !m.ExpiresAt.After(now)
+}
+
+// sweepExpired 清理过期的灰名单和去重记录；有域名设置了保留时长时删除过期邮件，
+// 邮件全部过期的邮箱一并删除，配置了归档时先归档
+func sweepExpired() {
+	now := sweepClock()
+	pruneGreylist(now)
+	pruneDedup(now)
+	if !retentionEnabled() {
+		return
+	}
+	archiveExpired(now)
+	n, err := mailStore.Expire(now)
+	if err != nil {
+		cleanupLogger.Error("清理过期邮件失败", "error", err)
+	} else if n > 0 {
+		cleanupLogger.Info("已删除过期邮件", "messages", n)
+	}
+}
+
+// retentionEnabled 是否有域名设置了保留时长
+func retentionEnabled() bool {
+	for _, domain := range config().AllowedDomains {
+		if settingsFor(domain).TTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// startExpirySweeper 每分钟清理一次。灰名单和去重记录不随邮件清空，不开启定时清空时也要靠它回收
+func startExpirySweeper() {
+	// 重新加载配置后会再次调用，只启动一次
+	expirySweeperOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(expirySweepInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				sweepExpired()
+			}
+		}()
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useSweepClock 让 sweepExpired 使用固定时间，测试结束后恢复
+func useSweepClock(t *testing.T, now time.Time) {
+	t.Helper()
+	old := sweepClock
+	sweepClock = func() time.Time { return now }
+	t.Cleanup(func() { sweepClock = old })
+}
+
+// TestSweepPrunesGreylistAndDedup 不开启定时清空、不设置保留时长时，灰名单和去重记录也按时回收
+func TestSweepPrunesGreylistAndDedup(t *testing.T) {
+	setupTest(t, map[string]string{
+		"MAIL_TTL":        "0",
+		"GREYLIST":        "true",
+		"GREYLIST_EXPIRY": "1h",
+		"DEDUP_MODE":      "mailbox",
+		"DEDUP_WINDOW":    "10m",
+	})
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	greylistMu.Lock()
+	greylist = map[string]greylistEntry{
+		"stale": {firstSeen: now.Add(-3 * time.Hour), lastSeen: now.Add(-2 * time.Hour)},
+		"fresh": {firstSeen: now.Add(-3 * time.Hour), lastSeen: now.Add(-30 * time.Minute)},
+	}
+	greylistMu.Unlock()
+	dedupMu.Lock()
+	dedupSeen = map[string]dedupEntry{
+		"stale": {deliveryID: "d1", seen: now.Add(-11 * time.Minute)},
+		"fresh": {deliveryID: "d2", seen: now.Add(-time.Minute)},
+	}
+	dedupMu.Unlock()
+	t.Cleanup(func() {
+		greylist = make(map[string]greylistEntry)
+		dedupSeen = make(map[string]dedupEntry)
+	})
+
+	useSweepClock(t, now)
+	sweepExpired()
+
+	if _, ok := greylist["stale"]; ok {
+		t.Error("超过 GREYLIST_EXPIRY 的灰名单记录应被清理")
+	}
+	if _, ok := greylist["fresh"]; !ok {
+		t.Error("未过期的灰名单记录应保留")
+	}
+	if _, ok := dedupSeen["stale"]; ok {
+		t.Error("超出 DEDUP_WINDOW 的去重记录应被清理")
+	}
+	if _, ok := dedupSeen["fresh"]; !ok {
+		t.Error("去重窗口内的记录应保留")
+	}
+}
+
+func TestSweepExpiresMail(t *testing.T) {
+	setupTest(t, map[string]string{"MAIL_TTL": "1h"})
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	expired, kept := now.Add(-time.Minute), now.Add(time.Minute)
+	mailStore.Append(mailContent{ID: "old", To: "a@test.local", ExpiresAt: &expired})
+	mailStore.Append(mailContent{ID: "new", To: "b@test.local", ExpiresAt: &kept})
+
+	useSweepClock(t, now)
+	sweepExpired()
+
+	if ok, _ := mailStore.Exists("a@test.local"); ok {
+		t.Error("邮件全部过期的邮箱应被删除")
+	}
+	if n, _ := mailStore.Count("b@test.local"); n != 1 {
+		t.Errorf("未过期的邮件应保留，剩余 %d 封", n)
+	}
+}
+
+// policyTestEnv 全局默认保留一天、每个邮箱 50 封、catch-all，各域名覆盖其中一部分
+var policyTestEnv = map[string]string{
+	"ALLOWED_DOMAINS":      "public.test,internal.test,*.wild.test,exact.wild.test,café.test",
+	"SMTP_HOSTNAME":        "mx.public.test",
+	"MAIL_TTL":             "24h",
+	"MAX_MAILBOX_MESSAGES": "50",
+	"DOMAIN_POLICIES": "public.test:ttl=1h;max_messages=2;max_message_bytes=2048," +
+		"internal.test:ttl=168h;catch_all=false," +
+		"*.wild.test:max_bytes=1000," +
+		"exact.wild.test:ttl=2h," +
+		"CAFÉ.test:max_messages=3",
+}
+
+// TestSettingsForPrecedence 域名自己的策略优先，其次是所匹配通配域名的策略，最后是全局默认；未覆盖的项沿用全局默认
+func TestSettingsForPrecedence(t *testing.T) {
+	setupTest(t, policyTestEnv)
+	const mb = maxMessageBytes
+	for domain, want := range map[string]domainPolicy{
+		"public.test":   {TTL: time.Hour, MaxMessages: 2, CatchAll: true, MaxMessageBytes: 2048},
+		"Public.TEST":   {TTL: time.Hour, MaxMessages: 2, CatchAll: true, MaxMessageBytes: 2048},
+		"internal.test": {TTL: 168 * time.Hour, MaxMessages: 50, CatchAll: false, MaxMessageBytes: mb},
+		// 子域名沿用通配域名的策略，不论层级
+		"a.wild.test":   {TTL: 24 * time.Hour, MaxMessages: 50, MaxBytes: 1000, CatchAll: true, MaxMessageBytes: mb},
+		"b.a.wild.test": {TTL: 24 * time.Hour, MaxMessages: 50, MaxBytes: 1000, CatchAll: true, MaxMessageBytes: mb},
+		// 完全匹配的策略优先，不叠加通配域名的设置
+		"exact.wild.test":   {TTL: 2 * time.Hour, MaxMessages: 50, CatchAll: true, MaxMessageBytes: mb},
+		"a.exact.wild.test": {TTL: 24 * time.Hour, MaxMessages: 50, MaxBytes: 1000, CatchAll: true, MaxMessageBytes: mb},
+		// 国际化域名按 punycode 匹配
+		"xn--caf-dma.test": {TTL: 24 * time.Hour, MaxMessages: 3, CatchAll: true, MaxMessageBytes: mb},
+		// 没有策略的域名使用全局默认
+		"wild.test":  {TTL: 24 * time.Hour, MaxMessages: 50, CatchAll: true, MaxMessageBytes: mb},
+		"other.test": {TTL: 24 * time.Hour, MaxMessages: 50, CatchAll: true, MaxMessageBytes: mb},
+	} {
+		if got := settingsFor(domain); got != want {
+			t.Errorf("settingsFor(%q) = %v，应为 %v", domain, got, want)
+		}
+	}
+	if got := config().largestMessageBytes(); got != mb {
+		t.Errorf("largestMessageBytes = %d，应为 %d", got, mb)
+	}
+}
+
+func TestParseDomainPoliciesErrors(t *testing.T) {
+	defaults := domainPolicy{TTL: time.Hour}
+	for _, value := range []string{
+		"public.test",
+		":ttl=1h",
+		"public.test:ttl=soon",
+		"public.test:ttl=-1h",
+		"public.test:max_messages=-1",
+		"public.test:max_bytes=x",
+		"public.test:catch_all=maybe",
+		"public.test:max_message_bytes=0",
+		"public.test:max_message_bytes=999999999",
+		"public.test:color=blue",
+	} {
+		if _, err := parseDomainPolicies(value, defaults); err == nil {
+			t.Errorf("parseDomainPolicies(%q) 应报错", value)
+		}
+	}
+	// 空的设置项忽略，没有设置的域名与默认值相同
+	policies, err := parseDomainPolicies("public.test:;ttl=2h;,internal.test:", defaults)
+	if err != nil || policies["public.test"].TTL != 2*time.Hour || policies["internal.test"] != defaults {
+		t.Errorf("parseDomainPolicies = %v, %v", policies, err)
+	}
+	// 策略中的域名必须是允许的域名
+	setupTest(t, nil)
+	t.Setenv("DOMAIN_POLICIES", "other.test:ttl=1h")
+	configErrors = nil
+	parseConfig()
+	defer func() { configErrors = nil }()
+	if len(configErrors) != 1 || !strings.Contains(configErrors[0], "other.test") {
+		t.Errorf("configErrors = %q", configErrors)
+	}
+}
+
+// TestDomainPolicySMTP SMTP 收件按收件人域名的策略检查收件模式、邮箱容量和邮件大小，并设置过期时间
+func TestDomainPolicySMTP(t *testing.T) {
+	setupTest(t, policyTestEnv)
+	addr := startTestSMTP(t)
+	body := "Subject: hi\n\nhello\n"
+	// internal.test 关闭了 catch-all，只接收已存在的邮箱
+	mailStore.Create("user@internal.test")
+	for _, to := range []string{"user@public.test", "user@public.test", "user@internal.test"} {
+		if err := sendTestMail(t, addr, "sender@example.com", []string{to}, body); err != nil {
+			t.Fatalf("发往 %s: %v", to, err)
+		}
+	}
+	// public.test 每个邮箱最多 2 封
+	if err := sendTestMail(t, addr, "sender@example.com", []string{"user@public.test"}, body); err == nil {
+		t.Error("超过 public.test 的邮箱容量应拒收")
+	}
+	// 不存在的地址拒收
+	if err := sendTestMail(t, addr, "sender@example.com", []string{"nobody@internal.test"}, body); err == nil {
+		t.Error("internal.test 不存在的地址应拒收")
+	}
+	// public.test 单封邮件最多 2048 字节，其他域名使用全局上限
+	large := "Subject: large\n\n" + strings.Repeat(strings.Repeat("x", 70)+"\n", 60)
+	if err := sendTestMail(t, addr, "sender@example.com", []string{"big@public.test"}, large); err == nil {
+		t.Error("超过 public.test 大小上限的邮件应拒收")
+	}
+	if err := sendTestMail(t, addr, "sender@example.com", []string{"big@a.wild.test"}, large); err != nil {
+		t.Errorf("其他域名应接收: %v", err)
+	}
+
+	for to, ttl := range map[string]time.Duration{"user@public.test": time.Hour, "user@internal.test": 168 * time.Hour, "big@a.wild.test": 24 * time.Hour} {
+		m, ok, _ := mailStore.Latest(to)
+		if !ok || m.ExpiresAt == nil || m.ExpiresAt.Sub(m.ReceivedAt).Round(time.Second) != ttl {
+			t.Errorf("%s 的过期时间 %v，应为收信后 %v", to, m.ExpiresAt, ttl)
+		}
+	}
+}
+
+// TestDomainPolicyPublicLimits getAllowedDomains?limits=true 按 settingsFor 列出各域名的公开设置
+func TestDomainPolicyPublicLimits(t *testing.T) {
+	setupTest(t, policyTestEnv)
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/getAllowedDomains?limits=true", nil))
+	var resp allowedDomainsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 {
+		t.Fatalf("返回 %d: %v", w.Code, err)
+	}
+	limits := map[string]infoDomain{}
+	for _, d := range resp.Limits {
+		limits[d.Domain] = d
+	}
+	want := map[string]infoDomain{
+		"public.test":      {Domain: "public.test", DisplayDomain: "public.test", TTLSeconds: 3600, MaxMessages: 2, CatchAll: true, MaxMessageBytes: 2048},
+		"internal.test":    {Domain: "internal.test", DisplayDomain: "internal.test", TTLSeconds: 604800, MaxMessages: 50, MaxMessageBytes: maxMessageBytes},
+		"*.wild.test":      {Domain: "*.wild.test", DisplayDomain: "*.wild.test", TTLSeconds: 86400, MaxMessages: 50, MaxBytes: 1000, CatchAll: true, MaxMessageBytes: maxMessageBytes},
+		"xn--caf-dma.test": {Domain: "xn--caf-dma.test", DisplayDomain: "café.test", TTLSeconds: 86400, MaxMessages: 3, CatchAll: true, MaxMessageBytes: maxMessageBytes},
+	}
+	for domain, w := range want {
+		if limits[domain] != w {
+			t.Errorf("%s 的设置 %+v，应为 %+v", domain, limits[domain], w)
+		}
+	}
+	if len(resp.Limits) != 5 {
+		t.Errorf("列出 %d 个域名", len(resp.Limits))
+	}
+}
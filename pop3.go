@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// POP3：开启 ENABLE_POP3 后在 POP3_PORT 上提供 RFC 1939 的取信服务，用户名为邮箱地址，
+// 密码任意；设置 MAILBOX_TOKEN_SECRET 时密码为新建邮箱时返回的令牌。
+// 登录时取邮箱当前邮件的快照，编号从最早的一封开始；DELE 只做标记，QUIT 时才从存储中删除，
+// 连接中途断开时不删除任何邮件
+
+// retrievalSessions 进行中的 POP3 和 IMAP 会话数，退出和平滑升级时与 SMTP 会话一起等待结束
+var retrievalSessions atomic.Int64
+
+// pop3IdleTimeout 两条命令之间的最长间隔，RFC 1939 要求不少于 10 分钟
+const pop3IdleTimeout = 10 * time.Minute
+
+// pop3Message 会话中的一封邮件，data 为 CRLF 换行的原始邮件
+type pop3Message struct {
+	mail    mailContent
+	data    []byte
+	deleted bool
+}
+
+type pop3Session struct {
+	conn     net.Conn
+	tp       *textproto.Conn
+	remoteIP string
+	tls      bool
+
+	user     string
+	mailbox  string
+	messages []pop3Message
+}
+
+// startPOP3Server 监听 POP3 端口，每个连接一个会话
+func startPOP3Server() {
+	if !config().EnablePOP3 {
+		return
+	}
+	ln, err := listen("pop3", listenAddr(config().SMTPBind, config().POP3Port))
+	if err != nil {
+		pop3Logger.Error("POP3服务器启动失败", "error", err)
+		return
+	}
+	log.Printf("POP3服务器正在启动于 %s...", ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if !draining.Load() {
+					pop3Logger.Error("POP3服务器停止", "error", err)
+				}
+				return
+			}
+			go newPOP3Session(conn).serve()
+		}
+	}()
+}
+
+func newPOP3Session(conn net.Conn) *pop3Session {
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return &pop3Session{conn: conn, tp: textproto.NewConn(conn), remoteIP: ip}
+}
+
+func (s *pop3Session) serve() {
+	retrievalSessions.Add(1)
+	defer retrievalSessions.Add(-1)
+	// STLS 后 s.conn 会换成 TLS 连接
+	defer func() { s.conn.Close() }()
+	s.reply(true, "%s POP3 ready", config().SMTPHostname)
+	for {
+		s.conn.SetDeadline(time.Now().Add(pop3IdleTimeout))
+		line, err := s.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if !s.handle(strings.ToUpper(cmd), strings.TrimSpace(arg)) {
+			return
+		}
+	}
+}
+
+func (s *pop3Session) reply(ok bool, format string, args ...interface{}) {
+	status := "-ERR "
+	if ok {
+		status = "+OK "
+	}
+	s.tp.PrintfLine("%s%s", status, fmt.Sprintf(format, args...))
+}
+
+// handle 处理一条命令，返回 false 时结束会话
+func (s *pop3Session) handle(cmd, arg string) bool {
+	switch cmd {
+	case "QUIT":
+		s.quit()
+		return false
+	case "CAPA":
+		lines := []string{"USER", "UIDL", "TOP", "RESP-CODES", "IMPLEMENTATION tempMail"}
+		if config().EnableSTARTTLS && !s.tls && s.messages == nil {
+			lines = append(lines, "STLS")
+		}
+		s.reply(true, "Capability list follows")
+		s.writeLines(lines)
+		return true
+	case "NOOP":
+		s.reply(true, "")
+		return true
+	}
+
+	// AUTHORIZATION 状态
+	if s.messages == nil {
+		switch cmd {
+		case "STLS":
+			s.startTLS()
+		case "USER":
+			address := normalizeAddress(arg)
+			if !strings.Contains(address, "@") || !domainAllowed(addressDomain(address)) {
+				s.user = ""
+				s.reply(false, "no such mailbox")
+				return true
+			}
+			s.user = address
+			s.reply(true, "send PASS")
+		case "PASS":
+			if s.user == "" {
+				s.reply(false, "send USER first")
+				return true
+			}
+			if !mailboxPasswordOK(s.user, arg) {
+				pop3Logger.Warn("POP3 登录失败", "mailbox", s.user, "ip", s.remoteIP)
+				s.user = ""
+				s.reply(false, "[AUTH] invalid password")
+				return true
+			}
+			s.login()
+		default:
+			s.reply(false, "command not valid in this state")
+		}
+		return true
+	}
+
+	// TRANSACTION 状态
+	switch cmd {
+	case "STAT":
+		n, size := 0, 0
+		for _, m := range s.messages {
+			if !m.deleted {
+				n++
+				size += len(m.data)
+			}
+		}
+		s.reply(true, "%d %d", n, size)
+	case "LIST", "UIDL":
+		line := func(i int, m pop3Message) string {
+			if cmd == "LIST" {
+				return fmt.Sprintf("%d %d", i+1, len(m.data))
+			}
+			return fmt.Sprintf("%d %s", i+1, m.mail.ID)
+		}
+		if arg != "" {
+			if i, ok := s.message(arg); ok {
+				s.reply(true, "%s", line(i, s.messages[i]))
+			}
+			return true
+		}
+		var lines []string
+		for i, m := range s.messages {
+			if !m.deleted {
+				lines = append(lines, line(i, m))
+			}
+		}
+		s.reply(true, "%d messages", len(lines))
+		s.writeLines(lines)
+	case "RETR":
+		if i, ok := s.message(arg); ok {
+			s.retrieve(i, -1)
+		}
+	case "TOP":
+		msg, nText, _ := strings.Cut(arg, " ")
+		n, err := strconv.Atoi(strings.TrimSpace(nText))
+		if err != nil || n < 0 {
+			s.reply(false, "usage: TOP msg n")
+			return true
+		}
+		if i, ok := s.message(msg); ok {
+			s.retrieve(i, n)
+		}
+	case "DELE":
+		if i, ok := s.message(arg); ok {
+			s.messages[i].deleted = true
+			s.reply(true, "message %d deleted", i+1)
+		}
+	case "RSET":
+		for i := range s.messages {
+			s.messages[i].deleted = false
+		}
+		s.reply(true, "")
+	default:
+		s.reply(false, "unknown command")
+	}
+	return true
+}
+
+// login 取邮箱当前的邮件，进入 TRANSACTION 状态
+func (s *pop3Session) login() {
+	mails, err := mailStore.List(s.user)
+	if err != nil {
+		pop3Logger.Error("POP3 读取邮箱失败", "mailbox", s.user, "error", err)
+		s.reply(false, "[SYS/TEMP] mailbox temporarily unavailable")
+		return
+	}
+	// List 最新在前，POP3 编号从最早的一封开始
+	s.messages = make([]pop3Message, 0, len(mails))
+	for i := len(mails) - 1; i >= 0; i-- {
+		s.messages = append(s.messages, pop3Message{mail: mails[i], data: pop3Data(mails[i])})
+	}
+	s.mailbox = s.user
+	pop3Logger.Info("POP3 登录", "mailbox", s.mailbox, "ip", s.remoteIP, "messages", len(s.messages))
+	s.reply(true, "%d messages", len(s.messages))
+}
+
+// pop3Data 原始邮件，没有保存原始邮件时按字段重建，换行统一为 CRLF
+func pop3Data(m mailContent) []byte {
+	data := m.raw
+	if len(data) == 0 {
+		data = buildEML(m)
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+// message 解析邮件编号，无效或已删除时回复错误
+func (s *pop3Session) message(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(s.messages) {
+		s.reply(false, "no such message")
+		return 0, false
+	}
+	if s.messages[n-1].deleted {
+		s.reply(false, "message %d already deleted", n)
+		return 0, false
+	}
+	return n - 1, true
+}
+
+// retrieve 发送邮件，lines 不小于 0 时只发送头部和正文的前 lines 行（TOP）
+func (s *pop3Session) retrieve(i, lines int) {
+	m := &s.messages[i]
+	data := m.data
+	if lines >= 0 {
+		header, body, found := bytes.Cut(data, []byte("\r\n\r\n"))
+		data = header
+		if found {
+			data = append(append(append([]byte(nil), header...), "\r\n\r\n"...), pop3FirstLines(body, lines)...)
+		}
+	}
+	s.reply(true, "%d octets", len(m.data))
+	w := s.tp.DotWriter()
+	w.Write(data)
+	w.Close()
+
+	if lines < 0 {
+		recordFetched()
+		if !m.mail.Read {
+			if _, err := mailStore.SetRead(s.mailbox, m.mail.ID, true); err == nil {
+				m.mail.Read = true
+			}
+		}
+	}
+}
+
+// pop3FirstLines 取正文的前 n 行
+func pop3FirstLines(body []byte, n int) []byte {
+	end := 0
+	for ; n > 0 && end < len(body); n-- {
+		i := bytes.Index(body[end:], []byte("\r\n"))
+		if i < 0 {
+			return body
+		}
+		end += i + 2
+	}
+	return body[:end]
+}
+
+// quit 在 TRANSACTION 状态下退出时删除标记的邮件（UPDATE 状态）
+func (s *pop3Session) quit() {
+	var ids []string
+	for _, m := range s.messages {
+		if m.deleted {
+			ids = append(ids, m.mail.ID)
+		}
+	}
+	if len(ids) == 0 {
+		s.reply(true, "bye")
+		return
+	}
+	n, err := mailStore.Remove(s.mailbox, ids)
+	if err != nil {
+		pop3Logger.Error("POP3 删除邮件失败", "mailbox", s.mailbox, "error", err)
+		s.reply(false, "[SYS/TEMP] some deleted messages not removed")
+		return
+	}
+	pop3Logger.Info("POP3 删除邮件", "mailbox", s.mailbox, "ip", s.remoteIP, "deleted", n)
+	s.reply(true, "%d messages deleted", n)
+}
+
+// startTLS 升级为 TLS，之后重新读取命令，登录前的状态全部丢弃
+func (s *pop3Session) startTLS() {
+	if !config().EnableSTARTTLS || s.tls {
+		s.reply(false, "STLS not available")
+		return
+	}
+	s.reply(true, "begin TLS negotiation")
+	conn := tls.Server(s.conn, serverTLSConfig())
+	if err := conn.Handshake(); err != nil {
+		s.conn.Close()
+		return
+	}
+	s.conn, s.tp, s.tls, s.user = conn, textproto.NewConn(conn), true, ""
+}
+
+// writeLines 发送多行响应，以单独一行 "." 结束
+func (s *pop3Session) writeLines(lines []string) {
+	w := s.tp.DotWriter()
+	for _, line := range lines {
+		io.WriteString(w, line+"\r\n")
+	}
+	w.Close()
+}
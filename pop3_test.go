@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pop3TestClient 连接到测试用 POP3 会话的客户端
+type pop3TestClient struct {
+	t    *testing.T
+	addr string
+	tp   *textproto.Conn
+}
+
+// startTestPOP3 在临时端口上提供 POP3 会话并连接，返回已读过问候行的客户端
+func startTestPOP3(t *testing.T) *pop3TestClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go newPOP3Session(conn).serve()
+		}
+	}()
+	return dialTestPOP3(t, ln.Addr().String())
+}
+
+func dialTestPOP3(t *testing.T, addr string) *pop3TestClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &pop3TestClient{t: t, addr: addr, tp: textproto.NewConn(conn)}
+	t.Cleanup(func() { c.tp.Close() })
+	if line, err := c.tp.ReadLine(); err != nil || !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("问候行 %q, %v", line, err)
+	}
+	return c
+}
+
+// cmd 发送一条命令，要求回复以 want（+OK 或 -ERR）开头，返回状态行中 want 之后的部分
+func (c *pop3TestClient) cmd(want, command string) string {
+	c.t.Helper()
+	if err := c.tp.PrintfLine("%s", command); err != nil {
+		c.t.Fatalf("发送 %s: %v", command, err)
+	}
+	line, err := c.tp.ReadLine()
+	if err != nil {
+		c.t.Fatalf("%s: 读取回复: %v", command, err)
+	}
+	if !strings.HasPrefix(line, want) {
+		c.t.Fatalf("%s: 回复 %q，应以 %s 开头", command, line, want)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, want))
+}
+
+// multi 发送一条多行响应的命令，返回去掉点填充后的各行
+func (c *pop3TestClient) multi(command string) []string {
+	c.t.Helper()
+	c.cmd("+OK", command)
+	lines, err := c.tp.ReadDotLines()
+	if err != nil {
+		c.t.Fatalf("%s: 读取多行响应: %v", command, err)
+	}
+	return lines
+}
+
+// pop3TestMails 按时间先后写入 m1、m2，m2 的正文有以 "." 开头的行
+func pop3TestMails(t *testing.T) {
+	t.Helper()
+	now := time.Now()
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", ReceivedAt: now.Add(-time.Minute),
+		raw: []byte("Subject: one\r\n\r\nfirst\r\n")})
+	mailStore.Append(mailContent{ID: "m2", To: "user@test.local", ReceivedAt: now,
+		raw: []byte("Subject: two\n\nline 1\n.dot line\nline 3\n")})
+}
+
+func TestPOP3Transaction(t *testing.T) {
+	setupTest(t, nil)
+	pop3TestMails(t)
+
+	c := startTestPOP3(t)
+	c.cmd("-ERR", "STAT")
+	c.cmd("+OK", "USER user@test.local")
+	c.cmd("+OK", "PASS anything")
+
+	// 编号从最早的一封开始，大小按 CRLF 换行计算
+	one, two := "Subject: one\r\n\r\nfirst\r\n", "Subject: two\r\n\r\nline 1\r\n.dot line\r\nline 3\r\n"
+	if got, want := c.cmd("+OK", "STAT"), "2 "+strconv.Itoa(len(one)+len(two)); got != want {
+		t.Errorf("STAT = %q，应为 %q", got, want)
+	}
+	if got, want := strings.Join(c.multi("LIST"), ","), "1 "+strconv.Itoa(len(one))+",2 "+strconv.Itoa(len(two)); got != want {
+		t.Errorf("LIST = %q，应为 %q", got, want)
+	}
+	if got := c.cmd("+OK", "LIST 2"); got != "2 "+strconv.Itoa(len(two)) {
+		t.Errorf("LIST 2 = %q", got)
+	}
+	if got := strings.Join(c.multi("UIDL"), ","); got != "1 m1,2 m2" {
+		t.Errorf("UIDL = %q", got)
+	}
+	if got := c.cmd("+OK", "UIDL 1"); got != "1 m1" {
+		t.Errorf("UIDL 1 = %q", got)
+	}
+	c.cmd("-ERR", "LIST 3")
+	c.cmd("-ERR", "RETR x")
+
+	// 以 "." 开头的行在传输中加点，客户端读到的与原文相同
+	if got := strings.Join(c.multi("RETR 2"), "\n"); got != "Subject: two\n\nline 1\n.dot line\nline 3" {
+		t.Errorf("RETR 2 = %q", got)
+	}
+	if m, _, _ := mailStore.Get("user@test.local", "m2"); !m.Read {
+		t.Error("RETR 后应标记已读")
+	}
+	if got := strings.Join(c.multi("TOP 2 1"), "\n"); got != "Subject: two\n\nline 1" {
+		t.Errorf("TOP 2 1 = %q", got)
+	}
+	c.cmd("+OK", "QUIT")
+	if n, _ := mailStore.Count("user@test.local"); n != 2 {
+		t.Errorf("没有 DELE 时 QUIT 不应删除邮件，剩余 %d 封", n)
+	}
+}
+
+// TestPOP3DeleteOnQuit DELE 只做标记，QUIT 时才删除；RSET 撤销标记，连接中途断开时不删除
+func TestPOP3DeleteOnQuit(t *testing.T) {
+	setupTest(t, nil)
+	pop3TestMails(t)
+
+	c := startTestPOP3(t)
+	c.cmd("+OK", "USER user@test.local")
+	c.cmd("+OK", "PASS x")
+	c.cmd("+OK", "DELE 1")
+	c.cmd("-ERR", "DELE 1")
+	c.cmd("-ERR", "RETR 1")
+	if got := c.cmd("+OK", "STAT"); !strings.HasPrefix(got, "1 ") {
+		t.Errorf("DELE 后 STAT = %q", got)
+	}
+	if got := c.multi("UIDL"); len(got) != 1 || got[0] != "2 m2" {
+		t.Errorf("DELE 后 UIDL = %q", got)
+	}
+	if n, _ := mailStore.Count("user@test.local"); n != 2 {
+		t.Fatalf("QUIT 之前不应删除，剩余 %d 封", n)
+	}
+
+	c.cmd("+OK", "RSET")
+	if got := c.cmd("+OK", "STAT"); !strings.HasPrefix(got, "2 ") {
+		t.Errorf("RSET 后 STAT = %q", got)
+	}
+
+	// 中途断开的会话中标记的邮件不删除
+	c.cmd("+OK", "DELE 2")
+	c.tp.Close()
+	other := dialTestPOP3(t, c.addr)
+	other.cmd("+OK", "USER user@test.local")
+	other.cmd("+OK", "PASS x")
+	if got := other.cmd("+OK", "STAT"); !strings.HasPrefix(got, "2 ") {
+		t.Fatalf("断开的会话不应删除邮件，STAT = %q", got)
+	}
+	other.cmd("+OK", "DELE 1")
+	other.cmd("+OK", "QUIT")
+	if _, ok, _ := mailStore.Get("user@test.local", "m1"); ok {
+		t.Error("QUIT 后标记的邮件应被删除")
+	}
+	if _, ok, _ := mailStore.Get("user@test.local", "m2"); !ok {
+		t.Error("没有标记的邮件不应删除")
+	}
+}
+
+// TestPOP3TokenAuth 设置 MAILBOX_TOKEN_SECRET 时密码必须是邮箱令牌
+func TestPOP3TokenAuth(t *testing.T) {
+	setupTest(t, map[string]string{"MAILBOX_TOKEN_SECRET": "secret"})
+	pop3TestMails(t)
+
+	c := startTestPOP3(t)
+	c.cmd("-ERR", "PASS x")
+	c.cmd("-ERR", "USER user@other.example")
+	c.cmd("+OK", "USER user@test.local")
+	c.cmd("-ERR", "PASS wrong")
+	// 密码错误后需要重新发送 USER
+	c.cmd("-ERR", "PASS "+mailboxToken("user@test.local"))
+	c.cmd("+OK", "USER user@test.local")
+	c.cmd("-ERR", "PASS "+mailboxToken("other@test.local"))
+	c.cmd("+OK", "USER user@TEST.Local")
+	if got := c.cmd("+OK", "PASS "+mailboxToken("user@test.local")); got != "2 messages" {
+		t.Errorf("登录回复 %q", got)
+	}
+	if got := c.cmd("+OK", "STAT"); !strings.HasPrefix(got, "2 ") {
+		t.Errorf("STAT = %q", got)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	rpprof "runtime/pprof"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxCPUProfileSeconds = 120
+
+// setupPprofRoutes 挂载 pprof，需要管理 API Key，不经过限流
+func setupPprofRoutes(base *gin.RouterGroup) {
+	debug := base.Group("/debug", apiKeyAuth())
+
+	debug.GET("/pprof/", gin.WrapF(pprof.Index))
+	debug.GET("/pprof/:name", func(c *gin.Context) {
+		// profile、trace 和带 seconds 的差量快照（如 heap?seconds=30）会持续采样，按采样时长延长写超时
+		if seconds, err := strconv.Atoi(c.Query("seconds")); err == nil && seconds > 0 {
+			extendWriteDeadline(c, time.Duration(seconds)*time.Second)
+		} else if name := c.Param("name"); name == "profile" || name == "trace" {
+			// 未指定时 profile 默认采样 30 秒，trace 默认 1 秒
+			extendWriteDeadline(c, 30*time.Second)
+		}
+		switch name := c.Param("name"); name {
+		case "cmdline":
+			pprof.Cmdline(c.Writer, c.Request)
+		case "profile":
+			pprof.Profile(c.Writer, c.Request)
+		case "symbol":
+			pprof.Symbol(c.Writer, c.Request)
+		case "trace":
+			pprof.Trace(c.Writer, c.Request)
+		default:
+			pprof.Handler(name).ServeHTTP(c.Writer, c.Request)
+		}
+	})
+
+	// 便捷下载：CPU 采样（默认 30 秒）和堆快照
+	debug.GET("/capture/cpu", handleCaptureCPU)
+	debug.GET("/capture/heap", handleCaptureHeap)
+}
+
+func handleCaptureCPU(c *gin.Context) {
+	seconds, err := strconv.Atoi(c.DefaultQuery("seconds", "30"))
+	if err != nil || seconds <= 0 || seconds > maxCPUProfileSeconds {
+		c.JSON(400, gin.H{"error": msg("out_of_range", "seconds", 1, maxCPUProfileSeconds)})
+		return
+	}
+
+	extendWriteDeadline(c, time.Duration(seconds)*time.Second)
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="cpu-%s.pprof"`, time.Now().Format("20060102-150405")))
+	if err := rpprof.StartCPUProfile(c.Writer); err != nil {
+		c.Header("Content-Disposition", "")
+		c.JSON(409, gin.H{"error": msg("profile_in_progress")})
+		return
+	}
+
+	select {
+	case <-time.After(time.Duration(seconds) * time.Second):
+	case <-c.Request.Context().Done():
+	}
+	rpprof.StopCPUProfile()
+}
+
+// extendWriteDeadline 采样时间可能超过 HTTP_WRITE_TIMEOUT，单独延长本次请求的写超时
+func extendWriteDeadline(c *gin.Context, sampling time.Duration) {
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Now().Add(sampling + config().HTTPWriteTimeout)); err != nil {
+		reqLogger(c).Warn("延长采样请求的写超时失败", "error", err)
+	}
+}
+
+func handleCaptureHeap(c *gin.Context) {
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="heap-%s.pprof"`, time.Now().Format("20060102-150405")))
+	if err := rpprof.Lookup("heap").WriteTo(c.Writer, 0); err != nil {
+		c.Status(500)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	rpprof "runtime/pprof"
+	"strings"
+	"testing"
+)
+
+// adminRequest 带 API Key 请求 r，key 为空时不带，返回状态码、响应体和 Content-Disposition
+func adminRequest(r http.Handler, path, key string) (int, []byte, string) {
+	req := httptest.NewRequest("GET", path, nil)
+	if key != "" {
+		req.Header.Set("X-Api-Key", key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body, _ := io.ReadAll(w.Body)
+	return w.Code, body, w.Header().Get("Content-Disposition")
+}
+
+func TestPprofRoutes(t *testing.T) {
+	setupTest(t, map[string]string{"ENABLE_PPROF": "true", "ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine", "/debug/capture/heap"} {
+		if code, _, _ := adminRequest(r, path, ""); code != 401 {
+			t.Errorf("没有 API Key 时 %s 返回 %d", path, code)
+		}
+		if code, _, _ := adminRequest(r, path, "wrong"); code != 401 {
+			t.Errorf("错误的 API Key 时 %s 返回 %d", path, code)
+		}
+	}
+
+	if code, body, _ := adminRequest(r, "/debug/pprof/", "secret"); code != 200 || !strings.Contains(string(body), "goroutine") {
+		t.Errorf("pprof 首页返回 %d", code)
+	}
+	if code, body, _ := adminRequest(r, "/debug/pprof/goroutine?debug=1", "secret"); code != 200 || !strings.Contains(string(body), "goroutine profile") {
+		t.Errorf("goroutine 返回 %d", code)
+	}
+	code, body, disposition := adminRequest(r, "/debug/capture/heap", "secret")
+	// pprof 格式是 gzip 压缩的 protobuf
+	if code != 200 || !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) || !strings.Contains(disposition, "heap-") {
+		t.Errorf("堆快照返回 %d，%q", code, disposition)
+	}
+}
+
+func TestCaptureCPU(t *testing.T) {
+	setupTest(t, map[string]string{"ENABLE_PPROF": "true", "ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+
+	for _, seconds := range []string{"0", "-1", "121", "abc"} {
+		if code, _, _ := adminRequest(r, "/debug/capture/cpu?seconds="+seconds, "secret"); code != 400 {
+			t.Errorf("seconds=%s 返回 %d", seconds, code)
+		}
+	}
+
+	// 已有采样在进行时返回 409
+	if err := rpprof.StartCPUProfile(io.Discard); err != nil {
+		t.Skipf("无法开始 CPU 采样: %v", err)
+	}
+	code, _, disposition := adminRequest(r, "/debug/capture/cpu?seconds=1", "secret")
+	rpprof.StopCPUProfile()
+	if code != 409 || disposition != "" {
+		t.Errorf("并发采样返回 %d，Content-Disposition %q", code, disposition)
+	}
+
+	code, body, disposition := adminRequest(r, "/debug/capture/cpu?seconds=1", "secret")
+	if code != 200 || !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) || !strings.Contains(disposition, "cpu-") {
+		t.Errorf("CPU 采样返回 %d，%d 字节，%q", code, len(body), disposition)
+	}
+}
+
+func TestPprofDisabled(t *testing.T) {
+	setupTest(t, map[string]string{"ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+	if code, _, _ := adminRequest(r, "/debug/pprof/", "secret"); code != 404 {
+		t.Errorf("未开启 ENABLE_PPROF 时返回 %d", code)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// accessLogIP 经过 newRouter 发出请求，返回访问日志中记录的客户端 IP
+func accessLogIP(t *testing.T, env map[string]string, remote string, headers map[string]string) string {
+	t.Helper()
+	setupTest(t, env)
+	var buf bytes.Buffer
+	old := httpLogger
+	httpLogger = slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	defer func() { httpLogger = old }()
+
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.RemoteAddr = remote + ":40000"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	newRouter().ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry struct {
+		IP string `json:"ip"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("解析访问日志 %q: %v", buf.String(), err)
+	}
+	return entry.IP
+}
+
+func TestTrustedProxyClientIP(t *testing.T) {
+	trusted := map[string]string{"TRUSTED_PROXIES": "10.0.0.0/8,192.0.2.10"}
+	cloudflare := map[string]string{"TRUSTED_PROXIES": "173.245.48.0/20", "REAL_IP_HEADERS": "CF-Connecting-IP"}
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		// 未配置可信代理时完全忽略请求头，伪造的地址不起作用
+		{"未配置代理时忽略 X-Forwarded-For", nil, "198.51.100.1", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "198.51.100.1"},
+		{"未配置代理时忽略 X-Real-IP", nil, "198.51.100.1", map[string]string{"X-Real-IP": "203.0.113.9"}, "198.51.100.1"},
+		{"不在可信网段的来源伪造请求头", trusted, "198.51.100.1", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "198.51.100.1"},
+		{"可信网段转发", trusted, "10.1.2.3", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		{"可信的单个地址转发", trusted, "192.0.2.10", map[string]string{"X-Forwarded-For": "203.0.113.9"}, "203.0.113.9"},
+		// 从右往左跳过可信代理，客户端在最左边伪造的地址不会被采用
+		{"多级代理", trusted, "10.1.2.3", map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.9, 10.0.0.5"}, "203.0.113.9"},
+		{"可信代理只带 X-Real-IP", trusted, "10.1.2.3", map[string]string{"X-Real-IP": "203.0.113.9"}, "203.0.113.9"},
+		{"Cloudflare", cloudflare, "173.245.48.1", map[string]string{"CF-Connecting-IP": "203.0.113.5", "X-Forwarded-For": "1.1.1.1"}, "203.0.113.5"},
+		{"伪造 CF-Connecting-IP", cloudflare, "198.51.100.1", map[string]string{"CF-Connecting-IP": "203.0.113.5"}, "198.51.100.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := accessLogIP(t, tc.env, tc.remote, tc.headers); got != tc.want {
+				t.Errorf("客户端 IP = %s，应为 %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestRateLimitBehindProxy 限流按解析出的客户端 IP 计数
+func TestRateLimitBehindProxy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		env    map[string]string
+		method string
+		path   string
+		remote string
+		want   []int
+	}{
+		// 伪造的请求头不能绕过限流：三个请求都算在同一个来源上
+		{"未配置代理", map[string]string{"RATE_LIMIT_RPM": "1"}, "GET", "/api/v1/domains", "198.51.100.1", []int{200, 429, 429}},
+		{"不可信来源", map[string]string{"RATE_LIMIT_RPM": "1", "TRUSTED_PROXIES": "10.0.0.0/8"}, "GET", "/api/v1/domains", "198.51.100.1", []int{200, 429, 429}},
+		// 经可信代理转发时按各自的客户端计数
+		{"可信代理", map[string]string{"RATE_LIMIT_RPM": "1", "TRUSTED_PROXIES": "10.0.0.0/8"}, "GET", "/api/v1/domains", "10.1.2.3", []int{200, 200, 429}},
+		{"创建邮箱限流", map[string]string{"CREATE_RATE_LIMIT_RPM": "1", "TRUSTED_PROXIES": "10.0.0.0/8"}, "POST", "/api/v1/mailboxes", "10.1.2.3", []int{201, 201, 429}},
+		{"创建邮箱限流不可信来源", map[string]string{"CREATE_RATE_LIMIT_RPM": "1"}, "POST", "/api/v1/mailboxes", "198.51.100.1", []int{201, 429, 429}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setupTest(t, tc.env)
+			r := newRouter()
+			// 第一和第三个请求来自同一个客户端
+			var got []int
+			for _, client := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.1"} {
+				req := httptest.NewRequest(tc.method, tc.path, nil)
+				req.RemoteAddr = tc.remote + ":40000"
+				req.Header.Set("X-Forwarded-For", client)
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, req)
+				got = append(got, w.Code)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("状态码 %v，应为 %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenBucket 单个客户端的令牌桶
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// ipRateLimiter 按客户端 IP 限流，IP 由 gin 的 ClientIP 决定，遵循可信代理配置
+type ipRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	rate    float64 // 每秒补充的令牌数
+	burst   float64
+}
+
+// rateLimiter 公开接口共用的限流器，createRateLimiter 另外限制创建邮箱，重新加载配置时据此调整
+var rateLimiter, createRateLimiter *ipRateLimiter
+
+func newIPRateLimiter(perMinute, burst int) *ipRateLimiter {
+	l := &ipRateLimiter{buckets: make(map[string]*tokenBucket)}
+	l.setLimits(perMinute, burst)
+	go l.pruneLoop()
+	return l
+}
+
+// setLimits 修改每分钟请求数和突发数，重新加载配置时调用。每分钟请求数为 0 时不限流
+func (l *ipRateLimiter) setLimits(perMinute, burst int) {
+	if burst <= 0 {
+		burst = perMinute
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(perMinute) / 60
+	l.burst = float64(burst)
+}
+
+// allow 消耗一个令牌，不足时返回需要等待的时间
+func (l *ipRateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.lastSeen).Seconds()*l.rate)
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// pruneLoop 定期清理令牌已补满的空闲客户端
+func (l *ipRateLimiter) pruneLoop() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		l.mu.Lock()
+		// 不限流时不再需要任何记录
+		var idle time.Duration
+		if l.rate > 0 {
+			idle = time.Duration(l.burst/l.rate*float64(time.Second)) + time.Minute
+		}
+		for ip, b := range l.buckets {
+			if now.Sub(b.lastSeen) > idle {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *ipRateLimiter) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, wait := l.allow(c.ClientIP(), time.Now())
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(429, gin.H{"error": msg("rate_limited")})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiter(t *testing.T) {
+	l := &ipRateLimiter{buckets: make(map[string]*tokenBucket)}
+	l.setLimits(60, 2)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := range 2 {
+		if ok, _ := l.allow("192.0.2.1", now); !ok {
+			t.Fatalf("突发内的第 %d 个请求应放行", i+1)
+		}
+	}
+	ok, wait := l.allow("192.0.2.1", now)
+	if ok || wait != time.Second {
+		t.Fatalf("超过突发数应拒绝并等待 1s，得到 %v, %v", ok, wait)
+	}
+	if ok, _ := l.allow("192.0.2.2", now); !ok {
+		t.Error("其他 IP 不受影响")
+	}
+	if ok, _ := l.allow("192.0.2.1", now.Add(time.Second)); !ok {
+		t.Error("补充令牌后应放行")
+	}
+
+	// 每分钟请求数为 0 时不限流
+	l.setLimits(0, 0)
+	for range 10 {
+		if ok, _ := l.allow("192.0.2.1", now.Add(time.Second)); !ok {
+			t.Fatal("不限流时应全部放行")
+		}
+	}
+}
+
+// testRequest 以 ip 为客户端地址请求 r
+func testRequest(r http.Handler, method, path, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestCreateMailboxRateLimit(t *testing.T) {
+	setupTest(t, map[string]string{"RATE_LIMIT_RPM": "100", "CREATE_RATE_LIMIT_RPM": "2"})
+	r := newRouter()
+
+	for i := range 2 {
+		if w := testRequest(r, "POST", "/api/v1/mailboxes", "192.0.2.1"); w.Code != 201 {
+			t.Fatalf("第 %d 次创建邮箱返回 %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	w := testRequest(r, "POST", "/api/v1/mailboxes", "192.0.2.1")
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("超过创建限制应返回 429 和 Retry-After，得到 %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// 读接口只受总体限流
+	for range 5 {
+		if w := testRequest(r, "GET", "/api/v1/mailboxes/user@test.local/messages", "192.0.2.1"); w.Code != 200 {
+			t.Fatalf("读取邮件返回 %d", w.Code)
+		}
+	}
+	if w := testRequest(r, "POST", "/api/v1/mailboxes", "192.0.2.2"); w.Code != 201 {
+		t.Errorf("其他 IP 创建邮箱返回 %d", w.Code)
+	}
+
+	var info struct {
+		Data infoResponse `json:"data"`
+	}
+	json.Unmarshal(testRequest(r, "GET", "/api/v1/info", "192.0.2.3").Body.Bytes(), &info)
+	if l := info.Data.CreateRateLimit; l == nil || l.RequestsPerMinute != 2 || l.Burst != 2 {
+		t.Errorf("info 中的 createRateLimit = %+v", l)
+	}
+
+	// 重新加载后调整创建限制
+	createRateLimiter.setLimits(0, 0)
+	if w := testRequest(r, "POST", "/api/v1/mailboxes", "192.0.2.1"); w.Code != 201 {
+		t.Errorf("取消创建限制后返回 %d", w.Code)
+	}
+}
+
+func TestCreateMailboxCountsTowardsRateLimit(t *testing.T) {
+	setupTest(t, map[string]string{"RATE_LIMIT_RPM": "3", "CREATE_RATE_LIMIT_RPM": "10"})
+	r := newRouter()
+
+	// 创建邮箱同时消耗总体限流的令牌
+	for range 3 {
+		testRequest(r, "POST", "/api/v1/mailboxes", "192.0.2.1")
+	}
+	if w := testRequest(r, "GET", "/api/v1/domains", "192.0.2.1"); w.Code != 429 {
+		t.Errorf("总体限流用尽后应返回 429，得到 %d", w.Code)
+	}
+}
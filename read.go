@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// handleMarkAllRead 把邮箱中的所有邮件标记为已读，返回邮件数
+func handleMarkAllRead(c *gin.Context) {
+	n, err := mailStore.SetRead(mailboxParam(c), "", true)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	c.JSON(200, markedResponse{Marked: n})
+}
+
+// handleMarkUnread 把单封邮件标记为未读
+func handleMarkUnread(c *gin.Context) {
+	n, err := mailStore.SetRead(mailboxParam(c), c.Param("id"), false)
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	if n == 0 {
+		c.JSON(404, gin.H{"error": msg("mail_not_found")})
+		return
+	}
+	c.JSON(200, okResponse{OK: true})
+}
+
+// handleCountMail 返回邮箱中的邮件数，unread=true 时只统计未读邮件
+func handleCountMail(c *gin.Context) {
+	mails, err := mailStore.List(mailboxParam(c))
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	count := len(mails)
+	if c.Query("unread") == "true" {
+		count = 0
+		for _, m := range mails {
+			if !m.Read {
+				count++
+			}
+		}
+	}
+	c.JSON(200, countResponse{Count: count})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// httpsRedirectHandler HTTPS_REDIRECT 模式下明文 HTTP 只处理健康检查，其余请求 301 到 HTTPS。
+// ACME 验证由外层的 acmeChallengeHandler 处理，不会被重定向
+func httpsRedirectHandler(router http.Handler) http.Handler {
+	exempt := map[string]bool{
+		config().BasePath + "/healthz": true,
+		config().BasePath + "/readyz":  true,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt[r.URL.Path] {
+			router.ServeHTTP(w, r)
+			return
+		}
+		target := "https://" + httpsRedirectHost(r.Host) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// httpsRedirectHost 优先使用 HTTPS_REDIRECT_HOST，否则沿用请求的主机名并换成 HTTPS 端口
+func httpsRedirectHost(requestHost string) string {
+	if config().HTTPSRedirectHost != "" {
+		return config().HTTPSRedirectHost
+	}
+	host := requestHost
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		host = h
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if config().HTTPSPort != "443" {
+		host += ":" + config().HTTPSPort
+	}
+	return host
+}
+
+// hstsMiddleware 只在 TLS 连接上返回 Strict-Transport-Security
+func hstsMiddleware() gin.HandlerFunc {
+	value := "max-age=" + strconv.Itoa(int(config().HSTSMaxAge.Seconds()))
+	if config().HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return func(c *gin.Context) {
+		if c.Request.TLS != nil {
+			c.Header("Strict-Transport-Security", value)
+		}
+		c.Next()
+	}
+}
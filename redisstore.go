@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisOpTimeout 单次 Redis 操作的超时，超时按存储不可用处理
+const redisOpTimeout = 3 * time.Second
+
+// redisExpiryGrace 邮件列表的过期时间比其中最晚过期的邮件再晚这么久。过期邮件正常由每分钟的清理删除并更新统计，
+// 键的过期时间只在没有实例运行清理时兜底，保证设置了保留时长的邮箱不会一直留在 Redis 中；
+// 列表这样过期后，邮箱集合和统计中的记录由之后第一次清理（或向该邮箱投递、删除该邮箱）按 mstats 扣除
+const redisExpiryGrace = time.Hour
+
+// redisStore 基于 Redis 的存储，多个实例共享同一份邮件。
+//
+// 键（均带 REDIS_PREFIX 前缀）：
+//   - mailboxes：所有邮箱地址的集合，包括没有邮件的空邮箱
+//   - mbox:<地址>：邮件列表，最新的在末尾，元素为 "<过期毫秒时间戳>|<字节数>|<JSON>"，0 表示不过期；
+//     其中的邮件都会过期时，键在最晚过期的邮件之后 redisExpiryGrace 过期
+//   - rev:<地址>、revcleared、revcounter：邮箱版本
+//   - stats：邮件数、字节数、上次清空时间；received:<分钟>：每分钟收件数
+//   - mstats:<地址>：邮箱的邮件数和字节数，与列表一起更新、不设过期时间，列表因过期时间被删除后据此修正 stats
+//   - greylist:<IP|发件人|收件人>：灰名单记录首次出现的毫秒时间戳，过期时间为 GREYLIST_EXPIRY，每次出现时延长
+//   - seq：已分配的最大邮件序号；uidvalidity：IMAP 的 UIDVALIDITY，第一次取用时写入。清空时都保留
+//
+// 修改多个键的操作用 Lua 脚本保证原子性，两个实例不会取出同一封邮件
+type redisStore struct {
+	client  *redis.Client
+	prefix  string
+	started time.Time
+}
+
+func newRedisStore() *redisStore {
+	return &redisStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     config().RedisAddr,
+			Password: config().RedisPassword,
+			DB:       config().RedisDB,
+		}),
+		prefix:  config().RedisPrefix,
+		started: time.Now(),
+	}
+}
+
+func (s *redisStore) key(parts ...string) string {
+	return s.prefix + strings.Join(parts, ":")
+}
+
+func (s *redisStore) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisOpTimeout)
+}
+
+// 脚本中 KEYS[1] 为邮件列表，KEYS[2] 为邮箱集合，KEYS[3] 为统计，KEYS[4] 为版本计数，KEYS[5] 为邮箱版本，
+// KEYS[6] 为邮箱的邮件数和字节数；ARGV[1] 为邮箱地址，ARGV[2] 为当前毫秒时间戳。
+// count 在改动列表之后调用，列表已不存在（没有邮件）时删除 KEYS[6]；
+// dropExpiredList 在列表因过期时间被删除时按 KEYS[6] 扣除统计，返回扣除的邮件数
+const redisTouchLua = `
+local function touch()
+	local rev = redis.call('INCR', KEYS[4])
+	redis.call('HSET', KEYS[5], 'r', rev, 'm', ARGV[2])
+end
+local function expiryOf(value)
+	return tonumber(string.match(value, '^(%d+)|')) or 0
+end
+local function sizeOf(value)
+	return tonumber(string.match(value, '^%d+|(%d+)|')) or string.len(value)
+end
+local function count(messages, bytes)
+	redis.call('HINCRBY', KEYS[3], 'messages', messages)
+	redis.call('HINCRBY', KEYS[3], 'bytes', bytes)
+	if redis.call('EXISTS', KEYS[1]) == 0 then
+		redis.call('DEL', KEYS[6])
+	else
+		redis.call('HINCRBY', KEYS[6], 'messages', messages)
+		redis.call('HINCRBY', KEYS[6], 'bytes', bytes)
+	end
+end
+local function dropExpiredList()
+	if redis.call('EXISTS', KEYS[1]) == 1 then
+		return 0
+	end
+	local recorded = redis.call('HMGET', KEYS[6], 'messages', 'bytes')
+	local messages = tonumber(recorded[1]) or 0
+	if messages > 0 then
+		count(-messages, -(tonumber(recorded[2]) or 0))
+	end
+	redis.call('DEL', KEYS[6])
+	return messages
+end
+`
+
+// KEYS[7] 为本分钟的收件数，KEYS[8] 为邮件序号。序号写在 JSON 的开头，编码时序号为 0，JSON 中没有这个字段。
+// 列表中原有的邮件都会过期时（新建的列表或已有过期时间），把列表的过期时间延长到这封邮件过期之后 ARGV[5] 毫秒，
+// 这封邮件不过期时去掉过期时间
+var redisAppendScript = redis.NewScript(redisTouchLua + `
+dropExpiredList()
+local seq = redis.call('INCR', KEYS[8])
+local value = string.gsub(ARGV[3], '|{', '|{"seq":' .. seq .. ',', 1)
+local existing = redis.call('LLEN', KEYS[1])
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('RPUSH', KEYS[1], value)
+local expiry = expiryOf(value)
+if expiry == 0 then
+	redis.call('PERSIST', KEYS[1])
+elseif existing == 0 or (ttl >= 0 and tonumber(ARGV[2]) + ttl < expiry + tonumber(ARGV[5])) then
+	redis.call('PEXPIREAT', KEYS[1], expiry + tonumber(ARGV[5]))
+end
+redis.call('SADD', KEYS[2], ARGV[1])
+count(1, sizeOf(value))
+touch()
+redis.call('INCR', KEYS[7])
+redis.call('EXPIRE', KEYS[7], ARGV[4])
+return 1
+`)
+
+var redisCreateScript = redis.NewScript(redisTouchLua + `
+if redis.call('SADD', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+touch()
+return 1
+`)
+
+var redisPopScript = redis.NewScript(redisTouchLua + `
+local value = redis.call('RPOP', KEYS[1])
+if not value then
+	return false
+end
+count(-1, -sizeOf(value))
+touch()
+return value
+`)
+
+var redisDeleteScript = redis.NewScript(redisTouchLua + `
+dropExpiredList()
+local values = redis.call('LRANGE', KEYS[1], 0, -1)
+local bytes = 0
+for _, v in ipairs(values) do
+	bytes = bytes + sizeOf(v)
+end
+redis.call('DEL', KEYS[1])
+redis.call('SREM', KEYS[2], ARGV[1])
+count(-#values, -bytes)
+touch()
+return #values
+`)
+
+// ARGV[3] 为清理时刻的毫秒时间戳，删除过期时间不晚于它的邮件，邮箱因此变空时一并删除。
+// 重建的列表按剩下的邮件重新设置过期时间，ARGV[4] 同 Append 的 ARGV[5]。
+// 列表已因过期时间被删除时，邮箱中的邮件全部算作过期；早期版本没有 KEYS[6]，按列表补上
+var redisExpireScript = redis.NewScript(redisTouchLua + `
+local expired = dropExpiredList()
+if expired > 0 then
+	redis.call('SREM', KEYS[2], ARGV[1])
+	touch()
+	return expired
+end
+local now = tonumber(ARGV[3])
+local values = redis.call('LRANGE', KEYS[1], 0, -1)
+local kept, removed, bytes, total, latest = {}, 0, 0, 0, 0
+for _, v in ipairs(values) do
+	local expiry = expiryOf(v)
+	total = total + sizeOf(v)
+	if expiry > 0 and expiry <= now then
+		removed = removed + 1
+		bytes = bytes + sizeOf(v)
+	else
+		kept[#kept + 1] = v
+		if latest >= 0 and expiry > 0 then
+			latest = math.max(latest, expiry)
+		else
+			latest = -1
+		end
+	end
+end
+local recorded = redis.call('HMGET', KEYS[6], 'messages', 'bytes')
+if #values > 0 and (tonumber(recorded[1]) ~= #values or tonumber(recorded[2]) ~= total) then
+	redis.call('HSET', KEYS[6], 'messages', #values, 'bytes', total)
+end
+if removed == 0 then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+if #kept == 0 then
+	redis.call('SREM', KEYS[2], ARGV[1])
+else
+	for i = 1, #kept, 1000 do
+		redis.call('RPUSH', KEYS[1], unpack(kept, i, math.min(i + 999, #kept)))
+	end
+	if latest > 0 then
+		redis.call('PEXPIREAT', KEYS[1], latest + tonumber(ARGV[4]))
+	end
+end
+count(-removed, -bytes)
+touch()
+return removed
+`)
+
+// ARGV[3] 为保留的邮件数，删除列表头部更早的邮件
+var redisTrimScript = redis.NewScript(redisTouchLua + `
+local keep = tonumber(ARGV[3])
+local len = redis.call('LLEN', KEYS[1])
+if len <= keep then
+	return 0
+end
+local values = redis.call('LRANGE', KEYS[1], 0, len - keep - 1)
+local bytes = 0
+for _, v in ipairs(values) do
+	bytes = bytes + sizeOf(v)
+end
+redis.call('LTRIM', KEYS[1], len - keep, -1)
+count(-#values, -bytes)
+touch()
+return #values
+`)
+
+// redisClearScript KEYS 为邮箱集合、统计、版本计数和清空时的版本，ARGV[1]、ARGV[2]、ARGV[3] 为邮件列表、
+// 邮箱版本和邮箱统计的键模式，ARGV[4] 为当前毫秒时间戳。这几类键的名字由地址决定，只能在脚本中用 SCAN 找出，因此不支持 Redis Cluster（其他脚本同样要求所有键在同一节点）
+var redisClearScript = redis.NewScript(`
+for _, pattern in ipairs({ARGV[1], ARGV[2], ARGV[3]}) do
+	local cursor = '0'
+	repeat
+		local page = redis.call('SCAN', cursor, 'MATCH', pattern, 'COUNT', 1000)
+		cursor = page[1]
+		for i = 1, #page[2], 1000 do
+			redis.call('DEL', unpack(page[2], i, math.min(i + 999, #page[2])))
+		end
+	until cursor == '0'
+end
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[2], 'messages', 0, 'bytes', 0, 'last_cleanup', ARGV[4])
+local rev = redis.call('INCR', KEYS[3])
+redis.call('HSET', KEYS[4], 'r', rev, 'm', ARGV[4])
+return 1
+`)
+
+// redisCountScript 在 WATCH 事务中改动列表后更新统计和版本，ARGV[3]、ARGV[4] 为邮件数和字节数的变化
+var redisCountScript = redis.NewScript(redisTouchLua + `
+count(tonumber(ARGV[3]), tonumber(ARGV[4]))
+touch()
+return 1
+`)
+
+// redisSequenceScript KEYS[1] 为 UIDVALIDITY，不存在时写入 ARGV[1]；KEYS[2] 为邮件序号
+var redisSequenceScript = redis.NewScript(`
+redis.call('SETNX', KEYS[1], ARGV[1])
+return {redis.call('GET', KEYS[1]), redis.call('GET', KEYS[2]) or '0'}
+`)
+
+// redisGreylistScript 取灰名单记录首次出现的时间，不存在时写入 ARGV[1]，并把过期时间延长到 ARGV[2] 毫秒之后
+var redisGreylistScript = redis.NewScript(`
+local first = redis.call('GET', KEYS[1])
+if not first then
+	first = ARGV[1]
+	redis.call('SET', KEYS[1], first)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return first
+`)
+
+// redisSizeScript 在服务端累加邮箱中各邮件的字节数，不必把邮件传回来
+var redisSizeScript = redis.NewScript(redisTouchLua + `
+local total = 0
+for _, value in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+	total = total + sizeOf(value)
+end
+return total
+`)
+
+// scriptKeys 按脚本约定的顺序返回邮箱相关的键
+func (s *redisStore) scriptKeys(mailbox string) []string {
+	return []string{s.key("mbox", mailbox), s.key("mailboxes"), s.key("stats"), s.key("revcounter"), s.key("rev", mailbox),
+		s.key("mstats", mailbox)}
+}
+
+func (s *redisStore) Append(m mailContent) error {
+	m.seq = 0
+	value, err := encodeStoredMail(m)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.ctx()
+	defer cancel()
+	minute := m.ReceivedAt.Unix() / 60
+	keys := append(s.scriptKeys(m.To), s.key("received", strconv.FormatInt(minute, 10)), s.key("seq"))
+	return redisAppendScript.Run(ctx, s.client, keys, m.To, time.Now().UnixMilli(), value, int64(statsBuckets*60+3600), redisExpiryGrace.Milliseconds()).Err()
+}
+
+func (s *redisStore) Create(mailbox string) (bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	n, err := redisCreateScript.Run(ctx, s.client, s.scriptKeys(mailbox), mailbox, time.Now().UnixMilli()).Int()
+	return n == 1, err
+}
+
+func (s *redisStore) Exists(mailbox string) (bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	return s.client.SIsMember(ctx, s.key("mailboxes"), mailbox).Result()
+}
+
+func (s *redisStore) Count(mailbox string) (int, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	n, err := s.client.LLen(ctx, s.key("mbox", mailbox)).Result()
+	return int(n), err
+}
+
+func (s *redisStore) Size(mailbox string) (int64, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	return redisSizeScript.Run(ctx, s.client, []string{s.key("mbox", mailbox)}).Int64()
+}
+
+func (s *redisStore) PopLatest(mailbox string) (mailContent, bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	value, err := redisPopScript.Run(ctx, s.client, s.scriptKeys(mailbox), mailbox, time.Now().UnixMilli()).Text()
+	if err == redis.Nil {
+		return mailContent{}, false, nil
+	}
+	if err != nil {
+		return mailContent{}, false, err
+	}
+	m, err := decodeStoredMail(value)
+	return m, err == nil, err
+}
+
+// Remove 在 WATCH 事务中按值删除匹配的邮件，期间邮箱有变化时重试
+func (s *redisStore) Remove(mailbox string, ids []string) (int, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	listKey := s.key("mbox", mailbox)
+	removed := 0
+	update := func(tx *redis.Tx) error {
+		values, err := tx.LRange(ctx, listKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		var dropped []string
+		var size int64
+		for _, value := range values {
+			m, err := decodeStoredMail(value)
+			if err != nil {
+				return err
+			}
+			if remove[m.ID] {
+				dropped = append(dropped, value)
+				size += storedMailSize([]byte(value))
+			}
+		}
+		removed = len(dropped)
+		if removed == 0 {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			for _, value := range dropped {
+				p.LRem(ctx, listKey, 1, value)
+			}
+			redisCountScript.Eval(ctx, p, s.scriptKeys(mailbox), mailbox, time.Now().UnixMilli(), -removed, -size)
+			return nil
+		})
+		return err
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		err := s.client.Watch(ctx, update, listKey)
+		if err != redis.TxFailedErr {
+			return removed, err
+		}
+	}
+	return 0, errors.New("邮箱频繁变化，删除邮件失败")
+}
+
+func (s *redisStore) Latest(mailbox string) (mailContent, bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	value, err := s.client.LIndex(ctx, s.key("mbox", mailbox), -1).Result()
+	if err == redis.Nil {
+		return mailContent{}, false, nil
+	}
+	if err != nil {
+		return mailContent{}, false, err
+	}
+	m, err := decodeStoredMail(value)
+	return m, err == nil, err
+}
+
+func (s *redisStore) List(mailbox string) ([]mailContent, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	values, err := s.client.LRange(ctx, s.key("mbox", mailbox), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	newestFirst := make([]mailContent, 0, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		m, err := decodeStoredMail(values[i])
+		if err != nil {
+			return nil, err
+		}
+		newestFirst = append(newestFirst, m)
+	}
+	return newestFirst, nil
+}
+
+func (s *redisStore) Get(mailbox, id string) (mailContent, bool, error) {
+	mails, err := s.List(mailbox)
+	if err != nil {
+		return mailContent{}, false, err
+	}
+	for _, m := range mails {
+		if m.ID == id {
+			return m, true, nil
+		}
+	}
+	return mailContent{}, false, nil
+}
+
+// SetRead 在 WATCH 事务中改写匹配的邮件，期间邮箱有变化（投递、取件）时重试
+func (s *redisStore) SetRead(mailbox, id string, read bool) (int, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	listKey := s.key("mbox", mailbox)
+	matched := 0
+	update := func(tx *redis.Tx) error {
+		values, err := tx.LRange(ctx, listKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		matched = 0
+		changed := make(map[int64]string)
+		var delta int64
+		for i, value := range values {
+			m, err := decodeStoredMail(value)
+			if err != nil {
+				return err
+			}
+			if id != "" && m.ID != id {
+				continue
+			}
+			matched++
+			if m.Read == read {
+				continue
+			}
+			m.Read = read
+			encoded, err := encodeStoredMail(m)
+			if err != nil {
+				return err
+			}
+			changed[int64(i)] = encoded
+			delta += mailSize(m) - storedMailSize([]byte(value))
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			for i, value := range changed {
+				p.LSet(ctx, listKey, i, value)
+			}
+			redisCountScript.Eval(ctx, p, s.scriptKeys(mailbox), mailbox, time.Now().UnixMilli(), 0, delta)
+			return nil
+		})
+		return err
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		err := s.client.Watch(ctx, update, listKey)
+		if err != redis.TxFailedErr {
+			return matched, err
+		}
+	}
+	return 0, errors.New("邮箱频繁变化，设置已读状态失败")
+}
+
+func (s *redisStore) Delete(mailbox string) (int, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	return redisDeleteScript.Run(ctx, s.client, s.scriptKeys(mailbox), mailbox, time.Now().UnixMilli()).Int()
+}
+
+// Clear 删除所有邮箱和版本记录；版本计数、邮件序号和灰名单保留，保证版本号不会回退、UID 不会重复。
+// 在一个脚本中完成，清空过程中投递的邮件要么在清空之前、要么在之后，统计与邮件始终一致；
+// 脚本执行期间 Redis 不处理其他命令，邮箱很多时会有短暂停顿
+func (s *redisStore) Clear() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisOpTimeout)
+	defer cancel()
+	keys := []string{s.key("mailboxes"), s.key("stats"), s.key("revcounter"), s.key("revcleared")}
+	return redisClearScript.Run(ctx, s.client, keys, s.key("mbox", "*"), s.key("rev", "*"), s.key("mstats", "*"), time.Now().UnixMilli()).Err()
+}
+
+func (s *redisStore) Expire(now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisOpTimeout)
+	defer cancel()
+
+	removed := 0
+	iter := s.client.SScan(ctx, s.key("mailboxes"), 0, "", 500).Iterator()
+	for iter.Next(ctx) {
+		mailbox := iter.Val()
+		n, err := redisExpireScript.Run(ctx, s.client, s.scriptKeys(mailbox), mailbox, time.Now().UnixMilli(), now.UnixMilli(), redisExpiryGrace.Milliseconds()).Int()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+	return removed, iter.Err()
+}
+
+func (s *redisStore) Trim(keep int) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisOpTimeout)
+	defer cancel()
+
+	removed, trimmed := 0, 0
+	iter := s.client.SScan(ctx, s.key("mailboxes"), 0, "", 500).Iterator()
+	for iter.Next(ctx) {
+		mailbox := iter.Val()
+		n, err := redisTrimScript.Run(ctx, s.client, s.scriptKeys(mailbox), mailbox, time.Now().UnixMilli(), keep).Int()
+		if err != nil {
+			return removed, trimmed, err
+		}
+		if n > 0 {
+			removed += n
+			trimmed++
+		}
+	}
+	return removed, trimmed, iter.Err()
+}
+
+func (s *redisStore) Revision(mailbox string) (mailboxRevision, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	for _, key := range []string{s.key("rev", mailbox), s.key("revcleared")} {
+		values, err := s.client.HMGet(ctx, key, "r", "m").Result()
+		if err != nil {
+			return mailboxRevision{}, err
+		}
+		if values[0] == nil {
+			continue
+		}
+		rev, _ := strconv.ParseUint(fmt.Sprint(values[0]), 10, 64)
+		ms, _ := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+		return mailboxRevision{revision: rev, modified: time.UnixMilli(ms)}, nil
+	}
+	return mailboxRevision{modified: s.started}, nil
+}
+
+func (s *redisStore) Mailboxes(prefix string) ([]mailboxSummary, error) {
+	prefix = strings.ToLower(prefix)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*redisOpTimeout)
+	defer cancel()
+
+	var summaries []mailboxSummary
+	iter := s.client.SScan(ctx, s.key("mailboxes"), 0, "", 500).Iterator()
+	for iter.Next(ctx) {
+		address := iter.Val()
+		if !strings.HasPrefix(strings.ToLower(address), prefix) {
+			continue
+		}
+		values, err := s.client.LRange(ctx, s.key("mbox", address), 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			continue
+		}
+		first, err := decodeStoredMail(values[0])
+		if err != nil {
+			return nil, err
+		}
+		last, err := decodeStoredMail(values[len(values)-1])
+		if err != nil {
+			return nil, err
+		}
+		sum := mailboxSummary{
+			Address:       address,
+			Messages:      len(values),
+			FirstDelivery: first.ReceivedAt,
+			LastDelivery:  last.ReceivedAt,
+		}
+		for _, v := range values {
+			sum.Bytes += storedMailSize([]byte(v))
+		}
+		summaries = append(summaries, sum)
+	}
+	return summaries, iter.Err()
+}
+
+func (s *redisStore) Stats(now time.Time) (storeStats, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+
+	var st storeStats
+	mailboxes, err := s.client.SCard(ctx, s.key("mailboxes")).Result()
+	if err != nil {
+		return st, err
+	}
+	st.Mailboxes = int(mailboxes)
+
+	values, err := s.client.HMGet(ctx, s.key("stats"), "messages", "bytes", "last_cleanup").Result()
+	if err != nil {
+		return st, err
+	}
+	st.Messages, _ = strconv.Atoi(fmt.Sprint(values[0]))
+	st.Bytes, _ = strconv.ParseInt(fmt.Sprint(values[1]), 10, 64)
+	if ms, _ := strconv.ParseInt(fmt.Sprint(values[2]), 10, 64); ms > 0 {
+		st.LastCleanup = time.UnixMilli(ms)
+	}
+
+	current := now.Unix() / 60
+	keys := make([]string, statsBuckets)
+	for i := range keys {
+		keys[i] = s.key("received", strconv.FormatInt(current-int64(i), 10))
+	}
+	counts, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return st, err
+	}
+	for i, c := range counts {
+		if c == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(fmt.Sprint(c))
+		if i < 60 {
+			st.ReceivedLastHour += n
+		}
+		st.ReceivedLastDay += n
+	}
+	return st, nil
+}
+
+func (s *redisStore) Sequence() (mailSequence, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	values, err := redisSequenceScript.Run(ctx, s.client, []string{s.key("uidvalidity"), s.key("seq")}, time.Now().Unix()).StringSlice()
+	if err != nil {
+		return mailSequence{}, err
+	}
+	validity, _ := strconv.ParseUint(values[0], 10, 32)
+	seq, _ := strconv.ParseUint(values[1], 10, 64)
+	return mailSequence{validity: uint32(validity), next: seq + 1}, nil
+}
+
+func (s *redisStore) greylistSeen(key string, now time.Time, expiry time.Duration) (time.Time, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	ms, err := redisGreylistScript.Run(ctx, s.client, []string{s.key("greylist", key)}, now.UnixMilli(), expiry.Milliseconds()).Int64()
+	return time.UnixMilli(ms), err
+}
+
+// pruneGreylist 记录靠过期时间自动删除
+func (s *redisStore) pruneGreylist(before time.Time) error {
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// startTestRedis 启动 miniredis 并把它作为 mailStore，env 同 setupTest。返回服务端（用于调整时间）和连到它的存储
+func startTestRedis(t *testing.T, env map[string]string) (*miniredis.Miniredis, *redisStore) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	t.Setenv("STORE_BACKEND", "redis")
+	t.Setenv("REDIS_ADDR", mr.Addr())
+	setupTest(t, env)
+	rs := newRedisStore()
+	t.Cleanup(func() { rs.client.Close() })
+	mailStore = rs
+	return mr, rs
+}
+
+// TestRedisMailboxExpiry 邮件列表的过期时间跟随最晚过期的邮件，有不过期的邮件时不过期
+func TestRedisMailboxExpiry(t *testing.T) {
+	mr, rs := startTestRedis(t, nil)
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	expectTTL := func(box string, want time.Duration) {
+		t.Helper()
+		got := mr.TTL(rs.key("mbox", box))
+		if got < want-time.Minute || got > want+time.Minute {
+			t.Errorf("%s 的过期时间为 %v，应约为 %v", box, got, want)
+		}
+	}
+	add := func(box, id string, expires *time.Time) {
+		t.Helper()
+		m := testMail(box, id, 0)
+		m.ExpiresAt = expires
+		if err := rs.Append(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("a@test.local", "a1", at(time.Hour))
+	expectTTL("a@test.local", time.Hour+redisExpiryGrace)
+	// 更早过期的邮件不缩短，更晚的延长
+	add("a@test.local", "a2", at(30*time.Minute))
+	expectTTL("a@test.local", time.Hour+redisExpiryGrace)
+	add("a@test.local", "a3", at(5*time.Hour))
+	expectTTL("a@test.local", 5*time.Hour+redisExpiryGrace)
+	// 有不过期的邮件时整个列表不过期，之后的邮件也不再设置
+	add("a@test.local", "a4", nil)
+	expectTTL("a@test.local", 0)
+	add("a@test.local", "a5", at(time.Hour))
+	expectTTL("a@test.local", 0)
+
+	// 清理重建列表后按剩下的邮件重新设置
+	add("b@test.local", "b1", at(10*time.Minute))
+	add("b@test.local", "b2", at(3*time.Hour))
+	if n, err := rs.Expire(now.Add(20 * time.Minute)); n != 1 || err != nil {
+		t.Fatalf("Expire = %d, %v", n, err)
+	}
+	expectTTL("b@test.local", 3*time.Hour+redisExpiryGrace)
+
+	// 没有实例运行清理时键自行过期
+	mr.FastForward(3*time.Hour + redisExpiryGrace + time.Minute)
+	if mr.Exists(rs.key("mbox", "b@test.local")) {
+		t.Error("超过过期时间后邮件列表应被删除")
+	}
+}
+
+// TestRedisExpiredListCleanup 邮件列表因过期时间被删除后，下一次清理或投递把邮箱集合和统计中的记录一并扣除，
+// 空邮箱和不过期的邮箱不受影响；没有 mstats 的早期数据由清理补上
+func TestRedisExpiredListCleanup(t *testing.T) {
+	mr, rs := startTestRedis(t, nil)
+	expires := time.Now().Add(time.Hour)
+	expiring := func(box, id string) mailContent {
+		m := testMail(box, id, 0)
+		m.ExpiresAt = &expires
+		return m
+	}
+	a1, a2, b1 := expiring("a@test.local", "a1"), expiring("a@test.local", "a2"), expiring("b@test.local", "b1")
+	d1 := testMail("d@test.local", "d1", 0)
+	appendAll(t, rs, a1, a2, b1, d1)
+	rs.Create("c@test.local")
+	rs.SetRead("b@test.local", "b1", true)
+	b1.Read = true
+
+	mr.FastForward(time.Hour + redisExpiryGrace + time.Minute)
+	if mr.Exists(rs.key("mbox", "a@test.local")) || mr.Exists(rs.key("mbox", "b@test.local")) {
+		t.Fatal("超过过期时间后邮件列表应被删除")
+	}
+	// 投递到列表已过期的邮箱时先扣除过期的邮件
+	b2 := testMail("b@test.local", "b2", 1)
+	appendAll(t, rs, b2)
+	if st, _ := rs.Stats(time.Now()); st.Messages != 4 || st.Bytes != mailSizes(a1, a2, d1, b2) {
+		t.Errorf("投递后统计 %d 封 %d 字节，应为 4 封 %d 字节", st.Messages, st.Bytes, mailSizes(a1, a2, d1, b2))
+	}
+
+	// 清理扣除 a 的邮件并移出邮箱集合
+	if n, err := rs.Expire(time.Now()); n != 2 || err != nil {
+		t.Errorf("Expire = %d, %v，应扣除 2 封", n, err)
+	}
+	st, _ := rs.Stats(time.Now())
+	if st.Messages != 2 || st.Bytes != mailSizes(d1, b2) || st.Mailboxes != 3 {
+		t.Errorf("清理后统计 %d 封 %d 字节 %d 个邮箱，应为 2 封 %d 字节 3 个邮箱", st.Messages, st.Bytes, st.Mailboxes, mailSizes(d1, b2))
+	}
+	for box, want := range map[string]bool{"a@test.local": false, "b@test.local": true, "c@test.local": true, "d@test.local": true} {
+		if ok, _ := rs.Exists(box); ok != want {
+			t.Errorf("Exists(%s) = %v，应为 %v", box, ok, want)
+		}
+	}
+	if mr.Exists(rs.key("mstats", "a@test.local")) {
+		t.Error("邮箱的统计应随过期的列表删除")
+	}
+
+	// 早期版本没有 mstats，清理时按列表补上
+	mr.Del(rs.key("mstats", "d@test.local"))
+	rs.Expire(time.Now())
+	if got := mr.HGet(rs.key("mstats", "d@test.local"), "messages"); got != "1" {
+		t.Errorf("补上的邮件数为 %q", got)
+	}
+	if got := mr.HGet(rs.key("mstats", "d@test.local"), "bytes"); got != fmt.Sprint(mailSize(d1)) {
+		t.Errorf("补上的字节数为 %q，应为 %d", got, mailSize(d1))
+	}
+}
+
+// TestRedisClearAtomic 清空与投递并发进行，统计始终与列表中实际的邮件一致；版本计数、邮件序号不重置
+func TestRedisClearAtomic(t *testing.T) {
+	mr, rs := startTestRedis(t, nil)
+	before, _ := rs.Sequence()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := rs.Append(testMail(fmt.Sprintf("u%d@test.local", i%5), fmt.Sprintf("%d-%d", w, i), i)); err != nil {
+					t.Errorf("Append: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	for i := 0; i < 10; i++ {
+		if err := rs.Clear(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	st, _ := rs.Stats(time.Now())
+	sums, _ := rs.Mailboxes("")
+	messages, bytes := 0, int64(0)
+	for _, sum := range sums {
+		messages += sum.Messages
+		bytes += sum.Bytes
+	}
+	if st.Messages != messages || st.Bytes != bytes {
+		t.Errorf("统计为 %d 封 %d 字节，列表中实际 %d 封 %d 字节", st.Messages, st.Bytes, messages, bytes)
+	}
+
+	if err := rs.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range mr.Keys() {
+		if strings.HasPrefix(key, rs.key("mbox")) || strings.HasPrefix(key, rs.key("rev", "")) {
+			t.Errorf("清空后仍有 %s", key)
+		}
+	}
+	after, _ := rs.Sequence()
+	if after.validity != before.validity || after.next != before.next+200 {
+		t.Errorf("清空后 Sequence = %+v，清空前 %+v", after, before)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+)
+
+// 重新加载配置：收到 SIGHUP 时重新读取 .env 和环境变量，只替换运行中可以安全修改的部分，
+// 如允许的域名、收件规则、保留策略、限流、DNSBL、灰名单和垃圾邮件评分。端口、存储、TLS 等
+// 需要重启的配置保持原值，并在日志中列出。配置整体通过原子指针替换，读取方不会看到改了一半的配置。
+// 也可以调用 POST /api/v1/admin/reload，结果和错误直接在响应中返回
+
+var currentConfig atomic.Pointer[Config]
+
+// config 当前生效的配置，重新加载时整体替换，调用方不能修改返回的内容
+func config() *Config {
+	return currentConfig.Load()
+}
+
+func setConfig(cfg Config) {
+	currentConfig.Store(&cfg)
+}
+
+// reloadableFields 运行中可以修改的 Config 字段，读取方都在处理每封邮件或每个请求时读取 config()
+var reloadableFields = map[string]bool{
+	"AllowedDomains":        true,
+	"AllowedDomainsDisplay": true,
+	"CatchAll":              true,
+	"RecipientAllowlist":    true,
+	"RelayReject":           true,
+	"RecipientReject":       true,
+	"MailTTL":               true,
+	"MaxMailboxMessages":    true,
+	"MaxMailboxBytes":       true,
+	"DomainPolicies":        true,
+	"CleanupKeepLast":       true,
+	"RateLimitRPM":          true,
+	"RateLimitBurst":        true,
+	"CreateRateLimitRPM":    true,
+	"CreateRateLimitBurst":  true,
+	"DNSBLZones":            true,
+	"DNSBLReject":           true,
+	"Greylist":              true,
+	"GreylistDelay":         true,
+	"GreylistExpiry":        true,
+	"SpamCheckURL":          true,
+	"SpamCheckCommand":      true,
+	"SpamCheckTimeout":      true,
+	"SpamRejectThreshold":   true,
+	"ImageMode":             true,
+	"MaxRcptPerMessage":     true,
+	"LogLevel":              true,
+	"Locale":                true,
+}
+
+var (
+	// reloadMu 保证同一时间只有一次重新加载，configErrors 只在持有时使用
+	reloadMu sync.Mutex
+	// dotenvKeys 来自 .env 文件的键。进程环境变量优先于 .env，已由环境变量设置的键重新加载时不覆盖
+	dotenvKeys = map[string]bool{}
+)
+
+// watchReloadSignal 记录哪些配置来自 .env，收到 SIGHUP 时重新加载
+func watchReloadSignal() {
+	if file, err := godotenv.Read(); err == nil {
+		for k, v := range file {
+			if os.Getenv(k) == v {
+				dotenvKeys[k] = true
+			}
+		}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			configLogger.Info("收到 SIGHUP，重新加载配置")
+			reloadConfig()
+		}
+	}()
+}
+
+// reloadDotenv 重新读取 .env，更新来自文件的键，文件中删除的键也从环境中删除
+func reloadDotenv() error {
+	file, err := godotenv.Read()
+	if err != nil {
+		if os.IsNotExist(err) {
+			file = map[string]string{}
+		} else {
+			return err
+		}
+	}
+	for k := range dotenvKeys {
+		if _, ok := file[k]; !ok {
+			os.Unsetenv(k)
+			delete(dotenvKeys, k)
+		}
+	}
+	for k, v := range file {
+		if _, set := os.LookupEnv(k); set && !dotenvKeys[k] {
+			continue
+		}
+		os.Setenv(k, v)
+		dotenvKeys[k] = true
+	}
+	return nil
+}
+
+// reloadConfig 重新读取配置并替换可以运行中修改的部分，返回已更新和因需要重启而忽略的字段。
+// 新配置有错误时不做任何修改
+func reloadConfig() (changed, ignored []string, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := reloadDotenv(); err != nil {
+		configLogger.Error("读取 .env 失败，继续使用原配置", "error", err)
+		return nil, nil, err
+	}
+	configErrors = nil
+	next := parseConfig()
+	if n := len(configErrors); n > 0 {
+		for _, msg := range configErrors {
+			configLogger.Error("配置错误", "problem", msg)
+		}
+		err := fmt.Errorf("配置有 %d 处错误: %s", n, strings.Join(configErrors, "；"))
+		configErrors = nil
+		configLogger.Error("配置有错误，继续使用原配置", "problems", n)
+		return nil, nil, err
+	}
+
+	changed, ignored = mergeReloadable(config(), &next)
+	setConfig(next)
+	rateLimiter.setLimits(next.RateLimitRPM, next.RateLimitBurst)
+	createRateLimiter.setLimits(next.CreateRateLimitRPM, next.CreateRateLimitBurst)
+	logLevel.Set(next.LogLevel)
+	startExpirySweeper()
+
+	for _, c := range changed {
+		configLogger.Info("配置已更新", "change", c)
+	}
+	if len(ignored) > 0 {
+		configLogger.Warn("以下配置需要重启才能生效，已忽略", "fields", strings.Join(ignored, ","))
+	}
+	configLogger.Info("配置已重新加载", "changed", len(changed), "restart_required", len(ignored))
+	return changed, ignored, nil
+}
+
+// mergeReloadable 逐个字段比较新旧配置：可以运行中修改的字段保留新值，记为 "字段: 旧值 -> 新值"；
+// 其余有变化的字段恢复为旧值，只记录字段名，避免把密码等写进日志
+func mergeReloadable(old, next *Config) (changed, ignored []string) {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := ov.Type().Field(i).Name
+		o, n := ov.Field(i), nv.Field(i)
+		if reflect.DeepEqual(o.Interface(), n.Interface()) {
+			continue
+		}
+		if reloadableFields[name] {
+			changed = append(changed, fmt.Sprintf("%s: %v -> %v", name, o.Interface(), n.Interface()))
+			continue
+		}
+		n.Set(o)
+		ignored = append(ignored, name)
+	}
+	return changed, ignored
+}
+
+// handleAdminReload 与 SIGHUP 相同地重新加载配置。新配置有错误时返回 400 并列出错误，运行中的配置不变
+func handleAdminReload(c *gin.Context) {
+	changed, ignored, err := reloadConfig()
+	if err != nil {
+		c.JSON(400, gin.H{"error": msg("reload_failed", err)})
+		return
+	}
+	resp := reloadResponse{Changed: []string{}, RestartRequired: []string{}}
+	resp.Changed = append(resp.Changed, changed...)
+	resp.RestartRequired = append(resp.RestartRequired, ignored...)
+	c.JSON(200, resp)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// setupReload 在临时目录中运行，避免读到仓库中的 .env，结束后恢复记录的 .env 键
+func setupReload(t *testing.T, env map[string]string) {
+	t.Helper()
+	setupTest(t, env)
+	t.Chdir(t.TempDir())
+	old := dotenvKeys
+	dotenvKeys = map[string]bool{}
+	t.Cleanup(func() { dotenvKeys = old })
+}
+
+// allowedDomains 通过旧版接口读取当前允许的域名
+func allowedDomains(t *testing.T) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/getAllowedDomains", nil))
+	var resp allowedDomainsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 {
+		t.Fatalf("GET /getAllowedDomains: %d %v", w.Code, err)
+	}
+	return resp.AllowedDomains
+}
+
+func TestReloadConfig(t *testing.T) {
+	setupReload(t, map[string]string{"ADMIN_API_KEYS": "old-secret", "RATE_LIMIT_RPM": "60"})
+	if got := allowedDomains(t); !reflect.DeepEqual(got, []string{"test.local"}) {
+		t.Fatalf("重新加载前的域名 %q", got)
+	}
+
+	t.Setenv("ALLOWED_DOMAINS", "test.local,new.test")
+	t.Setenv("MAIL_TTL", "2h")
+	t.Setenv("RATE_LIMIT_RPM", "5")
+	t.Setenv("SMTP_PORT", "2525")
+	t.Setenv("STORE_BACKEND", "bolt")
+	t.Setenv("ADMIN_API_KEYS", "new-secret")
+	changed, ignored, err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := allowedDomains(t); !reflect.DeepEqual(got, []string{"test.local", "new.test"}) {
+		t.Errorf("重新加载后的域名 %q", got)
+	}
+	if config().MailTTL != 2*time.Hour || config().RateLimitRPM != 5 {
+		t.Errorf("MailTTL = %v，RateLimitRPM = %d", config().MailTTL, config().RateLimitRPM)
+	}
+	if rateLimiter.burst != 5 {
+		t.Errorf("限流器没有按新配置调整: burst = %v", rateLimiter.burst)
+	}
+	// 需要重启的配置保持原值
+	if config().SMTPPort != "25" || config().StoreBackend != "memory" || !reflect.DeepEqual(config().AdminAPIKeys, []string{"old-secret"}) {
+		t.Errorf("需要重启的配置被修改: %s %s %v", config().SMTPPort, config().StoreBackend, config().AdminAPIKeys)
+	}
+
+	for _, field := range []string{"AllowedDomains", "MailTTL", "RateLimitRPM"} {
+		if !slices.ContainsFunc(changed, func(c string) bool { return strings.HasPrefix(c, field+": ") }) {
+			t.Errorf("changed 中没有 %s: %q", field, changed)
+		}
+	}
+	if !slices.Contains(changed, "MailTTL: 24h0m0s -> 2h0m0s") {
+		t.Errorf("changed 应列出旧值和新值: %q", changed)
+	}
+	slices.Sort(ignored)
+	if want := []string{"AdminAPIKeys", "SMTPPort", "StoreBackend"}; !reflect.DeepEqual(ignored, want) {
+		t.Errorf("ignored = %q，应为 %q", ignored, want)
+	}
+	// 忽略的字段只记录名字，不会把密钥写进日志
+	if strings.Contains(strings.Join(append(changed, ignored...), " "), "secret") {
+		t.Errorf("结果中带有密钥: %q %q", changed, ignored)
+	}
+}
+
+// TestReloadConfigInvalid 新配置有错误时返回错误，运行中的配置不变
+func TestReloadConfigInvalid(t *testing.T) {
+	setupReload(t, nil)
+	before := config()
+	t.Setenv("ALLOWED_DOMAINS", "new.test")
+	t.Setenv("MAIL_TTL", "soon")
+	if _, _, err := reloadConfig(); err == nil || !strings.Contains(err.Error(), "MAIL_TTL") {
+		t.Errorf("错误的配置应报错: %v", err)
+	}
+	if config() != before || !reflect.DeepEqual(allowedDomains(t), []string{"test.local"}) {
+		t.Error("配置有错误时不应替换")
+	}
+	if len(configErrors) != 0 {
+		t.Errorf("configErrors 没有清空: %q", configErrors)
+	}
+}
+
+// TestReloadSIGHUP 向进程发送 SIGHUP 后从 .env 读到新的域名
+func TestReloadSIGHUP(t *testing.T) {
+	setupReload(t, nil)
+	os.Unsetenv("ALLOWED_DOMAINS")
+	t.Cleanup(func() { os.Unsetenv("ALLOWED_DOMAINS") })
+	os.WriteFile(".env", []byte("ALLOWED_DOMAINS=test.local\n"), 0o600)
+	os.Setenv("ALLOWED_DOMAINS", "test.local")
+	watchReloadSignal()
+
+	os.WriteFile(".env", []byte("ALLOWED_DOMAINS=test.local,signal.test\n"), 0o600)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Contains(config().AllowedDomains, "signal.test") {
+		if time.Now().After(deadline) {
+			t.Fatalf("SIGHUP 后域名仍为 %q", config().AllowedDomains)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 等信号处理中的 reloadConfig 返回，它还会调整限流器
+	reloadMu.Lock()
+	reloadMu.Unlock()
+	if got := allowedDomains(t); !reflect.DeepEqual(got, []string{"test.local", "signal.test"}) {
+		t.Errorf("SIGHUP 后接口返回 %q", got)
+	}
+}
+
+// TestReloadDotenv 进程环境变量优先于 .env，文件中删除的键从环境中删除
+func TestReloadDotenv(t *testing.T) {
+	setupReload(t, map[string]string{"RATE_LIMIT_RPM": "30"})
+	for _, k := range []string{"MAIL_TTL", "DNSBL_ZONES"} {
+		os.Unsetenv(k)
+		t.Cleanup(func() { os.Unsetenv(k) })
+	}
+	os.WriteFile(filepath.Join(".", ".env"), []byte("MAIL_TTL=3h\nDNSBL_ZONES=zen.example.org\nRATE_LIMIT_RPM=1\n"), 0o600)
+	if err := reloadDotenv(); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("MAIL_TTL") != "3h" || os.Getenv("DNSBL_ZONES") != "zen.example.org" {
+		t.Errorf("没有读入 .env: MAIL_TTL=%q DNSBL_ZONES=%q", os.Getenv("MAIL_TTL"), os.Getenv("DNSBL_ZONES"))
+	}
+	if os.Getenv("RATE_LIMIT_RPM") != "30" {
+		t.Errorf("环境变量被 .env 覆盖: %q", os.Getenv("RATE_LIMIT_RPM"))
+	}
+
+	os.WriteFile(".env", []byte("MAIL_TTL=4h\n"), 0o600)
+	if err := reloadDotenv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, set := os.LookupEnv("DNSBL_ZONES"); set || os.Getenv("MAIL_TTL") != "4h" {
+		t.Errorf("DNSBL_ZONES 应删除，MAIL_TTL = %q", os.Getenv("MAIL_TTL"))
+	}
+	// 删除 .env 后来自文件的键全部删除
+	os.Remove(".env")
+	if err := reloadDotenv(); err != nil {
+		t.Fatal(err)
+	}
+	if _, set := os.LookupEnv("MAIL_TTL"); set || os.Getenv("RATE_LIMIT_RPM") != "30" {
+		t.Errorf("删除 .env 后 MAIL_TTL 仍存在或 RATE_LIMIT_RPM = %q", os.Getenv("RATE_LIMIT_RPM"))
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	setupReload(t, map[string]string{"ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+	reload := func() (int, string) {
+		req := httptest.NewRequest("POST", "/api/v1/admin/reload", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	t.Setenv("ALLOWED_DOMAINS", "test.local,admin.test")
+	t.Setenv("HTTP_PORT", "8081")
+	code, body := reload()
+	var resp struct {
+		Data reloadResponse `json:"data"`
+	}
+	json.Unmarshal([]byte(body), &resp)
+	if code != 200 || !reflect.DeepEqual(resp.Data.RestartRequired, []string{"HTTPPort"}) || len(resp.Data.Changed) == 0 {
+		t.Errorf("重新加载返回 %d %s", code, body)
+	}
+
+	// 改回运行中的端口后没有改动，两个列表都为空数组而不是 null
+	t.Setenv("HTTP_PORT", config().HTTPPort)
+	if code, body := reload(); code != 200 || !strings.Contains(body, `"changed":[]`) || !strings.Contains(body, `"restartRequired":[]`) {
+		t.Errorf("没有改动时返回 %d %s", code, body)
+	}
+
+	t.Setenv("MAIL_TTL", "soon")
+	if code, body := reload(); code != 400 || !strings.Contains(body, "MAIL_TTL") {
+		t.Errorf("配置有错误时返回 %d %s", code, body)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mailSummary listMail 返回的邮件摘要
+type mailSummary struct {
+	ID         string     `json:"id"`
+	TraceID    string     `json:"trace_id"`
+	From       string     `json:"from"`
+	Subject    string     `json:"subject"`
+	ReceivedAt time.Time  `json:"received_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Read       bool       `json:"read"`
+	// 外部垃圾邮件评分，未评分时为 null
+	Spam *spamVerdict `json:"spam"`
+
+	Attachments []attachment `json:"attachments"`
+}
+
+// mailView 响应中的邮件。按 STORE_PARTS 没有保存的正文直接省略，不返回看起来像丢了内容的空字符串
+type mailView struct {
+	mailContent
+	Text *string `json:"text,omitempty"`
+	HTML *string `json:"html,omitempty"`
+	// 收件域名为国际化域名时 to 的 Unicode 展示形式
+	ToDisplay string `json:"to_display,omitempty"`
+}
+
+func newMailView(m mailContent) mailView {
+	v := mailView{mailContent: m}
+	if display := displayAddress(m.To); display != m.To {
+		v.ToDisplay = display
+	}
+	if m.Text != "" || config().StoreParts != storePartsHTML {
+		v.Text = &m.Text
+	}
+	if m.HTML != "" || config().StoreParts != storePartsText {
+		v.HTML = &m.HTML
+	}
+	return v
+}
+
+// legacyMail 兼容旧版 getMail 的字段名，LEGACY_JSON=true 时使用
+type legacyMail struct {
+	ID          string         `json:"id"`
+	TraceID     string         `json:"traceId"`
+	From        string         `json:"from"`
+	Title       string         `json:"title"`
+	TextContent string         `json:"TextContent"`
+	HtmlContent string         `json:"HtmlContent"`
+	ClientIP    string         `json:"clientIP"`
+	Helo        string         `json:"helo"`
+	DNS         dnsCheckResult `json:"dns"`
+	DNSBL       []string       `json:"dnsbl"`
+}
+
+// legacySummary 兼容旧版 listMail 的字段名
+type legacySummary struct {
+	ID         string    `json:"id"`
+	TraceID    string    `json:"traceId"`
+	From       string    `json:"from"`
+	Title      string    `json:"title"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// legacyJSON 是否使用旧字段名，/api/v1 下始终使用新字段名
+func legacyJSON(c *gin.Context) bool {
+	return config().LegacyJSON && !isAPIv1(c)
+}
+
+// mailResponse 按配置生成 getMail 的响应
+func mailResponse(c *gin.Context, m mailContent) interface{} {
+	if !legacyJSON(c) {
+		return getMailResponse{Mail: newMailView(m)}
+	}
+	return gin.H{"mail": legacyMail{
+		ID:          m.ID,
+		TraceID:     m.TraceID,
+		From:        m.From,
+		Title:       m.Subject,
+		TextContent: m.Text,
+		HtmlContent: m.HTML,
+		ClientIP:    m.ClientIP,
+		Helo:        m.Helo,
+		DNS:         m.DNS,
+		DNSBL:       m.DNSBL,
+	}}
+}
+
+// listResponse 按配置生成 listMail 的响应，mails 需按最新在前排好
+func listResponse(c *gin.Context, mails []mailContent) interface{} {
+	if legacyJSON(c) {
+		list := make([]legacySummary, 0, len(mails))
+		for _, m := range mails {
+			list = append(list, legacySummary{ID: m.ID, TraceID: m.TraceID, From: m.From, Title: m.Subject, ReceivedAt: m.ReceivedAt})
+		}
+		return gin.H{"mails": list}
+	}
+	list := make([]mailSummary, 0, len(mails))
+	for _, m := range mails {
+		list = append(list, mailSummary{ID: m.ID, TraceID: m.TraceID, From: m.From, Subject: m.Subject, ReceivedAt: m.ReceivedAt, ExpiresAt: m.ExpiresAt, Read: m.Read, Spam: m.Spam, Attachments: m.Attachments})
+	}
+	return listMailResponse{Mails: list}
+}
+
+// 以下为各接口的响应结构，OpenAPI 文档也由这些结构生成
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type allowedDomainsResponse struct {
+	// punycode 形式，生成地址和调用接口时使用
+	AllowedDomains []string `json:"allowedDomains"`
+	// 与 allowedDomains 一一对应的 Unicode 展示形式
+	DisplayDomains []string `json:"displayDomains"`
+	// 请求带 limits=true 时返回各域名生效的保留时长和大小上限
+	Limits []infoDomain `json:"limits,omitempty"`
+}
+
+type getMailResponse struct {
+	Mail mailView `json:"mail"`
+}
+
+// emptyMailResponse LEGACY_EMPTY_MAIL=true 时旧接口 getMail 在邮箱为空时以 201 返回
+type emptyMailResponse struct {
+	Mail string `json:"mail"`
+}
+
+type listMailResponse struct {
+	Mails []mailSummary `json:"mails"`
+}
+
+// batchMailbox 批量查询中单个邮箱的邮件概要，最新在前
+type batchMailbox struct {
+	Address string        `json:"address"`
+	Mails   []mailSummary `json:"mails"`
+}
+
+type batchMailResponse struct {
+	Mailboxes []batchMailbox `json:"mailboxes"`
+}
+
+type codeResponse struct {
+	Code string `json:"code"`
+	ID   string `json:"id"`
+}
+
+type codeNotFoundResponse struct {
+	Error   string `json:"error"`
+	ID      string `json:"id"`
+	Subject string `json:"subject"`
+}
+
+type linksResponse struct {
+	Links             []mailLink `json:"links"`
+	ConfirmationGuess *mailLink  `json:"confirmationGuess"`
+}
+
+type adminStatsResponse struct {
+	Mailboxes        int        `json:"mailboxes"`
+	Messages         int        `json:"messages"`
+	Bytes            int64      `json:"bytes"`
+	ReceivedLastHour int        `json:"receivedLastHour"`
+	ReceivedLastDay  int        `json:"receivedLastDay"`
+	Rejected         uint64     `json:"rejected"`
+	LastCleanup      *time.Time `json:"lastCleanup"`
+	FileBytes        int64      `json:"fileBytes,omitempty"`
+	// 下一次定时清空的时间，未开启 DAILY_CLEANUP 时不返回
+	NextCleanup *time.Time `json:"nextCleanup,omitempty"`
+	// 占用字节数最多的邮箱，数量由 top 参数指定
+	TopMailboxes []mailboxSummary `json:"topMailboxes,omitempty"`
+}
+
+type mailboxListResponse struct {
+	Total     int              `json:"total"`
+	Offset    int              `json:"offset"`
+	Limit     int              `json:"limit"`
+	Mailboxes []mailboxSummary `json:"mailboxes"`
+}
+
+type reloadResponse struct {
+	// 已生效的改动，形如 "字段: 旧值 -> 新值"
+	Changed []string `json:"changed"`
+	// 有改动但需要重启才能生效的字段，运行中保持原值
+	RestartRequired []string `json:"restartRequired"`
+}
+
+type okResponse struct {
+	OK bool `json:"ok"`
+}
+
+type deletedResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+type markedResponse struct {
+	Marked int `json:"marked"`
+}
+
+type countResponse struct {
+	Count int `json:"count"`
+}
+
+type archiveResponse struct {
+	Mails []mailView `json:"mails"`
+}
+
+// handleAllowedDomains 返回可用域名，limits=true 时附带各域名可公开的设置
+func handleAllowedDomains(c *gin.Context) {
+	resp := allowedDomainsResponse{AllowedDomains: config().AllowedDomains, DisplayDomains: config().AllowedDomainsDisplay}
+	if c.Query("limits") == "true" {
+		resp.Limits = publicDomainSettings()
+	}
+	c.JSON(200, resp)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// 重试队列：存储暂时不可用（Redis、PostgreSQL 短暂中断）时，保存失败的邮件先放入内存队列，
+// 照常向发件方返回 250，后台每隔 STORE_RETRY_INTERVAL 按顺序重新写入。队列超过 STORE_RETRY_BUFFER_BYTES 时
+// 仍返回 451 让发件方重试。退出时在 SHUTDOWN_TIMEOUT 内尽量写完，写不完的邮件丢失并记录日志
+
+// retryQueue 为 nil 表示未启用
+var retryQueue *storeRetryQueue
+
+type storeRetryQueue struct {
+	mu      sync.Mutex
+	pending []mailContent
+	bytes   int64
+	// flushing 保证同一时间只有一个 flush，队首只由 flush 取出
+	flushing sync.Mutex
+}
+
+// initRetryQueue 设置 STORE_RETRY_BUFFER_BYTES 后启用，内存存储不会出错，不启用
+func initRetryQueue() {
+	if config().StoreRetryBufferBytes <= 0 || config().StoreBackend == "memory" {
+		return
+	}
+	retryQueue = &storeRetryQueue{}
+	go func() {
+		ticker := time.NewTicker(config().StoreRetryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			retryQueue.flush()
+		}
+	}()
+	log.Printf("已启用存储重试队列，存储不可用时最多暂存 %d 字节的邮件", config().StoreRetryBufferBytes)
+}
+
+// add 放入一封保存失败的邮件，队列已满时返回 false
+func (q *storeRetryQueue) add(m mailContent) bool {
+	if q == nil {
+		return false
+	}
+	size := mailSize(m)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.bytes+size > config().StoreRetryBufferBytes {
+		return false
+	}
+	q.pending = append(q.pending, m)
+	q.bytes += size
+	return true
+}
+
+// hasRoom 队列是否还能放下邮件，存储不可用时据此决定是否跳过容量检查
+func (q *storeRetryQueue) hasRoom() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes < config().StoreRetryBufferBytes
+}
+
+// flush 按放入的顺序写入存储，遇到失败停止，剩下的等下一轮。写入时不持有队列的锁，
+// 存储响应慢时投递不会被阻塞。返回仍在队列中的邮件数
+func (q *storeRetryQueue) flush() int {
+	q.flushing.Lock()
+	defer q.flushing.Unlock()
+	written := 0
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			break
+		}
+		m := q.pending[0]
+		q.mu.Unlock()
+
+		if err := mailStore.Append(m); err != nil {
+			if written == 0 {
+				storeLogger.Warn("重试写入存储失败", "queued", q.len(), "error", err)
+			}
+			break
+		}
+		q.mu.Lock()
+		q.pending[0] = mailContent{}
+		q.pending = q.pending[1:]
+		q.bytes -= mailSize(m)
+		q.mu.Unlock()
+		written++
+		notifyMailbox(m.To)
+		recordReceived(addressDomain(m.To))
+	}
+	left := q.len()
+	if written > 0 {
+		storeLogger.Info("重试队列已写入存储", "written", written, "queued", left)
+	}
+	return left
+}
+
+func (q *storeRetryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// drain 退出前在 ctx 结束之前反复写入，返回没能写入的邮件数
+func (q *storeRetryQueue) drain(ctx context.Context) int {
+	if q == nil {
+		return 0
+	}
+	for {
+		left := q.flush()
+		if left == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return left
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mailboxRevision 邮箱版本，投递、取出、删除、清空时变化
+type mailboxRevision struct {
+	revision uint64
+	modified time.Time
+}
+
+// revisionTracker 记录已删除邮箱的最后版本，由所属分片的锁保护；存在的邮箱自己保存版本。
+// 版本号来自整个存储共用的计数器，邮箱删除后重建也不会回退
+type revisionTracker struct {
+	revisions map[string]mailboxRevision
+	counter   *atomic.Uint64
+	// 清空后没有记录的邮箱使用清空时的版本，保证版本号不会回退
+	cleared mailboxRevision
+}
+
+func newRevisionTracker(counter *atomic.Uint64) revisionTracker {
+	return revisionTracker{
+		revisions: make(map[string]mailboxRevision),
+		counter:   counter,
+		cleared:   mailboxRevision{modified: time.Now()},
+	}
+}
+
+// next 分配一个新版本，只读计数器，不需要分片的锁
+func (t *revisionTracker) next() mailboxRevision {
+	return mailboxRevision{revision: t.counter.Add(1), modified: time.Now()}
+}
+
+// touch 邮箱被删除时记下新版本
+func (t *revisionTracker) touch(mailHead string) {
+	t.revisions[mailHead] = t.next()
+}
+
+// forget 邮箱重新创建后版本由邮箱自己保存
+func (t *revisionTracker) forget(mailHead string) {
+	delete(t.revisions, mailHead)
+}
+
+// reset 清空所有邮箱时调用
+func (t *revisionTracker) reset() {
+	t.revisions = make(map[string]mailboxRevision)
+	t.cleared = t.next()
+}
+
+// of 取邮箱当前版本
+func (t *revisionTracker) of(mailHead string) mailboxRevision {
+	if rev, ok := t.revisions[mailHead]; ok {
+		return rev
+	}
+	return t.cleared
+}
+
+// notModified 写入 ETag 和 Last-Modified，客户端缓存仍有效时返回 304 并返回 true
+func notModified(c *gin.Context, rev mailboxRevision) bool {
+	etag := `W/"` + strconv.FormatUint(rev.revision, 10) + `"`
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", rev.modified.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", "no-cache")
+
+	// 列表可以分在多个 If-None-Match 头中
+	if inm := strings.Join(c.Request.Header.Values("If-None-Match"), ","); inm != "" {
+		if etagListMatch(inm, etag) {
+			c.Status(304)
+			return true
+		}
+		return false
+	}
+	if ims := c.GetHeader("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil && !rev.modified.Truncate(time.Second).After(t) {
+			c.Status(304)
+			return true
+		}
+	}
+	return false
+}
+
+// etagListMatch 按 RFC 9110 §13.1.2 判断 If-None-Match 的值是否与 etag 匹配：* 匹配任何版本，
+// 否则是逗号分隔的实体标签列表，弱比较，忽略两边的 W/ 前缀。无法解析的项跳过
+func etagListMatch(field, etag string) bool {
+	if strings.TrimSpace(field) == "*" {
+		return true
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	for {
+		field = strings.TrimLeft(field, " \t,")
+		if field == "" {
+			return false
+		}
+		tag := strings.TrimPrefix(field, "W/")
+		// 引号内允许出现逗号，只能逐个扫描
+		end := -1
+		if strings.HasPrefix(tag, `"`) {
+			end = strings.IndexByte(tag[1:], '"')
+		}
+		if end < 0 {
+			_, field, _ = strings.Cut(field, ",")
+			continue
+		}
+		if tag[:end+2] == opaque {
+			return true
+		}
+		field = tag[end+2:]
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listRequest 带条件请求头读取邮件列表
+func listRequest(t *testing.T, r http.Handler, header, value string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/v1/mailboxes/user@test.local/messages", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestListMailETag(t *testing.T) {
+	setupTest(t, nil)
+	r := newRouter()
+
+	first := listRequest(t, r, "", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != 200 || etag == "" || first.Header().Get("Last-Modified") == "" {
+		t.Fatalf("首次请求 %d，ETag %q", first.Code, etag)
+	}
+	if w := listRequest(t, r, "If-None-Match", etag); w.Code != 304 || w.Body.Len() != 0 {
+		t.Errorf("ETag 未变化时应返回 304 且没有响应体，得到 %d %q", w.Code, w.Body)
+	}
+	if w := listRequest(t, r, "If-None-Match", "*"); w.Code != 304 {
+		t.Errorf("If-None-Match: * 应返回 304，得到 %d", w.Code)
+	}
+	if w := listRequest(t, r, "If-None-Match", `"stale", `+etag); w.Code != 304 {
+		t.Errorf("列表中包含当前 ETag 应返回 304，得到 %d", w.Code)
+	}
+	// 列表分在多个请求头中
+	req := httptest.NewRequest("GET", "/api/v1/mailboxes/user@test.local/messages", nil)
+	req.Header.Add("If-None-Match", `"stale"`)
+	req.Header.Add("If-None-Match", strings.TrimPrefix(etag, "W/"))
+	multi := httptest.NewRecorder()
+	r.ServeHTTP(multi, req)
+	if multi.Code != 304 {
+		t.Errorf("多个 If-None-Match 头中有当前 ETag 应返回 304，得到 %d", multi.Code)
+	}
+
+	// 收到新邮件后版本变化
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", ReceivedAt: time.Now()})
+	w := listRequest(t, r, "If-None-Match", etag)
+	if w.Code != 200 || w.Header().Get("ETag") == etag {
+		t.Fatalf("收信后应返回 200 和新的 ETag，得到 %d %q", w.Code, w.Header().Get("ETag"))
+	}
+	etag = w.Header().Get("ETag")
+
+	// 其他邮箱的变化不影响
+	mailStore.Append(mailContent{ID: "x1", To: "other@test.local", ReceivedAt: time.Now()})
+	if w := listRequest(t, r, "If-None-Match", etag); w.Code != 304 {
+		t.Errorf("其他邮箱收信后应仍返回 304，得到 %d", w.Code)
+	}
+
+	// 删除邮箱后重建，版本不会回退到旧值
+	mailStore.Delete("user@test.local")
+	deleted := listRequest(t, r, "If-None-Match", etag)
+	if deleted.Code != 200 {
+		t.Errorf("删除邮箱后应返回 200，得到 %d", deleted.Code)
+	}
+	mailStore.Append(mailContent{ID: "m2", To: "user@test.local", ReceivedAt: time.Now()})
+	for _, old := range []string{etag, deleted.Header().Get("ETag")} {
+		if w := listRequest(t, r, "If-None-Match", old); w.Code != 200 {
+			t.Errorf("重建邮箱后旧 ETag %s 应失效，得到 %d", old, w.Code)
+		}
+	}
+}
+
+func TestListMailIfModifiedSince(t *testing.T) {
+	setupTest(t, nil)
+	r := newRouter()
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", ReceivedAt: time.Now()})
+
+	modified := listRequest(t, r, "", "").Header().Get("Last-Modified")
+	if w := listRequest(t, r, "If-Modified-Since", modified); w.Code != 304 {
+		t.Errorf("未修改时应返回 304，得到 %d", w.Code)
+	}
+	earlier := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if w := listRequest(t, r, "If-Modified-Since", earlier); w.Code != 200 {
+		t.Errorf("之后修改过应返回 200，得到 %d", w.Code)
+	}
+	if w := listRequest(t, r, "If-Modified-Since", "yesterday"); w.Code != 200 {
+		t.Errorf("无法解析的日期应忽略，得到 %d", w.Code)
+	}
+
+	// If-None-Match 优先于 If-Modified-Since
+	req := httptest.NewRequest("GET", "/api/v1/mailboxes/user@test.local/messages", nil)
+	req.Header.Set("If-None-Match", `W/"0"`)
+	req.Header.Set("If-Modified-Since", modified)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("ETag 不匹配时应忽略 If-Modified-Since，得到 %d", w.Code)
+	}
+}
+
+// TestETagListMatch If-None-Match 按 RFC 9110 解析：实体标签列表、弱比较和 *
+func TestETagListMatch(t *testing.T) {
+	const etag = `W/"7"`
+	for _, tc := range []struct {
+		field string
+		want  bool
+	}{
+		{`W/"7"`, true},
+		{`"7"`, true},
+		{`W/"6"`, false},
+		{`"1", W/"7"`, true},
+		{` W/"1" ,"7" `, true},
+		{`"1","2"`, false},
+		{`"a,7", "b"`, false},
+		{`"x,W/"7"`, false},
+		{`bogus, "7"`, true},
+		{`W/"77"`, false},
+		{`*`, true},
+		{` * `, true},
+		{`"1", *`, false},
+		{`"7`, false},
+		{``, false},
+	} {
+		if got := etagListMatch(tc.field, etag); got != tc.want {
+			t.Errorf("etagListMatch(%q) = %v，应为 %v", tc.field, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// htmlPolicy 邮件 HTML 清洗策略：去掉脚本、事件属性、javascript: 链接和表单，保留常见排版、行内样式和图片
+var htmlPolicy = newHTMLPolicy()
+
+func newHTMLPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowDataURIImages()
+	p.AllowElements("font", "center", "span", "div")
+	p.AllowAttrs("color", "face", "size").OnElements("font")
+	p.AllowAttrs("align", "valign", "width", "height", "bgcolor", "border",
+		"cellpadding", "cellspacing").Globally()
+	p.AllowStyles("color", "background", "background-color", "font", "font-family",
+		"font-size", "font-weight", "font-style", "line-height", "text-align",
+		"text-decoration", "text-transform", "letter-spacing", "white-space",
+		"vertical-align", "width", "max-width", "min-width", "height", "max-height",
+		"margin", "margin-top", "margin-right", "margin-bottom", "margin-left",
+		"padding", "padding-top", "padding-right", "padding-bottom", "padding-left",
+		"border", "border-top", "border-right", "border-bottom", "border-left",
+		"border-color", "border-style", "border-width", "border-radius",
+		"border-collapse", "display").Globally()
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+// sanitizeHTML 清洗邮件 HTML
+func sanitizeHTML(html string) string {
+	if html == "" {
+		return ""
+	}
+	return htmlPolicy.Sanitize(html)
+}
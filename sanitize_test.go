@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// xssCorpus 常见的 XSS 写法，清洗后都不应留下可执行的内容
+var xssCorpus = []string{
+	`<script>alert(1)</script>`,
+	`<SCRIPT SRC=https://evil.example/x.js></SCRIPT>`,
+	`<scr<script>ipt>alert(1)</scr</script>ipt>`,
+	`<<script>alert(1)//<</script>`,
+	`<script/xss src="https://evil.example/x.js"></script>`,
+	`<img src=x onerror=alert(1)>`,
+	`<IMG SRC="javascript:alert(1)">`,
+	`<img src=JaVaScRiPt:alert(1)>`,
+	`<img src="jav&#x09;ascript:alert(1)">`,
+	`<img src="&#106;&#97;&#118;&#97;&#115;&#99;&#114;&#105;&#112;&#116;&#58;alert(1)">`,
+	`<img """><script>alert(1)</script>">`,
+	`<img src="x" onload="alert(1)" ONMOUSEOVER="alert(1)">`,
+	`<a href="javascript:alert(1)">click</a>`,
+	`<a href=" javascript:alert(1)">click</a>`,
+	`<a href="vbscript:msgbox(1)">click</a>`,
+	`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">click</a>`,
+	`<a href="#" onclick="alert(1)">click</a>`,
+	`<body onload=alert(1)>`,
+	`<svg onload=alert(1)>`,
+	`<svg><script>alert(1)</script></svg>`,
+	`<math><mi xlink:href="javascript:alert(1)">x</mi></math>`,
+	`<iframe src="https://evil.example"></iframe>`,
+	`<iframe srcdoc="<script>alert(1)</script>"></iframe>`,
+	`<object data="javascript:alert(1)"></object>`,
+	`<embed src="https://evil.example/x.swf">`,
+	`<form action="https://evil.example"><input name="password"><button>go</button></form>`,
+	`<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`,
+	`<base href="https://evil.example/">`,
+	`<link rel="stylesheet" href="https://evil.example/x.css">`,
+	`<style>body{background:url("javascript:alert(1)")}</style>`,
+	`<div style="background:url(javascript:alert(1))">x</div>`,
+	`<div style="width: expression(alert(1))">x</div>`,
+	`<div style="behavior: url(x.htc)">x</div>`,
+	`<table background="javascript:alert(1)"><tr><td>x</td></tr></table>`,
+	`<details open ontoggle=alert(1)>`,
+	`<video><source onerror="alert(1)"></video>`,
+	`<input autofocus onfocus=alert(1)>`,
+	`<marquee onstart=alert(1)>x</marquee>`,
+	`<isindex action=javascript:alert(1) type=submit>`,
+	`<!--<img src="--><img src=x onerror=alert(1)//">`,
+	`<noscript><p title="</noscript><img src=x onerror=alert(1)>">`,
+	`<textarea><script>alert(1)</script></textarea>`,
+	`<a href="https://ok.example" target="_self" onmouseover="alert(1)">ok</a>`,
+}
+
+// unsafeMarkup 解析清洗后的 HTML，返回第一个危险的元素或属性，没有时返回空串
+func unsafeMarkup(out string) string {
+	forbidden := map[string]bool{"script": true, "iframe": true, "object": true, "embed": true, "form": true,
+		"input": true, "button": true, "textarea": true, "meta": true, "base": true, "link": true, "style": true,
+		"svg": true, "math": true, "body": true, "isindex": true, "frame": true, "frameset": true}
+	z := html.NewTokenizer(strings.NewReader(out))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if forbidden[tok.Data] {
+				return "<" + tok.Data + ">"
+			}
+			for _, a := range tok.Attr {
+				key := strings.ToLower(a.Key)
+				// 去掉浏览器会忽略的空白和控制字符后再比较协议
+				value := strings.ToLower(strings.Map(func(r rune) rune {
+					if r <= ' ' {
+						return -1
+					}
+					return r
+				}, a.Val))
+				switch {
+				case strings.HasPrefix(key, "on"), key == "srcdoc", key == "formaction":
+					return key
+				case strings.HasPrefix(value, "javascript:"), strings.HasPrefix(value, "vbscript:"),
+					strings.HasPrefix(value, "data:text"):
+					return key + "=" + a.Val
+				case key == "style" && (strings.Contains(value, "expression(") || strings.Contains(value, "url(") ||
+					strings.Contains(value, "behavior")):
+					return key + "=" + a.Val
+				}
+			}
+		}
+	}
+}
+
+func TestSanitizeHTMLCorpus(t *testing.T) {
+	for _, in := range xssCorpus {
+		out := sanitizeHTML(in)
+		if bad := unsafeMarkup(out); bad != "" {
+			t.Errorf("清洗 %s\n得到 %s\n仍包含 %s", in, out, bad)
+		}
+		// 清洗结果再清洗一次不应变化
+		if again := sanitizeHTML(out); again != out {
+			t.Errorf("清洗结果不稳定: %s → %s", out, again)
+		}
+	}
+}
+
+func TestSanitizeHTMLKeepsFormatting(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{`<p style="color: red; text-align: center">hi</p>`, `style="color: red; text-align: center"`},
+		{`<font color="#333" face="Arial">x</font>`, `<font color="#333" face="Arial">`},
+		{`<table cellpadding="4" border="0"><tr><td align="center" bgcolor="#fff">x</td></tr></table>`, `<td align="center" bgcolor="#fff">`},
+		{`<a href="https://example.com/verify?t=1">verify</a>`, `href="https://example.com/verify?t=1"`},
+		{`<a href="https://example.com/">x</a>`, `target="_blank"`},
+		{`<a href="mailto:a@example.com">mail</a>`, `href="mailto:a@example.com"`},
+		{`<img src="https://example.com/logo.png" alt="logo" width="100">`, `src="https://example.com/logo.png"`},
+		{`<img src="data:image/png;base64,iVBORw0KGgo=">`, `src="data:image/png;base64,iVBORw0KGgo="`},
+		{`<b>bold</b> <i>i</i> <ul><li>one</li></ul>`, `<b>bold</b> <i>i</i> <ul><li>one</li></ul>`},
+	} {
+		if out := sanitizeHTML(tc.in); !strings.Contains(out, tc.want) {
+			t.Errorf("清洗 %s 得到 %s，应包含 %s", tc.in, out, tc.want)
+		}
+	}
+	if sanitizeHTML("") != "" {
+		t.Error("空 HTML 应保持为空")
+	}
+}
+
+func TestGetMessageSanitized(t *testing.T) {
+	setupTest(t, nil)
+	const raw = `<p>hi</p><script>alert(1)</script><img src=x onerror=alert(1)>`
+	mailStore.Append(mailContent{ID: "m1", To: "user@test.local", HTML: raw, ReceivedAt: time.Now()})
+	r := newRouter()
+
+	get := func(query string) string {
+		var resp struct {
+			Data getMailResponse `json:"data"`
+		}
+		w := testRequest(r, "GET", "/api/v1/mailboxes/user@test.local/messages/m1"+query, "192.0.2.1")
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 {
+			t.Fatalf("读取邮件 %d: %v", w.Code, err)
+		}
+		if resp.Data.Mail.HTML == nil {
+			t.Fatal("响应中没有 HTML")
+		}
+		return *resp.Data.Mail.HTML
+	}
+	if out := get(""); unsafeMarkup(out) != "" || !strings.Contains(out, "<p>hi</p>") {
+		t.Errorf("默认应返回清洗后的 HTML: %s", out)
+	}
+	if out := get("?sanitized=false"); !strings.Contains(out, "<script>") {
+		t.Errorf("sanitized=false 应返回原始 HTML: %s", out)
+	}
+}
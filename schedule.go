@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 定时清空：开启 DAILY_CLEANUP 后按 CLEANUP_SCHEDULE（五段 cron 表达式，默认 "0 0 * * *"，即每天零点）
+// 清空所有邮箱。表达式按服务器本地时区解释，以 "CRON_TZ=UTC " 开头时按指定时区
+
+// scheduleCheckInterval 等待下一次执行时单次睡眠的上限。计时器按单调时钟计时，
+// 系统时间被调整后每隔这么久按墙上时间重新计算一次
+const scheduleCheckInterval = time.Minute
+
+// cronSearchYears 查找下一次执行时间时最多往后找的年数，找不到说明表达式永远不会触发（如 2 月 30 日）
+const cronSearchYears = 5
+
+// cronSchedule 解析后的 cron 表达式，每段用位图表示允许的取值
+type cronSchedule struct {
+	expr                          string
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+	loc                           *time.Location
+}
+
+// cronField 一段的取值范围，names 为可用的英文缩写（月份、星期）
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	cronMinute = cronField{name: "分钟", min: 0, max: 59}
+	cronHour   = cronField{name: "小时", min: 0, max: 23}
+	cronDom    = cronField{name: "日期", min: 1, max: 31}
+	cronMonth  = cronField{name: "月份", min: 1, max: 12,
+		names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	// 星期 0 和 7 都是周日
+	cronDow = cronField{name: "星期", min: 0, max: 7,
+		names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron 解析五段 cron 表达式：分 时 日 月 星期，支持 *、数字、a-b、列表、/步长、月份和星期的英文缩写，
+// 以及 @daily 等简写。日和星期都不是 * 时满足任意一个即触发，与常见的 cron 实现一致
+func parseCron(expr string) (*cronSchedule, error) {
+	s := &cronSchedule{expr: expr, loc: time.Local}
+	spec := strings.TrimSpace(expr)
+	if rest, ok := strings.CutPrefix(spec, "CRON_TZ="); ok {
+		tz, fields, _ := strings.Cut(rest, " ")
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("时区 %q 无效: %v", tz, err)
+		}
+		s.loc, spec = loc, strings.TrimSpace(fields)
+	}
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("需要 5 段（分 时 日 月 星期），实际为 %d 段", len(fields))
+	}
+	var err error
+	for i, f := range []struct {
+		bits  *uint64
+		field cronField
+	}{{&s.minute, cronMinute}, {&s.hour, cronHour}, {&s.dom, cronDom}, {&s.month, cronMonth}, {&s.dow, cronDow}} {
+		if *f.bits, err = parseCronField(fields[i], f.field); err != nil {
+			return nil, err
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny, s.dowAny = fields[2] == "*", fields[4] == "*"
+
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%d 年内不会触发", cronSearchYears)
+	}
+	return s, nil
+}
+
+// parseCronField 解析一段，返回允许取值的位图
+func parseCronField(text string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(text, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%s %q 的步长无效", f.name, part)
+			}
+			step = n
+		}
+
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(loText); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(hiText); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "5/15" 表示从 5 开始到最大值
+				hi = f.max
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("%s %q 的范围无效", f.name, part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value 解析一个数字或英文缩写，检查是否在范围内
+func (f cronField) value(text string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(text, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s %q 无效，应在 %d-%d 之间", f.name, text, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (s *cronSchedule) String() string {
+	return s.expr
+}
+
+// dayMatches 日和星期都有限制时满足任意一个即可
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next 返回 t 之后（不含 t）的下一次触发时间，cronSearchYears 年内不会触发时返回零值。
+// 按墙上时间逐段查找再换算为时刻：夏令时跳过的时刻顺延到切换之后，回拨时重复出现的时刻只触发一次
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(s.loc)
+	w := wallClock(t).Truncate(time.Minute).Add(time.Minute)
+	limit := w.Year() + cronSearchYears
+	for w.Year() <= limit {
+		y, mo, d := w.Date()
+		switch {
+		case s.month&(1<<mo) == 0:
+			w = time.Date(y, mo+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(w):
+			w = time.Date(y, mo, d+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<w.Hour()) == 0:
+			w = time.Date(y, mo, d, w.Hour()+1, 0, 0, 0, time.UTC)
+		case s.minute&(1<<w.Minute()) == 0:
+			w = w.Add(time.Minute)
+		default:
+			if at := localTime(w, s.loc); at.After(t) {
+				return at
+			}
+			w = w.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
+
+// localTime 把墙上时间 w 换算为 loc 中的时刻。落在夏令时跳过的时段内时 time.Date 可能换算到切换之前，
+// 这里统一顺延跳过的时长，得到切换之后的时刻
+func localTime(w time.Time, loc *time.Location) time.Time {
+	t := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), 0, 0, loc)
+	if wallClock(t).Before(w) {
+		_, before := t.Zone()
+		_, after := t.Add(24 * time.Hour).Zone()
+		t = t.Add(time.Duration(after-before) * time.Second)
+	}
+	return t
+}
+
+// wallClock 把 t 的本地时间当作 UTC，用于按日历计算和比较墙上时间
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// nextRun 计算下一次执行时间：now 之后的下一次触发，且晚于上次执行的触发时间 last。
+// 系统时间回拨到上次执行之前时不会在同一个触发时间再执行一次
+func nextRun(s *cronSchedule, now, last time.Time) time.Time {
+	if now.Before(last) {
+		now = last
+	}
+	return s.next(now)
+}
+
+var (
+	nextCleanupMu sync.Mutex
+	nextCleanup   time.Time
+)
+
+// nextCleanupTime 下一次定时清空的时间，未开启时为零值
+func nextCleanupTime() time.Time {
+	nextCleanupMu.Lock()
+	defer nextCleanupMu.Unlock()
+	return nextCleanup
+}
+
+func setNextCleanup(t time.Time) {
+	nextCleanupMu.Lock()
+	nextCleanup = t
+	nextCleanupMu.Unlock()
+}
+
+// scheduleCleanup 按 s 定时执行 task，ctx 取消后停止。错过的触发时间（如进程被挂起）在恢复后补执行一次
+func scheduleCleanup(ctx context.Context, s *cronSchedule, task func()) {
+	next := nextRun(s, time.Now(), time.Time{})
+	setNextCleanup(next)
+	log.Printf("已启用定时清空（%s），下次清空时间 %s", s, next.Format(time.RFC3339))
+	go func() {
+		for {
+			// next 不带单调时钟读数，按墙上时间计算剩余时间
+			if wait := time.Until(next); wait > 0 {
+				timer := time.NewTimer(min(wait, scheduleCheckInterval))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			task()
+			next = nextRun(s, time.Now(), next)
+			setNextCleanup(next)
+			cleanupLogger.Info("下次清空时间", "next", next.Format(time.RFC3339))
+		}
+	}()
+}
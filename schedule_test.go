@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// mustCron 解析表达式，时区数据缺失时跳过测试
+func mustCron(t *testing.T, expr string) *cronSchedule {
+	t.Helper()
+	s, err := parseCron(expr)
+	if err != nil {
+		if _, tzErr := time.LoadLocation("America/New_York"); tzErr != nil {
+			t.Skipf("缺少时区数据: %v", tzErr)
+		}
+		t.Fatalf("parseCron(%q): %v", expr, err)
+	}
+	return s
+}
+
+func utc(text string) time.Time {
+	t, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestCronNext(t *testing.T) {
+	for _, tc := range []struct {
+		expr, from, want string
+	}{
+		{"CRON_TZ=UTC 0 3 * * *", "2024-01-01T02:59:00Z", "2024-01-01T03:00:00Z"},
+		// 恰好在触发时间时取下一次
+		{"CRON_TZ=UTC 0 3 * * *", "2024-01-01T03:00:00Z", "2024-01-02T03:00:00Z"},
+		{"CRON_TZ=UTC 0 3 * * *", "2024-01-01T03:00:30Z", "2024-01-02T03:00:00Z"},
+		// 跨月、跨年
+		{"CRON_TZ=UTC 0 0 * * *", "2024-12-31T12:00:00Z", "2025-01-01T00:00:00Z"},
+		{"CRON_TZ=UTC 0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		// 按本地时区计算
+		{"CRON_TZ=Asia/Shanghai 0 0 * * *", "2024-01-01T15:00:00Z", "2024-01-01T16:00:00Z"},
+		{"CRON_TZ=Asia/Shanghai 0 0 * * *", "2024-01-01T16:00:00Z", "2024-01-02T16:00:00Z"},
+
+		// 夏令时开始（纽约 2024-03-10 02:00 跳到 03:00）：跳过的 02:30 顺延到切换之后
+		{"CRON_TZ=America/New_York 30 2 * * *", "2024-03-10T05:00:00Z", "2024-03-10T07:30:00Z"},
+		{"CRON_TZ=America/New_York 30 2 * * *", "2024-03-10T07:30:00Z", "2024-03-11T06:30:00Z"},
+		// 不受影响的时刻按新的偏移计算
+		{"CRON_TZ=America/New_York 0 0 * * *", "2024-03-10T04:59:00Z", "2024-03-10T05:00:00Z"},
+		{"CRON_TZ=America/New_York 0 0 * * *", "2024-03-10T05:00:00Z", "2024-03-11T04:00:00Z"},
+
+		// 夏令时结束（纽约 2024-11-03 02:00 回拨到 01:00）：重复出现的 01:30 只触发一次
+		{"CRON_TZ=America/New_York 30 1 * * *", "2024-11-03T04:00:00Z", "2024-11-03T05:30:00Z"},
+		{"CRON_TZ=America/New_York 30 1 * * *", "2024-11-03T05:30:00Z", "2024-11-04T06:30:00Z"},
+		{"CRON_TZ=America/New_York 30 1 * * *", "2024-11-03T06:10:00Z", "2024-11-04T06:30:00Z"},
+		// 每分钟触发时回拨后重复的一小时不再触发，01:59 EDT 之后是 02:00 EST
+		{"CRON_TZ=America/New_York * * * * *", "2024-11-03T05:59:00Z", "2024-11-03T07:00:00Z"},
+	} {
+		s := mustCron(t, tc.expr)
+		if got := s.next(utc(tc.from)); !got.Equal(utc(tc.want)) {
+			t.Errorf("%s: next(%s) = %s，应为 %s", tc.expr, tc.from, got.UTC().Format(time.RFC3339), tc.want)
+		}
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	s := mustCron(t, "CRON_TZ=UTC 0 0 * * *")
+	last := utc("2024-01-02T00:00:00Z")
+
+	// 按假时钟推进：每次执行后从执行完成的时刻算下一次
+	now := last.Add(5 * time.Second)
+	for day := 3; day <= 5; day++ {
+		next := nextRun(s, now, last)
+		want := time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC)
+		if !next.Equal(want) {
+			t.Fatalf("第 %d 天: nextRun = %s，应为 %s", day, next, want)
+		}
+		last, now = next, next.Add(5*time.Second)
+	}
+
+	// 系统时间回拨到上次执行之前，不在同一个触发时间再执行
+	if got := nextRun(s, last.Add(-2*time.Hour), last); !got.Equal(last.AddDate(0, 0, 1)) {
+		t.Errorf("时间回拨后 nextRun = %s，应为 %s", got, last.AddDate(0, 0, 1))
+	}
+	// 进程挂起错过多次触发，恢复后只按当前时间算下一次
+	if got := nextRun(s, last.Add(72*time.Hour+time.Minute), last); !got.Equal(last.Add(96 * time.Hour)) {
+		t.Errorf("错过触发后 nextRun = %s，应为 %s", got, last.Add(96*time.Hour))
+	}
+	// 首次运行没有上次执行时间
+	if got := nextRun(s, utc("2024-06-01T12:00:00Z"), time.Time{}); !got.Equal(utc("2024-06-02T00:00:00Z")) {
+		t.Errorf("首次 nextRun = %s", got)
+	}
+}
+
+func TestNextRunAcrossDST(t *testing.T) {
+	s := mustCron(t, "CRON_TZ=America/New_York 30 2 * * *")
+	last := utc("2024-03-09T07:30:00Z") // 03-09 02:30 EST
+	var runs []string
+	for range 3 {
+		last = nextRun(s, last.Add(time.Second), last)
+		runs = append(runs, last.UTC().Format(time.RFC3339))
+	}
+	want := []string{"2024-03-10T07:30:00Z", "2024-03-11T06:30:00Z", "2024-03-12T06:30:00Z"}
+	for i := range want {
+		if runs[i] != want[i] {
+			t.Fatalf("夏令时前后的执行时间 %q，应为 %q", runs, want)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	from := utc("2024-09-01T00:00:00Z") // 周日
+	for _, tc := range []struct {
+		expr string
+		want []string // from 之后依次触发的时间
+	}{
+		{"CRON_TZ=UTC 0 0 * * *", []string{"2024-09-02T00:00:00Z", "2024-09-03T00:00:00Z"}},
+		{"CRON_TZ=UTC @daily", []string{"2024-09-02T00:00:00Z"}},
+		{"CRON_TZ=UTC @HOURLY", []string{"2024-09-01T01:00:00Z", "2024-09-01T02:00:00Z"}},
+		{"CRON_TZ=UTC @weekly", []string{"2024-09-08T00:00:00Z"}},
+		{"CRON_TZ=UTC @monthly", []string{"2024-10-01T00:00:00Z"}},
+		{"CRON_TZ=UTC @yearly", []string{"2025-01-01T00:00:00Z"}},
+		// 列表、范围、步长
+		{"CRON_TZ=UTC 15,45 6 * * *", []string{"2024-09-01T06:15:00Z", "2024-09-01T06:45:00Z", "2024-09-02T06:15:00Z"}},
+		{"CRON_TZ=UTC 0 8-10 * * *", []string{"2024-09-01T08:00:00Z", "2024-09-01T09:00:00Z", "2024-09-01T10:00:00Z", "2024-09-02T08:00:00Z"}},
+		{"CRON_TZ=UTC */20 0 * * *", []string{"2024-09-01T00:20:00Z", "2024-09-01T00:40:00Z", "2024-09-02T00:00:00Z"}},
+		{"CRON_TZ=UTC 5/30 0 * * *", []string{"2024-09-01T00:05:00Z", "2024-09-01T00:35:00Z"}},
+		{"CRON_TZ=UTC 0 0-12/6 * * *", []string{"2024-09-01T06:00:00Z", "2024-09-01T12:00:00Z", "2024-09-02T00:00:00Z"}},
+		// 月份和星期的英文缩写，星期 7 也是周日
+		{"CRON_TZ=UTC 0 0 1 jan-mar,Oct *", []string{"2024-10-01T00:00:00Z", "2025-01-01T00:00:00Z"}},
+		{"CRON_TZ=UTC 0 0 * * mon-fri", []string{"2024-09-02T00:00:00Z", "2024-09-03T00:00:00Z"}},
+		{"CRON_TZ=UTC 0 0 * * 7", []string{"2024-09-08T00:00:00Z"}},
+		{"CRON_TZ=UTC 0 0 * * SUN", []string{"2024-09-08T00:00:00Z"}},
+		// 日和星期都有限制时满足任意一个即可
+		{"CRON_TZ=UTC 0 0 13 * fri", []string{"2024-09-06T00:00:00Z", "2024-09-13T00:00:00Z", "2024-09-20T00:00:00Z"}},
+		// 日有限制、星期为 * 时只按日
+		{"CRON_TZ=UTC 0 0 13 * *", []string{"2024-09-13T00:00:00Z", "2024-10-13T00:00:00Z"}},
+		{"  CRON_TZ=UTC   0  0  *  *  *  ", []string{"2024-09-02T00:00:00Z"}},
+	} {
+		s := mustCron(t, tc.expr)
+		at := from
+		for _, want := range tc.want {
+			at = s.next(at)
+			if !at.Equal(utc(want)) {
+				t.Errorf("%q: 触发时间 %s，应为 %s", tc.expr, at.UTC().Format(time.RFC3339), want)
+				break
+			}
+		}
+		if s.String() != tc.expr {
+			t.Errorf("String() = %q，应为原始表达式 %q", s.String(), tc.expr)
+		}
+	}
+}
+
+func TestParseCronLocation(t *testing.T) {
+	if s, err := parseCron("0 0 * * *"); err != nil || s.loc != time.Local {
+		t.Errorf("未指定时区时应使用本地时区: %v", err)
+	}
+	s := mustCron(t, "CRON_TZ=Asia/Shanghai 0 0 * * *")
+	if s.loc.String() != "Asia/Shanghai" {
+		t.Errorf("时区 = %s", s.loc)
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"0 0 * *",
+		"0 0 * * * *",
+		"@reboot",
+		"60 0 * * *",
+		"0 24 * * *",
+		"0 0 0 * *",
+		"0 0 32 * *",
+		"0 0 * 13 *",
+		"0 0 * 0 *",
+		"0 0 * * 8",
+		"-1 0 * * *",
+		"a 0 * * *",
+		"0 0 * foo *",
+		"0 0 * * funday",
+		"10-5 0 * * *",
+		"0-5- 0 * * *",
+		"*/0 0 * * *",
+		"*/-1 0 * * *",
+		"*/x 0 * * *",
+		"1,,2 0 * * *",
+		"0 0 * * mon-",
+		// 永远不会触发
+		"0 0 30 2 *",
+		"0 0 31 4,6,9,11 *",
+		"CRON_TZ=Nowhere/City 0 0 * * *",
+		"CRON_TZ=UTC",
+	} {
+		if s, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) 应报错，得到 %v", expr, s)
+		}
+	}
+}
+
+func TestCleanupScheduleConfig(t *testing.T) {
+	cfg := newTestConfig(t, map[string]string{"CLEANUP_SCHEDULE": "CRON_TZ=UTC 30 4 * * *"})
+	if cfg.CleanupSchedule.String() != "CRON_TZ=UTC 30 4 * * *" {
+		t.Errorf("CleanupSchedule = %s", cfg.CleanupSchedule)
+	}
+
+	t.Setenv("ALLOWED_DOMAINS", "test.local")
+	t.Setenv("CLEANUP_SCHEDULE", "0 25 * * *")
+	configErrors = nil
+	parseConfig()
+	if len(configErrors) == 0 || !strings.Contains(strings.Join(configErrors, "\n"), "CLEANUP_SCHEDULE") {
+		t.Errorf("无效的 CLEANUP_SCHEDULE 应报告配置错误: %q", configErrors)
+	}
+	configErrors = nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-smtp"
+	"golang.org/x/net/idna"
+)
+
+// smtpBackend 实现 go-smtp 的 Backend 接口，不支持认证，所有发件方匿名投递
+type smtpBackend struct{}
+
+func (smtpBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (smtpBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	s := &smtpSession{
+		remoteIP: remoteIP(state.RemoteAddr),
+		helo:     state.Hostname,
+		conn:     connFor(state.RemoteAddr),
+	}
+	if err := checkSender(s); err != nil {
+		recordRejected("", "fcrdns")
+		return nil, err
+	}
+	if err := checkDNSBL(s); err != nil {
+		recordRejected("", "dnsbl")
+		return nil, err
+	}
+	observeSMTPSession(1)
+	return s, nil
+}
+
+// smtpSession 保存一次 SMTP 会话的连接信息和信封
+type smtpSession struct {
+	remoteIP string
+	helo     string
+	dns      dnsCheckResult
+	dnsbl    []string
+	conn     *timeoutConn
+
+	from string
+	to   []string
+	// MAIL FROM 中 SIZE 参数声明的邮件大小，未声明时为 0
+	size int64
+	// MAIL FROM 带有 SMTPUTF8 参数，信封中可以使用 UTF-8 地址
+	utf8 bool
+	// 本封邮件已记录过收件人数量达到上限
+	rcptLimitLogged bool
+}
+
+func (s *smtpSession) Mail(from string, opts smtp.MailOptions) error {
+	if s.conn != nil && s.conn.isClosed() {
+		return net.ErrClosed
+	}
+	if !opts.UTF8 && !isASCII(from) {
+		return errNeedSMTPUTF8.err()
+	}
+	s.from = from
+	s.size = int64(opts.Size)
+	s.utf8 = opts.UTF8
+	if s.conn != nil {
+		s.conn.beginTransaction()
+	}
+	return nil
+}
+
+func (s *smtpSession) Rcpt(to string) error {
+	to = strings.Trim(to, "<>")
+	if !s.utf8 && !isASCII(to) {
+		return errNeedSMTPUTF8.err()
+	}
+	to = normalizeAddress(to)
+	if !domainAllowed(addressDomain(to)) {
+		recordRejected(addressDomain(to), "relay")
+		return config().RelayReject
+	}
+	if limit := config().MaxRcptPerMessage; limit > 0 && len(s.to) >= limit && !containsFold(s.to, to) {
+		recordRejected(addressDomain(to), "too_many_recipients")
+		// 群发的发件方可能一次给出上千个收件人，每封邮件只记录一次
+		if !s.rcptLimitLogged {
+			s.rcptLimitLogged = true
+			smtpLogger.Warn("收件人数量达到上限", "limit", limit, "from", s.from, "ip", s.remoteIP)
+		}
+		return errTooManyRecipients.err()
+	}
+	allowed, err := recipientAllowed(to)
+	if err != nil {
+		smtpLogger.Error("检查收件人失败", "mailbox", to, "error", err)
+		return errStoreUnavailable.err()
+	}
+	if !allowed {
+		recordRejected(addressDomain(to), "recipient")
+		return config().RecipientReject
+	}
+	policy := settingsFor(addressDomain(to))
+	// SMTP 服务按所有域名中最大的上限读取，SIZE 声明超过该域名上限时在这里拒收
+	if s.size > int64(policy.MaxMessageBytes) {
+		recordRejected(addressDomain(to), "too_large")
+		return errMessageTooLarge.err()
+	}
+	if limit := policy.MaxMessages; limit > 0 {
+		n, err := mailStore.Count(to)
+		if err != nil && !retryQueue.hasRoom() {
+			smtpLogger.Error("检查邮箱容量失败", "mailbox", to, "error", err)
+			return errStoreUnavailable.err()
+		}
+		// 存储不可用但重试队列还有空间时不检查容量，n 为 0
+		if n >= limit {
+			recordRejected(addressDomain(to), "mailbox_full")
+			return errMailboxFull.err()
+		}
+	}
+	if limit := policy.MaxBytes; limit > 0 {
+		size, err := mailStore.Size(to)
+		if err != nil && !retryQueue.hasRoom() {
+			smtpLogger.Error("检查邮箱容量失败", "mailbox", to, "error", err)
+			return errStoreUnavailable.err()
+		}
+		// 空邮箱总能收下一封，否则超过上限的邮件会被无限重试；SIZE 声明的大小放不下时提前拒收
+		if size >= limit || size > 0 && size+s.size > limit {
+			recordRejected(addressDomain(to), "mailbox_full")
+			return errMailboxFull.err()
+		}
+	}
+	if err := greylistCheck(s.remoteIP, s.from, to); err != nil {
+		recordRejected(addressDomain(to), "greylist")
+		return err
+	}
+	// 同一收件人只保存一份
+	for _, existing := range s.to {
+		if strings.EqualFold(existing, to) {
+			return nil
+		}
+	}
+	s.to = append(s.to, to)
+	return nil
+}
+
+// Data 收到 DATA 或第一个 BDAT 分块时调用。BDAT 时 go-smtp 在单独的协程中调用 Data，
+// 之后的分块经由管道交给 r，客户端中途 RSET 时 Reset 会与之并发执行，所以先复制信封再读取邮件
+func (s *smtpSession) Data(r io.Reader) error {
+	if s.conn != nil {
+		s.conn.beginData()
+	}
+	tx := *s
+	tx.to = append([]string(nil), s.to...)
+	return handler(&tx, r)
+}
+
+func (s *smtpSession) Reset() {
+	s.from = ""
+	s.to = nil
+	s.size = 0
+	s.utf8 = false
+	s.rcptLimitLogged = false
+	if s.conn != nil {
+		s.conn.endTransaction()
+	}
+}
+
+func (s *smtpSession) Logout() error {
+	observeSMTPSession(-1)
+	return nil
+}
+
+// errRelayDenied 和 errNoSuchUser 为默认的拒收回复，可用 RELAY_REJECT_* 和 RECIPIENT_REJECT_* 覆盖
+var errRelayDenied = smtpReply{550, smtp.EnhancedCode{5, 7, 1}, "smtp_relay_denied"}
+
+// errMessageTooLarge 邮件超过收件人所在域名的大小上限
+var errMessageTooLarge = smtpReply{552, smtp.EnhancedCode{5, 3, 4}, "smtp_message_too_large"}
+
+// errMailboxFull 邮箱达到邮件数或字节数上限，取走邮件后发件方重试即可投递
+var errMailboxFull = smtpReply{452, smtp.EnhancedCode{4, 2, 2}, "smtp_mailbox_full"}
+
+// errTooManyRecipients 收件人数量达到 MAX_RCPT_PER_MESSAGE，发件方应把其余收件人放到下一封邮件（RFC 5321 4.5.3.1.10）
+var errTooManyRecipients = smtpReply{452, smtp.EnhancedCode{4, 5, 3}, "smtp_too_many_recipients"}
+
+// errNeedSMTPUTF8 信封中出现 UTF-8 地址但 MAIL FROM 没有声明 SMTPUTF8（RFC 6531 3.4）
+var errNeedSMTPUTF8 = smtpReply{553, smtp.EnhancedCode{5, 6, 7}, "smtp_need_smtputf8"}
+
+var errNoSuchUser = smtpReply{550, smtp.EnhancedCode{5, 1, 1}, "smtp_no_such_user"}
+
+// maxRejectMessageLength 自定义拒收文字的长度上限，加上状态码后不超过 RFC 5321 的 512 字节回复行
+const maxRejectMessageLength = 400
+
+// parseRejectReply 用增强状态码（如 5.1.1）和文字覆盖默认的拒收回复，留空的项沿用默认值。
+// 增强状态码的类别决定基本状态码：5.x.x 为 550 永久拒收，4.x.x 为 450 让发件方稍后重试
+func parseRejectReply(code, message string, defaults *smtp.SMTPError) (*smtp.SMTPError, error) {
+	reply := *defaults
+	if code = strings.TrimSpace(code); code != "" {
+		parts := strings.Split(code, ".")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("增强状态码 %q 格式应为 5.1.1", code)
+		}
+		var enhanced smtp.EnhancedCode
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 || n > 999 || (i == 0 && n != 4 && n != 5) {
+				return nil, fmt.Errorf("增强状态码 %q 无效，类别只能是 4 或 5", code)
+			}
+			enhanced[i] = n
+		}
+		reply.EnhancedCode = enhanced
+		reply.Code = 550
+		if enhanced[0] == 4 {
+			reply.Code = 450
+		}
+	}
+	if message = strings.TrimSpace(message); message != "" {
+		if len(message) > maxRejectMessageLength {
+			return nil, fmt.Errorf("拒收文字不能超过 %d 字节", maxRejectMessageLength)
+		}
+		for _, r := range message {
+			if r < 0x20 || r > 0x7e {
+				return nil, fmt.Errorf("拒收文字只能包含可打印 ASCII 字符")
+			}
+		}
+		reply.Message = message
+	}
+	return &reply, nil
+}
+
+// recipientAllowed 域名为 catch-all 模式时接收任意地址，否则要求地址在白名单中或邮箱已存在
+func recipientAllowed(to string) (bool, error) {
+	if settingsFor(addressDomain(to)).CatchAll {
+		return true, nil
+	}
+	local := to
+	if i := strings.LastIndex(to, "@"); i >= 0 {
+		local = to[:i]
+	}
+	for _, allowed := range config().RecipientAllowlist {
+		if strings.EqualFold(allowed, to) || strings.EqualFold(allowed, local) {
+			return true, nil
+		}
+	}
+
+	return mailStore.Exists(to)
+}
+
+// normalizeAddress 地址的规范形式：域名按 IDNA 转为小写的 ASCII（punycode），
+// 国际化的本地部分原样保留。投递和接口查询都使用这个形式作为邮箱键
+func normalizeAddress(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr
+	}
+	return addr[:i+1] + normalizeDomain(addr[i+1:])
+}
+
+// normalizeDomain 把域名转为小写的 ASCII 形式，café.example 和 xn--caf-dma.example 得到同一结果；
+// 不是合法的 IDNA 域名时只转小写，由后续的域名检查拒收
+func normalizeDomain(domain string) string {
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		return ascii
+	}
+	return strings.ToLower(domain)
+}
+
+// asciiDomain 把配置中的域名（可带 *. 通配前缀）转为小写的 ASCII 形式
+func asciiDomain(domain string) (string, error) {
+	prefix := ""
+	if isWildcardDomain(domain) {
+		prefix, domain = domain[:2], domain[2:]
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	return prefix + ascii, err
+}
+
+// displayDomain 域名的 Unicode 展示形式，xn--caf-dma.example 显示为 café.example
+func displayDomain(domain string) string {
+	prefix := ""
+	if isWildcardDomain(domain) {
+		prefix, domain = domain[:2], domain[2:]
+	}
+	if u, err := idna.Display.ToUnicode(domain); err == nil {
+		return prefix + u
+	}
+	return prefix + domain
+}
+
+// displayAddress 把地址的域名转为展示形式
+func displayAddress(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr
+	}
+	return addr[:i+1] + displayDomain(addr[i+1:])
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// addressDomain 取邮件地址的域名部分
+func addressDomain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[i+1:]
+	}
+	return ""
+}
+
+// domainAllowed 判断域名是否在 AllowedDomains 中
+func domainAllowed(domain string) bool {
+	_, ok := matchAllowedDomain(domain)
+	return ok
+}
+
+// matchAllowedDomain 返回域名命中的 AllowedDomains 条目，完全匹配优先于通配。
+// *.example.com 匹配任意层级的子域名，但不匹配 example.com 本身
+func matchAllowedDomain(domain string) (string, bool) {
+	if domain == "" || strings.Contains(domain, "*") {
+		return "", false
+	}
+	wildcard := ""
+	for _, d := range config().AllowedDomains {
+		d = strings.TrimSpace(d)
+		if strings.EqualFold(d, domain) {
+			return d, true
+		}
+		if wildcard == "" && domainMatchesWildcard(d, domain) {
+			wildcard = d
+		}
+	}
+	return wildcard, wildcard != ""
+}
+
+// domainMatchesWildcard 判断域名是否匹配 *.后缀 形式的通配
+func domainMatchesWildcard(pattern, domain string) bool {
+	if !isWildcardDomain(pattern) {
+		return false
+	}
+	suffix := strings.ToLower(pattern[1:])
+	domain = strings.ToLower(domain)
+	return len(domain) > len(suffix) && strings.HasSuffix(domain, suffix) && !strings.HasPrefix(domain, ".")
+}
+
+func isWildcardDomain(d string) bool {
+	return strings.HasPrefix(d, "*.")
+}
+
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchAllowedDomain(t *testing.T) {
+	setupTest(t, map[string]string{"ALLOWED_DOMAINS": "*.mail.example.com, example.org, *.example.org, deep.mail.example.com"})
+	for domain, want := range map[string]string{
+		"a.mail.example.com":     "*.mail.example.com",
+		"b.a.mail.example.com":   "*.mail.example.com",
+		"x.y.z.mail.example.com": "*.mail.example.com",
+		"A.Mail.Example.COM":     "*.mail.example.com",
+		// 完全匹配优先于通配
+		"deep.mail.example.com":   "deep.mail.example.com",
+		"a.deep.mail.example.com": "*.mail.example.com",
+		"example.org":             "example.org",
+		"sub.example.org":         "*.example.org",
+		// *.mail.example.com 不匹配 mail.example.com 本身和它的上级域名
+		"mail.example.com":      "",
+		"example.com":           "",
+		"x.example.com":         "",
+		"evilmail.example.com":  "",
+		"mail.example.com.evil": "",
+		".mail.example.com":     "",
+		"*.mail.example.com":    "",
+		"":                      "",
+	} {
+		got, ok := matchAllowedDomain(domain)
+		if got != want || ok != (want != "") {
+			t.Errorf("matchAllowedDomain(%q) = %q, %v，应为 %q", domain, got, ok, want)
+		}
+	}
+}
+
+// TestRcptWildcardDomains SMTP 收件时按通配规则接受任意层级的子域名
+func TestRcptWildcardDomains(t *testing.T) {
+	setupTest(t, map[string]string{"ALLOWED_DOMAINS": "*.mail.example.com", "SMTP_HOSTNAME": "mx.example.com"})
+	c, err := smtp.Dial(startTestSMTP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	for to, accepted := range map[string]bool{
+		"user@a.mail.example.com":      true,
+		"user@b.a.mail.example.com":    true,
+		"user@x.y.z.mail.example.com":  true,
+		"user@mail.example.com":        false,
+		"user@example.com":             false,
+		"user@othermail.example.com":   false,
+		"user@a.mail.example.com.evil": false,
+	} {
+		if err := c.Rcpt(to); (err == nil) != accepted {
+			t.Errorf("RCPT TO %s: %v", to, err)
+		}
+	}
+}
+
+// smtpTestConn 直接收发 SMTP 命令，用于 net/smtp 不支持的 BDAT 和不带 SMTPUTF8 参数的 MAIL FROM
+type smtpTestConn struct {
+	t  *testing.T
+	tp *textproto.Conn
+}
+
+func dialTestSMTP(t *testing.T, addr string) *smtpTestConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &smtpTestConn{t: t, tp: textproto.NewConn(conn)}
+	t.Cleanup(func() { c.tp.Close() })
+	if _, _, err := c.tp.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// cmd 发送一条命令，回复码不是 want 时测试失败，返回回复内容
+func (c *smtpTestConn) cmd(want int, format string, args ...any) string {
+	c.t.Helper()
+	if err := c.tp.PrintfLine(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.reply(want, fmt.Sprintf(format, args...))
+}
+
+// bdat 发送一个 BDAT 分块，分块内容原样发送，不做点转义
+func (c *smtpTestConn) bdat(want int, chunk string, last bool) string {
+	c.t.Helper()
+	command := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		command += " LAST"
+	}
+	fmt.Fprintf(c.tp.W, "%s\r\n%s", command, chunk)
+	if err := c.tp.W.Flush(); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.reply(want, command)
+}
+
+func (c *smtpTestConn) reply(want int, command string) string {
+	c.t.Helper()
+	_, msg, err := c.tp.ReadResponse(want)
+	if err != nil {
+		c.t.Fatalf("%s: %v", command, err)
+	}
+	return msg
+}
+
+// TestSMTPUTF8Recipient 国际化地址经 SMTPUTF8 投递，Unicode 和 punycode 两种写法都能查到同一个邮箱
+func TestSMTPUTF8Recipient(t *testing.T) {
+	setupTest(t, map[string]string{"ALLOWED_DOMAINS": "café.test"})
+	smtpAddr := startTestSMTP(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	// net/smtp 在服务端声明 SMTPUTF8 时给 MAIL FROM 加上该参数
+	body := "From: 发件人 <sender@example.com>\nTo: 用户@café.test\nSubject: 你好\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: 8bit\n\n验证码 482913\n"
+	if err := sendTestMail(t, smtpAddr, "发件人@例子.example", []string{"用户@Café.TEST"}, body); err != nil {
+		t.Fatal(err)
+	}
+
+	mails, _ := mailStore.List("用户@xn--caf-dma.test")
+	if len(mails) != 1 {
+		t.Fatalf("邮箱中有 %d 封邮件", len(mails))
+	}
+	if mails[0].Subject != "你好" || !strings.Contains(mails[0].Text, "验证码 482913") || mails[0].From != "发件人@例子.example" {
+		t.Errorf("邮件 %+v", mails[0])
+	}
+
+	for _, address := range []string{"用户@café.test", "用户@xn--caf-dma.test", "用户@CAFÉ.test"} {
+		var resp struct {
+			Data struct {
+				Mail struct {
+					To        string `json:"to"`
+					ToDisplay string `json:"to_display"`
+				} `json:"mail"`
+			} `json:"data"`
+		}
+		path := "/api/v1/mailboxes/" + url.PathEscape(address) + "/messages/latest"
+		if code := getJSON(t, srv, "GET", path, &resp); code != 200 {
+			t.Fatalf("GET %s: %d", address, code)
+		}
+		if m := resp.Data.Mail; m.To != "用户@xn--caf-dma.test" || m.ToDisplay != "用户@café.test" {
+			t.Errorf("%s: to = %q，to_display = %q", address, m.To, m.ToDisplay)
+		}
+	}
+}
+
+// TestSMTPUTF8Required 没有声明 SMTPUTF8 时拒绝信封中的 UTF-8 地址
+func TestSMTPUTF8Required(t *testing.T) {
+	setupTest(t, map[string]string{"ALLOWED_DOMAINS": "café.test"})
+	c := dialTestSMTP(t, startTestSMTP(t))
+	c.cmd(250, "EHLO client.example.com")
+	c.cmd(553, "MAIL FROM:<发件人@例子.example>")
+	c.cmd(250, "MAIL FROM:<sender@example.com>")
+	c.cmd(553, "RCPT TO:<用户@café.test>")
+	// punycode 写法是 ASCII，不需要 SMTPUTF8
+	c.cmd(250, "RCPT TO:<user@xn--caf-dma.test>")
+	c.cmd(250, "RSET")
+	c.cmd(250, "MAIL FROM:<发件人@例子.example> SMTPUTF8 BODY=8BITMIME")
+	c.cmd(250, "RCPT TO:<用户@café.test>")
+}
+
+// TestBDAT 分块发送的邮件按原样拼接后保存，分块边界可以落在换行和多字节字符中间
+func TestBDAT(t *testing.T) {
+	setupTest(t, map[string]string{"STORE_RAW": "true"})
+	c := dialTestSMTP(t, startTestSMTP(t))
+	if ehlo := c.cmd(250, "EHLO client.example.com"); !strings.Contains(ehlo, "CHUNKING") || !strings.Contains(ehlo, "8BITMIME") {
+		t.Errorf("EHLO 没有声明 CHUNKING 和 8BITMIME: %q", ehlo)
+	}
+
+	raw := "From: sender@example.com\r\nTo: user@test.local\r\nSubject: chunked\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n" +
+		"验证码 482913\r\n.leading dot\r\n..two dots\r\n" + strings.Repeat("line of text\r\n", 100)
+	// 切在 \r 和 \n 之间，以及 "验" 的三个字节中间
+	split1 := strings.Index(raw, "\r\n\r\n") + 1
+	split2 := strings.Index(raw, "验") + 1
+	c.cmd(250, "MAIL FROM:<sender@example.com> BODY=8BITMIME")
+	c.cmd(250, "RCPT TO:<user@test.local>")
+	c.bdat(250, raw[:split1], false)
+	c.bdat(250, raw[split1:split2], false)
+	c.bdat(250, raw[split2:len(raw)-10], false)
+	c.bdat(250, raw[len(raw)-10:], true)
+
+	m, ok, _ := mailStore.Latest("user@test.local")
+	if !ok {
+		t.Fatal("没有收到邮件")
+	}
+	// BDAT 不做点转义，以点开头的行原样保存
+	if string(m.raw) != raw {
+		t.Errorf("拼接后的原始邮件不一致:\n得到 %q\n应为 %q", m.raw, raw)
+	}
+	if m.Subject != "chunked" || !strings.HasPrefix(m.Text, "验证码 482913\r\n.leading dot\r\n..two dots\r\n") {
+		t.Errorf("Subject = %q，Text = %q", m.Subject, m.Text[:min(len(m.Text), 60)])
+	}
+
+	// 只有 BDAT 0 LAST 结束的邮件，之后同一连接还能用 DATA 发送
+	c.cmd(250, "MAIL FROM:<sender@example.com>")
+	c.cmd(250, "RCPT TO:<user@test.local>")
+	c.bdat(250, "Subject: second\r\n\r\nbody\r\n", false)
+	c.bdat(250, "", true)
+	c.cmd(250, "MAIL FROM:<sender@example.com>")
+	c.cmd(250, "RCPT TO:<user@test.local>")
+	c.cmd(354, "DATA")
+	c.cmd(250, "Subject: third\r\n\r\nbody\r\n.")
+	if n, _ := mailStore.Count("user@test.local"); n != 3 {
+		t.Errorf("收到 %d 封邮件，应为 3", n)
+	}
+}
+
+// TestBDATSizeLimit 拼接后的大小按服务的上限和收件人域名的上限检查
+func TestBDATSizeLimit(t *testing.T) {
+	setupTest(t, map[string]string{"ALLOWED_DOMAINS": "test.local,small.test", "DOMAIN_POLICIES": "small.test:max_message_bytes=2048"})
+	addr := startTestSMTP(t)
+	c := dialTestSMTP(t, addr)
+	c.cmd(250, "EHLO client.example.com")
+	chunk := strings.Repeat(strings.Repeat("x", 70)+"\r\n", 10)
+
+	// 每个分块都在上限以内，合计超过 small.test 的上限
+	c.cmd(250, "MAIL FROM:<sender@example.com>")
+	c.cmd(250, "RCPT TO:<user@small.test>")
+	c.bdat(250, "Subject: big\r\n\r\n"+chunk, false)
+	c.bdat(250, chunk, false)
+	c.bdat(552, chunk, true)
+	if n, _ := mailStore.Count("user@small.test"); n != 0 {
+		t.Errorf("超过域名上限的邮件被保存了 %d 封", n)
+	}
+
+	// 拒收后断开连接，之后重新连接发送
+	if _, err := c.tp.ReadLine(); err == nil {
+		t.Error("BDAT 被拒收后连接应断开")
+	}
+	c = dialTestSMTP(t, addr)
+	c.cmd(250, "EHLO client.example.com")
+	c.cmd(250, "MAIL FROM:<sender@example.com>")
+	c.cmd(250, "RCPT TO:<user@small.test>")
+	c.bdat(250, "Subject: ok\r\n\r\n"+chunk, true)
+	if n, _ := mailStore.Count("user@small.test"); n != 1 {
+		t.Errorf("重新连接后发送的邮件收到 %d 封", n)
+	}
+
+	// 合计超过服务的上限（所有域名中最大的上限）时 go-smtp 在中途直接拒收，同样断开连接
+	large := strings.Repeat(chunk, maxMessageBytes/len(chunk)/2+1)
+	c.cmd(250, "MAIL FROM:<sender@example.com>")
+	c.cmd(250, "RCPT TO:<user@test.local>")
+	c.bdat(250, "Subject: huge\r\n\r\n"+large, false)
+	c.bdat(552, large, true)
+	if _, err := c.tp.ReadLine(); err == nil {
+		t.Error("BDAT 被拒收后连接应断开")
+	}
+	if n, _ := mailStore.Count("user@test.local"); n != 0 {
+		t.Errorf("超过服务上限的邮件被保存了 %d 封", n)
+	}
+
+	// DATA 被拒收后连接继续可用
+	c = dialTestSMTP(t, addr)
+	c.cmd(250, "EHLO client.example.com")
+	c.cmd(250, "MAIL FROM:<sender@example.com>")
+	c.cmd(250, "RCPT TO:<user@small.test>")
+	c.cmd(354, "DATA")
+	c.cmd(552, "Subject: big\r\n\r\n%s%s%s.", chunk, chunk, chunk)
+	c.cmd(250, "MAIL FROM:<sender@example.com>")
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timeoutListener 为每个 SMTP 连接加上空闲、单条命令和整个事务的超时
+type timeoutListener struct {
+	net.Listener
+}
+
+// smtpConns 按远端地址登记连接，会话通过 ConnectionState.RemoteAddr 找到自己的连接
+var smtpConns sync.Map
+
+func (l timeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &timeoutConn{Conn: conn}
+	smtpConns.Store(conn.RemoteAddr().String(), tc)
+	return tc, nil
+}
+
+// timeoutConn 自己管理读超时：发出响应后等待下一条命令用 SMTP_IDLE_TIMEOUT，
+// 命令或 DATA 进行中两次读之间用 SMTP_COMMAND_TIMEOUT，MAIL FROM 之后整个事务不超过 SMTP_TRANSACTION_TIMEOUT。
+// 超时后先回复 421 再断开。BDAT 事务中回复 552 后也断开连接，见 Write
+type timeoutConn struct {
+	net.Conn
+
+	mu              sync.Mutex
+	awaitingCommand bool
+	greeted         bool
+	tlsUpgraded     bool
+	txDeadline      time.Time
+	timedOut        bool
+	// lastReply 最近一次回复的状态码，DATA 之后为 354，据此区分 Data 由 DATA 还是 BDAT 触发
+	lastReply string
+	// bdat 当前事务通过 BDAT 传输邮件
+	bdat bool
+	// closed 已在 BDAT 拒收后断开，之后不再接受新的事务
+	closed bool
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	timeout, reason := config().SMTPCommandTimeout, "command"
+	if c.awaitingCommand {
+		timeout, reason = config().SMTPIdleTimeout, "idle"
+	}
+	deadline := time.Now().Add(timeout)
+	if !c.txDeadline.IsZero() && c.txDeadline.Before(deadline) {
+		deadline, reason = c.txDeadline, "transaction"
+	}
+	c.mu.Unlock()
+
+	// 覆盖 go-smtp 自己设置的读超时
+	c.Conn.SetReadDeadline(deadline)
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.awaitingCommand = false
+		c.mu.Unlock()
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		c.timeout(reason)
+	}
+	return n, err
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	// 问候语之后再出现 220 只可能是 STARTTLS 的就绪响应，之后的数据都在 TLS 中
+	if c.greeted && strings.HasPrefix(string(p), "220 ") {
+		c.tlsUpgraded = true
+	}
+	c.greeted = true
+	c.awaitingCommand = true
+	if len(p) >= 3 {
+		c.lastReply = string(p[:3])
+	}
+	// BDAT 中途回复 552 后，发件方可能已经流水线发出了后面的分块，无法再从中找到下一条命令；
+	// go-smtp v0.15.0 在这之后仍在运行的 Data 协程也会与同一连接上的下一封邮件争用内部的结果通道
+	closeAfter := c.bdat && strings.HasPrefix(string(p), "552 ")
+	if closeAfter {
+		c.closed = true
+	}
+	timedOut := c.timedOut
+	c.mu.Unlock()
+
+	if timedOut {
+		return 0, net.ErrClosed
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(config().SMTPCommandTimeout))
+	n, err := c.Conn.Write(p)
+	if closeAfter {
+		smtpLogger.Info("BDAT 事务被拒收，断开连接", "ip", c.RemoteAddr().String())
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+// timeout 回复 421 并关闭连接；STARTTLS 之后无法在 TLS 之外写明文，只关闭连接
+func (c *timeoutConn) timeout(reason string) {
+	c.mu.Lock()
+	if c.timedOut {
+		c.mu.Unlock()
+		return
+	}
+	c.timedOut = true
+	upgraded := c.tlsUpgraded
+	c.mu.Unlock()
+
+	smtpLogger.Info("SMTP 连接超时，断开", "ip", c.RemoteAddr().String(), "reason", reason)
+	if !upgraded {
+		c.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(c.Conn, "421 4.4.2 %s Error: timeout exceeded\r\n", config().SMTPHostname)
+	}
+	c.Conn.Close()
+}
+
+func (c *timeoutConn) Close() error {
+	smtpConns.Delete(c.RemoteAddr().String())
+	return c.Conn.Close()
+}
+
+// beginTransaction MAIL FROM 时开始计算事务超时
+func (c *timeoutConn) beginTransaction() {
+	c.mu.Lock()
+	c.txDeadline = time.Now().Add(config().SMTPTransactionTimeout)
+	c.mu.Unlock()
+}
+
+// beginData Data 开始读取邮件时调用，之前的回复不是 354 说明邮件通过 BDAT 传输
+func (c *timeoutConn) beginData() {
+	c.mu.Lock()
+	c.bdat = c.lastReply != "354"
+	c.mu.Unlock()
+}
+
+// endTransaction DATA 结束或 RSET 时清除事务超时
+func (c *timeoutConn) endTransaction() {
+	c.mu.Lock()
+	c.txDeadline = time.Time{}
+	c.bdat = false
+	c.mu.Unlock()
+}
+
+// isClosed 连接是否已在 BDAT 拒收后断开。go-smtp 仍会处理已读入缓冲区的命令，
+// 断开后拒绝 MAIL FROM，不会在同一连接上开始下一封邮件
+func (c *timeoutConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// connFor 找到远端地址对应的连接，找不到时返回 nil
+func connFor(addr net.Addr) *timeoutConn {
+	if addr == nil {
+		return nil
+	}
+	if tc, ok := smtpConns.Load(addr.String()); ok {
+		return tc.(*timeoutConn)
+	}
+	return nil
+}
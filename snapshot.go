@@ -0,0 +1,215 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 内存存储快照：正常退出时把所有邮箱写入 SNAPSHOT_PATH，下次启动时读回后删除，
+// 重启不会丢掉用户正在等待的验证码邮件。路径以 .gz 结尾时使用 gzip 压缩
+const snapshotVersion = 1
+
+// memorySnapshot 快照文件内容，邮件沿用持久化存储的编码，每个邮箱按投递顺序保存
+type memorySnapshot struct {
+	Version   int                 `json:"version"`
+	SavedAt   time.Time           `json:"saved_at"`
+	Mailboxes map[string][]string `json:"mailboxes"`
+	// 存储的 UIDVALIDITY，恢复后沿用，IMAP 客户端不必重新同步；旧快照中没有
+	UIDValidity uint32 `json:"uid_validity,omitempty"`
+}
+
+// snapshot 复制当前所有邮箱，没有邮件的邮箱（POST /mailboxes 创建的）也会保留
+func (s *memoryStore) snapshot() map[string][]mailContent {
+	mailboxes := make(map[string][]mailContent)
+	for i := range s.shards {
+		for address, mb := range s.shards[i].entries() {
+			mb.mu.RLock()
+			if !mb.deleted {
+				mailboxes[address] = append([]mailContent{}, mb.mails...)
+			}
+			mb.mu.RUnlock()
+		}
+	}
+	return mailboxes
+}
+
+// restore 把快照中的邮箱放回各分片，并重建统计和版本号，启动时在收件之前调用。
+// validity 不为 0 时沿用快照的 UIDVALIDITY 和邮件序号，否则（旧快照）重新编号
+func (s *memoryStore) restore(mailboxes map[string][]mailContent, validity uint32) {
+	if validity != 0 {
+		s.validity = validity
+		for _, mails := range mailboxes {
+			for _, m := range mails {
+				if m.seq > s.seq.Load() {
+					s.seq.Store(m.seq)
+				}
+			}
+		}
+	}
+	for address, mails := range mailboxes {
+		sh := s.shard(address)
+		mb := sh.lock(address, true)
+		mb.mails = mails
+		for i := range mails {
+			if validity == 0 || mails[i].seq == 0 {
+				mails[i].seq = s.seq.Add(1)
+			}
+			mb.size += mailSize(mails[i])
+		}
+		sh.statsMu.Lock()
+		for _, m := range mails {
+			sh.stats.added(m)
+		}
+		sh.statsMu.Unlock()
+		s.access.add(address)
+		mb.mu.Unlock()
+	}
+}
+
+// saveSnapshot 先写临时文件再改名，写到一半退出不会留下损坏的快照
+func saveSnapshot(path string, ms *memoryStore) (int, error) {
+	snap := memorySnapshot{Version: snapshotVersion, SavedAt: time.Now(), Mailboxes: make(map[string][]string), UIDValidity: ms.validity}
+	count := 0
+	for address, mails := range ms.snapshot() {
+		encoded := make([]string, 0, len(mails))
+		for _, m := range mails {
+			value, err := encodeStoredMail(m)
+			if err != nil {
+				return 0, err
+			}
+			encoded = append(encoded, value)
+		}
+		snap.Mailboxes[address] = encoded
+		count += len(mails)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var w io.Writer = tmp
+	var zw *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		zw = gzip.NewWriter(tmp)
+		w = zw
+	}
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return count, os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot 读取并解码快照，不检查是否过期
+func loadSnapshot(path string) (memorySnapshot, map[string][]mailContent, error) {
+	var snap memorySnapshot
+	f, err := os.Open(path)
+	if err != nil {
+		return snap, nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return snap, nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return snap, nil, err
+	}
+	if snap.Version != snapshotVersion {
+		return snap, nil, fmt.Errorf("不支持的快照版本 %d", snap.Version)
+	}
+
+	mailboxes := make(map[string][]mailContent, len(snap.Mailboxes))
+	for address, values := range snap.Mailboxes {
+		mails := make([]mailContent, 0, len(values))
+		for _, value := range values {
+			m, err := decodeStoredMail(value)
+			if err != nil {
+				return snap, nil, fmt.Errorf("邮箱 %s: %w", address, err)
+			}
+			mails = append(mails, m)
+		}
+		mailboxes[address] = mails
+	}
+	return snap, mailboxes, nil
+}
+
+// snapshotStale 开启定时清空（不保留邮件）时，保存之后已经到过清空时间的快照没有意义；
+// 否则按每封邮件的过期时间清理
+func snapshotStale(savedAt, now time.Time) bool {
+	if savedAt.After(now) {
+		return true
+	}
+	return config().DailyCleanup && config().CleanupKeepLast == 0 && !config().CleanupSchedule.next(savedAt).After(now)
+}
+
+// restoreSnapshot 启动时从快照恢复内存存储。快照损坏只记录警告，保留文件待退出时覆盖；
+// 过期的快照直接删除。恢复后立即清理已超过保留时长的邮件
+func restoreSnapshot(ms *memoryStore) {
+	path := config().SnapshotPath
+	snap, mailboxes, err := loadSnapshot(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		storeLogger.Warn("邮件快照无法读取，已跳过", "file", path, "error", err)
+		return
+	}
+
+	now := time.Now()
+	if snapshotStale(snap.SavedAt, now) {
+		storeLogger.Warn("邮件快照已超过保留时长，已跳过", "saved_at", snap.SavedAt.Format(time.RFC3339))
+	} else {
+		ms.restore(mailboxes, snap.UIDValidity)
+		expired, _ := ms.Expire(now)
+		st, _ := ms.Stats(now)
+		log.Printf("已从快照恢复 %d 个邮箱、%d 封邮件（保存于 %s，其中 %d 封已过期删除）",
+			st.Mailboxes, st.Messages, snap.SavedAt.Format("2006-01-02 15:04:05"), expired)
+	}
+	if err := os.Remove(path); err != nil {
+		storeLogger.Error("删除邮件快照失败", "error", err)
+	}
+}
+
+// writeShutdownSnapshot 正常退出时保存快照；平滑升级时新进程已在运行，不再保存
+func writeShutdownSnapshot() {
+	ms, ok := backendStore().(*memoryStore)
+	if !ok || config().SnapshotPath == "" || upgrading.Load() {
+		return
+	}
+	n, err := saveSnapshot(config().SnapshotPath, ms)
+	if err != nil {
+		storeLogger.Error("保存邮件快照失败", "error", err)
+		return
+	}
+	storeLogger.Info("已保存邮件快照", "file", config().SnapshotPath, "messages", n)
+}
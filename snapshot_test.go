@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSnapshotKeepsUIDs 从快照恢复后 UIDVALIDITY 和邮件序号不变，之后的邮件接着编号
+func TestSnapshotKeepsUIDs(t *testing.T) {
+	setupTest(t, nil)
+	ms := newMemoryStore()
+	ms.validity = 12345
+	ms.Append(mailContent{ID: "m1", To: "user@test.local", ReceivedAt: time.Now()})
+	ms.Append(mailContent{ID: "m2", To: "user@test.local", ReceivedAt: time.Now()})
+	path := filepath.Join(t.TempDir(), "snapshot.json.gz")
+	if _, err := saveSnapshot(path, ms); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, mailboxes, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := newMemoryStore()
+	restored.restore(mailboxes, snap.UIDValidity)
+	seq, _ := restored.Sequence()
+	if seq.validity != 12345 || seq.next != 3 {
+		t.Fatalf("恢复后 validity=%d next=%d，应为 12345 和 3", seq.validity, seq.next)
+	}
+	restored.Append(mailContent{ID: "m3", To: "user@test.local", ReceivedAt: time.Now()})
+	mails, _ := restored.List("user@test.local")
+	for i, want := range []uint64{3, 2, 1} {
+		if mails[i].seq != want {
+			t.Errorf("第 %d 封邮件 %s 的序号为 %d，应为 %d", i, mails[i].ID, mails[i].seq, want)
+		}
+	}
+
+	// 旧快照没有 UIDVALIDITY，重新编号
+	legacy := newMemoryStore()
+	legacy.restore(mailboxes, 0)
+	if seq, _ := legacy.Sequence(); seq.validity == 12345 || seq.next != 3 {
+		t.Errorf("旧快照恢复后 validity=%d next=%d", seq.validity, seq.next)
+	}
+}
+
+// populateSnapshotStore 写入几个邮箱，包括附件、内嵌图片、原始邮件、已读标记、过期时间和一个空邮箱。
+// now 应为截到毫秒的 UTC 时间，与 JSON 解码出的时间可以直接比较
+func populateSnapshotStore(t *testing.T, ms *memoryStore, now time.Time) {
+	t.Helper()
+	expires := now.Add(time.Hour)
+	rich := mailContent{ID: "a1", TraceID: "trace-a1", To: "alice@test.local", From: "x@example.com", Subject: "你好",
+		Text: "code 482913", HTML: "<p>code</p>", ReceivedAt: now.Add(-time.Minute), ExpiresAt: &expires,
+		raw: []byte("Subject: hi\r\n\r\ncode 482913\r\n"), ClientIP: "192.0.2.1", Helo: "mx.example.com",
+		DNSBL: []string{"zen.example.org"}, Spam: &spamVerdict{Score: 1.5},
+		Attachments: []attachment{{Filename: "a.txt", ContentType: "text/plain", Size: 2, data: []byte("hi")}},
+		inline:      []inlinePart{{cid: "logo", contentType: "image/png", data: []byte{0x89, 'P', 'N', 'G'}}}}
+	appendAll(t, ms, rich,
+		mailContent{ID: "a2", To: "alice@test.local", Subject: "second", ReceivedAt: now},
+		mailContent{ID: "b1", To: "bob@test.local", Subject: "bob", ReceivedAt: now})
+	ms.SetRead("alice@test.local", "a2", true)
+	ms.Create("empty@test.local")
+}
+
+// utcExpiry 把过期时间统一成 UTC，恢复出的时间点相同但时区可能是 Local
+func utcExpiry(mails []mailContent) []mailContent {
+	for i := range mails {
+		if mails[i].ExpiresAt != nil {
+			expires := mails[i].ExpiresAt.UTC()
+			mails[i].ExpiresAt = &expires
+		}
+	}
+	return mails
+}
+
+// TestSnapshotRoundTrip 退出时保存的快照在启动时完整恢复，随后删除快照文件
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, name := range []string{"snapshot.json", "snapshot.json.gz"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			setupTest(t, map[string]string{"SNAPSHOT_PATH": path, "STORE_RAW": "true"})
+			now := time.Now().UTC().Truncate(time.Millisecond)
+			original := mailStore.(*memoryStore)
+			populateSnapshotStore(t, original, now)
+			writeShutdownSnapshot()
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("没有写入快照: %v", err)
+			}
+
+			restored := newMemoryStore()
+			restoreSnapshot(restored)
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("恢复后应删除快照: %v", err)
+			}
+
+			for _, mailbox := range []string{"alice@test.local", "bob@test.local"} {
+				want, _ := original.List(mailbox)
+				got, _ := restored.List(mailbox)
+				if !reflect.DeepEqual(utcExpiry(got), utcExpiry(want)) {
+					t.Errorf("%s 恢复后不一致:\n得到 %+v\n应为 %+v", mailbox, got, want)
+				}
+				wantSize, _ := original.Size(mailbox)
+				if size, _ := restored.Size(mailbox); size != wantSize {
+					t.Errorf("%s 的字节数 %d，应为 %d", mailbox, size, wantSize)
+				}
+			}
+			if exists, _ := restored.Exists("empty@test.local"); !exists {
+				t.Error("空邮箱应保留")
+			}
+			wantStats, _ := original.Stats(now)
+			if st, _ := restored.Stats(now); st.Mailboxes != wantStats.Mailboxes || st.Messages != wantStats.Messages || st.Bytes != wantStats.Bytes {
+				t.Errorf("恢复后 Stats = %+v，应为 %+v", st, wantStats)
+			}
+		})
+	}
+}
+
+func TestSnapshotRestoreDropsExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json.gz")
+	setupTest(t, map[string]string{"SNAPSHOT_PATH": path})
+	expired := time.Now().Add(-time.Minute)
+	ms := mailStore.(*memoryStore)
+	appendAll(t, ms, mailContent{ID: "old", To: "user@test.local", ReceivedAt: time.Now().Add(-time.Hour), ExpiresAt: &expired},
+		mailContent{ID: "new", To: "user@test.local", ReceivedAt: time.Now()})
+	writeShutdownSnapshot()
+
+	restored := newMemoryStore()
+	restoreSnapshot(restored)
+	mails, _ := restored.List("user@test.local")
+	if got := mailIDs(mails); len(got) != 1 || got[0] != "new" {
+		t.Errorf("恢复后的邮件 %q", got)
+	}
+}
+
+// TestSnapshotSkipped 损坏或过期的快照只记录警告并跳过，不影响启动
+func TestSnapshotSkipped(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, content := range map[string]string{
+		"garbage.json":    "not json",
+		"garbage.json.gz": "not gzip",
+		"version.json":    `{"version": 99, "saved_at": "2024-01-01T00:00:00Z", "mailboxes": {}}`,
+		"mail.json":       `{"version": 1, "saved_at": "2024-01-01T00:00:00Z", "mailboxes": {"a@test.local": ["%%%"]}}`,
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0o600)
+		setupTest(t, map[string]string{"SNAPSHOT_PATH": path})
+		ms := newMemoryStore()
+		restoreSnapshot(ms)
+		if st, _ := ms.Stats(time.Now()); st.Mailboxes != 0 {
+			t.Errorf("%s: 不应恢复任何邮箱", name)
+		}
+		// 损坏的快照保留，退出时被新快照覆盖
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s: 损坏的快照不应删除: %v", name, err)
+		}
+	}
+
+	// 没有快照文件时什么也不做
+	setupTest(t, map[string]string{"SNAPSHOT_PATH": filepath.Join(dir, "missing.json")})
+	restoreSnapshot(newMemoryStore())
+
+	// 开启定时清空时，保存之后已经过了清空时间的快照直接删除
+	path := filepath.Join(dir, "stale.json")
+	setupTest(t, map[string]string{"SNAPSHOT_PATH": path, "DAILY_CLEANUP": "true", "CLEANUP_SCHEDULE": "* * * * *"})
+	ms := mailStore.(*memoryStore)
+	ms.Append(mailContent{ID: "m1", To: "user@test.local", ReceivedAt: time.Now()})
+	if _, err := saveSnapshot(path, ms); err != nil {
+		t.Fatal(err)
+	}
+	snap, _, _ := loadSnapshot(path)
+	snap.SavedAt = time.Now().Add(-2 * time.Minute)
+	data, _ := json.Marshal(snap)
+	os.WriteFile(path, data, 0o600)
+	restored := newMemoryStore()
+	restoreSnapshot(restored)
+	if n, _ := restored.Count("user@test.local"); n != 0 {
+		t.Errorf("过期的快照恢复了 %d 封邮件", n)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("过期的快照应删除: %v", err)
+	}
+}
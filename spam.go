@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// 垃圾邮件评分：配置 SPAM_CHECK_URL 或 SPAM_CHECK_COMMAND 后，每封邮件保存前交给外部评分，
+// 结果记录在邮件的 spam 字段上；设置 SPAM_REJECT_THRESHOLD 后分数达到阈值的邮件在 DATA 阶段拒收。
+// 评分超时或出错时放行，邮件上不带评分
+
+// spamVerdict 外部评分的结果
+type spamVerdict struct {
+	Score   float64 `json:"score"`
+	Verdict string  `json:"verdict,omitempty"`
+}
+
+var errSpamRejected = smtpReply{550, smtp.EnhancedCode{5, 7, 1}, "smtp_spam_rejected"}
+
+// spamCheckEnabled 是否配置了评分
+func spamCheckEnabled() bool {
+	return config().SpamCheckURL != "" || config().SpamCheckCommand != ""
+}
+
+// checkSpam 对原始邮件评分，未配置或评分失败时返回 nil
+func checkSpam(s *smtpSession, raw []byte) (*spamVerdict, error) {
+	if !spamCheckEnabled() {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config().SpamCheckTimeout)
+	defer cancel()
+	if config().SpamCheckURL != "" {
+		return spamCheckHTTP(ctx, s, raw)
+	}
+	return spamCheckCommand(ctx, s, raw)
+}
+
+// spamCheckHTTP 把原始邮件 POST 到 SPAM_CHECK_URL，响应为 {"score": 5.2, "verdict": "spam"}
+func spamCheckHTTP(ctx context.Context, s *smtpSession, raw []byte) (*spamVerdict, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config().SpamCheckURL, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "message/rfc822")
+	req.Header.Set("X-Client-IP", s.remoteIP)
+	req.Header.Set("X-Helo", s.helo)
+	req.Header.Set("X-Mail-From", s.from)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("评分接口返回 %s", resp.Status)
+	}
+	return parseSpamOutput(body)
+}
+
+// spamCheckCommand 通过 sh -c 运行 SPAM_CHECK_COMMAND，原始邮件从标准输入传入，连接信息放在环境变量中。
+// 只看标准输出，不看退出码（spamc -c 判为垃圾邮件时以 1 退出）
+func spamCheckCommand(ctx context.Context, s *smtpSession, raw []byte) (*spamVerdict, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", config().SpamCheckCommand)
+	cmd.Stdin = bytes.NewReader(raw)
+	cmd.Env = append(os.Environ(),
+		"TEMPMAIL_CLIENT_IP="+s.remoteIP,
+		"TEMPMAIL_HELO="+s.helo,
+		"TEMPMAIL_MAIL_FROM="+s.from,
+	)
+	// 超时后子进程可能还占着输出管道，最多再等一秒
+	cmd.WaitDelay = time.Second
+	out, runErr := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	v, err := parseSpamOutput(out)
+	if err != nil && runErr != nil {
+		return nil, fmt.Errorf("%v: %v", runErr, err)
+	}
+	return v, err
+}
+
+// parseSpamOutput 接受 JSON {"score": 5.2, "verdict": "spam"}，或以分数开头的文本，
+// 如 spamc -c 输出的 "5.2/5.0"
+func parseSpamOutput(out []byte) (*spamVerdict, error) {
+	text := strings.TrimSpace(string(out))
+	if strings.HasPrefix(text, "{") {
+		var v spamVerdict
+		if err := json.Unmarshal([]byte(text), &v); err != nil {
+			return nil, fmt.Errorf("评分结果无效: %v", err)
+		}
+		return &v, nil
+	}
+	field, _, _ := strings.Cut(text, "/")
+	if fields := strings.Fields(field); len(fields) > 0 {
+		field = fields[0]
+	}
+	score, err := strconv.ParseFloat(field, 64)
+	if err != nil {
+		return nil, fmt.Errorf("评分结果无效: %q", text)
+	}
+	return &spamVerdict{Score: score}, nil
+}
+
+// spamRejected 分数是否达到拒收阈值，阈值为 0 时不拒收
+func spamRejected(v *spamVerdict) bool {
+	return v != nil && config().SpamRejectThreshold > 0 && v.Score >= config().SpamRejectThreshold
+}
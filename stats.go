@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const statsBuckets = 24 * 60
+
+// storeCounters 存储在投递、取出、删除、清空时增量维护的统计，由所属存储的锁保护
+type storeCounters struct {
+	messages    int
+	bytes       int64
+	lastCleanup time.Time
+	// 按分钟统计最近 24 小时收到的邮件数
+	receivedBuckets [statsBuckets]int
+	receivedMinute  [statsBuckets]int64
+}
+
+// rejectedTotal 被拒绝的投递数，拒绝发生在锁外，使用原子操作
+var rejectedTotal uint64
+
+// 启动以来保存和通过接口取出的邮件数，用于周期统计日志
+var receivedTotal, fetchedTotal uint64
+
+// mailSize 估算一封邮件占用的字节数，包括发件方连接信息。投递和删除时按同一封邮件计算，
+// 邮箱清空后累计值正好回到 0
+func mailSize(m mailContent) int64 {
+	size := int64(len(m.From) + len(m.To) + len(m.Subject) + len(m.Text) + len(m.HTML) + len(m.raw) +
+		len(m.ClientIP) + len(m.Helo))
+	for _, a := range m.Attachments {
+		size += int64(len(a.Filename) + len(a.data))
+	}
+	for _, p := range m.inline {
+		size += int64(len(p.cid) + len(p.data))
+	}
+	return size
+}
+
+// added 记录一封新邮件
+func (sc *storeCounters) added(m mailContent) {
+	sc.addedSized(m.ReceivedAt, mailSize(m))
+}
+
+// addedSized 按给定的字节数记录一封新邮件，用于启动时从编码后的邮件重建统计
+func (sc *storeCounters) addedSized(receivedAt time.Time, size int64) {
+	sc.messages++
+	sc.bytes += size
+
+	minute := receivedAt.Unix() / 60
+	i := minute % statsBuckets
+	if sc.receivedMinute[i] != minute {
+		sc.receivedMinute[i] = minute
+		sc.receivedBuckets[i] = 0
+	}
+	sc.receivedBuckets[i]++
+}
+
+// removed 记录删除的邮件
+func (sc *storeCounters) removed(mails ...mailContent) {
+	for _, m := range mails {
+		sc.messages--
+		sc.bytes -= mailSize(m)
+	}
+}
+
+// removedSized 记录删除的若干封邮件及其总字节数
+func (sc *storeCounters) removedSized(n int, size int64) {
+	sc.messages -= n
+	sc.bytes -= size
+}
+
+// cleared 清空所有邮箱时调用
+func (sc *storeCounters) cleared(now time.Time) {
+	sc.messages = 0
+	sc.bytes = 0
+	sc.lastCleanup = now
+}
+
+// receivedSince 统计最近若干分钟收到的邮件数
+func (sc *storeCounters) receivedSince(now time.Time, minutes int64) int {
+	current := now.Unix() / 60
+	total := 0
+	for i := range sc.receivedBuckets {
+		if age := current - sc.receivedMinute[i]; age >= 0 && age < minutes {
+			total += sc.receivedBuckets[i]
+		}
+	}
+	return total
+}
+
+// recordRejected 记录一次被拒绝的投递
+func recordRejected(domain, reason string) {
+	atomic.AddUint64(&rejectedTotal, 1)
+	smtpLogger.Debug("拒收", "domain", domain, "reason", reason)
+	observeRejected(domain, reason)
+}
+
+// recordReceived 记录一封保存成功的邮件
+func recordReceived(domain string) {
+	atomic.AddUint64(&receivedTotal, 1)
+	observeReceived(domain)
+}
+
+// recordFetched 记录一封通过接口取出或读取的邮件
+func recordFetched() {
+	atomic.AddUint64(&fetchedTotal, 1)
+}
+
+// startStatsLogger 设置 STATS_INTERVAL 后定期打印一行统计，不运行 Prometheus 时用作心跳。
+// 收到和取出的数量为距上一次打印的增量，之后清零；累计值一直保留
+func startStatsLogger() {
+	if config().StatsInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config().StatsInterval)
+		defer ticker.Stop()
+		var lastReceived, lastFetched uint64
+		for range ticker.C {
+			received, fetched := atomic.LoadUint64(&receivedTotal), atomic.LoadUint64(&fetchedTotal)
+			st, err := mailStore.Stats(time.Now())
+			if err != nil {
+				storeLogger.Error("统计失败", "error", err)
+				continue
+			}
+			var mem runtime.MemStats
+			runtime.ReadMemStats(&mem)
+			log.Printf("统计: 邮箱 %d 个，邮件 %d 封，估算 %d 字节，堆内存 %d 字节；最近 %s 收到 %d 封、取出 %d 封，累计收到 %d 封、取出 %d 封",
+				st.Mailboxes, st.Messages, st.Bytes, mem.HeapAlloc, config().StatsInterval,
+				received-lastReceived, fetched-lastFetched, received, fetched)
+			lastReceived, lastFetched = received, fetched
+		}
+	}()
+}
+
+func handleAdminStats(c *gin.Context) {
+	top, err := strconv.Atoi(c.DefaultQuery("top", strconv.Itoa(defaultTopMailboxes)))
+	if err != nil || top < 0 || top > maxTopMailboxes {
+		c.JSON(400, gin.H{"error": msg("out_of_range", "top", 0, maxTopMailboxes)})
+		return
+	}
+	st, err := mailStore.Stats(time.Now())
+	if err != nil {
+		storeUnavailable(c, err)
+		return
+	}
+	stats := adminStatsResponse{
+		Mailboxes:        st.Mailboxes,
+		Messages:         st.Messages,
+		Bytes:            st.Bytes,
+		ReceivedLastHour: st.ReceivedLastHour,
+		ReceivedLastDay:  st.ReceivedLastDay,
+		Rejected:         atomic.LoadUint64(&rejectedTotal),
+		FileBytes:        st.FileBytes,
+	}
+	if !st.LastCleanup.IsZero() {
+		stats.LastCleanup = &st.LastCleanup
+	}
+	if next := nextCleanupTime(); !next.IsZero() {
+		stats.NextCleanup = &next
+	}
+	if top > 0 {
+		if stats.TopMailboxes, err = largestMailboxes(top); err != nil {
+			storeUnavailable(c, err)
+			return
+		}
+	}
+
+	c.JSON(200, stats)
+}
+
+const (
+	defaultTopMailboxes = 10
+	maxTopMailboxes     = 100
+)
+
+// largestMailboxes 占用字节数最多的 n 个邮箱，字节数相同时按地址排序
+func largestMailboxes(n int) ([]mailboxSummary, error) {
+	summaries, err := mailStore.Mailboxes("")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Bytes != summaries[j].Bytes {
+			return summaries[i].Bytes > summaries[j].Bytes
+		}
+		return summaries[i].Address < summaries[j].Address
+	})
+	return summaries[:min(n, len(summaries))], nil
+}
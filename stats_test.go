@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStoreCountersReceivedSince(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 30, 0, time.UTC)
+	var sc storeCounters
+	for _, ago := range []time.Duration{0, 30 * time.Minute, 59 * time.Minute, 2 * time.Hour, 23*time.Hour + 59*time.Minute, 25 * time.Hour} {
+		sc.addedSized(now.Add(-ago), 10)
+	}
+	if got := sc.receivedSince(now, 60); got != 3 {
+		t.Errorf("最近一小时 %d 封，应为 3", got)
+	}
+	if got := sc.receivedSince(now, 24*60); got != 5 {
+		t.Errorf("最近一天 %d 封，应为 5", got)
+	}
+	if sc.messages != 6 || sc.bytes != 60 {
+		t.Errorf("累计 %d 封 %d 字节", sc.messages, sc.bytes)
+	}
+
+	// 一天后同一分钟的桶被复用，旧的计数不再算入
+	later := now.Add(24 * time.Hour)
+	sc.addedSized(later, 10)
+	if got := sc.receivedSince(later, 60); got != 1 {
+		t.Errorf("一天后最近一小时 %d 封，应为 1", got)
+	}
+	if got := sc.receivedSince(later, 24*60); got != 1 {
+		t.Errorf("一天后最近一天 %d 封，应为 1", got)
+	}
+
+	sc.removedSized(2, 20)
+	sc.cleared(later)
+	if sc.messages != 0 || sc.bytes != 0 || !sc.lastCleanup.Equal(later) {
+		t.Errorf("清空后 %+v", sc)
+	}
+}
+
+func TestStoreStats(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		now := time.Now()
+		recent := func(to, id string, ago time.Duration) mailContent {
+			m := testMail(to, id, 0)
+			m.ReceivedAt = now.Add(-ago).Truncate(time.Millisecond)
+			return m
+		}
+		appendAll(t, s, recent("a@test.local", "a1", 2*time.Hour), recent("a@test.local", "a2", time.Minute),
+			recent("b@test.local", "b1", time.Minute))
+
+		st, err := s.Stats(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mailboxes != 2 || st.Messages != 3 || st.Bytes <= 0 || st.ReceivedLastHour != 2 || st.ReceivedLastDay != 3 {
+			t.Errorf("Stats = %+v", st)
+		}
+
+		// 取出和删除后邮件数减少，收到的数量不变
+		s.PopLatest("a@test.local")
+		s.Delete("b@test.local")
+		if st, _ := s.Stats(now); st.Mailboxes != 1 || st.Messages != 1 || st.ReceivedLastDay != 3 {
+			t.Errorf("取出和删除后 Stats = %+v", st)
+		}
+	})
+}
+
+// checkStoreBytes 每个邮箱的 Size、邮箱列表中的字节数和 Stats 的总字节数一致
+func checkStoreBytes(t *testing.T, s MailStore, step string, mailboxes ...string) int64 {
+	t.Helper()
+	summaries, err := s.Mailboxes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := make(map[string]int64)
+	for _, sum := range summaries {
+		listed[sum.Address] = sum.Bytes
+	}
+	var total int64
+	for _, mailbox := range mailboxes {
+		size, err := s.Size(mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size < 0 || listed[mailbox] != size {
+			t.Errorf("%s: %s 的 Size = %d，邮箱列表中为 %d", step, mailbox, size, listed[mailbox])
+		}
+		total += size
+	}
+	if st, _ := s.Stats(testEpoch); st.Bytes != total {
+		t.Errorf("%s: Stats.Bytes = %d，各邮箱合计 %d", step, st.Bytes, total)
+	}
+	return total
+}
+
+// mailSizes 若干封邮件按 mailSize 计算的字节数之和
+func mailSizes(mails ...mailContent) int64 {
+	var total int64
+	for _, m := range mails {
+		total += mailSize(m)
+	}
+	return total
+}
+
+// TestStoreBytesReturnToZero 各存储都按 mailSize 统计字节数，经过投递、取出、删除、过期和清空后正好回到 0
+func TestStoreBytesReturnToZero(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		const a, b = "a@test.local", "b@test.local"
+		// Redis 按最后一封邮件的过期时间给列表设置 TTL，过期时间要晚于真实的当前时间，由 Expire 删除
+		expires := time.Now().Add(time.Hour)
+		rich := func(to, id string, n int) mailContent {
+			m := testMail(to, id, n)
+			m.HTML = "<p>" + strings.Repeat("newsletter ", 50*(n+1)) + "</p>"
+			m.raw = []byte("Subject: subject " + id + "\r\n\r\nbody " + id + "\r\n")
+			m.ClientIP, m.Helo = "192.0.2.1", "mx.example.com"
+			m.Attachments = []attachment{{Filename: "a.txt", ContentType: "text/plain", Size: 2, data: []byte("hi")}}
+			m.inline = []inlinePart{{cid: "logo", contentType: "image/png", data: []byte{0x89, 'P', 'N', 'G'}}}
+			return m
+		}
+		old := rich(a, "a0", 0)
+		old.ExpiresAt = &expires
+		mails := []mailContent{old, rich(a, "a1", 1), rich(a, "a2", 2), rich(a, "a3", 3), rich(b, "b1", 4), testMail(b, "b2", 5)}
+		appendAll(t, s, mails...)
+		if total, want := checkStoreBytes(t, s, "投递后", a, b), mailSizes(mails...); total != want {
+			t.Fatalf("投递后总字节数 %d，按 mailSize 应为 %d", total, want)
+		}
+		// 已读标记不影响字节数
+		s.SetRead(a, "a1", true)
+		if total, want := checkStoreBytes(t, s, "标记已读后", a, b), mailSizes(mails...); total != want {
+			t.Errorf("标记已读后总字节数 %d，应为 %d", total, want)
+		}
+		s.PopLatest(a)
+		if total, want := checkStoreBytes(t, s, "取出后", a, b), mailSizes(mails[0], mails[1], mails[2], mails[4], mails[5]); total != want {
+			t.Errorf("取出后总字节数 %d，应为 %d", total, want)
+		}
+		s.Remove(a, []string{"a1", "missing"})
+		if total, want := checkStoreBytes(t, s, "删除指定邮件后", a, b), mailSizes(mails[0], mails[2], mails[4], mails[5]); total != want {
+			t.Errorf("删除指定邮件后总字节数 %d，应为 %d", total, want)
+		}
+		if n, _ := s.Expire(expires.Add(time.Minute)); n != 1 {
+			t.Errorf("Expire 返回 %d", n)
+		}
+		if total, want := checkStoreBytes(t, s, "过期清理后", a, b), mailSizes(mails[2], mails[4], mails[5]); total != want {
+			t.Errorf("过期清理后总字节数 %d，应为 %d", total, want)
+		}
+		s.PopLatest(a)
+		if total := checkStoreBytes(t, s, "a 取空后", a, b); total == 0 {
+			t.Error("b 还有邮件，总字节数不应为 0")
+		}
+		if size, _ := s.Size(a); size != 0 {
+			t.Errorf("取空后 %s 的字节数 %d", a, size)
+		}
+		s.Delete(b)
+		if total := checkStoreBytes(t, s, "全部删除后", a, b); total != 0 {
+			t.Errorf("全部删除后总字节数 %d", total)
+		}
+
+		// 清空后重新投递同样的邮件，字节数与第一次相同
+		appendAll(t, s, rich(a, "a1", 1))
+		first := checkStoreBytes(t, s, "再次投递后", a, b)
+		s.Clear()
+		if total := checkStoreBytes(t, s, "清空后", a, b); total != 0 {
+			t.Errorf("清空后总字节数 %d", total)
+		}
+		appendAll(t, s, rich(a, "a1", 1))
+		if again := checkStoreBytes(t, s, "清空后投递", a, b); again != first {
+			t.Errorf("同一封邮件两次投递的字节数 %d 和 %d", first, again)
+		}
+	})
+}
+
+func TestAdminStats(t *testing.T) {
+	setupTest(t, map[string]string{"ADMIN_API_KEYS": "secret"})
+	r := newRouter()
+	mailStore.Append(mailContent{ID: "a1", To: "a@test.local", Text: "short", ReceivedAt: time.Now()})
+	mailStore.Append(mailContent{ID: "b1", To: "b@test.local", Text: "a much longer message body", ReceivedAt: time.Now()})
+	mailStore.Append(mailContent{ID: "c1", To: "c@test.local", Text: "medium body", ReceivedAt: time.Now()})
+
+	get := func(query string) (int, adminStatsResponse) {
+		req := httptest.NewRequest("GET", "/api/v1/admin/stats"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Data adminStatsResponse `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data
+	}
+
+	code, stats := get("")
+	if code != 200 || stats.Mailboxes != 3 || stats.Messages != 3 || stats.ReceivedLastHour != 3 || stats.LastCleanup != nil {
+		t.Fatalf("stats = %d %+v", code, stats)
+	}
+	if len(stats.TopMailboxes) != 3 || stats.TopMailboxes[0].Address != "b@test.local" || stats.TopMailboxes[2].Address != "a@test.local" {
+		t.Errorf("topMailboxes 应按字节数从大到小: %+v", stats.TopMailboxes)
+	}
+	if _, stats := get("?top=1"); len(stats.TopMailboxes) != 1 {
+		t.Errorf("top=1 返回 %d 个邮箱", len(stats.TopMailboxes))
+	}
+	if _, stats := get("?top=0"); stats.TopMailboxes != nil {
+		t.Errorf("top=0 不应返回 topMailboxes")
+	}
+	for _, top := range []string{"-1", "101", "x"} {
+		if code, _ := get("?top=" + top); code != 400 {
+			t.Errorf("top=%s 返回 %d", top, code)
+		}
+	}
+
+	clearMailBox()
+	if _, stats := get(""); stats.Messages != 0 || stats.Mailboxes != 0 || stats.LastCleanup == nil {
+		t.Errorf("清空后 stats = %+v", stats)
+	}
+
+	w := testRequest(r, "GET", "/api/v1/admin/stats", "192.0.2.1")
+	if w.Code != 401 {
+		t.Errorf("没有 API Key 时返回 %d", w.Code)
+	}
+}
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/gin-gonic/gin"
+)
+
+// MailStore 邮件存储。处理函数只通过它读写邮件，加锁方式由实现自己负责。
+// 列表类方法返回的切片归调用方所有，修改不会影响存储。
+// 返回的错误表示存储暂时不可用（如网络存储断开），HTTP 接口返回 503，SMTP 返回 451
+type MailStore interface {
+	// Append 把邮件保存到 m.To 对应的邮箱，邮箱不存在时创建
+	Append(m mailContent) error
+	// Create 创建空邮箱，已存在时返回 false
+	Create(mailbox string) (bool, error)
+	// Exists 邮箱是否存在（包括没有邮件的空邮箱）
+	Exists(mailbox string) (bool, error)
+	// Count 邮箱中的邮件数
+	Count(mailbox string) (int, error)
+	// Size 邮箱中邮件的大致字节数，与 Mailboxes 中的 Bytes 一致
+	Size(mailbox string) (int64, error)
+	// PopLatest 取出并删除最新一封邮件
+	PopLatest(mailbox string) (mailContent, bool, error)
+	// Remove 删除邮箱中指定 ID 的邮件，不存在的 ID 忽略，返回删除的邮件数
+	Remove(mailbox string, ids []string) (int, error)
+	// Latest 返回最新一封邮件，不删除
+	Latest(mailbox string) (mailContent, bool, error)
+	// List 返回邮箱中的所有邮件，最新在前
+	List(mailbox string) ([]mailContent, error)
+	// Get 按 ID 查找邮件
+	Get(mailbox, id string) (mailContent, bool, error)
+	// SetRead 设置邮件的已读状态，id 为空时设置邮箱中的所有邮件，返回匹配的邮件数
+	SetRead(mailbox, id string, read bool) (int, error)
+	// Delete 删除整个邮箱，返回删除的邮件数
+	Delete(mailbox string) (int, error)
+	// Clear 清空所有邮箱
+	Clear() error
+	// Expire 删除 now 之前过期的邮件，因此变空的邮箱一并删除，返回删除的邮件数
+	Expire(now time.Time) (int, error)
+	// Trim 每个邮箱只保留最新的 keep（大于 0）封邮件，返回删除的邮件数和被删减的邮箱数
+	Trim(keep int) (int, int, error)
+	// Revision 邮箱当前版本，用于 ETag
+	Revision(mailbox string) (mailboxRevision, error)
+	// Mailboxes 返回地址以 prefix 开头（不区分大小写）的非空邮箱概要，顺序不定
+	Mailboxes(prefix string) ([]mailboxSummary, error)
+	// Stats 存储统计
+	Stats(now time.Time) (storeStats, error)
+	// Sequence IMAP 使用的 UIDVALIDITY 和下一个邮件序号。序号由 Append 分配，在整个存储中递增、不重复，
+	// UIDVALIDITY 在存储的生命周期内不变
+	Sequence() (mailSequence, error)
+}
+
+// mailSequence 存储的 UIDVALIDITY 和下一封邮件将分配的序号
+type mailSequence struct {
+	validity uint32
+	next     uint64
+}
+
+// errStoreUnavailable 存储暂时不可用时 SMTP 返回的临时错误，发件方稍后重试
+var errStoreUnavailable = smtpReply{451, smtp.EnhancedCode{4, 3, 0}, "smtp_store_unavailable"}
+
+// storeUnavailable 存储出错时记录日志并返回 503
+func storeUnavailable(c *gin.Context, err error) {
+	reqLogger(c).Error("存储不可用", "error", err)
+	c.JSON(503, gin.H{"error": msg("store_unavailable")})
+}
+
+// storeStats 存储的统计数据
+type storeStats struct {
+	Mailboxes        int
+	Messages         int
+	Bytes            int64
+	ReceivedLastHour int
+	ReceivedLastDay  int
+	LastCleanup      time.Time
+	// 数据文件大小，只有 bolt 存储提供
+	FileBytes int64
+}
+
+// mailStore 当前使用的存储
+var mailStore MailStore = newMemoryStore()
+
+// storeShared 存储是否由多个实例共享，共享时其他实例投递的邮件不会触发本地的长轮询通知
+var storeShared bool
+
+// initStore 按 STORE_BACKEND 选择存储，内存存储配置了 SNAPSHOT_PATH 时从快照恢复；Redis 启动时连不上只记录日志，恢复前接口返回 503，
+// bolt 文件打不开或已损坏、Postgres 建表失败、Maildir 目录无法创建时直接退出
+func initStore() {
+	if config().StoreBackend == "bolt" {
+		bs, err := openBoltStore(config().BoltPath)
+		if err != nil {
+			log.Fatalf("错误：打开邮件数据库失败: %v", err)
+		}
+		mailStore = bs
+		st, _ := bs.Stats(time.Now())
+		log.Printf("邮件存储: bolt %s（%d 封邮件，文件 %d 字节）", config().BoltPath, st.Messages, st.FileBytes)
+		return
+	}
+	if config().StoreBackend == "maildir" {
+		ms, err := openMaildirStore(config().MaildirPath)
+		if err != nil {
+			log.Fatalf("错误：打开 Maildir 目录失败: %v", err)
+		}
+		mailStore = ms
+		st, _ := ms.Stats(time.Now())
+		log.Printf("邮件存储: Maildir %s（%d 个邮箱，%d 封邮件）", config().MaildirPath, st.Mailboxes, st.Messages)
+		return
+	}
+	if config().StoreBackend == "postgres" {
+		ps, err := newPgStore()
+		if err != nil {
+			log.Fatalf("错误：连接 Postgres 失败: %v", err)
+		}
+		if err := ps.migrate(); err != nil {
+			log.Fatalf("错误：Postgres 建表失败: %v", err)
+		}
+		mailStore, storeShared = ps, true
+		log.Printf("邮件存储: Postgres（最多 %d 个连接，语句超时 %v）", config().PostgresMaxConns, config().PostgresStatementTimeout)
+		return
+	}
+	if config().StoreBackend != "redis" {
+		ms := mailStore.(*memoryStore)
+		enableMailboxEviction(ms)
+		if config().SnapshotPath != "" {
+			restoreSnapshot(ms)
+		}
+		return
+	}
+	rs := newRedisStore()
+	mailStore, storeShared = rs, true
+	ctx, cancel := rs.ctx()
+	defer cancel()
+	if err := rs.client.Ping(ctx).Err(); err != nil {
+		storeLogger.Error("连接 Redis 失败，恢复前收件将返回 451、接口返回 503", "addr", config().RedisAddr, "error", err)
+		return
+	}
+	log.Printf("邮件存储: Redis %s（db %d，前缀 %s）", config().RedisAddr, config().RedisDB, config().RedisPrefix)
+}
+
+// storedMail 持久化存储中的邮件，补上 mailContent 中不出现在 API 里的字段
+type storedMail struct {
+	mailContent
+	Seq            uint64         `json:"seq,omitempty"`
+	Raw            []byte         `json:"raw,omitempty"`
+	AttachmentData [][]byte       `json:"attachment_data,omitempty"`
+	Inline         []storedInline `json:"inline,omitempty"`
+	// 外置到对象存储的附件的对象键，与 Attachments 一一对应，没有外置的为空
+	AttachmentBlobs []string `json:"attachment_blobs,omitempty"`
+}
+
+type storedInline struct {
+	CID         string `json:"cid"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+func newStoredMail(m mailContent) storedMail {
+	sm := storedMail{mailContent: m, Seq: m.seq, Raw: m.raw}
+	for _, a := range m.Attachments {
+		sm.AttachmentData = append(sm.AttachmentData, a.data)
+	}
+	sm.AttachmentBlobs = attachmentBlobs(m)
+	for _, p := range m.inline {
+		sm.Inline = append(sm.Inline, storedInline{CID: p.cid, ContentType: p.contentType, Data: p.data})
+	}
+	return sm
+}
+
+// mail 还原附件内容、内嵌图片和原始邮件
+func (sm storedMail) mail() mailContent {
+	m := sm.mailContent
+	m.seq, m.raw = sm.Seq, sm.Raw
+	for i := range m.Attachments {
+		if i < len(sm.AttachmentData) {
+			m.Attachments[i].data = sm.AttachmentData[i]
+		}
+		if i < len(sm.AttachmentBlobs) {
+			m.Attachments[i].blob = sm.AttachmentBlobs[i]
+		}
+	}
+	for _, p := range sm.Inline {
+		m.inline = append(m.inline, inlinePart{cid: p.CID, contentType: p.ContentType, data: p.Data})
+	}
+	return m
+}
+
+// encodeStoredMail 编码为 "<过期毫秒时间戳>|<字节数>|<JSON>"，0 表示不过期，字节数为 mailSize 的结果，
+// 过期清理和字节统计时只需解析前缀，与内存存储按同样的口径统计。启用静态加密时正文和附件为密文
+func encodeStoredMail(m mailContent) (string, error) {
+	size := mailSize(m)
+	m, err := sealMail(m)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(newStoredMail(m))
+	if err != nil {
+		return "", err
+	}
+	var expiry int64
+	if m.ExpiresAt != nil {
+		expiry = m.ExpiresAt.UnixMilli()
+	}
+	return strconv.FormatInt(expiry, 10) + "|" + strconv.FormatInt(size, 10) + "|" + string(data), nil
+}
+
+func decodeStoredMail(value string) (mailContent, error) {
+	expiry, data, ok := strings.Cut(value, "|")
+	if !ok {
+		return mailContent{}, errors.New("邮件格式无效")
+	}
+	// 早期版本的前缀中没有字节数，JSON 直接跟在过期时间之后
+	if !strings.HasPrefix(data, "{") {
+		if _, data, ok = strings.Cut(data, "|"); !ok {
+			return mailContent{}, errors.New("邮件格式无效")
+		}
+	}
+	var sm storedMail
+	if err := json.Unmarshal([]byte(data), &sm); err != nil {
+		return mailContent{}, err
+	}
+	m, err := openMail(sm.mail())
+	if err != nil {
+		return mailContent{}, err
+	}
+	if ms, _ := strconv.ParseInt(expiry, 10, 64); ms > 0 {
+		expiresAt := time.UnixMilli(ms)
+		m.ExpiresAt = &expiresAt
+	}
+	return m, nil
+}
+
+// storedMailSize 从编码后的邮件中取投递时记下的字节数，早期版本没有记录时按编码后的长度计算
+func storedMailSize(v []byte) int64 {
+	if i := bytes.IndexByte(v, '|'); i >= 0 {
+		rest := v[i+1:]
+		if j := bytes.IndexByte(rest, '|'); j > 0 {
+			if size, err := strconv.ParseInt(string(rest[:j]), 10, 64); err == nil {
+				return size
+			}
+		}
+	}
+	return int64(len(v))
+}
+
+// memoryShardCount 内存存储的分片数。邮箱按地址哈希到固定的分片，分片的锁只保护邮箱表，
+// 邮件本身由每个邮箱自己的锁保护，同一分片中的不同邮箱也不会互相等待
+const memoryShardCount = 16
+
+// memoryStore 默认的内存存储，每个邮箱按投递顺序保存，最新的在末尾。
+// 加锁顺序：分片锁、邮箱锁、统计锁和访问记录的锁，不会反过来获取
+type memoryStore struct {
+	shards [memoryShardCount]memoryShard
+	// 所有分片共用的版本计数器
+	revCounter atomic.Uint64
+	// 已分配的最大邮件序号；validity 为创建存储时的秒数，从快照恢复时沿用快照中的值
+	seq      atomic.Uint64
+	validity uint32
+	// 配置 MAX_MAILBOXES 时记录各邮箱的访问时间，否则为 nil
+	access *accessTracker
+}
+
+// memoryShard 一部分邮箱。mu 只在查找、创建和删除邮箱时使用
+type memoryShard struct {
+	mu        sync.RWMutex
+	mailboxes map[string]*memoryMailbox
+	revisions revisionTracker
+
+	statsMu sync.Mutex
+	stats   storeCounters
+}
+
+// memoryMailbox 单个邮箱，邮件、字节数和版本由 mu 保护。
+// 从邮箱表中删除时在持有 mu 的情况下设置 deleted，先取到邮箱、后加锁的操作看到后重新查找
+type memoryMailbox struct {
+	mu      sync.RWMutex
+	mails   []mailContent
+	size    int64
+	rev     mailboxRevision
+	deleted bool
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{validity: uint32(time.Now().Unix())}
+	for i := range s.shards {
+		s.shards[i].mailboxes = make(map[string]*memoryMailbox)
+		s.shards[i].revisions = newRevisionTracker(&s.revCounter)
+	}
+	return s
+}
+
+// shard 按地址（不区分大小写）的 FNV-1a 哈希选择分片，不分配内存
+func (s *memoryStore) shard(mailbox string) *memoryShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(mailbox); i++ {
+		c := mailbox[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return &s.shards[h%memoryShardCount]
+}
+
+// create 在邮箱表中新建邮箱，调用方持有分片的写锁
+func (sh *memoryShard) create(address string) *memoryMailbox {
+	mb := &memoryMailbox{rev: sh.revisions.next()}
+	sh.mailboxes[address] = mb
+	sh.revisions.forget(address)
+	return mb
+}
+
+// lookup 在邮箱表中查找邮箱，create 为 true 时不存在则创建
+func (sh *memoryShard) lookup(address string, create bool) *memoryMailbox {
+	sh.mu.RLock()
+	mb := sh.mailboxes[address]
+	sh.mu.RUnlock()
+	if mb != nil || !create {
+		return mb
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if mb = sh.mailboxes[address]; mb == nil {
+		mb = sh.create(address)
+	}
+	return mb
+}
+
+// lock 取邮箱并加写锁，加锁前邮箱已被删除时重新查找；不存在且 create 为 false 时返回 nil
+func (sh *memoryShard) lock(address string, create bool) *memoryMailbox {
+	for {
+		mb := sh.lookup(address, create)
+		if mb == nil {
+			return nil
+		}
+		mb.mu.Lock()
+		if !mb.deleted {
+			return mb
+		}
+		mb.mu.Unlock()
+	}
+}
+
+// rlock 取邮箱并加读锁，已被删除时视为不存在
+func (sh *memoryShard) rlock(address string) *memoryMailbox {
+	mb := sh.lookup(address, false)
+	if mb == nil {
+		return nil
+	}
+	mb.mu.RLock()
+	if mb.deleted {
+		mb.mu.RUnlock()
+		return nil
+	}
+	return mb
+}
+
+// remove 把邮箱从邮箱表中删除并返回其中的邮件，调用方持有分片的写锁和邮箱的写锁
+func (sh *memoryShard) remove(address string, mb *memoryMailbox) []mailContent {
+	mails := mb.mails
+	mb.mails, mb.size, mb.deleted = nil, 0, true
+	delete(sh.mailboxes, address)
+	sh.revisions.touch(address)
+	sh.statsMu.Lock()
+	sh.stats.removed(mails...)
+	sh.statsMu.Unlock()
+	return mails
+}
+
+func (s *memoryStore) Append(m mailContent) error {
+	sh := s.shard(m.To)
+	mb := sh.lock(m.To, true)
+	defer mb.mu.Unlock()
+	m.seq = s.seq.Add(1)
+	mb.mails = append(mb.mails, m)
+	mb.size += mailSize(m)
+	mb.rev = sh.revisions.next()
+	sh.statsMu.Lock()
+	sh.stats.added(m)
+	sh.statsMu.Unlock()
+	s.access.add(m.To)
+	return nil
+}
+
+func (s *memoryStore) Create(mailbox string) (bool, error) {
+	sh := s.shard(mailbox)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, exists := sh.mailboxes[mailbox]; exists {
+		return false, nil
+	}
+	sh.create(mailbox)
+	s.access.add(mailbox)
+	return true, nil
+}
+
+func (s *memoryStore) Exists(mailbox string) (bool, error) {
+	sh := s.shard(mailbox)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	_, exists := sh.mailboxes[mailbox]
+	return exists, nil
+}
+
+func (s *memoryStore) Count(mailbox string) (int, error) {
+	mb := s.shard(mailbox).rlock(mailbox)
+	if mb == nil {
+		return 0, nil
+	}
+	defer mb.mu.RUnlock()
+	return len(mb.mails), nil
+}
+
+func (s *memoryStore) Size(mailbox string) (int64, error) {
+	mb := s.shard(mailbox).rlock(mailbox)
+	if mb == nil {
+		return 0, nil
+	}
+	defer mb.mu.RUnlock()
+	return mb.size, nil
+}
+
+func (s *memoryStore) PopLatest(mailbox string) (mailContent, bool, error) {
+	sh := s.shard(mailbox)
+	mb := sh.lock(mailbox, false)
+	if mb == nil {
+		return mailContent{}, false, nil
+	}
+	defer mb.mu.Unlock()
+	if len(mb.mails) == 0 {
+		return mailContent{}, false, nil
+	}
+	last := len(mb.mails) - 1
+	m := mb.mails[last]
+	// 清掉引用，避免底层数组继续持有已取出的邮件
+	mb.mails[last] = mailContent{}
+	mb.mails = mb.mails[:last]
+	mb.size -= mailSize(m)
+	mb.rev = sh.revisions.next()
+	sh.statsMu.Lock()
+	sh.stats.removed(m)
+	sh.statsMu.Unlock()
+	return m, true, nil
+}
+
+func (s *memoryStore) Remove(mailbox string, ids []string) (int, error) {
+	sh := s.shard(mailbox)
+	mb := sh.lock(mailbox, false)
+	if mb == nil {
+		return 0, nil
+	}
+	defer mb.mu.Unlock()
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+	kept := mb.mails[:0]
+	var removed []mailContent
+	for _, m := range mb.mails {
+		if remove[m.ID] {
+			removed = append(removed, m)
+			mb.size -= mailSize(m)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	clear(mb.mails[len(kept):])
+	mb.mails = kept
+	mb.rev = sh.revisions.next()
+	sh.statsMu.Lock()
+	sh.stats.removed(removed...)
+	sh.statsMu.Unlock()
+	return len(removed), nil
+}
+
+func (s *memoryStore) Latest(mailbox string) (mailContent, bool, error) {
+	mb := s.shard(mailbox).rlock(mailbox)
+	if mb == nil {
+		return mailContent{}, false, nil
+	}
+	defer mb.mu.RUnlock()
+	if len(mb.mails) == 0 {
+		return mailContent{}, false, nil
+	}
+	return mb.mails[len(mb.mails)-1], true, nil
+}
+
+func (s *memoryStore) List(mailbox string) ([]mailContent, error) {
+	mb := s.shard(mailbox).rlock(mailbox)
+	if mb == nil {
+		return []mailContent{}, nil
+	}
+	defer mb.mu.RUnlock()
+	newestFirst := make([]mailContent, 0, len(mb.mails))
+	for i := len(mb.mails) - 1; i >= 0; i-- {
+		newestFirst = append(newestFirst, mb.mails[i])
+	}
+	return newestFirst, nil
+}
+
+func (s *memoryStore) Get(mailbox, id string) (mailContent, bool, error) {
+	mb := s.shard(mailbox).rlock(mailbox)
+	if mb == nil {
+		return mailContent{}, false, nil
+	}
+	defer mb.mu.RUnlock()
+	for _, m := range mb.mails {
+		if m.ID == id {
+			return m, true, nil
+		}
+	}
+	return mailContent{}, false, nil
+}
+
+func (s *memoryStore) SetRead(mailbox, id string, read bool) (int, error) {
+	sh := s.shard(mailbox)
+	mb := sh.lock(mailbox, false)
+	if mb == nil {
+		return 0, nil
+	}
+	defer mb.mu.Unlock()
+	matched, changed := 0, false
+	for i := range mb.mails {
+		if id != "" && mb.mails[i].ID != id {
+			continue
+		}
+		matched++
+		if mb.mails[i].Read != read {
+			mb.mails[i].Read = read
+			changed = true
+		}
+	}
+	if changed {
+		mb.rev = sh.revisions.next()
+	}
+	return matched, nil
+}
+
+func (s *memoryStore) Delete(mailbox string) (int, error) {
+	sh := s.shard(mailbox)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	s.access.forget(mailbox)
+	mb := sh.mailboxes[mailbox]
+	if mb == nil {
+		// 与删除存在的邮箱一样更新版本
+		sh.revisions.touch(mailbox)
+		return 0, nil
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return len(sh.remove(mailbox, mb)), nil
+}
+
+// Clear 逐个分片清空，不会同时持有所有分片的锁。先清空访问记录，
+// 清空过程中投递到已清空分片的邮箱仍有记录，残留的记录在淘汰时跳过
+func (s *memoryStore) Clear() error {
+	s.access.reset()
+	now := time.Now()
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for _, mb := range sh.mailboxes {
+			mb.mu.Lock()
+			mb.mails, mb.size, mb.deleted = nil, 0, true
+			mb.mu.Unlock()
+		}
+		sh.mailboxes = make(map[string]*memoryMailbox)
+		sh.revisions.reset()
+		sh.statsMu.Lock()
+		sh.stats.cleared(now)
+		sh.statsMu.Unlock()
+		sh.mu.Unlock()
+	}
+	return nil
+}
+
+// Expire 逐个邮箱删除过期邮件，只有邮件全部过期、需要删除邮箱时才获取分片的写锁
+func (s *memoryStore) Expire(now time.Time) (int, error) {
+	removed := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		for address, mb := range sh.entries() {
+			n, emptied := sh.expire(mb, now)
+			removed += n
+			if emptied && sh.removeIfEmpty(address, mb) {
+				s.access.forget(address)
+			}
+		}
+	}
+	return removed, nil
+}
+
+func (s *memoryStore) Trim(keep int) (int, int, error) {
+	removed, trimmed := 0, 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		for _, mb := range sh.entries() {
+			if n := sh.trim(mb, keep); n > 0 {
+				removed += n
+				trimmed++
+			}
+		}
+	}
+	return removed, trimmed, nil
+}
+
+// trim 删除邮箱中最新 keep 封之外的邮件，其余邮件保持原来的顺序，返回删除数
+func (sh *memoryShard) trim(mb *memoryMailbox, keep int) int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	n := len(mb.mails) - keep
+	if mb.deleted || n <= 0 {
+		return 0
+	}
+	dropped := append([]mailContent(nil), mb.mails[:n]...)
+	for _, m := range dropped {
+		mb.size -= mailSize(m)
+	}
+	kept := copy(mb.mails, mb.mails[n:])
+	clear(mb.mails[kept:])
+	mb.mails = mb.mails[:kept]
+	mb.rev = sh.revisions.next()
+	sh.statsMu.Lock()
+	sh.stats.removed(dropped...)
+	sh.statsMu.Unlock()
+	return n
+}
+
+// entries 复制分片的邮箱表，遍历时不持有分片的锁
+func (sh *memoryShard) entries() map[string]*memoryMailbox {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	mailboxes := make(map[string]*memoryMailbox, len(sh.mailboxes))
+	for address, mb := range sh.mailboxes {
+		mailboxes[address] = mb
+	}
+	return mailboxes
+}
+
+// expire 删除邮箱中的过期邮件，返回删除数和邮箱是否因此变空
+func (sh *memoryShard) expire(mb *memoryMailbox, now time.Time) (int, bool) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.deleted {
+		return 0, false
+	}
+	kept := mb.mails[:0]
+	var expired []mailContent
+	for _, m := range mb.mails {
+		if m.expired(now) {
+			expired = append(expired, m)
+			mb.size -= mailSize(m)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	if len(expired) == 0 {
+		return 0, false
+	}
+	// 清掉尾部的引用，避免底层数组继续持有已删除的邮件
+	clear(mb.mails[len(kept):])
+	mb.mails = kept
+	mb.rev = sh.revisions.next()
+	sh.statsMu.Lock()
+	sh.stats.removed(expired...)
+	sh.statsMu.Unlock()
+	return len(expired), len(kept) == 0
+}
+
+// removeIfEmpty 删除已经变空的邮箱；获取写锁期间又收到邮件或已被删除时保留不动
+func (sh *memoryShard) removeIfEmpty(address string, mb *memoryMailbox) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.deleted || len(mb.mails) > 0 {
+		return false
+	}
+	sh.remove(address, mb)
+	return true
+}
+
+func (s *memoryStore) Revision(mailbox string) (mailboxRevision, error) {
+	sh := s.shard(mailbox)
+	for {
+		sh.mu.RLock()
+		mb := sh.mailboxes[mailbox]
+		if mb == nil {
+			rev := sh.revisions.of(mailbox)
+			sh.mu.RUnlock()
+			return rev, nil
+		}
+		sh.mu.RUnlock()
+		mb.mu.RLock()
+		rev, deleted := mb.rev, mb.deleted
+		mb.mu.RUnlock()
+		if !deleted {
+			return rev, nil
+		}
+	}
+}
+
+func (s *memoryStore) Mailboxes(prefix string) ([]mailboxSummary, error) {
+	prefix = strings.ToLower(prefix)
+
+	summaries := make([]mailboxSummary, 0)
+	for i := range s.shards {
+		for address, mb := range s.shards[i].entries() {
+			if !strings.HasPrefix(strings.ToLower(address), prefix) {
+				continue
+			}
+			mb.mu.RLock()
+			if len(mb.mails) > 0 {
+				summaries = append(summaries, mailboxSummary{
+					Address:       address,
+					Messages:      len(mb.mails),
+					Bytes:         mb.size,
+					FirstDelivery: mb.mails[0].ReceivedAt,
+					LastDelivery:  mb.mails[len(mb.mails)-1].ReceivedAt,
+				})
+			}
+			mb.mu.RUnlock()
+		}
+	}
+	return summaries, nil
+}
+
+// Stats 逐个分片累加，各分片的数字不是同一时刻的，作为统计足够
+func (s *memoryStore) Stats(now time.Time) (storeStats, error) {
+	var st storeStats
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		st.Mailboxes += len(sh.mailboxes)
+		sh.mu.RUnlock()
+		sh.statsMu.Lock()
+		st.Messages += sh.stats.messages
+		st.Bytes += sh.stats.bytes
+		st.ReceivedLastHour += sh.stats.receivedSince(now, 60)
+		st.ReceivedLastDay += sh.stats.receivedSince(now, statsBuckets)
+		if sh.stats.lastCleanup.After(st.LastCleanup) {
+			st.LastCleanup = sh.stats.lastCleanup
+		}
+		sh.statsMu.Unlock()
+	}
+	return st, nil
+}
+
+func (s *memoryStore) Sequence() (mailSequence, error) {
+	return mailSequence{validity: s.validity, next: s.seq.Load() + 1}, nil
+}
+
+// mailboxCount 所有分片的邮箱数
+func (s *memoryStore) mailboxCount() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += len(sh.mailboxes)
+		sh.mu.RUnlock()
+	}
+	return n
+}
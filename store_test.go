@@ -0,0 +1,733 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// storeFactories 契约测试覆盖的存储。Postgres 需要设置 TEST_POSTGRES_DSN 指向一个可以随意清空的库，否则跳过
+var storeFactories = []struct {
+	name string
+	open func(t *testing.T) MailStore
+}{
+	{"memory", func(t *testing.T) MailStore {
+		setupTest(t, nil)
+		return newMemoryStore()
+	}},
+	{"bolt", func(t *testing.T) MailStore {
+		setupTest(t, nil)
+		bs, err := openBoltStore(filepath.Join(t.TempDir(), "mail.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { bs.Close() })
+		return bs
+	}},
+	{"maildir", func(t *testing.T) MailStore {
+		setupTest(t, nil)
+		ms, err := openMaildirStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ms
+	}},
+	{"redis", func(t *testing.T) MailStore {
+		_, rs := startTestRedis(t, nil)
+		return rs
+	}},
+	{"postgres", func(t *testing.T) MailStore {
+		return openTestPgStore(t, nil)
+	}},
+}
+
+// forEachStore 对每种存储运行 test，每次使用新的空存储
+func forEachStore(t *testing.T, test func(t *testing.T, s MailStore)) {
+	for _, f := range storeFactories {
+		t.Run(f.name, func(t *testing.T) {
+			test(t, f.open(t))
+		})
+	}
+}
+
+var testEpoch = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testMail 收信时间按 n 递增，保证各存储中的顺序确定
+func testMail(to, id string, n int) mailContent {
+	return mailContent{
+		ID: id, TraceID: "trace-" + id, To: to, From: "sender@example.com", Subject: "subject " + id,
+		Text: "body " + id, ReceivedAt: testEpoch.Add(time.Duration(n) * time.Second),
+	}
+}
+
+func appendAll(t *testing.T, s MailStore, mails ...mailContent) {
+	t.Helper()
+	for _, m := range mails {
+		if err := s.Append(m); err != nil {
+			t.Fatalf("Append %s: %v", m.ID, err)
+		}
+	}
+}
+
+func mailIDs(mails []mailContent) []string {
+	ids := make([]string, len(mails))
+	for i, m := range mails {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func TestStoreAppendAndRead(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		const box = "user@test.local"
+		appendAll(t, s, testMail(box, "m1", 1), testMail(box, "m2", 2), testMail(box, "m3", 3))
+
+		if ok, err := s.Exists(box); !ok || err != nil {
+			t.Fatalf("Exists = %v, %v", ok, err)
+		}
+		if n, _ := s.Count(box); n != 3 {
+			t.Errorf("Count = %d", n)
+		}
+		list, err := s.List(box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(mailIDs(list)); got != "[m3 m2 m1]" {
+			t.Errorf("List 应最新在前: %s", got)
+		}
+		if m, ok, _ := s.Latest(box); !ok || m.ID != "m3" {
+			t.Errorf("Latest = %s, %v", m.ID, ok)
+		}
+		m, ok, err := s.Get(box, "m2")
+		if !ok || err != nil {
+			t.Fatalf("Get m2 = %v, %v", ok, err)
+		}
+		if m.Subject != "subject m2" || m.Text != "body m2" || m.From != "sender@example.com" || m.To != box || !m.ReceivedAt.Equal(testEpoch.Add(2*time.Second)) {
+			t.Errorf("Get 取回的邮件与保存的不同: %+v", m)
+		}
+		if _, ok, _ := s.Get(box, "missing"); ok {
+			t.Error("不存在的 ID 不应找到")
+		}
+		if _, ok, _ := s.Get("nobody@test.local", "m1"); ok {
+			t.Error("不应在其他邮箱中找到邮件")
+		}
+
+		// Size 与 Mailboxes 中的 Bytes 一致
+		size, _ := s.Size(box)
+		sums, _ := s.Mailboxes("USER@")
+		if len(sums) != 1 || sums[0].Messages != 3 || sums[0].Bytes != size || size <= 0 {
+			t.Errorf("Mailboxes = %+v, Size = %d", sums, size)
+		}
+		if sums, _ := s.Mailboxes("other"); len(sums) != 0 {
+			t.Errorf("前缀不匹配时应为空: %+v", sums)
+		}
+		if st, _ := s.Stats(time.Now()); st.Messages != 3 || st.Mailboxes != 1 {
+			t.Errorf("Stats = %+v", st)
+		}
+	})
+}
+
+func TestStoreCreateAndDelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		const box = "empty@test.local"
+		if created, err := s.Create(box); !created || err != nil {
+			t.Fatalf("Create = %v, %v", created, err)
+		}
+		if created, _ := s.Create(box); created {
+			t.Error("已存在的邮箱再次 Create 应返回 false")
+		}
+		if ok, _ := s.Exists(box); !ok {
+			t.Error("空邮箱应存在")
+		}
+		if _, ok, _ := s.PopLatest(box); ok {
+			t.Error("空邮箱不应取出邮件")
+		}
+		if sums, _ := s.Mailboxes(""); len(sums) != 0 {
+			t.Errorf("Mailboxes 不含空邮箱: %+v", sums)
+		}
+
+		appendAll(t, s, testMail(box, "m1", 1), testMail(box, "m2", 2))
+		if n, err := s.Delete(box); n != 2 || err != nil {
+			t.Errorf("Delete = %d, %v", n, err)
+		}
+		if ok, _ := s.Exists(box); ok {
+			t.Error("Delete 后邮箱不应存在")
+		}
+		if n, _ := s.Delete(box); n != 0 {
+			t.Errorf("删除不存在的邮箱应返回 0，实际 %d", n)
+		}
+	})
+}
+
+func TestStorePopRemoveAndSetRead(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		const box = "user@test.local"
+		appendAll(t, s, testMail(box, "m1", 1), testMail(box, "m2", 2), testMail(box, "m3", 3), testMail(box, "m4", 4))
+
+		m, ok, err := s.PopLatest(box)
+		if !ok || err != nil || m.ID != "m4" {
+			t.Fatalf("PopLatest = %s, %v, %v", m.ID, ok, err)
+		}
+		if n, err := s.Remove(box, []string{"m1", "missing"}); n != 1 || err != nil {
+			t.Errorf("Remove = %d, %v", n, err)
+		}
+		if n, _ := s.Remove("other@test.local", []string{"m2"}); n != 0 {
+			t.Error("不应删除其他邮箱中的邮件")
+		}
+
+		if n, err := s.SetRead(box, "m2", true); n != 1 || err != nil {
+			t.Errorf("SetRead m2 = %d, %v", n, err)
+		}
+		if m, _, _ := s.Get(box, "m2"); !m.Read {
+			t.Error("m2 应为已读")
+		}
+		if m, _, _ := s.Get(box, "m3"); m.Read {
+			t.Error("m3 应为未读")
+		}
+		if n, _ := s.SetRead(box, "", true); n != 2 {
+			t.Errorf("SetRead 全部应匹配 2 封，实际 %d", n)
+		}
+		list, _ := s.List(box)
+		for _, m := range list {
+			if !m.Read {
+				t.Errorf("%s 应为已读", m.ID)
+			}
+		}
+		if got := fmt.Sprint(mailIDs(list)); got != "[m3 m2]" {
+			t.Errorf("剩余邮件 %s", got)
+		}
+	})
+}
+
+// TestStoredMailSize 编码后的邮件带有 mailSize 的字节数，早期没有字节数的格式仍能解码，按编码后的长度计算
+func TestStoredMailSize(t *testing.T) {
+	setupTest(t, nil)
+	m := testMail("user@test.local", "m1", 1)
+	m.raw = []byte("Subject: subject m1\r\n\r\nbody m1\r\n")
+	value, err := encodeStoredMail(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := storedMailSize([]byte(value)); got != mailSize(m) {
+		t.Errorf("storedMailSize = %d，应为 %d", got, mailSize(m))
+	}
+
+	_, rest, _ := strings.Cut(value, "|")
+	_, data, _ := strings.Cut(rest, "|")
+	legacy := "0|" + data
+	if got := storedMailSize([]byte(legacy)); got != int64(len(legacy)) {
+		t.Errorf("早期格式的 storedMailSize = %d，应为 %d", got, len(legacy))
+	}
+	if got, err := decodeStoredMail(legacy); err != nil || got.ID != "m1" || string(got.raw) != string(m.raw) {
+		t.Errorf("早期格式解码为 %+v, %v", got, err)
+	}
+}
+
+func TestStoreExpireTrimClear(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		// 保存时都还没有过期，清理时刻在两者之间（Redis 的键在最晚过期的邮件之后才过期）
+		sweep := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+		past, future := sweep.Add(-30*time.Minute), sweep.Add(time.Hour)
+		old, keep := testMail("a@test.local", "a1", 1), testMail("a@test.local", "a2", 2)
+		old.ExpiresAt, keep.ExpiresAt = &past, &future
+		gone := testMail("b@test.local", "b1", 3)
+		gone.ExpiresAt = &past
+		appendAll(t, s, old, keep, gone)
+
+		if n, err := s.Expire(sweep); n != 2 || err != nil {
+			t.Errorf("Expire = %d, %v", n, err)
+		}
+		if ok, _ := s.Exists("b@test.local"); ok {
+			t.Error("邮件全部过期的邮箱应被删除")
+		}
+		if m, ok, _ := s.Latest("a@test.local"); !ok || m.ID != "a2" || m.ExpiresAt == nil || !m.ExpiresAt.Equal(future) {
+			t.Errorf("未过期的邮件应保留过期时间: %+v", m)
+		}
+
+		appendAll(t, s, testMail("a@test.local", "a3", 4), testMail("a@test.local", "a4", 5), testMail("c@test.local", "c1", 6))
+		removed, trimmed, err := s.Trim(2)
+		if removed != 1 || trimmed != 1 || err != nil {
+			t.Errorf("Trim(2) = %d, %d, %v", removed, trimmed, err)
+		}
+		if list, _ := s.List("a@test.local"); fmt.Sprint(mailIDs(list)) != "[a4 a3]" {
+			t.Errorf("Trim 应保留最新的邮件: %v", mailIDs(list))
+		}
+
+		before, _ := s.Revision("a@test.local")
+		if err := s.Clear(); err != nil {
+			t.Fatal(err)
+		}
+		if st, _ := s.Stats(time.Now()); st.Messages != 0 || st.Mailboxes != 0 || st.LastCleanup.IsZero() {
+			t.Errorf("Clear 后 Stats = %+v", st)
+		}
+		if after, _ := s.Revision("a@test.local"); after.revision <= before.revision {
+			t.Errorf("Clear 后版本不应回退: %d → %d", before.revision, after.revision)
+		}
+	})
+}
+
+func TestStoreTrimBoundaries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		appendAll(t, s,
+			testMail("a@test.local", "a1", 1), testMail("a@test.local", "a2", 2), testMail("a@test.local", "a3", 3),
+			testMail("b@test.local", "b1", 4), testMail("b@test.local", "b2", 5),
+			testMail("c@test.local", "c1", 6))
+		counts := func() string {
+			var got []int
+			for _, box := range []string{"a@test.local", "b@test.local", "c@test.local"} {
+				n, _ := s.Count(box)
+				got = append(got, n)
+			}
+			return fmt.Sprint(got)
+		}
+		revB, _ := s.Revision("b@test.local")
+
+		// N 大于邮箱中的邮件数：什么都不删
+		if removed, trimmed, err := s.Trim(5); removed != 0 || trimmed != 0 || err != nil {
+			t.Errorf("Trim(5) = %d, %d, %v", removed, trimmed, err)
+		}
+		if got := counts(); got != "[3 2 1]" {
+			t.Errorf("Trim(5) 后邮件数 %s", got)
+		}
+
+		// N 等于邮件数的邮箱不算被删减，版本不变
+		if removed, trimmed, err := s.Trim(2); removed != 1 || trimmed != 1 || err != nil {
+			t.Errorf("Trim(2) = %d, %d, %v", removed, trimmed, err)
+		}
+		if got := counts(); got != "[2 2 1]" {
+			t.Errorf("Trim(2) 后邮件数 %s", got)
+		}
+		if list, _ := s.List("a@test.local"); fmt.Sprint(mailIDs(list)) != "[a3 a2]" {
+			t.Errorf("Trim(2) 应保留最新的邮件: %v", mailIDs(list))
+		}
+		if rev, _ := s.Revision("b@test.local"); rev.revision != revB.revision {
+			t.Errorf("未删减的邮箱版本不应变化: %d → %d", revB.revision, rev.revision)
+		}
+
+		// N 为 0：删除所有邮件
+		if removed, trimmed, err := s.Trim(0); removed != 5 || trimmed != 3 || err != nil {
+			t.Errorf("Trim(0) = %d, %d, %v", removed, trimmed, err)
+		}
+		if got := counts(); got != "[0 0 0]" {
+			t.Errorf("Trim(0) 后邮件数 %s", got)
+		}
+		if st, _ := s.Stats(time.Now()); st.Messages != 0 {
+			t.Errorf("Trim(0) 后 Stats.Messages = %d", st.Messages)
+		}
+		if n, _ := s.Size("a@test.local"); n != 0 {
+			t.Errorf("Trim(0) 后邮箱大小 %d", n)
+		}
+		if removed, trimmed, err := s.Trim(0); removed != 0 || trimmed != 0 || err != nil {
+			t.Errorf("空邮箱 Trim(0) = %d, %d, %v", removed, trimmed, err)
+		}
+
+		// 删减后仍可继续收信
+		appendAll(t, s, testMail("a@test.local", "a4", 7))
+		if m, ok, _ := s.Latest("a@test.local"); !ok || m.ID != "a4" {
+			t.Errorf("删减后收信: %+v, %v", m, ok)
+		}
+	})
+}
+
+// TestTrimMailBoxes 定时清理时按 CLEANUP_KEEP_LAST 删减所有邮箱
+func TestTrimMailBoxes(t *testing.T) {
+	for _, tc := range []struct {
+		keep int
+		want string
+	}{{0, "[0 0]"}, {1, "[1 1]"}, {2, "[2 1]"}, {10, "[3 1]"}} {
+		setupTest(t, nil)
+		appendAll(t, mailStore,
+			testMail("a@test.local", "a1", 1), testMail("a@test.local", "a2", 2), testMail("a@test.local", "a3", 3),
+			testMail("b@test.local", "b1", 4))
+		trimMailBoxes(tc.keep)
+		na, _ := mailStore.Count("a@test.local")
+		nb, _ := mailStore.Count("b@test.local")
+		if got := fmt.Sprint([]int{na, nb}); got != tc.want {
+			t.Errorf("trimMailBoxes(%d) 后邮件数 %s，应为 %s", tc.keep, got, tc.want)
+		}
+		if m, ok, _ := mailStore.Latest("a@test.local"); tc.keep > 0 && (!ok || m.ID != "a3") {
+			t.Errorf("trimMailBoxes(%d) 应保留最新的邮件，得到 %+v", tc.keep, m)
+		}
+	}
+}
+
+func TestStoreRevision(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		const box = "user@test.local"
+		r0, _ := s.Revision(box)
+		appendAll(t, s, testMail(box, "m1", 1))
+		r1, _ := s.Revision(box)
+		s.SetRead(box, "m1", true)
+		r2, _ := s.Revision(box)
+		appendAll(t, s, testMail("other@test.local", "x1", 2))
+		r3, _ := s.Revision(box)
+		if !(r0.revision < r1.revision && r1.revision < r2.revision) {
+			t.Errorf("修改后版本应增大: %d %d %d", r0.revision, r1.revision, r2.revision)
+		}
+		if r3.revision != r2.revision {
+			t.Errorf("其他邮箱的变化不应影响版本: %d → %d", r2.revision, r3.revision)
+		}
+	})
+}
+
+func TestStoreSequence(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		first, err := s.Sequence()
+		if err != nil || first.validity == 0 {
+			t.Fatalf("Sequence = %+v, %v", first, err)
+		}
+		appendAll(t, s, testMail("a@test.local", "a1", 1), testMail("b@test.local", "b1", 2), testMail("a@test.local", "a2", 3))
+		list, _ := s.List("a@test.local")
+		b, _, _ := s.Get("b@test.local", "b1")
+		a2, a1 := list[0].seq, list[1].seq
+		if !(first.next <= a1 && a1 < b.seq && b.seq < a2) {
+			t.Errorf("序号应按投递顺序递增: 起始 %d，a1=%d b1=%d a2=%d", first.next, a1, b.seq, a2)
+		}
+		// 改写邮件（标记已读）不改变序号
+		s.SetRead("a@test.local", "", true)
+		if m, _, _ := s.Get("a@test.local", "a1"); m.seq != a1 {
+			t.Errorf("SetRead 后序号从 %d 变为 %d", a1, m.seq)
+		}
+		if m, _, _ := s.PopLatest("a@test.local"); m.seq != a2 {
+			t.Errorf("PopLatest 取回的序号 %d，应为 %d", m.seq, a2)
+		}
+		// 取走最新的邮件、清空后序号也不重复使用
+		s.Clear()
+		next, _ := s.Sequence()
+		if next.validity != first.validity || next.next <= a2 {
+			t.Errorf("Clear 后 Sequence = %+v，起始 %+v", next, first)
+		}
+	})
+}
+
+// TestStoreConcurrentAppendPop 并发投递和取件，每封邮件只被取出一次，取出和剩余的合起来正好是投递的全部
+func TestStoreConcurrentAppendPop(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s MailStore) {
+		const box = "busy@test.local"
+		const writers, perWriter = 4, 25
+		var (
+			wg     sync.WaitGroup
+			mu     sync.Mutex
+			popped []string
+			done   = make(chan struct{})
+		)
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < perWriter; i++ {
+					if err := s.Append(testMail(box, fmt.Sprintf("w%d-%d", w, i), w*perWriter+i)); err != nil {
+						t.Errorf("Append: %v", err)
+						return
+					}
+				}
+			}(w)
+		}
+		var readers sync.WaitGroup
+		for r := 0; r < 3; r++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for {
+					m, ok, err := s.PopLatest(box)
+					if err != nil {
+						t.Errorf("PopLatest: %v", err)
+						return
+					}
+					if ok {
+						mu.Lock()
+						popped = append(popped, m.ID)
+						mu.Unlock()
+						continue
+					}
+					select {
+					case <-done:
+						return
+					default:
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(done)
+		readers.Wait()
+
+		rest, err := s.List(box)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all := append(popped, mailIDs(rest)...)
+		sort.Strings(all)
+		if len(all) != writers*perWriter {
+			t.Fatalf("取出 %d 封，剩余 %d 封，应共 %d 封", len(popped), len(rest), writers*perWriter)
+		}
+		for i := 1; i < len(all); i++ {
+			if all[i] == all[i-1] {
+				t.Fatalf("邮件 %s 出现了两次", all[i])
+			}
+		}
+		if n, _ := s.Count(box); n != len(rest) {
+			t.Errorf("Count = %d，List 有 %d 封", n, len(rest))
+		}
+		if st, _ := s.Stats(time.Now()); st.Messages != len(rest) {
+			t.Errorf("Stats.Messages = %d，应为 %d", st.Messages, len(rest))
+		}
+	})
+}
+
+// TestBoltCount bolt 的邮件数由 counts 桶维护，经过各种增删后与邮箱中实际的邮件数一致，
+// 没有 counts 桶的早期文件重新打开时重建
+func TestBoltCount(t *testing.T) {
+	setupTest(t, nil)
+	path := filepath.Join(t.TempDir(), "mail.db")
+	bs, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const a, b = "a@test.local", "b@test.local"
+	check := func(step string) {
+		t.Helper()
+		for _, box := range []string{a, b} {
+			n, err := bs.Count(box)
+			mails, _ := bs.List(box)
+			if err != nil || n != len(mails) {
+				t.Errorf("%s: Count(%s) = %d, %v，实际 %d 封", step, box, n, err, len(mails))
+			}
+		}
+	}
+
+	expires := time.Now().Add(-time.Second)
+	for i := range 6 {
+		m := testMail(a, fmt.Sprintf("a%d", i), i)
+		if i < 2 {
+			m.ExpiresAt = &expires
+		}
+		appendAll(t, bs, m)
+	}
+	appendAll(t, bs, testMail(b, "b0", 0), testMail(b, "b1", 1))
+	check("投递")
+	bs.PopLatest(a)
+	check("PopLatest")
+	bs.Remove(a, []string{"a4", "missing"})
+	check("Remove")
+	bs.Expire(time.Now())
+	check("Expire")
+	bs.Trim(1)
+	check("Trim")
+	bs.Delete(b)
+	check("Delete")
+
+	// 去掉 counts 桶模拟早期版本的文件
+	if err := bs.db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(boltCountsBucket) }); err != nil {
+		t.Fatal(err)
+	}
+	bs.Close()
+	if bs, err = openBoltStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	check("重新打开")
+	if n, _ := bs.Count(a); n != 1 {
+		t.Errorf("重新打开后 Count = %d，应为 1", n)
+	}
+	bs.Clear()
+	check("Clear")
+}
+
+// checkMemoryCounters 各分片的统计与邮箱中实际的邮件数、字节数一致
+func checkMemoryCounters(t *testing.T, s *memoryStore) {
+	t.Helper()
+	for i := range s.shards {
+		sh := &s.shards[i]
+		var messages int
+		var bytes int64
+		for address, mb := range sh.entries() {
+			mb.mu.RLock()
+			var size int64
+			for _, m := range mb.mails {
+				size += mailSize(m)
+			}
+			if size != mb.size {
+				t.Errorf("邮箱 %s 记录的字节数 %d，实际 %d", address, mb.size, size)
+			}
+			messages += len(mb.mails)
+			bytes += size
+			mb.mu.RUnlock()
+		}
+		sh.statsMu.Lock()
+		if sh.stats.messages != messages || sh.stats.bytes != bytes {
+			t.Errorf("分片 %d 统计为 %d 封 %d 字节，实际 %d 封 %d 字节", i, sh.stats.messages, sh.stats.bytes, messages, bytes)
+		}
+		sh.statsMu.Unlock()
+	}
+}
+
+// TestMemoryCreateWhileDelete 投递、创建和删除同一个邮箱交错进行：投递到刚被删除的邮箱对象的邮件不能丢失，
+// 每封邮件要么随 Delete 计数，要么仍在邮箱中
+func TestMemoryCreateWhileDelete(t *testing.T) {
+	setupTest(t, nil)
+	s := newMemoryStore()
+	const box = "race@test.local"
+	const appends = 2000
+	var wg sync.WaitGroup
+	var deleted int
+	stop := make(chan struct{})
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < appends; i++ {
+			if err := s.Append(testMail(box, fmt.Sprint(i), i)); err != nil {
+				t.Errorf("Append: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < appends; i++ {
+			s.Create(box)
+			s.Exists(box)
+		}
+	}()
+	var deleter sync.WaitGroup
+	deleter.Add(1)
+	go func() {
+		defer deleter.Done()
+		for {
+			n, _ := s.Delete(box)
+			deleted += n
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	deleter.Wait()
+
+	remaining, _ := s.Count(box)
+	if deleted+remaining != appends {
+		t.Errorf("删除 %d 封，剩余 %d 封，应共 %d 封", deleted, remaining, appends)
+	}
+	checkMemoryCounters(t, s)
+}
+
+// TestMemoryPopWhileAppend 同一邮箱上并发投递、取件、列表和删减，结束后统计与邮件一致，取空后字节数归零
+func TestMemoryPopWhileAppend(t *testing.T) {
+	setupTest(t, nil)
+	s := newMemoryStore()
+	const box = "busy@test.local"
+	const appends = 1000
+	var wg sync.WaitGroup
+	var popped sync.Map
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < appends/2; i++ {
+				m := testMail(box, fmt.Sprintf("%d-%d", w, i), i)
+				m.Text = string(make([]byte, i%500))
+				s.Append(m)
+			}
+		}(w)
+	}
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < appends/2; i++ {
+				if m, ok, _ := s.PopLatest(box); ok {
+					if _, dup := popped.LoadOrStore(m.ID, true); dup {
+						t.Errorf("邮件 %s 被取出两次", m.ID)
+					}
+				}
+				s.List(box)
+				s.Size(box)
+			}
+		}()
+	}
+	wg.Wait()
+	checkMemoryCounters(t, s)
+
+	for {
+		if _, ok, _ := s.PopLatest(box); !ok {
+			break
+		}
+	}
+	if size, _ := s.Size(box); size != 0 {
+		t.Errorf("取空后字节数应为 0，实际 %d", size)
+	}
+	checkMemoryCounters(t, s)
+}
+
+// globalLockStore 分片之前的做法：所有邮箱共用一把锁，用于基准测试对比
+type globalLockStore struct {
+	mu sync.RWMutex
+	MailStore
+}
+
+func (s *globalLockStore) Append(m mailContent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.MailStore.Append(m)
+}
+
+func (s *globalLockStore) PopLatest(mailbox string) (mailContent, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.MailStore.PopLatest(mailbox)
+}
+
+func (s *globalLockStore) List(mailbox string) ([]mailContent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.MailStore.List(mailbox)
+}
+
+// BenchmarkMemoryMixed 64 个邮箱上并发投递、取件和列表（含 JSON 序列化），比较共用一把锁与按邮箱加锁，需要多核才能看出差别：
+//
+//	go test -run '^$' -bench MemoryMixed -cpu 1,4,16
+func BenchmarkMemoryMixed(b *testing.B) {
+	setupTest(b, nil)
+	for _, bc := range []struct {
+		name  string
+		store func() MailStore
+	}{
+		{"global-lock", func() MailStore { return &globalLockStore{MailStore: newMemoryStore()} }},
+		{"per-mailbox", func() MailStore { return newMemoryStore() }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s := bc.store()
+			body := string(make([]byte, 4096))
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := int(next.Add(1))
+					box := fmt.Sprintf("user%d@test.local", i/10%64)
+					switch i % 10 {
+					case 0, 1, 2:
+						m := testMail(box, fmt.Sprint(i), i)
+						m.HTML = body
+						s.Append(m)
+					case 3, 4, 5, 6:
+						s.PopLatest(box)
+					default:
+						mails, _ := s.List(box)
+						json.Marshal(mails)
+					}
+				}
+			})
+		})
+	}
+}
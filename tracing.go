@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer 未配置 OTEL_EXPORTER_OTLP_ENDPOINT 时为 otel 默认的空实现，开销可忽略
+var tracer trace.Tracer = otel.Tracer("tempmail")
+
+// initTracing 配置了 OTLP 地址时启用链路追踪
+func initTracing() {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return
+	}
+
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		logger.Error("初始化链路追踪失败", "error", err)
+		return
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "tempmail"))),
+	)
+	otel.SetTracerProvider(tp)
+	tracer = tp.Tracer("tempmail")
+	log.Printf("链路追踪已启用")
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 平滑升级：收到 SIGUSR2 时启动新进程并把监听套接字传给它，
+// 新进程就绪后旧进程停止接受连接，等已有会话结束再退出
+const (
+	envInheritedListeners = "TEMPMAIL_LISTENERS" // 继承的监听名称，按顺序对应 fd 3、4、...
+	envUpgradeReadyFD     = "TEMPMAIL_READY_FD"  // 新进程就绪后关闭这个管道通知旧进程
+)
+
+var (
+	// inherited 从父进程继承、尚未被取用的监听
+	inherited = map[string]net.Listener{}
+	// activeListeners 本进程正在使用的监听，升级时传给新进程
+	activeListeners   = map[string]net.Listener{}
+	activeListenersMu sync.Mutex
+
+	upgrading atomic.Bool
+	// draining 已开始停止服务，监听关闭不再视为错误
+	draining atomic.Bool
+
+	// backgroundCtx 在开始停止服务时取消，定时任务据此退出
+	backgroundCtx, stopBackground = context.WithCancel(context.Background())
+)
+
+// initInheritedListeners 读取父进程传来的监听；没有时正常冷启动
+func initInheritedListeners() {
+	names := splitList(os.Getenv(envInheritedListeners))
+	os.Unsetenv(envInheritedListeners)
+	for i, name := range names {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			logger.Warn("继承监听失败，将重新监听", "listener", name, "error", err)
+			continue
+		}
+		inherited[name] = ln
+	}
+	if len(inherited) > 0 {
+		log.Printf("已从旧进程继承 %d 个监听: %s", len(inherited), strings.Join(names, ","))
+	}
+}
+
+// listen 优先使用继承的同名监听，地址不一致（配置改了端口）时重新监听
+func listen(name, addr string) (net.Listener, error) {
+	activeListenersMu.Lock()
+	defer activeListenersMu.Unlock()
+
+	if ln, ok := inherited[name]; ok {
+		delete(inherited, name)
+		if sameAddr(ln.Addr(), addr) {
+			activeListeners[name] = ln
+			return ln, nil
+		}
+		ln.Close()
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	activeListeners[name] = ln
+	return ln, nil
+}
+
+func sameAddr(a net.Addr, addr string) bool {
+	tcp, ok := a.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != fmt.Sprint(tcp.Port) {
+		return false
+	}
+	if host == "" {
+		return tcp.IP.IsUnspecified()
+	}
+	return tcp.IP.Equal(net.ParseIP(host))
+}
+
+// notifyUpgradeReady 所有监听就绪后通知旧进程可以退出
+func notifyUpgradeReady() {
+	activeListenersMu.Lock()
+	for name, ln := range inherited {
+		ln.Close()
+		delete(inherited, name)
+	}
+	activeListenersMu.Unlock()
+
+	fd := os.Getenv(envUpgradeReadyFD)
+	os.Unsetenv(envUpgradeReadyFD)
+	if fd == "" {
+		return
+	}
+	var n uintptr
+	if _, err := fmt.Sscan(fd, &n); err == nil {
+		os.NewFile(n, "ready").Close()
+	}
+}
+
+// watchUpgradeSignal 启用 GRACEFUL_UPGRADE 时监听 SIGUSR2
+func watchUpgradeSignal() {
+	if !config().GracefulUpgrade {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR2)
+	go func() {
+		for range ch {
+			if err := upgrade(); err != nil {
+				logger.Error("平滑升级失败，继续由当前进程服务", "error", err)
+				upgrading.Store(false)
+				continue
+			}
+			log.Printf("新进程已就绪，旧进程停止接受连接并等待现有会话结束")
+			drainAndExit(config().UpgradeTimeout)
+		}
+	}()
+	log.Printf("已启用平滑升级，发送 SIGUSR2 重启进程（pid %d）", os.Getpid())
+}
+
+// upgrade 启动新进程并等待它就绪
+func upgrade() error {
+	if !upgrading.CompareAndSwap(false, true) {
+		return errors.New("升级已在进行中")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	activeListenersMu.Lock()
+	var names []string
+	var files []*os.File
+	for name, ln := range activeListeners {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			activeListenersMu.Unlock()
+			closeFiles(files)
+			return fmt.Errorf("导出监听 %s: %w", name, err)
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	activeListenersMu.Unlock()
+	defer closeFiles(files)
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		envInheritedListeners+"="+strings.Join(names, ","),
+		fmt.Sprintf("%s=%d", envUpgradeReadyFD, 3+len(files)),
+	)
+	if err := cmd.Start(); err != nil {
+		readyW.Close()
+		return err
+	}
+	readyW.Close()
+	log.Printf("已启动新进程 pid %d，等待就绪", cmd.Process.Pid)
+
+	// 新进程关闭管道表示就绪；在此之前退出说明启动失败
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan struct{})
+	go func() {
+		readyR.Read(make([]byte, 1))
+		close(ready)
+	}()
+	select {
+	case <-ready:
+		// 管道也会因新进程退出而关闭，稍等确认它仍在运行
+		select {
+		case err := <-exited:
+			return fmt.Errorf("新进程启动后退出: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("新进程退出: %v", err)
+	case <-time.After(config().UpgradeTimeout):
+		cmd.Process.Kill()
+		return errors.New("等待新进程就绪超时")
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// watchShutdownSignal 收到 SIGTERM/SIGINT 时优雅退出，再次收到时立即退出
+func watchShutdownSignal() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-ch
+		log.Printf("收到 %v，停止接受连接并等待现有会话结束", sig)
+		go func() {
+			<-ch
+			log.Printf("再次收到退出信号，立即退出")
+			os.Exit(1)
+		}()
+		drainAndExit(config().ShutdownTimeout)
+	}()
+}
+
+// drainAndExit 停止接受新连接，等待进行中的 HTTP 请求和 SMTP 会话结束后退出
+func drainAndExit(timeout time.Duration) {
+	if !draining.CompareAndSwap(false, true) {
+		return
+	}
+	stopBackground()
+	// HTTP 的监听由 Shutdown 关闭，否则 Serve 会把关闭当作错误
+	activeListenersMu.Lock()
+	for name, ln := range activeListeners {
+		if name != "http" && name != "https" && name != "admin" {
+			ln.Close()
+		}
+	}
+	activeListenersMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range []*http.Server{httpServer, httpsServer, adminServer} {
+		if srv != nil {
+			wg.Add(1)
+			go func(srv *http.Server) {
+				defer wg.Done()
+				srv.Shutdown(ctx)
+			}(srv)
+		}
+	}
+	wg.Wait()
+	// POP3/IMAP 会话被断开时不会删除标记的邮件，与客户端断线相同
+	for ctx.Err() == nil && smtpSessionCount()+int(retrievalSessions.Load()) > 0 {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if n := smtpSessionCount(); n > 0 {
+		logger.Warn("等待超时，SMTP 会话被断开", "sessions", n)
+	}
+	if n := retrievalSessions.Load(); n > 0 {
+		logger.Warn("等待超时，POP3/IMAP 会话被断开", "sessions", n)
+	}
+	if n := retryQueue.drain(ctx); n > 0 {
+		logger.Error("存储仍不可用，重试队列中的邮件未能保存", "messages", n)
+	}
+	writeShutdownSnapshot()
+	if closer, ok := mailStore.(io.Closer); ok {
+		closer.Close()
+	}
+	log.Printf("进程退出")
+	os.Exit(0)
+}
+
+func smtpSessionCount() int {
+	n := 0
+	smtpConns.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
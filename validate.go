@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configErrors 启动时收集的配置错误，全部检查完后一起报告，避免改一处重启一次
+var configErrors []string
+
+func configError(format string, args ...interface{}) {
+	configErrors = append(configErrors, fmt.Sprintf(format, args...))
+}
+
+// reportConfigErrors 有配置错误时逐条打印后退出，不会带着错误的配置启动一半的服务
+func reportConfigErrors() {
+	if len(configErrors) == 0 {
+		return
+	}
+	for _, msg := range configErrors {
+		// 使用了命令行参数时注明配置项对应的参数名
+		if len(flagValues) > 0 {
+			msg = withFlagNames(msg)
+		}
+		log.Printf("错误：%s", msg)
+	}
+	log.Fatalf("配置有 %d 处错误，请修正后重新启动", len(configErrors))
+}
+
+// Validate 检查端口、监听地址、证书、时长、域名和互斥的选项，返回全部问题，没有问题时返回 nil。
+// 只检查 Config 本身，解析环境变量时的错误由 parseConfig 记录
+func (cfg Config) Validate() []string {
+	var p configProblems
+	p.port("HTTP_PORT", cfg.HTTPPort)
+	p.port("SMTP_PORT", cfg.SMTPPort)
+	if cfg.EnableHTTPS {
+		p.port("HTTPS_PORT", cfg.HTTPSPort)
+	}
+	if cfg.EnableSMTPS {
+		p.port("SMTPS_PORT", cfg.SMTPSPort)
+	}
+	if cfg.AdminPort != "" {
+		p.port("ADMIN_PORT", cfg.AdminPort)
+	}
+	if cfg.EnablePOP3 {
+		p.port("POP3_PORT", cfg.POP3Port)
+	}
+	if cfg.EnableIMAP {
+		p.port("IMAP_PORT", cfg.IMAPPort)
+	}
+	p.bind("SMTP_BIND", cfg.SMTPBind)
+	p.bind("HTTP_BIND", cfg.HTTPBind)
+
+	// 自动证书模式下证书由 ACME 申请，不需要本地文件
+	if !cfg.EnableAutocert && (cfg.EnableHTTPS || cfg.EnableSTARTTLS || cfg.EnableSMTPS) {
+		p.keyPair(cfg.CertFile, cfg.KeyFile)
+	}
+	p.listenConflicts(cfg)
+
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"MAIL_TTL", cfg.MailTTL},
+		{"DEDUP_WINDOW", cfg.DedupWindow},
+		{"GREYLIST_DELAY", cfg.GreylistDelay},
+		{"GREYLIST_EXPIRY", cfg.GreylistExpiry},
+		{"HSTS_MAX_AGE", cfg.HSTSMaxAge},
+		{"HTTP_READ_HEADER_TIMEOUT", cfg.HTTPReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", cfg.HTTPReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", cfg.HTTPWriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", cfg.HTTPIdleTimeout},
+		{"SMTP_IDLE_TIMEOUT", cfg.SMTPIdleTimeout},
+		{"SMTP_COMMAND_TIMEOUT", cfg.SMTPCommandTimeout},
+		{"SMTP_TRANSACTION_TIMEOUT", cfg.SMTPTransactionTimeout},
+		{"SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout},
+		{"UPGRADE_TIMEOUT", cfg.UpgradeTimeout},
+		{"POSTGRES_STATEMENT_TIMEOUT", cfg.PostgresStatementTimeout},
+		{"ARCHIVE_RETENTION", cfg.ArchiveRetention},
+		{"S3_TIMEOUT", cfg.S3Timeout},
+		{"SPAM_CHECK_TIMEOUT", cfg.SpamCheckTimeout},
+		{"STORE_RETRY_INTERVAL", cfg.StoreRetryInterval},
+		{"STATS_INTERVAL", cfg.StatsInterval},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			p.add("%s 不能为负数", d.key)
+		}
+	}
+
+	if cfg.StoreRetryBufferBytes > 0 && cfg.StoreRetryInterval <= 0 {
+		p.add("STORE_RETRY_INTERVAL 必须大于 0")
+	}
+	for _, n := range []struct {
+		key   string
+		value int
+	}{
+		{"RATE_LIMIT_RPM", cfg.RateLimitRPM},
+		{"RATE_LIMIT_BURST", cfg.RateLimitBurst},
+		{"CREATE_RATE_LIMIT_RPM", cfg.CreateRateLimitRPM},
+		{"CREATE_RATE_LIMIT_BURST", cfg.CreateRateLimitBurst},
+	} {
+		if n.value < 0 {
+			p.add("%s 不能为负数", n.key)
+		}
+	}
+	if cfg.MaxRcptPerMessage < 0 {
+		p.add("MAX_RCPT_PER_MESSAGE 不能为负数")
+	}
+	if cfg.CleanupKeepLast < 0 {
+		p.add("CLEANUP_KEEP_LAST 不能为负数")
+	}
+	if cfg.MaxMailboxBytes < 0 {
+		p.add("MAX_MAILBOX_BYTES 不能为负数")
+	}
+	if cfg.ArchiveDir != "" && cfg.ArchiveMaxFileBytes <= 0 {
+		p.add("ARCHIVE_MAX_FILE_BYTES 必须大于 0")
+	}
+
+	for _, d := range cfg.AllowedDomains {
+		d = strings.TrimSpace(d)
+		if isWildcardDomain(d) {
+			d = d[2:]
+		}
+		if d != "" && !strings.Contains(d, "*") && !validHostname(d) {
+			p.add("ALLOWED_DOMAINS 中的 %q 不是有效的域名", d)
+		}
+	}
+	if cfg.SMTPHostname != "" && !validHostname(cfg.SMTPHostname) {
+		p.add("SMTP_HOSTNAME %q 不是有效的主机名", cfg.SMTPHostname)
+	}
+
+	if len(cfg.AllowedDomains) == 0 || cfg.AllowedDomains[0] == "" {
+		p.add("ALLOWED_DOMAINS 未设置")
+	}
+	// 带凭据的请求对任意来源放行时，任何网站都能以访问者的身份调用接口
+	if cfg.CORSAllowCredentials {
+		for _, origin := range cfg.CORSAllowedOrigins {
+			if originMatchesAny(origin) {
+				p.add("CORS_ALLOW_CREDENTIALS=true 时 CORS_ALLOWED_ORIGINS 不能包含匹配任意网站的 %q，请列出具体的来源", origin)
+			}
+		}
+	}
+	if cfg.HTTPSRedirect && !cfg.EnableHTTPS && !cfg.EnableAutocert {
+		p.add("HTTPS_REDIRECT 需要启用 HTTPS（ENABLE_HTTPS 或 ENABLE_AUTOCERT）")
+	}
+
+	switch cfg.StoreBackend {
+	case "memory", "redis", "bolt", "maildir":
+	case "postgres":
+		if cfg.PostgresDSN == "" {
+			p.add("STORE_BACKEND=postgres 需要设置 POSTGRES_DSN")
+		}
+		if cfg.PostgresMaxConns <= 0 {
+			p.add("POSTGRES_MAX_CONNS 必须大于 0")
+		}
+	default:
+		p.add("不支持的 STORE_BACKEND %q，可选 memory、redis、postgres、bolt、maildir", cfg.StoreBackend)
+	}
+	if _, err := parseEncryptionKeys(cfg.EncryptionKeys); err != nil {
+		p.add("ENCRYPTION_KEY %v", err)
+	}
+	// Maildir 的邮件文件需要保持为标准格式，供其他工具直接读取
+	if len(cfg.EncryptionKeys) > 0 && cfg.StoreBackend == "maildir" {
+		p.add("ENCRYPTION_KEY 不适用于 STORE_BACKEND=maildir")
+	}
+	if cfg.SnapshotPath != "" && cfg.StoreBackend != "memory" {
+		p.add("SNAPSHOT_PATH 只适用于 STORE_BACKEND=memory")
+	}
+	if cfg.MaxMailboxes < 0 {
+		p.add("MAX_MAILBOXES 不能为负数")
+	} else if cfg.MaxMailboxes > 0 && cfg.StoreBackend != "memory" {
+		p.add("MAX_MAILBOXES 只适用于 STORE_BACKEND=memory")
+	}
+	// bolt 文件同一时间只能由一个进程打开，新进程会一直等待旧进程释放
+	if cfg.StoreBackend == "bolt" && cfg.GracefulUpgrade {
+		p.add("STORE_BACKEND=bolt 不支持 GRACEFUL_UPGRADE，请改用 SIGTERM 重启")
+	}
+
+	if cfg.SpamCheckURL != "" && cfg.SpamCheckCommand != "" {
+		p.add("SPAM_CHECK_URL 和 SPAM_CHECK_COMMAND 只能设置一个")
+	}
+	if cfg.SpamCheckURL != "" {
+		if u, err := url.Parse(cfg.SpamCheckURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			p.add("SPAM_CHECK_URL %q 不是有效的 http(s) 地址", cfg.SpamCheckURL)
+		}
+	}
+	if cfg.SpamRejectThreshold < 0 {
+		p.add("SPAM_REJECT_THRESHOLD 不能为负数")
+	} else if cfg.SpamRejectThreshold > 0 && cfg.SpamCheckURL == "" && cfg.SpamCheckCommand == "" {
+		p.add("SPAM_REJECT_THRESHOLD 需要同时设置 SPAM_CHECK_URL 或 SPAM_CHECK_COMMAND")
+	}
+
+	if cfg.S3Bucket != "" {
+		if u, err := url.Parse(cfg.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			p.add("S3_BUCKET 需要设置 S3_ENDPOINT，如 https://s3.us-east-1.amazonaws.com 或 http://minio:9000")
+		}
+		if cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+			p.add("S3_BUCKET 需要设置 S3_ACCESS_KEY 和 S3_SECRET_KEY")
+		}
+		if cfg.AttachmentOffloadBytes <= 0 {
+			p.add("ATTACHMENT_OFFLOAD_BYTES 必须大于 0")
+		}
+		// Maildir 的邮件文件本身包含附件，外置没有意义
+		if cfg.StoreBackend == "maildir" {
+			p.add("S3_BUCKET 不适用于 STORE_BACKEND=maildir")
+		}
+	}
+
+	if cfg.StoreParts != storePartsBoth && cfg.StoreParts != storePartsText && cfg.StoreParts != storePartsHTML {
+		p.add("不支持的 STORE_PARTS %q，可选 both、text、html", cfg.StoreParts)
+	}
+
+	if cfg.ImageMode != imageModeOriginal && cfg.ImageMode != imageModeBlocked && cfg.ImageMode != imageModeProxied {
+		p.add("不支持的 IMAGE_MODE %q，可选 %s、%s、%s", cfg.ImageMode, imageModeOriginal, imageModeBlocked, imageModeProxied)
+	}
+	if cfg.InlineImageMode != inlineModeURL && cfg.InlineImageMode != inlineModeData {
+		p.add("不支持的 INLINE_IMAGE_MODE %q，可选 %s、%s", cfg.InlineImageMode, inlineModeURL, inlineModeData)
+	}
+
+	if cfg.DedupMode != dedupOff && cfg.DedupMode != dedupMailbox && cfg.DedupMode != dedupGlobal {
+		p.add("不支持的 DEDUP_MODE %q，可选 off、mailbox、global", cfg.DedupMode)
+	}
+
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		p.add("不支持的 LOG_FORMAT %q，可选 text、json", cfg.LogFormat)
+	}
+	for _, n := range []struct {
+		key   string
+		value int
+	}{
+		{"LOG_MAX_SIZE_MB", cfg.LogMaxSizeMB},
+		{"LOG_MAX_BACKUPS", cfg.LogMaxBackups},
+		{"LOG_MAX_AGE_DAYS", cfg.LogMaxAgeDays},
+	} {
+		if n.value < 0 {
+			p.add("%s 不能为负数", n.key)
+		}
+	}
+
+	for _, proxy := range cfg.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			p.add("TRUSTED_PROXIES 中的 %q 不是有效的 IP 或 CIDR", proxy)
+		}
+	}
+	return p
+}
+
+// configProblems 收集配置中的问题
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// port 端口必须是 1-65535 之间的数字
+func (p *configProblems) port(key, port string) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		p.add("%s %q 不是有效的端口，需为 1-65535", key, port)
+	}
+}
+
+// bind 监听地址为空（所有网卡）或本机 IP，IPv6 不带方括号
+func (p *configProblems) bind(key, bind string) {
+	if bind != "" && net.ParseIP(bind) == nil {
+		p.add("%s %q 不是有效的 IP 地址", key, bind)
+	}
+}
+
+// keyPair 确认证书和私钥文件可读，并且能作为一对加载，避免到第一次 TLS 握手时才发现
+func (p *configProblems) keyPair(certFile, keyFile string) {
+	readable := true
+	for _, f := range []struct{ key, path string }{{"CERT_FILE", certFile}, {"KEY_FILE", keyFile}} {
+		file, err := os.Open(f.path)
+		if err != nil {
+			p.add("%s 无法读取: %v", f.key, err)
+			readable = false
+			continue
+		}
+		file.Close()
+	}
+	if !readable {
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		p.add("CERT_FILE/KEY_FILE 无法加载: %v", err)
+	}
+}
+
+// listenConflicts 启用的监听中，同一地址上的端口不能重复。SMTP、SMTPS、POP3、IMAP 监听 SMTP_BIND，
+// HTTP、HTTPS 和管理端口监听 HTTP_BIND，其中一个为空（所有网卡）时也算同一地址
+func (p *configProblems) listenConflicts(cfg Config) {
+	type listener struct{ key, bind, port string }
+	listeners := []listener{{"SMTP_PORT", cfg.SMTPBind, cfg.SMTPPort}, {"HTTP_PORT", cfg.HTTPBind, cfg.HTTPPort}}
+	for _, l := range []struct {
+		enabled bool
+		listener
+	}{
+		{cfg.EnableHTTPS, listener{"HTTPS_PORT", cfg.HTTPBind, cfg.HTTPSPort}},
+		{cfg.EnableSMTPS, listener{"SMTPS_PORT", cfg.SMTPBind, cfg.SMTPSPort}},
+		{cfg.AdminPort != "", listener{"ADMIN_PORT", cfg.HTTPBind, cfg.AdminPort}},
+		{cfg.EnablePOP3, listener{"POP3_PORT", cfg.SMTPBind, cfg.POP3Port}},
+		{cfg.EnableIMAP, listener{"IMAP_PORT", cfg.SMTPBind, cfg.IMAPPort}},
+	} {
+		if l.enabled {
+			listeners = append(listeners, l.listener)
+		}
+	}
+	for i, a := range listeners {
+		for _, b := range listeners[i+1:] {
+			if a.port == b.port && (a.bind == b.bind || a.bind == "" || b.bind == "") {
+				p.add("%s 和 %s 使用了同一个端口 %s", a.key, b.key, a.port)
+			}
+		}
+	}
+}
+
+// validHostname 按 RFC 1123 检查主机名：每段 1-63 个字母、数字或连字符，不以连字符开头结尾，总长不超过 253
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestKeyPair 在临时目录写入一对自签名证书和私钥
+func writeTestKeyPair(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"test.local"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestValidateDefaults(t *testing.T) {
+	if problems := newTestConfig(t, nil).Validate(); problems != nil {
+		t.Fatalf("默认配置不应有问题: %q", problems)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	certFile, keyFile := writeTestKeyPair(t)
+	garbage := filepath.Join(t.TempDir(), "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), 0o600)
+
+	for _, tc := range []struct {
+		name   string
+		modify func(cfg *Config)
+		want   string // 为空时应没有问题，否则某条问题应包含 want
+	}{
+		{"端口不是数字", func(cfg *Config) { cfg.HTTPPort = "http" }, "HTTP_PORT"},
+		{"端口为 0", func(cfg *Config) { cfg.SMTPPort = "0" }, "SMTP_PORT"},
+		{"端口超出范围", func(cfg *Config) { cfg.SMTPPort = "65536" }, "SMTP_PORT"},
+		{"未启用的端口不检查", func(cfg *Config) { cfg.POP3Port = "x" }, ""},
+		{"启用后检查端口", func(cfg *Config) { cfg.EnablePOP3, cfg.POP3Port = true, "x" }, "POP3_PORT"},
+		{"监听地址不是 IP", func(cfg *Config) { cfg.SMTPBind = "localhost" }, "SMTP_BIND"},
+		{"IPv6 监听地址", func(cfg *Config) { cfg.HTTPBind = "::1" }, ""},
+		{"IPv6 监听地址带方括号", func(cfg *Config) { cfg.HTTPBind = "[::1]" }, "HTTP_BIND"},
+
+		{"端口冲突", func(cfg *Config) { cfg.HTTPPort = cfg.SMTPPort }, "同一个端口"},
+		{"管理端口与 HTTP 冲突", func(cfg *Config) { cfg.AdminPort = cfg.HTTPPort }, "ADMIN_PORT 使用了同一个端口"},
+		{"不同地址上的相同端口", func(cfg *Config) {
+			cfg.SMTPBind, cfg.HTTPBind, cfg.HTTPPort = "127.0.0.1", "127.0.0.2", cfg.SMTPPort
+		}, ""},
+		{"一个监听所有网卡时算冲突", func(cfg *Config) {
+			cfg.HTTPBind, cfg.HTTPPort = "127.0.0.2", cfg.SMTPPort
+		}, "同一个端口"},
+
+		{"HTTPS 缺少证书", func(cfg *Config) { cfg.EnableHTTPS, cfg.CertFile, cfg.KeyFile = true, "/nonexistent/cert.pem", keyFile }, "CERT_FILE 无法读取"},
+		{"证书无法加载", func(cfg *Config) { cfg.EnableSMTPS, cfg.CertFile, cfg.KeyFile = true, garbage, keyFile }, "无法加载"},
+		{"证书和私钥不配对", func(cfg *Config) { cfg.EnableSTARTTLS, cfg.CertFile, cfg.KeyFile = true, keyFile, certFile }, "无法加载"},
+		{"有效的证书", func(cfg *Config) { cfg.EnableHTTPS, cfg.CertFile, cfg.KeyFile = true, certFile, keyFile }, ""},
+		{"自动证书不需要证书文件", func(cfg *Config) { cfg.EnableHTTPS, cfg.EnableAutocert, cfg.CertFile = true, true, "/nonexistent" }, ""},
+
+		{"负的时长", func(cfg *Config) { cfg.MailTTL = -time.Second }, "MAIL_TTL 不能为负数"},
+		{"负的超时", func(cfg *Config) { cfg.SMTPCommandTimeout = -time.Second }, "SMTP_COMMAND_TIMEOUT"},
+		{"重试缓冲需要间隔", func(cfg *Config) { cfg.StoreRetryBufferBytes, cfg.StoreRetryInterval = 1024, 0 }, "STORE_RETRY_INTERVAL"},
+		{"负的收件人上限", func(cfg *Config) { cfg.MaxRcptPerMessage = -1 }, "MAX_RCPT_PER_MESSAGE"},
+		{"负的保留封数", func(cfg *Config) { cfg.CleanupKeepLast = -1 }, "CLEANUP_KEEP_LAST"},
+		{"负的邮箱容量", func(cfg *Config) { cfg.MaxMailboxBytes = -1 }, "MAX_MAILBOX_BYTES"},
+		{"归档文件大小", func(cfg *Config) { cfg.ArchiveDir, cfg.ArchiveMaxFileBytes = t.TempDir(), 0 }, "ARCHIVE_MAX_FILE_BYTES"},
+		{"负的日志大小", func(cfg *Config) { cfg.LogMaxBackups = -1 }, "LOG_MAX_BACKUPS"},
+
+		{"未设置域名", func(cfg *Config) { cfg.AllowedDomains = nil }, "ALLOWED_DOMAINS 未设置"},
+		{"无效的域名", func(cfg *Config) { cfg.AllowedDomains = []string{"test.local", "bad_domain.com"} }, "bad_domain.com"},
+		{"域名段过长", func(cfg *Config) { cfg.AllowedDomains = []string{strings.Repeat("a", 64) + ".com"} }, "不是有效的域名"},
+		{"通配域名", func(cfg *Config) { cfg.AllowedDomains = []string{"test.local", "*.test.local"} }, ""},
+		{"无效的主机名", func(cfg *Config) { cfg.SMTPHostname = "-mx.test.local" }, "SMTP_HOSTNAME"},
+
+		{"凭据与任意来源", func(cfg *Config) {
+			cfg.CORSAllowCredentials, cfg.CORSAllowedOrigins = true, []string{"https://app.test.local", "*"}
+		}, "CORS_ALLOWED_ORIGINS"},
+		{"凭据与具体来源", func(cfg *Config) {
+			cfg.CORSAllowCredentials, cfg.CORSAllowedOrigins = true, []string{"https://app.test.local"}
+		}, ""},
+		{"HTTPS 跳转需要 HTTPS", func(cfg *Config) { cfg.HTTPSRedirect = true }, "HTTPS_REDIRECT"},
+
+		{"未知的存储", func(cfg *Config) { cfg.StoreBackend = "mysql" }, "STORE_BACKEND"},
+		{"Postgres 缺少 DSN", func(cfg *Config) { cfg.StoreBackend, cfg.PostgresDSN = "postgres", "" }, "POSTGRES_DSN"},
+		{"Postgres 连接数", func(cfg *Config) {
+			cfg.StoreBackend, cfg.PostgresDSN, cfg.PostgresMaxConns = "postgres", "postgres://localhost/mail", 0
+		}, "POSTGRES_MAX_CONNS"},
+		{"无效的加密密钥", func(cfg *Config) { cfg.EncryptionKeys = []string{"short"} }, "ENCRYPTION_KEY"},
+		{"Maildir 不加密", func(cfg *Config) {
+			cfg.StoreBackend, cfg.EncryptionKeys = "maildir", []string{strings.Repeat("ab", 32)}
+		}, "STORE_BACKEND=maildir"},
+		{"快照只适用于内存存储", func(cfg *Config) { cfg.StoreBackend, cfg.SnapshotPath = "bolt", "snap.json" }, "SNAPSHOT_PATH"},
+		{"负的邮箱数上限", func(cfg *Config) { cfg.MaxMailboxes = -1 }, "MAX_MAILBOXES 不能为负数"},
+		{"邮箱数上限只适用于内存存储", func(cfg *Config) { cfg.StoreBackend, cfg.MaxMailboxes = "redis", 10 }, "MAX_MAILBOXES 只适用于"},
+		{"bolt 不支持平滑升级", func(cfg *Config) { cfg.StoreBackend, cfg.GracefulUpgrade = "bolt", true }, "GRACEFUL_UPGRADE"},
+
+		{"两种垃圾邮件检查", func(cfg *Config) {
+			cfg.SpamCheckURL, cfg.SpamCheckCommand = "http://rspamd:11333/checkv2", "spamc"
+		}, "只能设置一个"},
+		{"垃圾邮件检查地址", func(cfg *Config) { cfg.SpamCheckURL = "ftp://rspamd" }, "SPAM_CHECK_URL"},
+		{"拒收阈值需要检查", func(cfg *Config) { cfg.SpamRejectThreshold = 10 }, "SPAM_REJECT_THRESHOLD 需要"},
+		{"负的拒收阈值", func(cfg *Config) { cfg.SpamRejectThreshold = -1 }, "SPAM_REJECT_THRESHOLD 不能为负数"},
+
+		{"S3 缺少地址和密钥", func(cfg *Config) { cfg.S3Bucket, cfg.S3Endpoint = "mail", "" }, "S3_ENDPOINT"},
+		{"S3 缺少密钥", func(cfg *Config) {
+			cfg.S3Bucket, cfg.S3Endpoint, cfg.AttachmentOffloadBytes = "mail", "http://minio:9000", 1024
+		}, "S3_ACCESS_KEY"},
+		{"Maildir 不外置附件", func(cfg *Config) {
+			cfg.StoreBackend, cfg.S3Bucket, cfg.S3Endpoint = "maildir", "mail", "http://minio:9000"
+			cfg.S3AccessKey, cfg.S3SecretKey, cfg.AttachmentOffloadBytes = "k", "s", 1024
+		}, "S3_BUCKET 不适用于"},
+
+		{"未知的 STORE_PARTS", func(cfg *Config) { cfg.StoreParts = "all" }, "STORE_PARTS"},
+		{"未知的 IMAGE_MODE", func(cfg *Config) { cfg.ImageMode = "proxy" }, "IMAGE_MODE"},
+		{"代理外部图片", func(cfg *Config) { cfg.ImageMode = imageModeProxied }, ""},
+		{"未知的 INLINE_IMAGE_MODE", func(cfg *Config) { cfg.InlineImageMode = "base64" }, "INLINE_IMAGE_MODE"},
+		{"内嵌图片转为 data URI", func(cfg *Config) { cfg.InlineImageMode = inlineModeData }, ""},
+		{"未知的 DEDUP_MODE", func(cfg *Config) { cfg.DedupMode = "always" }, "DEDUP_MODE"},
+		{"未知的 LOG_FORMAT", func(cfg *Config) { cfg.LogFormat = "xml" }, "LOG_FORMAT"},
+		{"无效的代理", func(cfg *Config) { cfg.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.0/33"} }, "10.0.0.0/33"},
+		{"代理可以是 IP", func(cfg *Config) { cfg.TrustedProxies = []string{"10.0.0.1", "::1"} }, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig(t, nil)
+			tc.modify(&cfg)
+			problems := cfg.Validate()
+			if tc.want == "" {
+				if problems != nil {
+					t.Errorf("不应有问题: %q", problems)
+				}
+				return
+			}
+			if !strings.Contains(strings.Join(problems, "\n"), tc.want) {
+				t.Errorf("问题 %q 中应包含 %q", problems, tc.want)
+			}
+		})
+	}
+}
+
+// TestValidateReportsAll 多处错误一次全部报告
+func TestValidateReportsAll(t *testing.T) {
+	cfg := newTestConfig(t, nil)
+	cfg.HTTPPort, cfg.MailTTL, cfg.DedupMode = "0", -time.Minute, "always"
+	if problems := cfg.Validate(); len(problems) != 3 {
+		t.Errorf("应报告 3 处问题: %q", problems)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 构建信息，通过 -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..." 注入
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+type versionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	GoVersion string `json:"goVersion"`
+}
+
+// buildInfo 未注入 commit 时尝试读取 go build 记录的 VCS 信息
+func buildInfo() versionResponse {
+	info := versionResponse{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "unknown":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildTime == "unknown":
+				info.BuildTime = s.Value
+			}
+		}
+	}
+	return info
+}
+
+func handleVersion(c *gin.Context) {
+	c.JSON(200, buildInfo())
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// setupWebUI 在根路径提供内置的收件页面，页面只调用公开的 /api/v1 接口
+func setupWebUI(base *gin.RouterGroup) {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		log.Fatalf("加载内置页面失败: %v", err)
+	}
+	index, err := fs.ReadFile(root, "index.html")
+	if err != nil {
+		log.Fatalf("加载内置页面失败: %v", err)
+	}
+
+	base.GET("/", func(c *gin.Context) {
+		c.Data(200, "text/html; charset=utf-8", index)
+	})
+	base.StaticFS("/assets", http.FS(root))
+}
@@ -0,0 +1,133 @@
+// 只使用公开的 /api/v1 接口，可作为 API 的使用示例
+(function () {
+  var api = "api/v1";
+  var address = localStorage.getItem("tempmail.address");
+  var selected = null;
+
+  function $(id) { return document.getElementById(id); }
+
+  // 所有 v1 响应都包装为 {data, error, meta}
+  function call(method, path) {
+    return fetch(api + path, { method: method, cache: "no-cache" }).then(function (res) {
+      return res.json().then(function (body) {
+        if (body.error) { throw new Error(body.error.message); }
+        return body.data;
+      });
+    });
+  }
+
+  function setAddress(addr) {
+    address = addr;
+    localStorage.setItem("tempmail.address", addr);
+    $("address").textContent = addr;
+    selected = null;
+    $("viewer").hidden = true;
+    refresh();
+  }
+
+  function newAddress() {
+    var domain = $("domain").value;
+    call("POST", "/mailboxes" + (domain ? "?domain=" + encodeURIComponent(domain) : "")).then(function (data) {
+      setAddress(data.address);
+    }).catch(function (err) { $("address").textContent = "生成地址失败：" + err.message; });
+  }
+
+  function refresh() {
+    if (!address) { return; }
+    call("GET", "/mailboxes/" + encodeURIComponent(address) + "/messages").then(function (data) {
+      renderList(data.mails || []);
+    }).catch(function () {});
+  }
+
+  function renderList(mails) {
+    var list = $("list");
+    list.innerHTML = "";
+    if (mails.length === 0) {
+      var empty = document.createElement("li");
+      empty.className = "empty";
+      empty.textContent = "暂无邮件";
+      list.appendChild(empty);
+      return;
+    }
+    mails.forEach(function (m) {
+      var li = document.createElement("li");
+      if (m.id === selected) { li.className = "active"; }
+      var subject = document.createElement("div");
+      subject.textContent = (m.attachments && m.attachments.length ? "📎 " : "") + (m.subject || "(无主题)");
+      var from = document.createElement("div");
+      from.className = "from";
+      from.textContent = m.from + " · " + new Date(m.received_at).toLocaleString();
+      li.appendChild(subject);
+      li.appendChild(from);
+      li.onclick = function () { show(m.id); };
+      list.appendChild(li);
+    });
+  }
+
+  function show(id) {
+    selected = id;
+    call("GET", "/mailboxes/" + encodeURIComponent(address) + "/messages/" + id + "?images=proxied").then(function (data) {
+      var m = data.mail;
+      $("subject").textContent = m.subject || "(无主题)";
+      $("from").textContent = m.from;
+      $("time").textContent = new Date(m.received_at).toLocaleString();
+      // html 已由服务端清洗，iframe 再加 sandbox 隔离
+      $("body").srcdoc = m.html || "<pre>" + escapeHTML(m.text) + "</pre>";
+      renderAttachments(id, m.attachments || []);
+      $("viewer").hidden = false;
+      refresh();
+    }).catch(function (err) { alert(err.message); });
+  }
+
+  // 附件只在列表中显示元数据，点击时才下载内容
+  function renderAttachments(id, attachments) {
+    var box = $("attachments");
+    box.innerHTML = "";
+    attachments.forEach(function (a, i) {
+      var link = document.createElement("a");
+      link.href = api + "/mailboxes/" + encodeURIComponent(address) + "/messages/" + id + "/attachments/" + i;
+      link.textContent = "📎 " + (a.filename || "附件" + (i + 1)) + " (" + formatSize(a.size) + ")";
+      box.appendChild(link);
+    });
+  }
+
+  function formatSize(n) {
+    if (n < 1024) { return n + " B"; }
+    if (n < 1024 * 1024) { return (n / 1024).toFixed(1) + " KB"; }
+    return (n / 1024 / 1024).toFixed(1) + " MB";
+  }
+
+  function escapeHTML(s) {
+    return (s || "").replace(/[&<>"]/g, function (c) {
+      return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;" }[c];
+    });
+  }
+
+  $("copy").onclick = function () {
+    if (!address) { return; }
+    navigator.clipboard.writeText(address).then(function () {
+      $("copy").textContent = "已复制";
+      setTimeout(function () { $("copy").textContent = "复制"; }, 1500);
+    });
+  };
+  $("renew").onclick = newAddress;
+
+  call("GET", "/domains").then(function (data) {
+    data.allowedDomains.forEach(function (d, i) {
+      // 通配域名不能直接生成地址
+      if (d.indexOf("*.") === 0) return;
+      var opt = document.createElement("option");
+      opt.value = d;
+      opt.textContent = (data.displayDomains || [])[i] || d;
+      $("domain").appendChild(opt);
+    });
+    if (address) {
+      $("address").textContent = address;
+      refresh();
+    } else {
+      newAddress();
+    }
+  });
+
+  setInterval(refresh, 5000);
+})();